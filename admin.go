@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminToken is the bearer token required to access the admin routes, and
+// moderatorTokens those of the moderators, who only reach the moderation
+// routes. When both are empty the admin routes are disabled.
+var (
+	adminToken      string
+	moderatorTokens []string
+)
+
+// role is the scope of an admin api token.
+type role int
+
+const (
+	roleModerator role = iota
+	roleAdmin
+)
+
+// tokenRole returns the role granted by a bearer token.
+func tokenRole(token string) (role, bool) {
+	if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return roleAdmin, true
+	}
+	for _, t := range moderatorTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return roleModerator, true
+		}
+	}
+	return 0, false
+}
+
+// requireAdmin wraps handler so that it is only reachable with a valid
+// "Authorization: Bearer <adminToken>" header.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return requireRole(roleAdmin, handler)
+}
+
+// requireModerator wraps handler so that it is reachable with the admin
+// token or a moderator one. Only the routes hiding, reviewing or looking
+// into messages are, never the ones moving funds or handling keys.
+func requireModerator(handler http.HandlerFunc) http.HandlerFunc {
+	return requireRole(roleModerator, handler)
+}
+
+// requireRole wraps handler so that it is only reachable with a token of at
+// least role min.
+func requireRole(min role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" && len(moderatorTokens) == 0 {
+			writeError(w, http.StatusNotFound, "admin api disabled")
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		granted, ok := tokenRole(token)
+		if token == auth || !ok {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if granted < min {
+			writeError(w, http.StatusForbidden, "forbidden for moderators")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func getTopOrigins(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, map[string]interface{}{"origins": topOrigins.top(limit)})
+}
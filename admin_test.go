@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireRole(t *testing.T) {
+	defer func(admin string, moderators []string) {
+		adminToken, moderatorTokens = admin, moderators
+	}(adminToken, moderatorTokens)
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"status": "OK"})
+	}
+	tests := []struct {
+		name     string
+		disabled bool
+		wrap     func(http.HandlerFunc) http.HandlerFunc
+		header   string
+		want     int
+	}{
+		{"admin on admin route", false, requireAdmin, "Bearer admin", http.StatusOK},
+		{"moderator on admin route", false, requireAdmin, "Bearer moderator", http.StatusForbidden},
+		{"anonymous on admin route", false, requireAdmin, "", http.StatusUnauthorized},
+		{"wrong token on admin route", false, requireAdmin, "Bearer nope", http.StatusUnauthorized},
+		{"bare token on admin route", false, requireAdmin, "admin", http.StatusUnauthorized},
+		{"admin on moderator route", false, requireModerator, "Bearer admin", http.StatusOK},
+		{"moderator on moderator route", false, requireModerator, "Bearer moderator", http.StatusOK},
+		{"second moderator on moderator route", false, requireModerator, "Bearer other", http.StatusOK},
+		{"anonymous on moderator route", false, requireModerator, "", http.StatusUnauthorized},
+		{"wrong token on moderator route", false, requireModerator, "Bearer nope", http.StatusUnauthorized},
+		{"disabled admin route", true, requireAdmin, "Bearer admin", http.StatusNotFound},
+		{"disabled moderator route", true, requireModerator, "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adminToken, moderatorTokens = "admin", []string{"moderator", "other"}
+			if tt.disabled {
+				adminToken, moderatorTokens = "", nil
+			}
+			r := httptest.NewRequest("POST", "/admin/moderate/x/hide", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			tt.wrap(ok)(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
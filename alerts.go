@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/template"
+	"time"
+)
+
+// alertRulesTemplate are the recommended Prometheus alerting rules,
+// matched to the metrics exported on /metrics.
+var alertRulesTemplate = template.Must(template.New("alerts").Parse(`groups:
+- name: chat-backend
+  rules:
+  - alert: ChatBackendDown
+    expr: up{job="{{.Job}}"} == 0
+    for: 5m
+    labels:
+      severity: critical
+    annotations:
+      summary: The chat backend can't be scraped, it is down or unreachable.
+  - alert: ChatBackendInvoiceStreamDown
+    expr: {{.Namespace}}_invoice_subscription_up{job="{{.Job}}"} == 0
+    for: 2m
+    labels:
+      severity: critical
+    annotations:
+      summary: The lnd invoice subscription is down, settlements aren't delivered.
+  - alert: ChatBackendInvoiceStreamFlapping
+    expr: increase({{.Namespace}}_invoice_resubscriptions_total{job="{{.Job}}"}[15m]) > 5
+    labels:
+      severity: warning
+    annotations:
+      summary: The lnd invoice subscription keeps failing and resubscribing.
+  - alert: ChatBackendSettleLag
+    expr: histogram_quantile(0.95, sum by (le) (rate({{.Namespace}}_settle_lag_seconds_bucket{job="{{.Job}}"}[10m]))) > {{.SettleLag}}
+    for: 10m
+    labels:
+      severity: warning
+    annotations:
+      summary: Paid messages take more than {{.SettleLag}}s to show as settled (p95).
+  - alert: ChatBackendNotReady
+    expr: min({{.Namespace}}_lnd_subsystem_up{job="{{.Job}}",subsystem="lnrpc"}) == 0 or min({{.Namespace}}_invoice_subscription_up{job="{{.Job}}"}) == 0
+    for: 5m
+    labels:
+      severity: critical
+    annotations:
+      summary: The backend fails its readiness checks, lnd is unreachable or the invoice subscription is down, see /readyz.
+  - alert: ChatBackendHTTPErrors
+    expr: sum(rate({{.Namespace}}_http_requests_total{job="{{.Job}}",code=~"5.."}[5m])) / sum(rate({{.Namespace}}_http_requests_total{job="{{.Job}}"}[5m])) > 0.05
+    for: 10m
+    labels:
+      severity: warning
+    annotations:
+      summary: More than 5% of the api requests fail.
+  - alert: ChatBackendFirestoreBacklog
+    expr: max({{.Namespace}}_firestore_writes_queued{job="{{.Job}}"}) > 100
+    for: 10m
+    labels:
+      severity: warning
+    annotations:
+      summary: Firestore writes are queueing behind the write rate limiter.
+  - alert: ChatBackendFirestoreUpdatesFailing
+    expr: increase({{.Namespace}}_firestore_update_failures_total{job="{{.Job}}"}[15m]) > 5
+    labels:
+      severity: warning
+    annotations:
+      summary: Firestore updates fail, settlements may not be recorded.
+  - alert: ChatBackendLndErrors
+    expr: sum(rate({{.Namespace}}_lnd_rpc_errors_total{job="{{.Job}}",code!="Canceled"}[5m])) > 0.1
+    for: 10m
+    labels:
+      severity: warning
+    annotations:
+      summary: lnd RPCs keep failing.
+  - alert: ChatBackendWebhookBacklog
+    expr: sum(rate({{.Namespace}}_webhook_posts_total{job="{{.Job}}",outcome=~"retried|failed"}[15m])) > sum(rate({{.Namespace}}_webhook_posts_total{job="{{.Job}}",outcome="delivered"}[15m]))
+    for: 15m
+    labels:
+      severity: warning
+    annotations:
+      summary: Webhook posts are retried or fail more often than they are delivered, the receivers fall behind.
+  - alert: ChatBackendJobsFailing
+    expr: increase({{.Namespace}}_jobs_finished_total{job="{{.Job}}",outcome="failed"}[1h]) > 0
+    labels:
+      severity: warning
+    annotations:
+      summary: Background jobs failed for good, see /admin/jobs.
+  - alert: ChatBackendUnmatchedSettlements
+    expr: increase({{.Namespace}}_unmatched_settlements_total{job="{{.Job}}"}[1h]) > 0
+    labels:
+      severity: warning
+    annotations:
+      summary: Payments settled without a message, reconcile them with /admin/unmatched.
+`))
+
+// genAlerts writes the alerting rules for the scrape job named job.
+func genAlerts(w io.Writer, job string, settleLag time.Duration) error {
+	return alertRulesTemplate.Execute(w, map[string]interface{}{
+		"Job":       job,
+		"Namespace": metricsNamespace,
+		"SettleLag": settleLag.Seconds(),
+	})
+}
+
+// genAlertsCommand runs the gen-alerts subcommand, which prints the rules
+// file to load in Prometheus.
+func genAlertsCommand(args []string) {
+	fs := flag.NewFlagSet("gen-alerts", flag.ExitOnError)
+	job := fs.String("job", "chat-backend", "name of the prometheus scrape job of the backend.")
+	settleLag := fs.Duration("settleLag", defaultSettleLagAlert, "p95 settlement lag to alert above.")
+	fs.Parse(args)
+	if err := genAlerts(os.Stdout, *job, *settleLag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// analyticsDoc is the document of metaCollection recording the last day the
+// analytics export was enqueued for, so that replicas export it once.
+const analyticsDoc = "analytics"
+
+var (
+	// analyticsDest is where the daily Parquet exports of -analytics are
+	// written, a local directory or an S3 compatible destination, nil
+	// disabling them.
+	analyticsDest objectDest
+
+	errAnalyticsScheduled = errors.New("analytics export already scheduled")
+)
+
+func init() {
+	registerJob("analytics_export", runAnalyticsExport, defaultRetryPolicy)
+}
+
+// objectDest is a destination objects are put to.
+type objectDest interface {
+	put(ctx context.Context, name, contentType string, body []byte) (string, error)
+}
+
+// localDest is a local directory objects are written to as files.
+type localDest string
+
+func (d localDest) put(ctx context.Context, name, contentType string, body []byte) (string, error) {
+	path := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// parseObjectDest parses s3://bucket/prefix destinations like parseS3Dest,
+// the others being local directories.
+func parseObjectDest(s string) (objectDest, error) {
+	if strings.HasPrefix(s, "s3://") {
+		return parseS3Dest(s)
+	}
+	return localDest(cleanAndExpandPath(s)), nil
+}
+
+// analyticsPayload is the payload of analytics_export jobs.
+type analyticsPayload struct {
+	Day string `json:"day"`
+}
+
+// runAnalyticsExport is the job handler writing the rollups and settlements
+// of a day as Parquet files, partitioned by day so that DuckDB reads them
+// all with read_parquet('rollups/*/*.parquet', hive_partitioning = true).
+func runAnalyticsExport(ctx context.Context, j *job) (interface{}, error) {
+	if analyticsDest == nil {
+		return nil, permanent(fmt.Errorf("no analytics destination, see -analytics"))
+	}
+	var p analyticsPayload
+	if err := j.decodePayload(&p); err != nil {
+		return nil, err
+	}
+	from, err := time.Parse(dayFormat, p.Day)
+	if err != nil {
+		return nil, permanent(err)
+	}
+
+	snapshot, err := collection(statsCollection).Where("day", "==", p.Day).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var tags, values []string
+	var counts, amounts []int64
+	for _, s := range snapshot {
+		var r rollup
+		if err := s.DataTo(&r); err != nil {
+			continue
+		}
+		tags = append(tags, r.Tag)
+		values = append(values, r.Value)
+		counts = append(counts, r.Count)
+		amounts = append(amounts, r.AmountMsat)
+	}
+	var rollups bytes.Buffer
+	if err := writeParquet(&rollups, []*parquetColumn{
+		stringColumn("tag", tags),
+		stringColumn("value", values),
+		int64Column("count", counts),
+		int64Column("amount_msat", amounts),
+	}); err != nil {
+		return nil, err
+	}
+
+	messages, err := store.ListSettled(ctx, from, from.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(messages))
+	settledAt := make([]time.Time, len(messages))
+	rooms := make([]string, len(messages))
+	backends := make([]string, len(messages))
+	paid := make([]int64, len(messages))
+	boosts := make([]bool, len(messages))
+	dms := make([]bool, len(messages))
+	refunded := make([]bool, len(messages))
+	for i, m := range messages {
+		ids[i] = publicIDs.Encode(m.ID)
+		settledAt[i] = m.SettledAt
+		rooms[i] = m.Room
+		if rooms[i] == "" {
+			rooms[i] = defaultRoom
+		}
+		backends[i] = messageBackend(m)
+		paid[i] = m.AmountPaidMsat
+		boosts[i] = m.BoostOf != ""
+		dms[i] = m.DM != nil
+		refunded[i] = m.Expired
+	}
+	var settlements bytes.Buffer
+	if err := writeParquet(&settlements, []*parquetColumn{
+		stringColumn("id", ids),
+		timestampColumn("settled_at", settledAt),
+		stringColumn("room", rooms),
+		stringColumn("backend", backends),
+		int64Column("amount_paid_msat", paid),
+		boolColumn("boost", boosts),
+		boolColumn("dm", dms),
+		boolColumn("refunded", refunded),
+	}); err != nil {
+		return nil, err
+	}
+
+	partition := "day=" + p.Day
+	rollupsObject, err := analyticsDest.put(ctx, "rollups/"+partition+"/rollups.parquet", "application/vnd.apache.parquet", rollups.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	settlementsObject, err := analyticsDest.put(ctx, "settlements/"+partition+"/settlements.parquet", "application/vnd.apache.parquet", settlements.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"rollups":     rollupsObject,
+		"settlements": settlementsObject,
+		"messages":    len(messages),
+	}, nil
+}
+
+// scheduleAnalytics enqueues the analytics export of every day once it is
+// over, checking hourly, until ctx is done.
+func scheduleAnalytics(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		day := appClock.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1).Format(dayFormat)
+		err := claimAnalytics(ctx, day)
+		if err == nil {
+			_, err = enqueueJob(ctx, "analytics_export", analyticsPayload{Day: day})
+		}
+		if err != nil && err != errAnalyticsScheduled {
+			logError("Failed to schedule the analytics export", "day", day, "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimAnalytics records that the export of day is scheduled, failing with
+// errAnalyticsScheduled if it already was.
+func claimAnalytics(ctx context.Context, day string) error {
+	if err := waitForWrite(ctx, metaCollection); err != nil {
+		return err
+	}
+	ref := collection(metaCollection).Doc(analyticsDoc)
+	return firebaseDb.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		s, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			if last, ok := s.Data()["last_day"].(string); ok && last >= day {
+				return errAnalyticsScheduled
+			}
+		}
+		return tx.Set(ref, map[string]interface{}{"last_day": day})
+	})
+}
+
+// postAnalyticsExport enqueues the analytics export of ?day=2006-01-02,
+// yesterday by default, to backfill or redo one.
+func postAnalyticsExport(w http.ResponseWriter, r *http.Request) {
+	if analyticsDest == nil {
+		writeError(w, http.StatusNotFound, "no analytics destination, see -analytics")
+		return
+	}
+	day := appClock.Now().UTC().AddDate(0, 0, -1).Format(dayFormat)
+	if v := r.URL.Query().Get("day"); v != "" {
+		if _, err := time.Parse(dayFormat, v); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid day: "+v)
+			return
+		}
+		day = v
+	}
+	j, err := enqueueJob(r.Context(), "analytics_export", analyticsPayload{Day: day})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, j)
+}
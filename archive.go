@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// archiveDest is the S3 compatible destination of the archived exports,
+// parsed from -archive, nil disabling archival.
+var archiveDest *s3Dest
+
+func init() {
+	registerJob("archive", runArchive, defaultRetryPolicy)
+}
+
+// archivePayload is the payload of archive jobs, the days being inclusive.
+type archivePayload struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// runArchive is the job handler uploading the export of a date range to the
+// archive destination.
+func runArchive(ctx context.Context, j *job) (interface{}, error) {
+	if archiveDest == nil {
+		return nil, permanent(fmt.Errorf("no archive destination, see -archive"))
+	}
+	var p archivePayload
+	if err := j.decodePayload(&p); err != nil {
+		return nil, err
+	}
+	messages, err := store.ListSettled(ctx, p.From, p.To.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	if err := writeExport(&body, messages); err != nil {
+		return nil, err
+	}
+	object, err := archiveDest.put(ctx, exportName(p.From, p.To), "text/csv", body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"object": object, "messages": len(messages)}, nil
+}
+
+// postArchive enqueues the archival of the export of a date range, given
+// like for getExport.
+func postArchive(w http.ResponseWriter, r *http.Request) {
+	if archiveDest == nil {
+		writeError(w, http.StatusNotFound, "no archive destination, see -archive")
+		return
+	}
+	from, to, err := dateRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	j, err := enqueueJob(r.Context(), "archive", archivePayload{From: from, To: to})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, j)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+const auditCollection = "audit"
+
+// auditTimeout bounds the write of an audit entry, which is done whatever
+// the context of the action, like the settlements.
+const auditTimeout = 10 * time.Second
+
+// The actions of the audit log.
+const (
+	auditInvoiceCreated      = "invoice_created"
+	auditSettleReceived      = "settle_received"
+	auditSettlementRecorded  = "settlement_recorded"
+	auditSettlementFailed    = "settlement_failed"
+	auditSettlementUnmatched = "settlement_unmatched"
+	auditReconciled          = "reconciled"
+	auditForceSettled        = "force_settled"
+	auditForceUnsettled      = "force_unsettled"
+	auditInvoiceCancelled    = "invoice_cancelled"
+)
+
+// auditEntry is an action on the payment of a message, kept in the append
+// only audit log of the message store so that operators can tell after the
+// fact whether and when a payment was received and recorded.
+type auditEntry struct {
+	ID         string    `firestore:"-" json:"id"`
+	At         time.Time `firestore:"at" json:"at"`
+	Action     string    `firestore:"action" json:"action"`
+	MessageID  string    `firestore:"message_id,omitempty" json:"message_id,omitempty"`
+	RHash      string    `firestore:"r_hash,omitempty" json:"r_hash,omitempty"`
+	AmountMsat int64     `firestore:"amount_msat,omitempty" json:"amount_msat,omitempty"`
+	// Detail is where the action comes from, e.g. the backend of a
+	// settlement, or the error of a failure.
+	Detail string `firestore:"detail,omitempty" json:"detail,omitempty"`
+}
+
+var auditFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "audit_failures_total",
+	Help:      "Number of audit log entries which couldn't be written.",
+})
+
+func init() {
+	prometheus.MustRegister(auditFailures)
+}
+
+// audit appends the action on m, nil for the payments without a message, to
+// the audit log. The payment hash is the one of invoice, else the one of m.
+// Failures are logged, never failing the action.
+func audit(action string, m *Message, invoice *lnrpc.Invoice, detail string) {
+	e := &auditEntry{At: appClock.Now(), Action: action, Detail: detail}
+	if m != nil {
+		e.MessageID, e.RHash = m.ID, m.RHash
+	}
+	if invoice != nil {
+		if len(invoice.GetRHash()) > 0 {
+			e.RHash = hex.EncodeToString(invoice.GetRHash())
+		}
+		e.AmountMsat = invoice.GetAmtPaidMsat()
+	}
+	if e.AmountMsat == 0 && m != nil {
+		e.AmountMsat = m.Amount * 1000
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	if err := store.AppendAudit(ctx, e); err != nil {
+		auditFailures.Inc()
+		logError("Failed to write the audit log", "action", action, "doc_id", e.MessageID, "payment_hash", e.RHash, "err", err)
+	}
+}
+
+// getAudit lists the audit log of a message, by its id, or of a payment
+// hash, oldest entries first.
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var id string
+	if v := q.Get("message"); v != "" {
+		decoded, err := publicIDs.Decode(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid message id")
+			return
+		}
+		id = decoded
+	}
+	hash := q.Get("r_hash")
+	if b, err := hex.DecodeString(hash); hash != "" && (err != nil || len(b) != 32) {
+		writeError(w, http.StatusBadRequest, "invalid r_hash")
+		return
+	}
+	if id == "" && hash == "" {
+		writeError(w, http.StatusBadRequest, "missing message or r_hash")
+		return
+	}
+	list, err := store.ListAudit(r.Context(), id, hash)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	for _, e := range list {
+		if e.MessageID != "" {
+			e.MessageID = publicIDs.Encode(e.MessageID)
+		}
+	}
+	writeJSON(w, map[string]interface{}{"audit": list})
+}
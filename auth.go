@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"firebase.google.com/go/auth"
+)
+
+var (
+	// authClient verifies the Firebase ID tokens of the users, set up in
+	// main along with Firestore, and requireAuth rejects the writes of the
+	// anonymous users.
+	authClient  *auth.Client
+	requireAuth bool
+)
+
+// withAuth wraps a write handler so that the Firebase ID token of the
+// "Authorization: Bearer <token>" header, when given, is verified, its uid
+// being the user of the request and so the user of its invoice.
+// Requests without a token go through as anonymous unless -requireAuth,
+// those with an invalid one never do.
+func withAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authClient == nil {
+			handler(w, r)
+			return
+		}
+		header := r.Header.Get("Authorization")
+		idToken := strings.TrimPrefix(header, "Bearer ")
+		if idToken == header || idToken == "" {
+			if requireAuth {
+				writeError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+			handler(w, r)
+			return
+		}
+		token, err := authClient.VerifyIDToken(r.Context(), idToken)
+		if err != nil {
+			logDebug("Rejected ID token", "err", err)
+			writeError(w, http.StatusUnauthorized, "invalid ID token")
+			return
+		}
+		stateOf(r).User = token.UID
+		handler(w, r)
+	}
+}
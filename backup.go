@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// backupTimeFormat names the channel backups, sorting them by time.
+const backupTimeFormat = "20060102T150405Z"
+
+// postChannelBackup exports the static channel backup of all the channels of
+// the node and uploads it to the archive destination, each backup being kept
+// as a new version, since the backend is often the only process always
+// running next to the node.
+func postChannelBackup(w http.ResponseWriter, r *http.Request) {
+	if err := checkLnd(); err != nil {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if archiveDest == nil {
+		writeError(w, http.StatusNotFound, "no archive destination, see -archive")
+		return
+	}
+	c, clean := getClient()
+	defer clean()
+
+	res, err := c.ExportAllChannelBackups(r.Context(), &lnrpc.ChanBackupExportRequest{})
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	multi := res.GetMultiChanBackup()
+	now := appClock.Now().UTC()
+	object, err := archiveDest.put(r.Context(), "channel-backups/channel-"+now.Format(backupTimeFormat)+".backup",
+		"application/octet-stream", multi.GetMultiChanBackup())
+	if err != nil {
+		writeErrorCode(w, http.StatusBadGateway, codeUpstreamUnavailable, err.Error(), nil)
+		return
+	}
+	logInfo("Uploaded the channel backup", "object", object, "channels", len(multi.GetChanPoints()))
+	writeJSON(w, map[string]interface{}{
+		"object":     object,
+		"channels":   len(multi.GetChanPoints()),
+		"created_at": now,
+	})
+}
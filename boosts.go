@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Event types of the incremental updates of the boosted messages,
+	// sent instead of the whole message.
+	eventBoostTotal    = "boost_total"
+	eventReactionAdded = "reaction_added"
+
+	maxReactionLength = 32
+)
+
+// boostRequest is the body of postBoost.
+type boostRequest struct {
+	Amount   int64  `json:"amount"`
+	Reaction string `json:"reaction"`
+}
+
+// postBoost creates the invoice boosting a settled message by an amount,
+// with an optional reaction.
+func postBoost(w http.ResponseWriter, r *http.Request) {
+	var b boostRequest
+	if err := decodeJSON(r, &b); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	createBoost(w, r, b)
+}
+
+// getReaction creates the invoice of a paid emoji reaction to a settled
+// message, a boost of the minimum amount unless ?amount is given, whose
+// settlement counts the emoji on the message.
+func getReaction(w http.ResponseWriter, r *http.Request) {
+	b := boostRequest{Reaction: pathParam(r, "emoji")}
+	if !isEmoji(b.Reaction) {
+		writeError(w, http.StatusBadRequest, "invalid emoji")
+		return
+	}
+	if v := r.URL.Query().Get("amount"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid amount")
+			return
+		}
+		b.Amount = n
+	}
+	createBoost(w, r, b)
+}
+
+// isEmoji reports whether s is made of emoji: symbols, with their skin tone
+// modifiers, variation selectors and joiners.
+func isEmoji(s string) bool {
+	if s == "" || !utf8.ValidString(s) {
+		return false
+	}
+	for _, c := range s {
+		if !unicode.Is(unicode.So, c) && !unicode.Is(unicode.Sk, c) && c != '\u200d' && (c < '\ufe00' || c > '\ufe0f') {
+			return false
+		}
+	}
+	return true
+}
+
+// createBoost validates and creates the boost b of the message of the route.
+func createBoost(w http.ResponseWriter, r *http.Request, b boostRequest) {
+	b.Reaction = strings.TrimSpace(b.Reaction)
+	if len(b.Reaction) > maxReactionLength || !utf8.ValidString(b.Reaction) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("reaction must be at most %d bytes of utf-8", maxReactionLength))
+		return
+	}
+	min := currentSettings().MinAmount
+	if b.Amount == 0 {
+		b.Amount = min
+	}
+	if b.Amount < min {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("amount must be at least %d", min))
+		return
+	}
+
+	id, err := publicIDs.Decode(pathParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	parent, err := store.GetMessage(r.Context(), id)
+	if err == errMessageNotFound || (err == nil && (!parent.Settled || parent.DM != nil || parent.BoostOf != "")) {
+		writeErrorCode(w, http.StatusNotFound, codeUnknownMessage, errMessageNotFound.Error(), nil)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	memo := "Boost"
+	if b.Reaction != "" {
+		memo += " " + b.Reaction
+	}
+	req, err := newInvoiceRequest(r, memo, b.Amount)
+	if err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	msg, res, err := createMessage(r.Context(), req, &lnrpc.Invoice{
+		Memo:  req.Memo,
+		Value: req.Amount,
+	}, &Message{Room: parent.Room, BoostOf: parent.ID, Reaction: b.Reaction})
+	if err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"id":          publicIDs.Encode(msg.ID),
+		"pay_req":     res.PaymentRequest,
+		"amount":      msg.Amount,
+		"payer_token": payerToken(msg.RHash),
+	})
+}
+
+// recordBoost adds the settled boost m to the totals of the message it
+// boosts and notifies the changes, rather than the whole message, to its
+// room and to the payer following the invoice.
+func recordBoost(ctx context.Context, m *Message, invoice *lnrpc.Invoice) {
+	boosted, err := store.AddBoost(ctx, m.BoostOf, invoice.GetAmtPaidMsat(), m.Reaction)
+	if err != nil {
+		logError("Failed to add boost", "doc_id", m.ID, "boost_of", m.BoostOf, "err", err)
+		return
+	}
+	id := publicIDs.Encode(boosted.ID)
+	hash := hex.EncodeToString(invoice.GetRHash())
+	events := []event{{
+		Type:        eventBoostTotal,
+		Room:        boosted.Room,
+		PaymentHash: hash,
+		Data:        map[string]interface{}{"id": id, "boost_total_msat": boosted.BoostTotalMsat},
+	}}
+	if m.Reaction != "" {
+		events = append(events, event{
+			Type:        eventReactionAdded,
+			Room:        boosted.Room,
+			PaymentHash: hash,
+			Data:        map[string]interface{}{"id": id, "reaction": m.Reaction, "count": boosted.Reactions[m.Reaction]},
+		})
+	}
+	for _, ev := range events {
+		publishEvent(ev)
+		postWebhooks(ev)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// botTag names the bot rule of its system replies, and replyToTag the
+	// public id of the message they reply to.
+	botTag     = "bot"
+	replyToTag = "reply_to"
+
+	// botInvoicePrefix prefixes the key standing in for the payment request
+	// of the replies, which have none, one reply per message and rule.
+	botInvoicePrefix = "bot:"
+
+	// eventBotReply is the event type of the bot replies.
+	eventBotReply = "bot_reply"
+)
+
+// botRules are the rules loaded with -bots, run on every settled message.
+var botRules []*botRule
+
+// botRule is a rule of the rules file loaded with -bots, responding to the
+// settled messages whose memo matches Pattern, e.g. "^!song (.+)$".
+type botRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+
+	// Rooms, when set, restricts the rule to the messages of these rooms.
+	Rooms []string `json:"rooms"`
+
+	// Reply is posted to the room of the message as a system reply, $1,
+	// ${name}... expanding to the submatches of the pattern. Webhook is
+	// posted the parsed command. Either may be empty.
+	Reply   string `json:"reply"`
+	Webhook string `json:"webhook"`
+
+	re *regexp.Regexp
+}
+
+// botCommand is the body posted to the webhook of a bot rule.
+type botCommand struct {
+	Bot     string   `json:"bot"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	ID      string   `json:"id"`
+	Room    string   `json:"room"`
+	Memo    string   `json:"memo"`
+
+	AmountPaidMsat int64 `json:"amount_paid_msat"`
+}
+
+// loadBotRules reads a JSON list of botRule from path.
+func loadBotRules(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rules []*botRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return fmt.Errorf("invalid bot rules %v: %v", path, err)
+	}
+	names := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.Name == "" || names[rule.Name] {
+			return fmt.Errorf("bot rule %d: missing or duplicate name", i)
+		}
+		names[rule.Name] = true
+		if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("bot rule %v: %v", rule.Name, err)
+		}
+		if rule.Reply == "" && rule.Webhook == "" {
+			return fmt.Errorf("bot rule %v: needs a reply or a webhook", rule.Name)
+		}
+	}
+	botRules = rules
+	return nil
+}
+
+func (rule *botRule) inRoom(room string) bool {
+	if len(rule.Rooms) == 0 {
+		return true
+	}
+	if room == "" {
+		room = defaultRoom
+	}
+	for _, r := range rule.Rooms {
+		if r == room {
+			return true
+		}
+	}
+	return false
+}
+
+// runBots runs the bot rules on m, a public message just settled and
+// notified. Replies are posted right away, the webhooks in the background.
+func runBots(ctx context.Context, m *Message) {
+	for _, rule := range botRules {
+		if !rule.inRoom(m.Room) {
+			continue
+		}
+		match := rule.re.FindStringSubmatchIndex(m.Memo)
+		if match == nil {
+			continue
+		}
+		if rule.Reply != "" {
+			reply := string(rule.re.ExpandString(nil, rule.Reply, m.Memo, match))
+			if err := postBotReply(ctx, rule, m, reply); err != nil {
+				logError("Failed to post the bot reply", "bot", rule.Name, "doc_id", m.ID, "err", err)
+			}
+		}
+		if rule.Webhook != "" {
+			cmd := botCommand{
+				Bot:            rule.Name,
+				ID:             publicIDs.Encode(m.ID),
+				Room:           m.Room,
+				Memo:           m.Memo,
+				AmountPaidMsat: m.AmountPaidMsat,
+			}
+			for i := 0; i+1 < len(match); i += 2 {
+				s := ""
+				if match[i] >= 0 {
+					s = m.Memo[match[i]:match[i+1]]
+				}
+				if i == 0 {
+					cmd.Command = s
+				} else {
+					cmd.Args = append(cmd.Args, s)
+				}
+			}
+			go callBotWebhook(rule, cmd)
+		}
+	}
+}
+
+// postBotReply posts memo as the system reply of rule to m, unless it was
+// already posted for a replayed settlement.
+func postBotReply(ctx context.Context, rule *botRule, m *Message, memo string) error {
+	key := botInvoicePrefix + m.ID + ":" + rule.Name
+	if _, err := store.FindByInvoice(ctx, key); err != errMessageNotFound {
+		return err
+	}
+	now := appClock.Now()
+	reply := &Message{
+		Invoice:   key,
+		Memo:      memo,
+		Room:      m.Room,
+		Tags:      map[string]string{botTag: rule.Name, replyToTag: publicIDs.Encode(m.ID)},
+		CreatedAt: now,
+	}
+	if err := store.CreateMessage(ctx, reply); err != nil {
+		return err
+	}
+	if _, err := store.MarkSettled(ctx, reply.ID, Settlement{SettledAt: now}); err != nil {
+		return err
+	}
+	ev := event{
+		Type: eventBotReply,
+		Room: m.Room,
+		Data: map[string]interface{}{
+			"id":       publicIDs.Encode(reply.ID),
+			"reply_to": publicIDs.Encode(m.ID),
+			"bot":      rule.Name,
+			"memo":     memo,
+		},
+	}
+	publishEvent(ev)
+	postWebhooks(ev)
+	return nil
+}
+
+// callBotWebhook posts cmd to the webhook of rule, signed like the
+// settlement webhooks. Deliveries are best effort, commands are not retried.
+func callBotWebhook(rule *botRule, cmd botCommand) {
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		logError("Failed to encode bot command", "bot", rule.Name, "err", err)
+		return
+	}
+	res, err := signedPost(rule.Webhook, body)
+	if err != nil {
+		logWarn("Bot webhook failed", "bot", rule.Name, "url", rule.Webhook, "err", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		logWarn("Bot webhook failed", "bot", rule.Name, "url", rule.Webhook, "status", res.Status)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+// maxBulkItems is the maximum number of messages a single bulk operation
+// may target.
+const maxBulkItems = 500
+
+var errAlreadySettled = errors.New("message already settled")
+
+// bulkOps maps the bulk operations to constructors of the function applied
+// to every message, called once per job run. Supported operations are
+// "expire", "cancel" (cancels the invoices in lnd and expires the messages)
+// and "recheck" (re-runs the settlement check).
+var bulkOps = map[string]func() func(ctx context.Context, key string) error{
+	"expire": func() func(context.Context, string) error {
+		return expireMessage
+	},
+	"cancel": func() func(context.Context, string) error {
+		return cancelMessage
+	},
+	"recheck": func() func(context.Context, string) error {
+		limiter := newReconcileLimiter()
+		return func(ctx context.Context, key string) error {
+			return recheckMessage(ctx, key, limiter)
+		}
+	},
+}
+
+func init() {
+	for op, newFn := range bulkOps {
+		registerJob("bulk_"+op, runBulk(newFn), defaultRetryPolicy)
+	}
+}
+
+// bulkRequest is the body of the bulk admin operations.
+type bulkRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// bulkPayload is the payload of bulk jobs.
+type bulkPayload struct {
+	Keys []string `json:"keys"`
+}
+
+// bulkResult is the result of bulk jobs, errors being keyed by public id.
+type bulkResult struct {
+	Processed int               `json:"processed"`
+	Failed    int               `json:"failed"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+// runBulk returns the job handler applying a bulk operation to the messages
+// of the job. Failing messages are reported in the result without failing
+// the job; all operations are idempotent so a retried job simply starts
+// over.
+func runBulk(newFn func() func(context.Context, string) error) jobHandler {
+	return func(ctx context.Context, j *job) (interface{}, error) {
+		var p bulkPayload
+		if err := j.decodePayload(&p); err != nil {
+			return nil, err
+		}
+
+		fn := newFn()
+		res := bulkResult{}
+		for i, key := range p.Keys {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := fn(ctx, key); err != nil {
+				if res.Errors == nil {
+					res.Errors = make(map[string]string)
+				}
+				res.Failed++
+				res.Errors[publicIDs.Encode(key)] = err.Error()
+			}
+			res.Processed++
+			if (i+1)%50 == 0 {
+				j.reportProgress(ctx, i+1, len(p.Keys))
+			}
+		}
+		j.reportProgress(ctx, len(p.Keys), len(p.Keys))
+		return res, nil
+	}
+}
+
+// postBulk enqueues a bulk operation on a list of messages and returns the
+// job processing it.
+func postBulk(w http.ResponseWriter, r *http.Request) {
+	op := pathParam(r, "op")
+	if _, ok := bulkOps[op]; !ok {
+		writeError(w, http.StatusNotFound, "unknown bulk operation")
+		return
+	}
+
+	var req bulkRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxBulkItems {
+		writeError(w, http.StatusBadRequest, "between 1 and 500 ids are required")
+		return
+	}
+
+	keys := make([]string, len(req.IDs))
+	for i, id := range req.IDs {
+		key, err := publicIDs.Decode(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid id "+id)
+			return
+		}
+		keys[i] = key
+	}
+
+	j, err := enqueueJob(r.Context(), "bulk_"+op, bulkPayload{Keys: keys})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, j)
+}
+
+// getUnsettledMessage returns the message stored under key, failing if it
+// was already paid.
+func getUnsettledMessage(ctx context.Context, key string) (*Message, error) {
+	m, err := store.GetMessage(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if m.Settled {
+		return nil, errAlreadySettled
+	}
+	return m, nil
+}
+
+// expireMessage marks an unpaid message as expired so that it is no longer
+// displayed nor reconciled.
+func expireMessage(ctx context.Context, key string) error {
+	return store.Expire(ctx, key)
+}
+
+// cancelMessage cancels the invoice of an unpaid message in lnd, so that it
+// can't be paid anymore, and expires the message.
+func cancelMessage(ctx context.Context, key string) error {
+	m, err := getUnsettledMessage(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := checkLnd(); err != nil {
+		return err
+	}
+
+	c, clean := getClient()
+	defer clean()
+	decoded, err := c.DecodePayReq(ctx, &lnrpc.PayReqString{PayReq: m.Invoice})
+	if err != nil {
+		return err
+	}
+	hash, err := hex.DecodeString(decoded.GetPaymentHash())
+	if err != nil {
+		return err
+	}
+
+	inv, cleanInv := getInvoicesClient()
+	defer cleanInv()
+	// lnd refuses to cancel settled invoices, in which case the message
+	// is left for the watcher to settle.
+	_, err = inv.CancelInvoice(ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: hash})
+	if err != nil {
+		return err
+	}
+
+	return store.Expire(ctx, m.ID)
+}
+
+// recheckMessage runs the settlement check of checkPayments on a single
+// message.
+func recheckMessage(ctx context.Context, key string, limiter *rate.Limiter) error {
+	m, err := getUnsettledMessage(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return checkPayment(limiter, m)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// clnTimeout bounds the calls but waitanyinvoice, which blocks until an
+// invoice is paid.
+const clnTimeout = 30 * time.Second
+
+// clnBackend is the LightningBackend of a Core Lightning node, through the
+// REST api of its clnrest plugin, authenticated with a rune.
+type clnBackend struct {
+	url      string
+	authRune string
+
+	client *http.Client
+
+	// reachable is 1 while the last call reached the node.
+	reachable int32
+}
+
+// newCLNBackend returns the backend of the clnrest api at url, e.g.
+// https://localhost:3010, its certificate being checked against the CA at
+// certPath when set.
+func newCLNBackend(url, authRune, certPath string) (*clnBackend, error) {
+	if url == "" || authRune == "" {
+		return nil, fmt.Errorf("-backend=cln needs -clnUrl and -clnRune")
+	}
+	transport := &http.Transport{}
+	if certPath != "" {
+		pem, err := ioutil.ReadFile(cleanAndExpandPath(certPath))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %v", certPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &clnBackend{
+		url:      strings.TrimSuffix(url, "/"),
+		authRune: authRune,
+		client:   &http.Client{Transport: transport},
+	}, nil
+}
+
+// clnError is the body of the failed calls.
+type clnError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// call calls the method of the node with params, decoding the result into
+// res.
+func (b *clnBackend) call(ctx context.Context, method string, params, res interface{}) error {
+	if method != "waitanyinvoice" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, clnTimeout)
+		defer cancel()
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, b.url+"/v1/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Rune", b.authRune)
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == nil {
+			atomic.StoreInt32(&b.reachable, 0)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	atomic.StoreInt32(&b.reachable, 1)
+	if resp.StatusCode >= 300 {
+		var e clnError
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Message != "" {
+			return fmt.Errorf("cln %v: %v (%d)", method, e.Message, e.Code)
+		}
+		return fmt.Errorf("cln %v: %v", method, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+func (b *clnBackend) health() string {
+	if atomic.LoadInt32(&b.reachable) == 1 {
+		return healthOK
+	}
+	return healthDown
+}
+
+// clnInvoice is an invoice of listinvoices and waitanyinvoice.
+type clnInvoice struct {
+	Label              string `json:"label"`
+	Bolt11             string `json:"bolt11"`
+	PaymentHash        string `json:"payment_hash"`
+	Status             string `json:"status"`
+	Description        string `json:"description"`
+	AmountMsat         int64  `json:"amount_msat"`
+	AmountReceivedMsat int64  `json:"amount_received_msat"`
+	PayIndex           uint64 `json:"pay_index"`
+	PaidAt             int64  `json:"paid_at"`
+	ExpiresAt          int64  `json:"expires_at"`
+	PaymentPreimage    string `json:"payment_preimage"`
+
+	// Bolt12 is the invoice of the payments to an offer, LocalOfferID the
+	// offer and PayerNote the note of its payer.
+	Bolt12       string `json:"bolt12"`
+	LocalOfferID string `json:"local_offer_id"`
+	PayerNote    string `json:"invreq_payer_note"`
+}
+
+// invoice converts i to an lnd invoice, its pay index standing for the
+// settle index. Core Lightning doesn't report the creation date, the
+// invoice being dated at its expiry instead.
+func (i *clnInvoice) invoice() *lnrpc.Invoice {
+	hash, _ := hex.DecodeString(i.PaymentHash)
+	preimage, _ := hex.DecodeString(i.PaymentPreimage)
+	invoice := &lnrpc.Invoice{
+		Memo:           i.Description,
+		RHash:          hash,
+		RPreimage:      preimage,
+		PaymentRequest: i.Bolt11,
+		Value:          i.AmountMsat / 1000,
+		ValueMsat:      i.AmountMsat,
+		CreationDate:   i.ExpiresAt,
+		AmtPaidMsat:    i.AmountReceivedMsat,
+		AmtPaidSat:     i.AmountReceivedMsat / 1000,
+		SettleIndex:    i.PayIndex,
+		SettleDate:     i.PaidAt,
+	}
+	if invoice.PaymentRequest == "" {
+		invoice.PaymentRequest = i.Bolt12
+	}
+	switch i.Status {
+	case "paid":
+		invoice.State = lnrpc.Invoice_SETTLED
+		invoice.Settled = true
+	case "expired":
+		invoice.State = lnrpc.Invoice_CANCELED
+	default:
+		invoice.State = lnrpc.Invoice_OPEN
+	}
+	return invoice
+}
+
+func (b *clnBackend) AddInvoice(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+	// The description hash of lnurl-pay invoices is only known hashed,
+	// Core Lightning wanting the description itself.
+	if len(invoice.GetDescriptionHash()) > 0 {
+		return nil, fmt.Errorf("description hash invoices, e.g. lnurl-pay ones, %v", errLndOnly)
+	}
+	label := make([]byte, 16)
+	if _, err := rand.Read(label); err != nil {
+		return nil, err
+	}
+	amount := invoice.GetValueMsat()
+	if amount == 0 {
+		amount = invoice.GetValue() * 1000
+	}
+	params := map[string]interface{}{
+		"amount_msat": amount,
+		"label":       "chat-" + hex.EncodeToString(label),
+		"description": invoice.GetMemo(),
+	}
+	if invoice.GetExpiry() > 0 {
+		params["expiry"] = invoice.GetExpiry()
+	}
+	var res struct {
+		PaymentHash  string `json:"payment_hash"`
+		Bolt11       string `json:"bolt11"`
+		CreatedIndex uint64 `json:"created_index"`
+	}
+	if err := b.call(ctx, "invoice", params, &res); err != nil {
+		return nil, err
+	}
+	hash, err := hex.DecodeString(res.PaymentHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cln payment hash: %v", err)
+	}
+	return &lnrpc.AddInvoiceResponse{RHash: hash, PaymentRequest: res.Bolt11, AddIndex: res.CreatedIndex}, nil
+}
+
+func (b *clnBackend) DecodePayReq(ctx context.Context, payReq string) (*lnrpc.PayReq, error) {
+	var res struct {
+		PaymentHash string `json:"payment_hash"`
+		Payee       string `json:"payee"`
+		Description string `json:"description"`
+		AmountMsat  int64  `json:"amount_msat"`
+		CreatedAt   int64  `json:"created_at"`
+		Expiry      int64  `json:"expiry"`
+		Valid       bool   `json:"valid"`
+	}
+	if err := b.call(ctx, "decode", map[string]string{"string": payReq}, &res); err != nil {
+		return nil, err
+	}
+	if !res.Valid || res.PaymentHash == "" {
+		return nil, fmt.Errorf("invalid payment request")
+	}
+	return &lnrpc.PayReq{
+		Destination: res.Payee,
+		PaymentHash: res.PaymentHash,
+		NumSatoshis: res.AmountMsat / 1000,
+		NumMsat:     res.AmountMsat,
+		Timestamp:   res.CreatedAt,
+		Expiry:      res.Expiry,
+		Description: res.Description,
+	}, nil
+}
+
+func (b *clnBackend) LookupInvoice(ctx context.Context, hash string) (*lnrpc.Invoice, error) {
+	var res struct {
+		Invoices []*clnInvoice `json:"invoices"`
+	}
+	if err := b.call(ctx, "listinvoices", map[string]string{"payment_hash": hash}, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Invoices) == 0 {
+		return nil, status.Error(codes.NotFound, "unable to locate invoice")
+	}
+	return res.Invoices[0].invoice(), nil
+}
+
+// clnStream waits for the invoices paid after a pay index, one call at a
+// time.
+type clnStream struct {
+	ctx      context.Context
+	b        *clnBackend
+	payIndex uint64
+}
+
+func (s *clnStream) Recv() (*lnrpc.Invoice, error) {
+	var i clnInvoice
+	if err := s.b.call(s.ctx, "waitanyinvoice", map[string]uint64{"lastpay_index": s.payIndex}, &i); err != nil {
+		return nil, err
+	}
+	if i.PayIndex > s.payIndex {
+		s.payIndex = i.PayIndex
+	}
+	return i.invoice(), nil
+}
+
+// SubscribeInvoices streams the invoices paid after the settle index of
+// resume, Core Lightning not notifying the invoices added.
+func (b *clnBackend) SubscribeInvoices(ctx context.Context, resume *lnrpc.InvoiceSubscription) (invoiceStream, error) {
+	// The subscription is up once the node answers.
+	if _, err := b.GetInfo(ctx); err != nil {
+		return nil, err
+	}
+	return &clnStream{ctx: ctx, b: b, payIndex: resume.GetSettleIndex()}, nil
+}
+
+func (b *clnBackend) GetInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error) {
+	var res struct {
+		ID      string `json:"id"`
+		Alias   string `json:"alias"`
+		Network string `json:"network"`
+		Address []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+			Port    int    `json:"port"`
+		} `json:"address"`
+	}
+	if err := b.call(ctx, "getinfo", struct{}{}, &res); err != nil {
+		return nil, err
+	}
+	network := res.Network
+	if network == "bitcoin" {
+		network = mainnet
+	}
+	info := &lnrpc.GetInfoResponse{
+		IdentityPubkey: res.ID,
+		Alias:          res.Alias,
+		Chains:         []*lnrpc.Chain{{Chain: "bitcoin", Network: network}},
+	}
+	for _, a := range res.Address {
+		info.Uris = append(info.Uris, res.ID+"@"+a.Address+":"+strconv.Itoa(a.Port))
+	}
+	return info, nil
+}
+
+func (b *clnBackend) SignMessage(ctx context.Context, msg []byte) (string, error) {
+	var res struct {
+		Zbase string `json:"zbase"`
+	}
+	if err := b.call(ctx, "signmessage", map[string]string{"message": string(msg)}, &res); err != nil {
+		return "", err
+	}
+	return res.Zbase, nil
+}
+
+// Offer creates the offer of label, Core Lightning returning the existing
+// one when it was already created.
+func (b *clnBackend) Offer(ctx context.Context, label, description string, amountMsat int64, recurrence string) (string, error) {
+	params := map[string]interface{}{
+		"amount":      "any",
+		"description": description,
+		"label":       label,
+	}
+	if amountMsat > 0 {
+		params["amount"] = strconv.FormatInt(amountMsat, 10) + "msat"
+	}
+	if recurrence != "" {
+		params["recurrence"] = recurrence
+	}
+	var res struct {
+		Bolt12 string `json:"bolt12"`
+		Active bool   `json:"active"`
+	}
+	if err := b.call(ctx, "offer", params, &res); err != nil {
+		return "", err
+	}
+	if !res.Active {
+		return "", fmt.Errorf("offer %v was disabled", label)
+	}
+	return res.Bolt12, nil
+}
+
+func (b *clnBackend) OfferPayment(ctx context.Context, hash string) (string, string, error) {
+	var invoices struct {
+		Invoices []*clnInvoice `json:"invoices"`
+	}
+	if err := b.call(ctx, "listinvoices", map[string]string{"payment_hash": hash}, &invoices); err != nil {
+		return "", "", err
+	}
+	if len(invoices.Invoices) == 0 || invoices.Invoices[0].LocalOfferID == "" {
+		return "", "", fmt.Errorf("invoice %v didn't pay an offer", hash)
+	}
+	invoice := invoices.Invoices[0]
+	var offers struct {
+		Offers []struct {
+			Label string `json:"label"`
+		} `json:"offers"`
+	}
+	if err := b.call(ctx, "listoffers", map[string]string{"offer_id": invoice.LocalOfferID}, &offers); err != nil {
+		return "", "", err
+	}
+	if len(offers.Offers) == 0 {
+		return "", "", fmt.Errorf("unknown offer %v", invoice.LocalOfferID)
+	}
+	return offers.Offers[0].Label, invoice.PayerNote, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// clock tells the current time to the watcher, the schedulers and the
+// pricing, so that expiries, periods and settle lags can be computed on a
+// fake clock.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// idGenerator generates the random identifiers of the messages and promo
+// codes.
+type idGenerator interface {
+	// NewID returns n characters drawn from alphabet.
+	NewID(alphabet string, n int) (string, error)
+
+	// NewUUIDv7 returns a version 7 UUID, whose first 48 bits are the
+	// unix time of t in milliseconds, so that the UUIDs sort by creation.
+	NewUUIDv7(t time.Time) (string, error)
+}
+
+type randomIDs struct{}
+
+// NewID draws the characters from random bytes, rejecting the bytes past
+// the largest multiple of the alphabet length so that every character is
+// as likely.
+func (randomIDs) NewID(alphabet string, n int) (string, error) {
+	limit := 256 - 256%len(alphabet)
+	id := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(id) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, c := range buf {
+			if int(c) < limit && len(id) < n {
+				id = append(id, alphabet[int(c)%len(alphabet)])
+			}
+		}
+	}
+	return string(id), nil
+}
+
+func (randomIDs) NewUUIDv7(t time.Time) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	return formatUUIDv7(t, b), nil
+}
+
+// formatUUIDv7 returns the UUIDv7 of time t and the random bits of b, as
+// laid out by RFC 9562: the 48 bits of unix milliseconds overwrite the first
+// 6 bytes of b and the version and variant bits are set.
+func formatUUIDv7(t time.Time, b [16]byte) string {
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	copy(b[:6], ms[2:])
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+var (
+	// appClock and ids are the system clock and crypto/rand, replaced
+	// with deterministic ones to test the logic depending on them.
+	appClock clock       = systemClock{}
+	ids      idGenerator = randomIDs{}
+)
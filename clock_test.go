@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock only moving when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// sequentialIDs generates the IDs of a counter, written in the alphabet
+// asked for and left padded with its first character.
+type sequentialIDs struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (s *sequentialIDs) NewID(alphabet string, n int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	b := make([]byte, n)
+	for i, v := n-1, s.next; i >= 0; i-- {
+		b[i] = alphabet[v%len(alphabet)]
+		v /= len(alphabet)
+	}
+	return string(b), nil
+}
+
+// NewUUIDv7 returns the UUIDv7 of t whose random bits are the counter.
+func (s *sequentialIDs) NewUUIDv7(t time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	var b [16]byte
+	b[15] = byte(s.next)
+	return formatUUIDv7(t, b), nil
+}
+
+// useFakes replaces appClock and ids with fakes until the end of t.
+func useFakes(t *testing.T, now time.Time) (*fakeClock, *sequentialIDs) {
+	t.Helper()
+	savedClock, savedIDs := appClock, ids
+	t.Cleanup(func() { appClock, ids = savedClock, savedIDs })
+	c, s := &fakeClock{now: now}, &sequentialIDs{}
+	appClock, ids = c, s
+	return c, s
+}
+
+func TestStreamTokenExpiry(t *testing.T) {
+	c, _ := useFakes(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	token, err := signStreamToken(streamClaims{User: "alice", Expiry: c.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyStreamToken(token); err != nil {
+		t.Fatalf("fresh token rejected: %v", err)
+	}
+	c.Advance(time.Minute)
+	if _, err := verifyStreamToken(token); err != nil {
+		t.Fatalf("token rejected at its expiry: %v", err)
+	}
+	c.Advance(time.Second)
+	if _, err := verifyStreamToken(token); err != errInvalidToken {
+		t.Fatalf("expired token: got %v, want %v", err, errInvalidToken)
+	}
+}
+
+func TestVoucherAvailable(t *testing.T) {
+	c, _ := useFakes(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	v := &voucher{ExpiresAt: c.Now().Add(time.Hour)}
+	if !v.available() {
+		t.Fatal("voucher unavailable before its expiry")
+	}
+	c.Advance(time.Hour)
+	if v.available() {
+		t.Fatal("voucher available at its expiry")
+	}
+	v = &voucher{ExpiresAt: c.Now().Add(time.Hour), Claimed: true}
+	if v.available() {
+		t.Fatal("claimed voucher available")
+	}
+}
+
+func TestNewMessageID(t *testing.T) {
+	defer func(codec idCodec) { publicIDs = codec }(publicIDs)
+	c, _ := useFakes(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	tests := []struct {
+		codec idCodec
+		want  []string
+	}{
+		{plainIDs{}, []string{"AAAAAAAAAAAAAAAAAAAB", "AAAAAAAAAAAAAAAAAAAC"}},
+		{uuidIDs{}, []string{"016f5e66-e802-7000-8000-000000000003", "016f5e66-e803-7000-8000-000000000004"}},
+	}
+	for _, tt := range tests {
+		publicIDs = tt.codec
+		for _, want := range tt.want {
+			id, err := newMessageID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != want {
+				t.Errorf("newMessageID() = %v, want %v", id, want)
+			}
+			c.Advance(time.Millisecond)
+		}
+	}
+}
+
+func TestRandomIDs(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		id, err := randomIDs{}.NewID(messageIDAlphabet, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 20 || strings.Trim(id, messageIDAlphabet) != "" {
+			t.Fatalf("NewID() = %q, want 20 characters of the alphabet", id)
+		}
+	}
+}
+
+func TestNewUUIDv7(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a, err := randomIDs{}.NewUUIDv7(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := randomIDs{}.NewUUIDv7(now.Add(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 36 || a[:13] != "016f5e66-e800" || a[14] != '7' || !strings.ContainsRune("89ab", rune(a[19])) {
+		t.Errorf("NewUUIDv7() = %v, not a UUIDv7 of %v", a, now)
+	}
+	if a >= b {
+		t.Errorf("UUIDv7s not ordered by time: %v >= %v", a, b)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"cloud.google.com/go/firestore"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// storeNamespace prefixes the Firestore collections, so that several
+// environments can share a project. Empty means no prefix.
+var storeNamespace string
+
+// collection returns the collection name in the store namespace.
+func collection(name string) *firestore.CollectionRef {
+	return firebaseDb.Collection(namespaced(name))
+}
+
+func namespaced(name string) string {
+	if storeNamespace == "" {
+		return name
+	}
+	return storeNamespace + "_" + name
+}
+
+// unnamespaced returns the collection name of a namespaced one.
+func unnamespaced(name string) string {
+	if storeNamespace == "" {
+		return name
+	}
+	return strings.TrimPrefix(name, storeNamespace+"_")
+}
+
+// envPrefix prefixes the environment variables setting the flags, e.g.
+// CHAT_BACKEND_RPC_SERVER for -rpcServer.
+const envPrefix = "CHAT_BACKEND_"
+
+// envName returns the environment variable of the flag name.
+func envName(name string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 && !unicode.IsUpper(rune(name[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// applyEnvironment sets the flags from their environment variable, which
+// takes precedence over the command line, and returns the flags set by
+// either, which the config file doesn't override.
+func applyEnvironment() (map[string]bool, error) {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok && err == nil {
+			if l, ok := f.Value.(*stringList); ok {
+				// The variable replaces the list of the command line.
+				*l = nil
+			}
+			if e := flag.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("%v: %v", envName(f.Name), e)
+			}
+		}
+	})
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set, err
+}
+
+// flagKey normalizes a setting name of the config file, so that both
+// rpcServer and rpc_server or rpc-server name -rpcServer.
+func flagKey(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+}
+
+// loadConfigFile sets the flags not in set from the TOML or YAML file at
+// path, according to its extension, JSON being read as YAML, e.g.
+//
+//	rpc_server = "lnd:10009"
+//	allowed_origins = ["https://chat.example.com"]
+//
+//	[staging]
+//	namespace = "staging"
+//
+// The top level settings apply, then those of the table named profile,
+// the other tables being left for the other profiles. Lists are joined
+// with commas, like the flags take them.
+func loadConfigFile(path, profile string, set map[string]bool) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	doc := make(map[string]interface{})
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml", ".json":
+		err = yaml.Unmarshal(b, &doc)
+	default:
+		err = toml.Unmarshal(b, &doc)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config %v: %v", path, err)
+	}
+	settings, err := profileSettings(doc, profile)
+	if err != nil {
+		return fmt.Errorf("invalid config %v: %v", path, err)
+	}
+
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[flagKey(f.Name)] = f.Name
+	})
+	for key, value := range settings {
+		name, ok := flags[flagKey(key)]
+		if !ok {
+			return fmt.Errorf("config %v: unknown setting %q", path, key)
+		}
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("config %v: %v: %v", path, key, err)
+		}
+	}
+	return nil
+}
+
+// profileSettings returns the flag values of the top level settings of doc
+// and of its table named profile, which take precedence.
+func profileSettings(doc map[string]interface{}, profile string) (map[string]string, error) {
+	settings := make(map[string]string)
+	add := func(table map[string]interface{}, prefix string) error {
+		for key, v := range table {
+			if _, ok := asTable(v); ok {
+				// The top level tables are the profiles.
+				if prefix != "" {
+					return fmt.Errorf("%v%v: nested tables are not supported", prefix, key)
+				}
+				continue
+			}
+			value, err := settingValue(v)
+			if err != nil {
+				return fmt.Errorf("%v%v: %v", prefix, key, err)
+			}
+			settings[key] = value
+		}
+		return nil
+	}
+	if err := add(doc, ""); err != nil {
+		return nil, err
+	}
+	if profile == "" {
+		return settings, nil
+	}
+	table, ok := asTable(doc[profile])
+	if !ok {
+		return nil, fmt.Errorf("no profile %q", profile)
+	}
+	if err := add(table, profile+"."); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// asTable returns v as a table if it is a TOML table or a YAML mapping,
+// whose keys may be any scalar.
+func asTable(v interface{}) (map[string]interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t, true
+	case map[interface{}]interface{}:
+		table := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			table[fmt.Sprint(k)] = v
+		}
+		return table, true
+	}
+	return nil, false
+}
+
+// settingValue returns the flag value of a scalar setting, or of a list of
+// them joined with commas.
+func settingValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			if _, ok := asTable(item); ok {
+				return "", fmt.Errorf("lists may only hold values")
+			}
+			s, err := settingValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	files := map[string]string{
+		"config.toml": `
+rpc_server = "lnd:10009"
+allowed_origins = ["https://a.example.com", "https://b.example.com"]
+price = 100
+allowAllOrigins = false
+
+[staging]
+rpc_server = "lnd-testnet:10009"
+namespace = "staging"
+
+[prod]
+namespace = "prod"
+`,
+		"config.yaml": `
+rpc_server: lnd:10009
+allowed_origins:
+  - https://a.example.com
+  - https://b.example.com
+price: 100
+allowAllOrigins: false
+staging:
+  rpc_server: lnd-testnet:10009
+  namespace: staging
+prod:
+  namespace: prod
+`,
+		"config.json": `{
+  "rpc_server": "lnd:10009",
+  "allowed_origins": ["https://a.example.com", "https://b.example.com"],
+  "price": 100,
+  "allowAllOrigins": false,
+  "staging": {"rpc_server": "lnd-testnet:10009", "namespace": "staging"},
+  "prod": {"namespace": "prod"}
+}`,
+	}
+	tests := []struct {
+		profile string
+		set     map[string]bool
+		want    map[string]string
+	}{
+		{"", nil, map[string]string{"rpcServer": "lnd:10009", "namespace": "", "price": "100"}},
+		{"staging", nil, map[string]string{"rpcServer": "lnd-testnet:10009", "namespace": "staging"}},
+		{"staging", map[string]bool{"rpcServer": true}, map[string]string{"rpcServer": "cli:10009", "namespace": "staging"}},
+	}
+	for name, content := range files {
+		path := filepath.Join(t.TempDir(), name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			withFlags(t, func(fs *flag.FlagSet) {
+				fs.String("rpcServer", "cli:10009", "")
+				fs.String("namespace", "", "")
+				fs.Int64("price", 0, "")
+				fs.Bool("allowAllOrigins", true, "")
+				var origins stringList
+				fs.Var(&origins, "allowedOrigins", "")
+
+				if err := loadConfigFile(path, tt.profile, tt.set); err != nil {
+					t.Fatalf("%v: %v", name, err)
+				}
+				for flagName, want := range tt.want {
+					if got := fs.Lookup(flagName).Value.String(); got != want {
+						t.Errorf("%v, profile %q: -%v = %q, want %q", name, tt.profile, flagName, got, want)
+					}
+				}
+				if len(origins) != 2 || origins[1] != "https://b.example.com" {
+					t.Errorf("%v: -allowedOrigins = %q, want both origins", name, origins)
+				}
+				if got := fs.Lookup("allowAllOrigins").Value.String(); got != "false" {
+					t.Errorf("%v: -allowAllOrigins = %v, want false", name, got)
+				}
+			})
+		}
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown.toml":   `bogus = 1`,
+		"nested.toml":    "[staging]\n[staging.deeper]\nnamespace = \"x\"",
+		"invalid.toml":   `price = `,
+		"invalid.yaml":   "price: [100",
+		"wrongtype.yml":  "price: abc",
+		"noprofile.toml": "price = 1\n[prod]\nnamespace = \"prod\"",
+	}
+	for name, content := range tests {
+		path := filepath.Join(t.TempDir(), name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		withFlags(t, func(fs *flag.FlagSet) {
+			fs.String("namespace", "", "")
+			fs.Int64("price", 0, "")
+			if err := loadConfigFile(path, "staging", nil); err == nil {
+				t.Errorf("%v: loaded without error", name)
+			}
+		})
+	}
+}
+
+// withFlags runs fn with a fresh command line flag set.
+func withFlags(t *testing.T, fn func(fs *flag.FlagSet)) {
+	saved := flag.CommandLine
+	defer func() { flag.CommandLine = saved }()
+	flag.CommandLine = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	fn(flag.CommandLine)
+}
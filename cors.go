@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	// allowedOrigins are the origins allowed to call the api from a
+	// browser, e.g. https://chat.example.com or https://*.example.com for
+	// any of its subdomains. allowAllOrigins allows any origin, for
+	// development.
+	allowedOrigins  []string
+	allowAllOrigins bool
+)
+
+// originAllowed reports whether a browser at origin may call the api.
+func originAllowed(origin string) bool {
+	if allowAllOrigins {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range allowedOrigins {
+		if origin == allowed {
+			return true
+		}
+		// https://*.example.com matches https://a.example.com and
+		// https://a.b.example.com, but not https://example.com.
+		if i := strings.Index(allowed, "://*."); i >= 0 {
+			scheme, domain := allowed[:i+3], allowed[i+4:]
+			if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, domain) &&
+				len(origin) > len(scheme)+len(domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The CORS policy of the api, the answer to the preflight requests.
+var (
+	corsAllowedMethods = []string{"GET", "POST", "PUT"}
+	corsAllowedHeaders = []string{
+		"Accept", "Authorization", "Content-Type", "X-Custom-Header", "Origin", apiVersionHeader, payerTokenHeader,
+		requestIDHeader, traceparentHeader}
+	corsExposedHeaders = []string{apiVersionHeader, requestIDHeader}
+)
+
+// corsMaxAge is how long browsers may cache the answer to a preflight
+// request, in seconds.
+const corsMaxAge = 3600
+
+// corsMiddleware answers the CORS preflight requests and allows the browsers
+// at allowed origins to read the answers of the others. Requests of origins
+// not allowed are rejected, those without an origin or from the host of the
+// api aren't CORS ones and go through.
+func corsMiddleware(h http.Handler) http.Handler {
+	methods := map[string]bool{}
+	for _, m := range corsAllowedMethods {
+		methods[strings.ToUpper(m)] = true
+	}
+	headers := map[string]bool{}
+	canonical := make([]string, len(corsAllowedHeaders))
+	for i, name := range corsAllowedHeaders {
+		canonical[i] = http.CanonicalHeaderKey(name)
+		headers[canonical[i]] = true
+	}
+	allowedMethods, allowedHeaders := strings.Join(corsAllowedMethods, ","), strings.Join(canonical, ",")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if !isCORSRequest(r, origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !originAllowed(origin) {
+			writeError(w, http.StatusForbidden, "invalid origin")
+			return
+		}
+
+		method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+		if r.Method == http.MethodOptions && method != "" {
+			if !methods[method] {
+				writeError(w, http.StatusForbidden, "invalid preflight request")
+				return
+			}
+			for _, list := range r.Header.Values("Access-Control-Request-Headers") {
+				for _, name := range strings.Split(list, ",") {
+					if name = strings.TrimSpace(name); name != "" && !headers[http.CanonicalHeaderKey(name)] {
+						writeError(w, http.StatusForbidden, "invalid preflight request")
+						return
+					}
+				}
+			}
+			w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		for _, name := range corsExposedHeaders {
+			w.Header().Add("Access-Control-Expose-Headers", name)
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isCORSRequest reports whether r, sent from origin, is a cross origin one.
+func isCORSRequest(r *http.Request, origin string) bool {
+	switch origin {
+	case "":
+		return false
+	case "null":
+		return true
+	}
+	u, err := url.ParseRequestURI(origin)
+	return err == nil && u.Host != r.Host
+}
+
+// checkWSOrigin is the origin check of the websocket upgrades, the clients
+// which aren't browsers sending no origin.
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || originAllowed(origin)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+)
+
+const (
+	regtest = "regtest"
+
+	demoPayTimeout = time.Minute
+)
+
+var (
+	// demoPayer is the regtest lnd node of -demoPayer paying the invoices
+	// of POST /demo/pay/:rhash, nil outside of the demo mode.
+	demoPayer lnrpc.LightningClient
+
+	errDemoPaid = errors.New("message already paid")
+)
+
+// openDemoPayer dials the payer node of the demo mode, which only runs on
+// regtest where the coins are worthless.
+func openDemoPayer(server, tlsCert, rpcMacaroon string) error {
+	if lndNetwork != regtest {
+		return fmt.Errorf("-demoPayer needs a regtest node, not %q", lndNetwork)
+	}
+	if tlsCert == "" || rpcMacaroon == "" {
+		return fmt.Errorf("-demoPayer needs -demoPayerCert and -demoPayerMacaroon")
+	}
+	conn, err := dialNode(server, tlsCert, rpcMacaroon)
+	if err != nil {
+		return fmt.Errorf("demo payer: %v", err)
+	}
+	demoPayer = lnrpc.NewLightningClient(conn)
+	logWarn("Demo mode: POST /demo/pay/:rhash pays the invoices from the demo payer", "node", server)
+	return nil
+}
+
+// postDemoPay pays the invoice of the message of a payment hash from the
+// demo payer, so that the frontends can be developed and demoed end to end
+// without paying by hand. The settlement then flows as any other.
+func postDemoPay(w http.ResponseWriter, r *http.Request) {
+	hash := strings.ToLower(pathParam(r, "rhash"))
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 {
+		writeError(w, http.StatusBadRequest, "invalid payment hash")
+		return
+	}
+	m, err := store.FindByPaymentHash(r.Context(), hash)
+	if err == nil && m.Settled {
+		err = errDemoPaid
+	}
+	switch err {
+	case nil:
+	case errMessageNotFound:
+		writeErrorCode(w, http.StatusNotFound, codeUnknownMessage, err.Error(), nil)
+		return
+	case errDemoPaid:
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	default:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), demoPayTimeout)
+	defer cancel()
+	res, err := demoPayer.SendPaymentSync(ctx, &lnrpc.SendRequest{PaymentRequest: m.Invoice})
+	if err == nil && res.GetPaymentError() != "" {
+		err = errors.New(res.GetPaymentError())
+	}
+	if err != nil {
+		logWarn("Demo payment failed", "payment_hash", hash, "err", err)
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	logInfo("Demo payment sent", "doc_id", m.ID, "payment_hash", hash)
+	writeJSON(w, map[string]interface{}{
+		"id":       publicIDs.Encode(m.ID),
+		"preimage": hex.EncodeToString(res.GetPaymentPreimage()),
+		"amount":   m.Amount,
+	})
+}
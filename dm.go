@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	dmKeysCollection = "dm_keys"
+
+	// maxDMCiphertext bounds the size of an encrypted direct message.
+	maxDMCiphertext = 4096
+)
+
+// dmPayload is a direct message encrypted by the sender with NaCl box
+// (X25519, XSalsa20-Poly1305) for the public key of the recipient. The
+// backend never sees the plaintext. All fields are base64 encoded.
+type dmPayload struct {
+	SenderKey  string `json:"sender_key" firestore:"sender_key"`
+	Nonce      string `json:"nonce" firestore:"nonce"`
+	Ciphertext string `json:"ciphertext" firestore:"ciphertext"`
+}
+
+func (p *dmPayload) validate() error {
+	enc := base64.StdEncoding
+	key, err := enc.DecodeString(p.SenderKey)
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("sender_key must be a base64 encoded 32 byte key")
+	}
+	nonce, err := enc.DecodeString(p.Nonce)
+	if err != nil || len(nonce) != 24 {
+		return fmt.Errorf("nonce must be 24 base64 encoded bytes")
+	}
+	ct, err := enc.DecodeString(p.Ciphertext)
+	if err != nil || len(ct) <= box.Overhead || len(ct) > maxDMCiphertext {
+		return fmt.Errorf("ciphertext must be between %d and %d base64 encoded bytes",
+			box.Overhead+1, maxDMCiphertext)
+	}
+	return nil
+}
+
+// dmKey is the public key a user receives direct messages for.
+type dmKey struct {
+	PublicKey string    `json:"public_key" firestore:"public_key"`
+	UpdatedAt time.Time `json:"updated_at" firestore:"updated_at"`
+}
+
+// streamUser returns the claims of the stream token authenticating r,
+// which must identify a user.
+func streamUser(w http.ResponseWriter, r *http.Request) *streamClaims {
+	claims, err := streamClaimsOf(r)
+	if err == nil && claims.User == "" {
+		err = errInvalidToken
+	}
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return nil
+	}
+	return claims
+}
+
+// putDMKey registers the public key of the authenticated user.
+func putDMKey(w http.ResponseWriter, r *http.Request) {
+	claims := streamUser(w, r)
+	if claims == nil {
+		return
+	}
+
+	var k dmKey
+	if err := decodeJSON(r, &k); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if key, err := base64.StdEncoding.DecodeString(k.PublicKey); err != nil || len(key) != 32 {
+		writeError(w, http.StatusBadRequest, "public_key must be a base64 encoded 32 byte key")
+		return
+	}
+	k.UpdatedAt = appClock.Now()
+
+	if err := waitForWrite(r.Context(), dmKeysCollection); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if _, err := collection(dmKeysCollection).Doc(claims.User).Set(r.Context(), k); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, k)
+}
+
+// getDMKey returns the public key DMs to a user must be encrypted for.
+func getDMKey(w http.ResponseWriter, r *http.Request) {
+	s, err := collection(dmKeysCollection).Doc(pathParam(r, "user")).Get(r.Context())
+	if status.Code(err) == codes.NotFound {
+		writeError(w, http.StatusNotFound, "user has no dm key")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	var k dmKey
+	if err := s.DataTo(&k); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, k)
+}
+
+// postDM stores an encrypted direct message to a user and returns the
+// invoice that delivers it once paid.
+func postDM(w http.ResponseWriter, r *http.Request) {
+	recipient := pathParam(r, "user")
+	var p dmPayload
+	if err := decodeJSON(r, &p); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := p.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req, err := newInvoiceRequest(r, "Direct message", currentSettings().Price)
+	if err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	m, res, err := createMessage(r.Context(), req, &lnrpc.Invoice{
+		Memo:  req.Memo,
+		Value: req.Amount,
+	}, &Message{
+		Room: dmRoomPrefix + recipient,
+		DM:   &p,
+	})
+	if err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	writeJSON(w, map[string]string{
+		"id":          publicIDs.Encode(m.ID),
+		"pay_req":     res.PaymentRequest,
+		"payer_token": payerToken(m.RHash),
+	})
+}
+
+// getDMInbox returns the paid direct messages of the authenticated user,
+// still encrypted.
+func getDMInbox(w http.ResponseWriter, r *http.Request) {
+	claims := streamUser(w, r)
+	if claims == nil {
+		return
+	}
+
+	messages, err := store.ListSettledInRoom(r.Context(), dmRoomPrefix+claims.User)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	inbox := make([]map[string]interface{}, 0, len(messages))
+	for _, m := range messages {
+		inbox = append(inbox, map[string]interface{}{
+			"id":         publicIDs.Encode(m.ID),
+			"dm":         m.DM,
+			"settled_at": m.SettledAt,
+		})
+	}
+	writeJSON(w, map[string]interface{}{"messages": inbox})
+}
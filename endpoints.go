@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+var (
+	// onionAddress is the Tor onion service the backend is also reachable
+	// at, advertised to the clients.
+	onionAddress string
+
+	// invoiceSubscriptionUp is 1 while the invoice subscription of the
+	// primary node feeding the settlement events is open.
+	invoiceSubscriptionUp int32
+)
+
+// endpoint is a transport clients can reach the backend over.
+type endpoint struct {
+	Transport string `json:"transport"`
+	URL       string `json:"url"`
+	Health    string `json:"health"`
+}
+
+// lndHealth reports the state of the connection to the node, which all the
+// transports depend on.
+func lndHealth() string {
+	// The other backends tell whether their last call reached them.
+	if b, ok := lightning.(interface{ health() string }); ok {
+		return b.health()
+	}
+	lndConnMu.Lock()
+	conn := lndConn
+	lndConnMu.Unlock()
+	if conn == nil {
+		return healthDown
+	}
+	switch conn.GetState() {
+	case connectivity.Ready, connectivity.Idle:
+		return healthOK
+	case connectivity.Connecting:
+		return healthDegraded
+	default:
+		return healthDown
+	}
+}
+
+// streamHealth reports whether the event stream delivers settlements.
+func streamHealth() string {
+	if subscriptionsUp() {
+		return healthOK
+	}
+	return healthDegraded
+}
+
+// websocketURL returns the websocket URL of an http base URL.
+func websocketURL(base string) string {
+	if strings.HasPrefix(base, "https://") {
+		return "wss://" + strings.TrimPrefix(base, "https://") + "/ws"
+	}
+	return "ws://" + strings.TrimPrefix(base, "http://") + "/ws"
+}
+
+// getEndpoints serves the discovery document of the transports, in order of
+// preference, with their health so that clients can fail over between
+// them.
+func getEndpoints(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r).String()
+	api, stream := lndHealth(), streamHealth()
+	if api == healthDown {
+		stream = healthDown
+	}
+
+	list := []endpoint{
+		{Transport: "websocket", URL: websocketURL(base), Health: stream},
+		{Transport: "http", URL: base, Health: api},
+	}
+	if onionAddress != "" {
+		onion := "http://" + onionAddress
+		list = append(list,
+			endpoint{Transport: "websocket+tor", URL: websocketURL(onion), Health: stream},
+			endpoint{Transport: "http+tor", URL: onion, Health: api},
+		)
+	}
+	writeJSON(w, map[string]interface{}{"endpoints": list})
+}
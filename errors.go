@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+)
+
+// The codes of the api errors, telling the failure modes apart. Most follow
+// from the status of the answer, see statusErrorCodes.
+const (
+	codeInvalidRequest   = "invalid_request"
+	codeUnauthorized     = "unauthorized"
+	codeUnpaid           = "unpaid"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeConflict         = "conflict"
+	codeTooLarge         = "too_large"
+	codeUnsupportedMedia = "unsupported_media_type"
+	codeRateLimited      = "rate_limited"
+	codeInternal         = "internal"
+	codeNotImplemented   = "not_implemented"
+	codeLndUnreachable   = "lnd_unreachable"
+	codeStoreUnavailable = "store_unavailable"
+
+	codeUnknownInvoice = "unknown_invoice"
+	codeUnknownMessage = "unknown_message"
+
+	// codeUpstreamUnavailable is a service other than lnd, such as FCM or
+	// S3, failing.
+	codeUpstreamUnavailable = "upstream_unavailable"
+)
+
+// statusErrorCodes are the codes of the errors answered with a status,
+// unless more specific.
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:            codeInvalidRequest,
+	http.StatusUnauthorized:          codeUnauthorized,
+	http.StatusPaymentRequired:       codeUnpaid,
+	http.StatusForbidden:             codeForbidden,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusMethodNotAllowed:      codeMethodNotAllowed,
+	http.StatusConflict:              codeConflict,
+	http.StatusRequestEntityTooLarge: codeTooLarge,
+	http.StatusUnsupportedMediaType:  codeUnsupportedMedia,
+	http.StatusTooManyRequests:       codeRateLimited,
+	http.StatusInternalServerError:   codeInternal,
+	http.StatusNotImplemented:        codeNotImplemented,
+	http.StatusBadGateway:            codeLndUnreachable,
+	http.StatusServiceUnavailable:    codeStoreUnavailable,
+}
+
+// storeError is a failure of the message store, answered 503 and
+// invoiceError one of the backend adding an invoice, answered 502, by the
+// handlers creating messages.
+type (
+	storeError   struct{ error }
+	invoiceError struct{ error }
+)
+
+// writeCreateError answers an error of newInvoiceRequest or createMessage.
+// Those of the store and of the invoice backend are told apart, the others,
+// such as hook rejections, being the request's.
+func writeCreateError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case storeError:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case invoiceError:
+		writeError(w, http.StatusBadGateway, err.Error())
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+// apiError is the envelope of the errors of the api. Error repeats Message
+// for the clients of the former {"error": ...} answers.
+type apiError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+	Error   string      `json:"error"`
+}
+
+// writeError answers status with the error msg, coded after the status.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeErrorCode(w, status, statusErrorCodes[status], msg, nil)
+}
+
+// writeErrorCode answers status with the error msg of code, and its details
+// unless nil.
+func writeErrorCode(w http.ResponseWriter, status int, code, msg string, details interface{}) {
+	if code == "" {
+		code = codeInternal
+	}
+	w.WriteHeader(status)
+	writeJSON(w, apiError{Code: code, Message: msg, Details: details, Error: msg})
+}
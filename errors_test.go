@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteCreateError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{storeError{errors.New("firestore down")}, http.StatusServiceUnavailable, codeStoreUnavailable},
+		{invoiceError{errors.New("lnd down")}, http.StatusBadGateway, codeLndUnreachable},
+		{errBannedUser, http.StatusBadRequest, codeInvalidRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeCreateError(w, tt.err)
+		var body apiError
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.status || body.Code != tt.code {
+			t.Errorf("%v: answered %d %v, want %d %v", tt.err, w.Code, body.Code, tt.status, tt.code)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+)
+
+const (
+	// replicaAttribute is the attribute of the bus messages naming the
+	// replica which published them.
+	replicaAttribute = "replica"
+
+	eventBusRetry = 5 * time.Second
+)
+
+var (
+	// eventTopic is the Pub/Sub topic the replicas share their events
+	// through, nil when the backend runs alone, and eventSubscription the
+	// subscription of this replica, replicaID telling its events apart.
+	eventTopic        *pubsub.Topic
+	eventSubscription *pubsub.Subscription
+	replicaID         string
+
+	// follower replicas don't subscribe to the invoices of lnd, the
+	// settlements reaching their websocket clients through the event bus.
+	follower bool
+
+	eventBusMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "event_bus_messages_total",
+		Help:      "Number of events shared with the other replicas by direction (published, received, failed).",
+	}, []string{"direction"})
+)
+
+func init() {
+	prometheus.MustRegister(eventBusMessages)
+}
+
+// openEventBus connects to the Pub/Sub topic projects/<project>/topics/<id>
+// and creates the subscription of this replica to it.
+func openEventBus(ctx context.Context, name string, opts ...option.ClientOption) error {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" {
+		return fmt.Errorf("invalid event topic %q, want projects/<project>/topics/<topic>", name)
+	}
+	client, err := pubsub.NewClient(ctx, parts[1], opts...)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	replicaID = hex.EncodeToString(id)
+
+	eventTopic = client.Topic(parts[3])
+	eventSubscription, err = client.CreateSubscription(ctx, parts[3]+"-"+replicaID, pubsub.SubscriptionConfig{
+		Topic:       eventTopic,
+		AckDeadline: 10 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	logInfo("Joined the event bus", "topic", name, "replica", replicaID, "follower", follower)
+	return nil
+}
+
+// shareEvent publishes ev to the other replicas, in the background.
+func shareEvent(ev event) {
+	if eventTopic == nil {
+		return
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		logError("Failed to encode the event", "err", err)
+		return
+	}
+	res := eventTopic.Publish(context.Background(), &pubsub.Message{
+		Data:       b,
+		Attributes: map[string]string{replicaAttribute: replicaID},
+	})
+	go func() {
+		if _, err := res.Get(context.Background()); err != nil {
+			eventBusMessages.WithLabelValues("failed").Inc()
+			logWarn("Failed to share the event", "type", ev.Type, "err", err)
+			return
+		}
+		eventBusMessages.WithLabelValues("published").Inc()
+	}()
+}
+
+// relayEvents delivers the events of the other replicas to the websocket
+// clients of this one until ctx is done, then deletes the subscription of
+// the replica.
+func relayEvents(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := eventSubscription.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+			m.Ack()
+			if m.Attributes[replicaAttribute] == replicaID {
+				return
+			}
+			var ev event
+			if err := json.Unmarshal(m.Data, &ev); err != nil {
+				logWarn("Invalid event on the bus", "err", err)
+				return
+			}
+			eventBusMessages.WithLabelValues("received").Inc()
+			unindexEvent(ev)
+			eventHub.publish(ev)
+		})
+		if ctx.Err() != nil {
+			break
+		}
+		logWarn("Event bus subscription failed", "err", err, "retry_in", eventBusRetry)
+		select {
+		case <-ctx.Done():
+		case <-time.After(eventBusRetry):
+		}
+	}
+
+	deleteCtx, cancel := context.WithTimeout(context.Background(), eventBusRetry)
+	defer cancel()
+	if err := eventSubscription.Delete(deleteCtx); err != nil {
+		logWarn("Failed to delete the event bus subscription", "err", err)
+	}
+}
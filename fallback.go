@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// backendTag is the tag of the messages whose invoice wasn't created
+	// on the node, naming the backend it was created on instead.
+	backendTag    = "backend"
+	backendLnbits = "lnbits"
+
+	// fallbackPollInterval is how often the unpaid fallback invoices are
+	// looked up, LNbits having no invoice subscription.
+	fallbackPollInterval = 15 * time.Second
+
+	defaultFallbackExpiry = 3600
+)
+
+var (
+	// fallbackURL is the LNbits instance, and fallbackKey the invoice key of
+	// its wallet, the invoices the node lacks the inbound liquidity to be
+	// paid are created on. An empty url disables the fallback.
+	fallbackURL string
+	fallbackKey string
+
+	fallbackClient = &http.Client{Timeout: 10 * time.Second}
+
+	// fallbackPending are the unpaid messages of fallback invoices, by
+	// payment hash, polled until they are paid or their invoice expires.
+	fallbackPendingMu sync.Mutex
+	fallbackPending   = make(map[string]*Message)
+)
+
+// inboundLiquidity returns the satoshis the node can receive over its active
+// channels, the remote balances less the reserves the peers must keep.
+func inboundLiquidity(ctx context.Context, c lnrpc.LightningClient) (int64, error) {
+	res, err := c.ListChannels(ctx, &lnrpc.ListChannelsRequest{ActiveOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	var inbound int64
+	for _, ch := range res.GetChannels() {
+		if receivable := ch.GetRemoteBalance() - int64(ch.GetRemoteConstraints().GetChanReserveSat()); receivable > 0 {
+			inbound += receivable
+		}
+	}
+	return inbound, nil
+}
+
+// needsFallback reports whether invoice is better created on the fallback
+// backend, the node lacking the inbound liquidity to receive it. Amounts
+// which aren't whole satoshis can't be invoiced by LNbits.
+func needsFallback(ctx context.Context, invoice *lnrpc.Invoice) bool {
+	if fallbackURL == "" || invoice.GetValueMsat()%1000 != 0 {
+		return false
+	}
+	c, clean := getClient()
+	defer clean()
+	amount := invoice.GetValue()
+	if invoice.GetValueMsat() != 0 {
+		amount = invoice.GetValueMsat() / 1000
+	}
+	inbound, err := inboundLiquidity(ctx, c)
+	if err != nil {
+		logWarn("Failed to get the inbound liquidity", "err", err)
+		return false
+	}
+	return inbound < amount
+}
+
+// lnbitsRequest sends a request to the LNbits api of the fallback wallet and
+// decodes its response into res.
+func lnbitsRequest(ctx context.Context, method, path string, body, res interface{}) error {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, fallbackURL+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", fallbackKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := fallbackClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("lnbits %v %v: %v", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// addFallbackInvoice creates invoice on the LNbits wallet.
+func addFallbackInvoice(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+	amount := invoice.GetValue()
+	if invoice.GetValueMsat() != 0 {
+		amount = invoice.GetValueMsat() / 1000
+	}
+	expiry := invoice.GetExpiry()
+	if expiry == 0 {
+		expiry = defaultFallbackExpiry
+	}
+	body := map[string]interface{}{
+		"out":    false,
+		"amount": amount,
+		"memo":   invoice.GetMemo(),
+		"expiry": expiry,
+	}
+	if len(invoice.GetDescriptionHash()) > 0 {
+		body["description_hash"] = hex.EncodeToString(invoice.GetDescriptionHash())
+	}
+	var res struct {
+		PaymentHash    string `json:"payment_hash"`
+		PaymentRequest string `json:"payment_request"`
+	}
+	if err := lnbitsRequest(ctx, http.MethodPost, "/api/v1/payments", body, &res); err != nil {
+		return nil, err
+	}
+	hash, err := hex.DecodeString(res.PaymentHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lnbits payment hash: %v", err)
+	}
+	return &lnrpc.AddInvoiceResponse{RHash: hash, PaymentRequest: res.PaymentRequest}, nil
+}
+
+// lookupFallbackInvoice returns the invoice of m, a message paid through
+// the fallback wallet, as lnd would have described it.
+func lookupFallbackInvoice(ctx context.Context, m *Message) (*lnrpc.Invoice, error) {
+	var res struct {
+		Paid     bool   `json:"paid"`
+		Preimage string `json:"preimage"`
+		Details  struct {
+			Amount int64 `json:"amount"`
+		} `json:"details"`
+	}
+	if err := lnbitsRequest(ctx, http.MethodGet, "/api/v1/payments/"+m.RHash, nil, &res); err != nil {
+		return nil, err
+	}
+	hash, err := hex.DecodeString(m.RHash)
+	if err != nil {
+		return nil, err
+	}
+	invoice := &lnrpc.Invoice{
+		RHash:          hash,
+		PaymentRequest: m.Invoice,
+		Value:          m.Amount,
+		CreationDate:   m.CreatedAt.Unix(),
+		Expiry:         defaultFallbackExpiry,
+		State:          lnrpc.Invoice_OPEN,
+	}
+	if res.Paid {
+		invoice.State = lnrpc.Invoice_SETTLED
+		invoice.RPreimage, _ = hex.DecodeString(res.Preimage)
+		invoice.AmtPaidMsat = res.Details.Amount
+		if invoice.AmtPaidMsat == 0 {
+			invoice.AmtPaidMsat = m.Amount * 1000
+		}
+	}
+	return invoice, nil
+}
+
+// lookupInvoice returns the invoice of m from the backend or node it was
+// created on, every lnd RPC waiting for the limiter first.
+func lookupInvoice(ctx context.Context, limiter *rate.Limiter, m *Message) (*lnrpc.Invoice, error) {
+	if m.Tags[backendTag] == backendLnbits {
+		return lookupFallbackInvoice(ctx, m)
+	}
+	b := messageLightning(m)
+	hash, err := paymentHash(ctx, b, limiter, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	invoice, err := b.LookupInvoice(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	// LNDHub doesn't report the amount paid of its older invoices.
+	if invoice.GetState() == lnrpc.Invoice_SETTLED && invoice.GetAmtPaidMsat() == 0 {
+		invoice.AmtPaidMsat = m.Amount * 1000
+	}
+	if invoice.GetPaymentRequest() == "" {
+		invoice.PaymentRequest = m.Invoice
+	}
+	return invoice, nil
+}
+
+// trackFallback polls the invoice of m, a message of the fallback wallet,
+// until it is paid.
+func trackFallback(m *Message) {
+	fallbackPendingMu.Lock()
+	fallbackPending[m.RHash] = m
+	fallbackPendingMu.Unlock()
+}
+
+// watchFallback settles the messages paid through the fallback wallet every
+// fallbackPollInterval until ctx is done, forgetting those whose invoice
+// expired.
+func watchFallback(ctx context.Context) {
+	ticker := time.NewTicker(fallbackPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fallbackPendingMu.Lock()
+		pending := make([]*Message, 0, len(fallbackPending))
+		for _, m := range fallbackPending {
+			pending = append(pending, m)
+		}
+		fallbackPendingMu.Unlock()
+
+		for _, m := range pending {
+			invoice, err := lookupFallbackInvoice(ctx, m)
+			if err != nil {
+				logWarn("Failed to look the fallback invoice up", "doc_id", m.ID, "payment_hash", m.RHash, "err", err)
+				continue
+			}
+			switch {
+			case invoice.GetState() == lnrpc.Invoice_SETTLED:
+				// Settlements are recorded whatever ctx, like the
+				// ones of the node.
+				audit(auditSettleReceived, m, invoice, backendLnbits)
+				if err := markSettled(context.Background(), m, invoice); err != nil {
+					logError("Failed to mark the message settled", "doc_id", m.ID, "payment_hash", m.RHash, "err", err)
+					continue
+				}
+			case !invoiceStale(invoice, appClock.Now()):
+				continue
+			}
+			fallbackPendingMu.Lock()
+			delete(fallbackPending, m.RHash)
+			fallbackPendingMu.Unlock()
+		}
+	}
+}
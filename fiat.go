@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// fiatPrice is the price of a message in fiatCurrency, e.g. 0.05 for 5
+	// US cents, converted to sats at invoice time. 0 prices messages in
+	// sats.
+	fiatPrice float64
+
+	errRateUnavailable = errors.New("no current exchange rate to price the message")
+)
+
+const (
+	// rateRefreshInterval is how often the rate pricing the messages is
+	// refreshed, and maxRateAge how old it can get when the provider fails
+	// before invoices are refused rather than mispriced.
+	rateRefreshInterval = time.Minute
+	maxRateAge          = 15 * time.Minute
+)
+
+var liveRate struct {
+	sync.RWMutex
+	rate float64
+	at   time.Time
+}
+
+// watchRate refreshes the rate pricing the messages every
+// rateRefreshInterval until ctx is done.
+func watchRate(ctx context.Context) {
+	ticker := time.NewTicker(rateRefreshInterval)
+	defer ticker.Stop()
+	for {
+		rate, err := fetchRate(ctx)
+		if err != nil {
+			logWarn("Failed to refresh the exchange rate", "currency", fiatCurrency, "err", err)
+		} else {
+			liveRate.Lock()
+			liveRate.rate, liveRate.at = rate, appClock.Now()
+			liveRate.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// currentRate returns the rate pricing the messages, failing with
+// errRateUnavailable when it is older than maxRateAge.
+func currentRate() (float64, error) {
+	liveRate.RLock()
+	defer liveRate.RUnlock()
+	if liveRate.rate <= 0 || appClock.Now().Sub(liveRate.at) > maxRateAge {
+		return 0, errRateUnavailable
+	}
+	return liveRate.rate, nil
+}
+
+// fiatToSats converts an amount of fiat to sats at rate, rounding up so that
+// messages never cost less than their fiat price.
+func fiatToSats(amount, rate float64) int64 {
+	return int64(math.Ceil(amount / rate * 1e8))
+}
+
+// satsToFiat converts an amount of sats to fiat at rate.
+func satsToFiat(sats int64, rate float64) float64 {
+	return float64(sats) * rate / 1e8
+}
+
+// priceFiat records the fiat value of m, an amount of sats, at the current
+// rate, when the messages are priced in fiat.
+func priceFiat(m *Message) {
+	if fiatPrice <= 0 {
+		return
+	}
+	rate, err := currentRate()
+	if err != nil {
+		return
+	}
+	m.FiatCurrency = fiatCurrency
+	m.FiatRate = rate
+	m.FiatAmount = satsToFiat(m.Amount, rate)
+}
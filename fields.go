@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// withSparseFields lets clients of a list endpoint restrict the fields of
+// every returned item with a "?fields=a,b" query parameter, JSON:API style.
+// Only the listed fields are kept, the id when the list names none.
+func withSparseFields(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields := parseFields(r.URL.Query().Get("fields"))
+		if fields == nil {
+			handler(w, r)
+			return
+		}
+		handler(&sparseWriter{ResponseWriter: w, fields: fields}, r)
+	}
+}
+
+// parseFields returns the set of requested fields, nil meaning all of them.
+func parseFields(param string) map[string]bool {
+	if param == "" {
+		return nil
+	}
+	fields := make(map[string]bool)
+	for _, f := range strings.Split(param, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields[f] = true
+		}
+	}
+	if len(fields) == 0 {
+		fields["id"] = true
+	}
+	return fields
+}
+
+// sparseWriter filters the items of lists written with writeJSON.
+type sparseWriter struct {
+	http.ResponseWriter
+	fields map[string]bool
+}
+
+// WriteJSON filters the list items of v before writing it. Items are the
+// elements of v if it is a list, or of the lists it holds if it is an
+// object.
+func (w *sparseWriter) WriteJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return err
+	}
+
+	switch t := generic.(type) {
+	case []interface{}:
+		w.filterList(t)
+	case map[string]interface{}:
+		for _, value := range t {
+			if list, ok := value.([]interface{}); ok {
+				w.filterList(list)
+			}
+		}
+	}
+	return writeJSON(w.ResponseWriter, generic)
+}
+
+func (w *sparseWriter) filterList(list []interface{}) {
+	for _, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for k := range obj {
+			if !w.fields[k] {
+				delete(obj, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	tests := []struct {
+		param string
+		want  map[string]bool
+	}{
+		{"", nil},
+		{"memo", map[string]bool{"memo": true}},
+		{"memo, amount", map[string]bool{"memo": true, "amount": true}},
+		{"id,memo", map[string]bool{"id": true, "memo": true}},
+		{" , ", map[string]bool{"id": true}},
+	}
+	for _, tt := range tests {
+		if got := parseFields(tt.param); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFields(%q) = %v, want %v", tt.param, got, tt.want)
+		}
+	}
+}
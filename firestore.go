@@ -0,0 +1,531 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	messagesCollection = "messages"
+	bansCollection     = "bans"
+)
+
+// firestoreEnabled reports whether the backend runs with Firestore, which is
+// optional with the sql message stores.
+func firestoreEnabled() bool {
+	return firebaseDb != nil
+}
+
+// firestoreStore is the MessageStore keeping the messages in the messages
+// collection of Firestore, where the web client reads them from.
+type firestoreStore struct{}
+
+func (firestoreStore) messages() *firestore.CollectionRef {
+	return collection(networkCollection(messagesCollection))
+}
+
+func messageFromSnapshot(s *firestore.DocumentSnapshot) (*Message, error) {
+	var m Message
+	if err := s.DataTo(&m); err != nil {
+		return nil, &messageValidationError{ID: s.Ref.ID, Field: "document", Reason: err.Error()}
+	}
+	m.ID = s.Ref.ID
+	if err := validateMessage(&m); err != nil {
+		return nil, err
+	}
+	fillAmountMsat(&m)
+	return &m, nil
+}
+
+func messagesFromQuery(ctx context.Context, q firestore.Query) ([]*Message, error) {
+	snapshot, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Message, 0, len(snapshot))
+	for _, s := range snapshot {
+		m, err := messageFromSnapshot(s)
+		if skipMalformed(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, nil
+}
+
+func (st firestoreStore) CreateMessage(ctx context.Context, m *Message) error {
+	if err := waitForWrite(ctx, messagesCollection); err != nil {
+		return err
+	}
+	id, err := newMessageID()
+	if err != nil {
+		return err
+	}
+	if _, err := st.messages().Doc(id).Create(ctx, m); err != nil {
+		return err
+	}
+	m.ID = id
+	return nil
+}
+
+func (st firestoreStore) GetMessage(ctx context.Context, id string) (*Message, error) {
+	s, err := st.messages().Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, errMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return messageFromSnapshot(s)
+}
+
+func (st firestoreStore) FindByInvoice(ctx context.Context, invoice string) (*Message, error) {
+	list, err := messagesFromQuery(ctx, st.messages().Where("invoice", "==", invoice).Limit(1))
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, errMessageNotFound
+	}
+	return list[0], nil
+}
+
+func (st firestoreStore) FindByPaymentHash(ctx context.Context, hash string) (*Message, error) {
+	list, err := messagesFromQuery(ctx, st.messages().Where("r_hash", "==", hash).Limit(1))
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, errMessageNotFound
+	}
+	return list[0], nil
+}
+
+func (st firestoreStore) FindByOnchainAddress(ctx context.Context, address string) (*Message, error) {
+	list, err := messagesFromQuery(ctx, st.messages().Where("onchain_address", "==", address).Limit(1))
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, errMessageNotFound
+	}
+	return list[0], nil
+}
+
+func (st firestoreStore) ListUnsettled(ctx context.Context) ([]*Message, error) {
+	list, err := messagesFromQuery(ctx, st.messages().Where("settled", "==", false))
+	if err != nil {
+		return nil, err
+	}
+	unexpired := list[:0]
+	for _, m := range list {
+		if !m.Expired {
+			unexpired = append(unexpired, m)
+		}
+	}
+	return unexpired, nil
+}
+
+func (st firestoreStore) ListUnsettledPage(ctx context.Context, after string, limit int) ([]*Message, error) {
+	q := st.messages().Where("settled", "==", false).OrderBy(firestore.DocumentID, firestore.Asc)
+	if after != "" {
+		q = q.StartAfter(after)
+	}
+	return messagesFromQuery(ctx, q.Limit(limit))
+}
+
+func (st firestoreStore) ListHeld(ctx context.Context) ([]*Message, error) {
+	return messagesFromQuery(ctx, st.messages().Where("held", "==", true))
+}
+
+func (st firestoreStore) ListSettledInRoom(ctx context.Context, room string) ([]*Message, error) {
+	list, err := messagesFromQuery(ctx, st.messages().Where("room", "==", room))
+	if err != nil {
+		return nil, err
+	}
+	settled := list[:0]
+	for _, m := range list {
+		if m.Settled && !m.Hidden {
+			settled = append(settled, m)
+		}
+	}
+	return settled, nil
+}
+
+// ListSettledPage filters the held messages and the boosts out while
+// iterating, and the other rooms too for the default one, whose messages
+// may have no room field to query.
+func (st firestoreStore) ListSettledPage(ctx context.Context, room string, cursor messageCursor, limit int) ([]*Message, error) {
+	q := st.messages().Where("settled", "==", true)
+	if room != "" {
+		q = q.Where("room", "==", room)
+	}
+	q = q.OrderBy("settled_at", firestore.Desc).OrderBy(firestore.DocumentID, firestore.Desc)
+	if cursor.ID != "" {
+		q = q.StartAfter(cursor.SettledAt, cursor.ID)
+	}
+	it := q.Documents(ctx)
+	defer it.Stop()
+	list := make([]*Message, 0, limit)
+	for len(list) < limit {
+		s, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		m, err := messageFromSnapshot(s)
+		if skipMalformed(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m.Held || m.Hidden || m.BoostOf != "" || room == "" && m.Room != "" && m.Room != defaultRoom {
+			continue
+		}
+		list = append(list, m)
+	}
+	return list, nil
+}
+
+// ListTopSettled sorts the messages of the range in memory, Firestore not
+// ordering by a sum, with the index of ListSettledPage.
+func (st firestoreStore) ListTopSettled(ctx context.Context, room string, since time.Time, limit int) ([]*Message, error) {
+	q := st.messages().Where("settled", "==", true)
+	if room != "" {
+		q = q.Where("room", "==", room)
+	}
+	list, err := messagesFromQuery(ctx, q.Where("settled_at", ">=", since))
+	if err != nil {
+		return nil, err
+	}
+	top := list[:0]
+	for _, m := range list {
+		if m.Held || m.Hidden || m.BoostOf != "" || room == "" && m.Room != "" && m.Room != defaultRoom {
+			continue
+		}
+		top = append(top, m)
+	}
+	sort.SliceStable(top, func(i, j int) bool {
+		if vi, vj := messageValue(top[i]), messageValue(top[j]); vi != vj {
+			return vi > vj
+		}
+		return top[i].SettledAt.After(top[j].SettledAt)
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	return top, nil
+}
+
+// ListPinned sorts the pinned messages in memory, there being few of them.
+func (st firestoreStore) ListPinned(ctx context.Context, room string, limit int) ([]*Message, error) {
+	q := st.messages().Where("settled", "==", true)
+	if room != "" {
+		q = q.Where("room", "==", room)
+	}
+	list, err := messagesFromQuery(ctx, q.Where("pinned", "==", true))
+	if err != nil {
+		return nil, err
+	}
+	pinned := list[:0]
+	for _, m := range list {
+		if m.Held || m.Hidden || m.BoostOf != "" || room == "" && m.Room != "" && m.Room != defaultRoom {
+			continue
+		}
+		pinned = append(pinned, m)
+	}
+	sort.SliceStable(pinned, func(i, j int) bool {
+		return pinned[i].SettledAt.After(pinned[j].SettledAt)
+	})
+	if len(pinned) > limit {
+		pinned = pinned[:limit]
+	}
+	return pinned, nil
+}
+
+// ListThread sorts the replies in memory, so that it only needs the single
+// field index of thread_id.
+func (st firestoreStore) ListThread(ctx context.Context, threadID string, limit int) ([]*Message, error) {
+	list, err := messagesFromQuery(ctx, st.messages().Where("thread_id", "==", threadID))
+	if err != nil {
+		return nil, err
+	}
+	replies := list[:0]
+	for _, m := range list {
+		if m.Settled && !m.Held && !m.Hidden {
+			replies = append(replies, m)
+		}
+	}
+	sort.SliceStable(replies, func(i, j int) bool {
+		return replies[i].SettledAt.Before(replies[j].SettledAt)
+	})
+	if len(replies) > limit {
+		replies = replies[:limit]
+	}
+	return replies, nil
+}
+
+func (st firestoreStore) ListPendingReview(ctx context.Context) ([]*Message, error) {
+	return messagesFromQuery(ctx, st.messages().Where("pending_review", "==", true))
+}
+
+func (st firestoreStore) ListSettled(ctx context.Context, from, to time.Time) ([]*Message, error) {
+	return messagesFromQuery(ctx, st.messages().
+		Where("settled_at", ">=", from).
+		Where("settled_at", "<", to).
+		OrderBy("settled_at", firestore.Asc))
+}
+
+// update runs fn on the current state of a message in a transaction and
+// applies the updates it returns, if any. It reports whether there were.
+func (st firestoreStore) update(ctx context.Context, id string, fn func(m *Message) ([]firestore.Update, error)) (bool, error) {
+	if err := waitForWrite(ctx, messagesCollection); err != nil {
+		return false, err
+	}
+	ref := st.messages().Doc(id)
+	var updated bool
+	err := firebaseDb.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		updated = false
+		s, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return errMessageNotFound
+		}
+		if err != nil {
+			return err
+		}
+		m, err := messageFromSnapshot(s)
+		if err != nil {
+			return err
+		}
+		updates, err := fn(m)
+		if err != nil || len(updates) == 0 {
+			return err
+		}
+		updated = true
+		return tx.Update(ref, updates)
+	})
+	countUpdateFailure(messagesCollection, err)
+	return updated, err
+}
+
+func (st firestoreStore) MarkSettled(ctx context.Context, id string, s Settlement) (bool, error) {
+	return st.update(ctx, id, func(m *Message) ([]firestore.Update, error) {
+		if m.Settled {
+			return nil, nil
+		}
+		updates := []firestore.Update{
+			{Path: "settled", Value: true},
+			{Path: "settled_at", Value: s.SettledAt},
+			{Path: "amount_paid_msat", Value: s.AmountPaidMsat},
+		}
+		if m.PendingReview {
+			updates = append(updates, firestore.Update{Path: "pending_review", Value: firestore.Delete})
+		}
+		if s.SessionID != "" {
+			updates = append(updates, firestore.Update{Path: "session_id", Value: s.SessionID})
+		}
+		if s.Preimage != "" {
+			updates = append(updates, firestore.Update{Path: "preimage", Value: s.Preimage})
+		}
+		if s.Held {
+			updates = append(updates, firestore.Update{Path: "held", Value: true})
+		}
+		return updates, nil
+	})
+}
+
+func (st firestoreStore) SetPaymentHash(ctx context.Context, id, hash string) error {
+	_, err := st.update(ctx, id, func(m *Message) ([]firestore.Update, error) {
+		if m.RHash != "" {
+			return nil, nil
+		}
+		return []firestore.Update{{Path: "r_hash", Value: hash}}, nil
+	})
+	return err
+}
+
+func (st firestoreStore) MarkUnsettled(ctx context.Context, id string) (bool, error) {
+	return st.update(ctx, id, func(m *Message) ([]firestore.Update, error) {
+		if !m.Settled {
+			return nil, nil
+		}
+		return []firestore.Update{
+			{Path: "settled", Value: false},
+			{Path: "settled_at", Value: firestore.Delete},
+			{Path: "amount_paid_msat", Value: firestore.Delete},
+			{Path: "session_id", Value: firestore.Delete},
+			{Path: "preimage", Value: firestore.Delete},
+			{Path: "held", Value: firestore.Delete},
+		}, nil
+	})
+}
+
+func (st firestoreStore) MarkPendingReview(ctx context.Context, id string) (bool, error) {
+	return st.update(ctx, id, func(m *Message) ([]firestore.Update, error) {
+		if m.Settled || m.Expired || m.PendingReview {
+			return nil, nil
+		}
+		return []firestore.Update{{Path: "pending_review", Value: true}}, nil
+	})
+}
+
+func (st firestoreStore) Hide(ctx context.Context, id string) (bool, error) {
+	return st.update(ctx, id, func(m *Message) ([]firestore.Update, error) {
+		if m.Hidden {
+			return nil, nil
+		}
+		return []firestore.Update{{Path: "hidden", Value: true}}, nil
+	})
+}
+
+func (st firestoreStore) Flag(ctx context.Context, id, reason string) error {
+	_, err := st.update(ctx, id, func(m *Message) ([]firestore.Update, error) {
+		return []firestore.Update{{Path: "flagged", Value: true}, {Path: "flag_reason", Value: reason}}, nil
+	})
+	return err
+}
+
+func (st firestoreStore) ListFlagged(ctx context.Context) ([]*Message, error) {
+	return messagesFromQuery(ctx, st.messages().Where("flagged", "==", true))
+}
+
+// ban is a banned user, the ID of its document being the uid.
+type ban struct {
+	Reason    string    `firestore:"reason,omitempty"`
+	CreatedAt time.Time `firestore:"created_at"`
+}
+
+func (firestoreStore) Ban(ctx context.Context, uid, reason string) error {
+	if err := waitForWrite(ctx, bansCollection); err != nil {
+		return err
+	}
+	_, err := collection(bansCollection).Doc(uid).Set(ctx, ban{Reason: reason, CreatedAt: appClock.Now()})
+	return err
+}
+
+func (firestoreStore) IsBanned(ctx context.Context, uid string) (bool, error) {
+	_, err := collection(bansCollection).Doc(uid).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (st firestoreStore) Expire(ctx context.Context, id string) error {
+	_, err := st.update(ctx, id, func(m *Message) ([]firestore.Update, error) {
+		if m.Settled {
+			return nil, errAlreadySettled
+		}
+		updates := []firestore.Update{{Path: "expired", Value: true}}
+		if m.PendingReview {
+			updates = append(updates, firestore.Update{Path: "pending_review", Value: firestore.Delete})
+		}
+		return updates, nil
+	})
+	return err
+}
+
+func (st firestoreStore) Delete(ctx context.Context, id string) error {
+	if err := waitForWrite(ctx, messagesCollection); err != nil {
+		return err
+	}
+	ref := st.messages().Doc(id)
+	return firebaseDb.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		s, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return errMessageNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if settled, _ := s.Data()["settled"].(bool); settled {
+			return errAlreadySettled
+		}
+		return tx.Delete(ref)
+	})
+}
+
+func (st firestoreStore) AddBoost(ctx context.Context, id string, amountMsat int64, reaction string) (*Message, error) {
+	var boosted *Message
+	_, err := st.update(ctx, id, func(m *Message) ([]firestore.Update, error) {
+		m.BoostTotalMsat += amountMsat
+		updates := []firestore.Update{{Path: "boost_total_msat", Value: m.BoostTotalMsat}}
+		if reaction != "" {
+			if m.Reactions == nil {
+				m.Reactions = make(map[string]int64)
+			}
+			m.Reactions[reaction]++
+			updates = append(updates, firestore.Update{Path: "reactions", Value: m.Reactions})
+		}
+		boosted = m
+		return updates, nil
+	})
+	return boosted, err
+}
+
+func (st firestoreStore) Publish(ctx context.Context, id, sessionID string) (bool, error) {
+	return st.update(ctx, id, func(m *Message) ([]firestore.Update, error) {
+		if !m.Held {
+			return nil, nil
+		}
+		return []firestore.Update{
+			{Path: "held", Value: false},
+			{Path: "session_id", Value: sessionID},
+			{Path: "published_at", Value: appClock.Now()},
+		}, nil
+	})
+}
+
+func (firestoreStore) AppendAudit(ctx context.Context, e *auditEntry) error {
+	if err := waitForWrite(ctx, auditCollection); err != nil {
+		return err
+	}
+	_, err := collection(networkCollection(auditCollection)).NewDoc().Create(ctx, e)
+	return err
+}
+
+// ListAudit queries the entries by message and by payment hash, sorting them
+// in memory rather than needing composite indexes.
+func (firestoreStore) ListAudit(ctx context.Context, id, hash string) ([]*auditEntry, error) {
+	entries := map[string]*auditEntry{}
+	for field, value := range map[string]string{"message_id": id, "r_hash": hash} {
+		if value == "" {
+			continue
+		}
+		snapshot, err := collection(networkCollection(auditCollection)).Where(field, "==", value).Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range snapshot {
+			var e auditEntry
+			if err := s.DataTo(&e); err != nil {
+				return nil, err
+			}
+			e.ID = s.Ref.ID
+			entries[e.ID] = &e
+		}
+	}
+	list := make([]*auditEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].At.Equal(list[j].At) {
+			return list[i].At.Before(list[j].At)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// readinessTimeout bounds each of the checks of /readyz.
+const readinessTimeout = 5 * time.Second
+
+var (
+	errSubscriptionDown = errors.New("invoice subscription down")
+	errDraining         = errors.New("shutting down")
+)
+
+// serveHealthz answers as long as the process serves http.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": healthOK})
+}
+
+// serveReadyz answers 200 when lnd answers GetInfo, the message store and
+// Firestore answer a read, and the invoice subscription is open, 503 with
+// the failed checks otherwise, so that the service is restarted when the
+// watcher died but http still answers. It also fails while shutting down.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	checks, ready := readiness(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	res := map[string]interface{}{"status": healthOK, "checks": checks}
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		res["status"] = healthDown
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// readiness runs the readiness checks and returns their outcome, "ok" or
+// the error, and whether they all passed.
+func readiness(ctx context.Context) (map[string]string, bool) {
+	checks := make(map[string]string)
+	ready := true
+	check := func(name string, fn func(ctx context.Context) error) {
+		ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+		defer cancel()
+		if err := fn(ctx); err != nil {
+			checks[name] = err.Error()
+			ready = false
+			return
+		}
+		checks[name] = healthOK
+	}
+
+	check("shutdown", func(ctx context.Context) error {
+		if atomic.LoadInt32(&draining) == 1 {
+			return errDraining
+		}
+		return nil
+	})
+	// The invoices fail over to the -nodes, one answering is enough.
+	check("lnd", func(ctx context.Context) error {
+		_, err := lightning.GetInfo(ctx)
+		for _, n := range lndNodes {
+			if err == nil {
+				break
+			}
+			_, err = n.lightning().GetInfo(ctx, &lnrpc.GetInfoRequest{})
+		}
+		return err
+	})
+	if s, ok := store.(*sqlStore); ok {
+		check("store", func(ctx context.Context) error {
+			return s.db.PingContext(ctx)
+		})
+	}
+	if firestoreEnabled() {
+		check("firestore", func(ctx context.Context) error {
+			_, err := collection(metaCollection).Doc(remoteConfigDoc).Get(ctx)
+			if status.Code(err) == codes.NotFound {
+				return nil
+			}
+			return err
+		})
+	}
+	// Followers leave the invoice subscription to the leader.
+	if !follower {
+		check("invoice_subscription", func(ctx context.Context) error {
+			if !subscriptionsUp() {
+				return errSubscriptionDown
+			}
+			return nil
+		})
+	}
+	return checks, ready
+}
+
+// notifyWatchdog pings the systemd watchdog, when the service runs with
+// WatchdogSec, at half its interval as long as the backend is ready, so that
+// systemd restarts it otherwise.
+func notifyWatchdog(ctx context.Context) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if socket == "" || err != nil || usec <= 0 {
+		return
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		logError("Failed to connect to the systemd notify socket", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for {
+		if _, ready := readiness(ctx); ready {
+			if _, err := conn.Write([]byte("WATCHDOG=1")); err != nil {
+				logWarn("Failed to ping the systemd watchdog", "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+)
+
+// invoiceRequest describes an invoice about to be created. Hooks may rewrite
+// any of its fields.
+type invoiceRequest struct {
+	Memo   string
+	Amount int64
+
+	// Node is the name of the lnd node backing the invoice, empty meaning
+	// the default one.
+	Node string
+
+	// Tags are attached to the message paid by the invoice, to attribute
+	// it to a campaign for instance.
+	Tags map[string]string
+
+	// Header and User describe who is asking for the invoice, User being
+	// empty for anonymous requests.
+	Header http.Header
+	User   string
+
+	// IP is the address of the requester, see clientIP.
+	IP string
+}
+
+// invoiceHook is called before an invoice is created and may rewrite it.
+// Returning an error rejects the request.
+type invoiceHook func(req *invoiceRequest) error
+
+var invoiceHooks []invoiceHook
+
+// registerInvoiceHook adds a hook run, in registration order, on every
+// invoice request.
+func registerInvoiceHook(h invoiceHook) {
+	invoiceHooks = append(invoiceHooks, h)
+}
+
+// newInvoiceRequest builds the invoice request of an api call, tagged with
+// the tags of its query, and runs it through the registered hooks.
+func newInvoiceRequest(r *http.Request, memo string, amount int64) (*invoiceRequest, error) {
+	tags, err := tagsFromQuery(r)
+	if err != nil {
+		return nil, err
+	}
+	req := &invoiceRequest{
+		Memo:   memo,
+		Amount: amount,
+		Tags:   tags,
+		Header: r.Header,
+		IP:     clientIP(r),
+	}
+	if user := stateOf(r).User; user != "" {
+		req.User = user
+	}
+	if err := runInvoiceHooks(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// runInvoiceHooks runs req through the registered hooks.
+func runInvoiceHooks(req *invoiceRequest) error {
+	for _, h := range invoiceHooks {
+		if err := h(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invoiceRule is a rule of the rules file loaded with -invoiceHooks. Rules
+// whose conditions all hold are applied in file order.
+type invoiceRule struct {
+	// Headers must all be present with the given values.
+	Headers map[string]string `json:"headers"`
+
+	// Percent, when set, restricts the rule to a stable share of the
+	// requesters, which allows A/B tests. Requesters are bucketed by user,
+	// or by origin for anonymous ones.
+	Percent int `json:"percent"`
+
+	MemoPrefix string            `json:"memo_prefix"`
+	MemoSuffix string            `json:"memo_suffix"`
+	Amount     int64             `json:"amount"`
+	Node       string            `json:"node"`
+	Tags       map[string]string `json:"tags"`
+}
+
+// loadInvoiceRules reads a JSON list of invoiceRule from path and registers
+// the hook applying them.
+func loadInvoiceRules(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rules []invoiceRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return fmt.Errorf("invalid invoice rules %v: %v", path, err)
+	}
+	for i, rule := range rules {
+		if rule.Percent < 0 || rule.Percent > 100 {
+			return fmt.Errorf("invoice rule %d: percent must be between 0 and 100", i)
+		}
+		if rule.Amount < 0 {
+			return fmt.Errorf("invoice rule %d: negative amount", i)
+		}
+	}
+
+	registerInvoiceHook(func(req *invoiceRequest) error {
+		for _, rule := range rules {
+			if rule.matches(req) {
+				rule.apply(req)
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+func (rule *invoiceRule) matches(req *invoiceRequest) bool {
+	for k, v := range rule.Headers {
+		if req.Header.Get(k) != v {
+			return false
+		}
+	}
+	if rule.Percent == 0 {
+		return true
+	}
+
+	who := req.User
+	if who == "" {
+		who = req.Header.Get("Origin")
+	}
+	h := fnv.New32a()
+	h.Write([]byte(who))
+	return int(h.Sum32()%100) < rule.Percent
+}
+
+func (rule *invoiceRule) apply(req *invoiceRequest) {
+	req.Memo = rule.MemoPrefix + req.Memo + rule.MemoSuffix
+	if rule.Amount > 0 {
+		req.Amount = rule.Amount
+	}
+	if rule.Node != "" {
+		req.Node = rule.Node
+	}
+	for k, v := range rule.Tags {
+		req.Tags[k] = v
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	hashids "github.com/speps/go-hashids"
+)
+
+// publicIDs translates the internal message keys to the identifiers exposed
+// by the public api.
+var publicIDs idCodec = plainIDs{}
+
+var errInvalidID = errors.New("invalid id")
+
+// idCodec maps internal keys to public identifiers and back. Internal keys
+// are never rewritten so that switching codecs only changes what clients
+// see.
+type idCodec interface {
+	// Encode returns the public identifier of an internal key.
+	Encode(key string) string
+
+	// Decode returns the internal key of a public identifier.
+	Decode(id string) (string, error)
+}
+
+// newIDCodec returns the codec registered under name.
+func newIDCodec(name, salt string) (idCodec, error) {
+	switch name {
+	case "", "plain":
+		return plainIDs{}, nil
+	case "hashid":
+		return newHashIDs(salt)
+	case "uuidv7":
+		return uuidIDs{}, nil
+	default:
+		return nil, fmt.Errorf("unknown public id scheme %q", name)
+	}
+}
+
+// plainIDs exposes the internal keys as they are.
+type plainIDs struct{}
+
+func (plainIDs) Encode(key string) string { return key }
+
+func (plainIDs) Decode(id string) (string, error) {
+	if id == "" {
+		return "", errInvalidID
+	}
+	return id, nil
+}
+
+// uuidIDs exposes the internal keys as they are, the new messages being
+// keyed with UUIDv7s. Those are ordered by creation but, random past their
+// timestamp, don't tell how many messages exist. The keys of the older
+// messages are kept.
+type uuidIDs struct {
+	plainIDs
+}
+
+// hashIDs exposes salted hashids of the internal keys, which don't leak how
+// many messages exist or how fast they are created when keys are
+// sequential.
+type hashIDs struct {
+	h *hashids.HashID
+}
+
+func newHashIDs(salt string) (*hashIDs, error) {
+	if salt == "" {
+		return nil, errors.New("hashid public ids require a salt")
+	}
+	data := hashids.NewData()
+	data.Salt = salt
+	data.MinLength = 12
+	h, err := hashids.NewWithData(data)
+	if err != nil {
+		return nil, err
+	}
+	return &hashIDs{h: h}, nil
+}
+
+func (c *hashIDs) Encode(key string) string {
+	id, err := c.h.EncodeHex(hex.EncodeToString([]byte(key)))
+	if err != nil {
+		// Only happens for an empty key.
+		return ""
+	}
+	return id
+}
+
+func (c *hashIDs) Decode(id string) (string, error) {
+	h, err := c.h.DecodeHex(id)
+	if err != nil {
+		return "", errInvalidID
+	}
+	key, err := hex.DecodeString(h)
+	if err != nil || len(key) == 0 {
+		return "", errInvalidID
+	}
+	return string(key), nil
+}
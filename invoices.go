@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// maxInvoicesPage is the maximum number of invoices listed per page of
+// getInvoices.
+const maxInvoicesPage = 500
+
+// invoiceEntry is an invoice of the node as listed by getInvoices, with the
+// message it paid for, if any.
+type invoiceEntry struct {
+	AddIndex       uint64   `json:"add_index"`
+	PaymentHash    string   `json:"payment_hash"`
+	PaymentRequest string   `json:"payment_request,omitempty"`
+	Memo           string   `json:"memo"`
+	ValueMsat      int64    `json:"value_msat"`
+	AmtPaidMsat    int64    `json:"amt_paid_msat"`
+	State          string   `json:"state"`
+	Keysend        bool     `json:"keysend"`
+	CreatedAt      int64    `json:"created_at"`
+	SettledAt      int64    `json:"settled_at,omitempty"`
+	Message        *Message `json:"message"`
+}
+
+// getInvoices lists the invoices of the node, a page of at most limit past
+// the add index after, newest first with reversed=true, joined with their
+// messages, so that bookkeeping doesn't need access to lnd. The next page
+// starts after the returned last_index_offset, or before the
+// first_index_offset when reversed.
+func getInvoices(w http.ResponseWriter, r *http.Request) {
+	if err := checkLnd(); err != nil {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	var after uint64
+	if v := q.Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid after")
+			return
+		}
+	}
+	limit := uint64(100)
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n == 0 || n > maxInvoicesPage {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxInvoicesPage))
+			return
+		}
+		limit = n
+	}
+
+	c, clean := getClient()
+	defer clean()
+	res, err := c.ListInvoices(r.Context(), &lnrpc.ListInvoiceRequest{
+		IndexOffset:    after,
+		NumMaxInvoices: limit,
+		Reversed:       q.Get("reversed") == "true",
+		PendingOnly:    q.Get("pending") == "true",
+	})
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	entries := make([]invoiceEntry, 0, len(res.GetInvoices()))
+	for _, invoice := range res.GetInvoices() {
+		e := invoiceEntry{
+			AddIndex:       invoice.GetAddIndex(),
+			PaymentHash:    hex.EncodeToString(invoice.GetRHash()),
+			PaymentRequest: invoice.GetPaymentRequest(),
+			Memo:           invoice.GetMemo(),
+			ValueMsat:      invoice.GetValueMsat(),
+			AmtPaidMsat:    invoice.GetAmtPaidMsat(),
+			State:          strings.ToLower(invoice.GetState().String()),
+			Keysend:        invoice.GetIsKeysend(),
+			CreatedAt:      invoice.GetCreationDate(),
+			SettledAt:      invoice.GetSettleDate(),
+		}
+		// Keysend invoices have no payment request, their messages
+		// being stored under their payment hash.
+		key := e.PaymentRequest
+		if e.Keysend {
+			key = keysendInvoicePrefix + e.PaymentHash
+		}
+		m, err := store.FindByInvoice(r.Context(), key)
+		switch err {
+		case nil:
+			m.ID = publicIDs.Encode(m.ID)
+			signAttachments(m)
+			e.Message = m
+		case errMessageNotFound:
+		default:
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		entries = append(entries, e)
+	}
+	writeJSON(w, map[string]interface{}{
+		"invoices":           entries,
+		"first_index_offset": res.GetFirstIndexOffset(),
+		"last_index_offset":  res.GetLastIndexOffset(),
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+const (
+	janitorExpire = "expire"
+	janitorDelete = "delete"
+)
+
+var (
+	// janitorMode is what the janitor does with the messages whose invoice
+	// expired or was cancelled, expire or delete, and janitorInterval how
+	// often it runs, 0 disabling it.
+	janitorMode     = janitorExpire
+	janitorInterval = defaultJanitorInterval
+
+	defaultJanitorInterval = 10 * time.Minute
+
+	staleMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stale_messages_total",
+		Help:      "Number of unpaid messages cleaned up by the janitor by action (expire, delete).",
+	}, []string{"action"})
+)
+
+func init() {
+	prometheus.MustRegister(staleMessages)
+}
+
+// runJanitor cleans up the stale unpaid messages every janitorInterval
+// until ctx is done, so that reconciliations don't keep looking their dead
+// invoices up.
+func runJanitor(ctx context.Context) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cleanStaleMessages(ctx); err != nil {
+				logError("Janitor failed", "err", err)
+			}
+		}
+	}
+}
+
+// cleanStaleMessages expires or deletes the unpaid messages whose invoice
+// can't be paid anymore, at the rate of the reconciliations.
+func cleanStaleMessages(ctx context.Context) error {
+	unsettled, err := store.ListUnsettled(ctx)
+	if err != nil {
+		return err
+	}
+	limiter := newReconcileLimiter()
+
+	for _, m := range unsettled {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		invoice, err := lookupInvoice(ctx, limiter, m)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		if err != nil || !invoiceStale(invoice, appClock.Now()) {
+			continue
+		}
+
+		if janitorMode == janitorDelete {
+			err = store.Delete(ctx, m.ID)
+		} else {
+			err = store.Expire(ctx, m.ID)
+		}
+		// A message paid meanwhile is left to the watcher.
+		if err == errAlreadySettled {
+			continue
+		}
+		if err != nil {
+			logError("Janitor failed to clean up a message", "action", janitorMode, "doc_id", m.ID, "err", err)
+			continue
+		}
+		staleMessages.WithLabelValues(janitorMode).Inc()
+	}
+	return nil
+}
+
+// invoiceStale reports whether invoice can't be paid anymore at now.
+func invoiceStale(invoice *lnrpc.Invoice, now time.Time) bool {
+	switch invoice.GetState() {
+	case lnrpc.Invoice_CANCELED:
+		return true
+	case lnrpc.Invoice_OPEN:
+		expiry := time.Duration(invoice.GetExpiry()) * time.Second
+		return now.After(time.Unix(invoice.GetCreationDate(), 0).Add(expiry))
+	default:
+		return false
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Job statuses.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+const jobsCollection = "jobs"
+
+var (
+	// jobWorkers is the number of jobs processed concurrently and
+	// jobPollInterval how often the queue is checked for runnable jobs.
+	jobWorkers      = defaultJobWorkers
+	jobPollInterval = defaultJobPollInterval
+
+	defaultJobWorkers      = 2
+	defaultJobPollInterval = 5 * time.Second
+
+	// jobLease is how long a worker owns a running job, renewed every
+	// jobLeaseRenewal while it runs. Jobs whose lease expired, because the
+	// process died while running them, are picked up again.
+	jobLease        = 10 * time.Minute
+	jobLeaseRenewal = jobLease / 3
+
+	defaultRetryPolicy = retryPolicy{
+		MaxAttempts: 5,
+		Backoff:     10 * time.Second,
+		MaxBackoff:  10 * time.Minute,
+	}
+
+	jobHandlersMu sync.RWMutex
+	jobHandlers   = make(map[string]registeredJob)
+
+	// jobsWake is signalled when a job is enqueued so that it is picked up
+	// without waiting for the next poll.
+	jobsWake = make(chan struct{}, 1)
+
+	jobsEnqueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "jobs_enqueued_total",
+		Help:      "Number of jobs enqueued by kind.",
+	}, []string{"kind"})
+
+	jobsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "jobs_finished_total",
+		Help:      "Number of job attempts by kind and outcome (done, retry, failed).",
+	}, []string{"kind", "outcome"})
+
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_duration_seconds",
+		Help:      "Duration of job attempts by kind.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 30, 60, 300, 900},
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(jobsEnqueued, jobsFinished, jobDuration)
+}
+
+// retryPolicy controls how failed job attempts are retried. Attempts are
+// spaced with an exponential backoff starting at Backoff and capped at
+// MaxBackoff.
+type retryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// delay returns how long to wait before the attempt following the given
+// one.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// errPermanent wraps errors that retrying a job won't fix.
+type errPermanent struct{ error }
+
+// permanent marks err as not worth retrying.
+func permanent(err error) error {
+	return errPermanent{err}
+}
+
+// jobHandler runs a job. The returned value, if any, is stored as the
+// result of the job and must be encodable as JSON.
+type jobHandler func(ctx context.Context, j *job) (interface{}, error)
+
+type registeredJob struct {
+	handler jobHandler
+	policy  retryPolicy
+}
+
+// registerJob makes jobs of the given kind runnable. It is meant to be
+// called from init functions.
+func registerJob(kind string, handler jobHandler, policy retryPolicy) {
+	jobHandlersMu.Lock()
+	defer jobHandlersMu.Unlock()
+
+	if _, ok := jobHandlers[kind]; ok {
+		panic("job kind registered twice: " + kind)
+	}
+	jobHandlers[kind] = registeredJob{handler: handler, policy: policy}
+}
+
+// job is a persistent unit of asynchronous work.
+type job struct {
+	ID          string     `firestore:"-" json:"id"`
+	Kind        string     `firestore:"kind" json:"kind"`
+	Status      string     `firestore:"status" json:"status"`
+	Payload     string     `firestore:"payload" json:"-"`
+	Result      string     `firestore:"result,omitempty" json:"-"`
+	Attempts    int        `firestore:"attempts" json:"attempts"`
+	MaxAttempts int        `firestore:"max_attempts" json:"max_attempts"`
+	LastError   string     `firestore:"last_error,omitempty" json:"last_error,omitempty"`
+	Total       int        `firestore:"total,omitempty" json:"total,omitempty"`
+	Processed   int        `firestore:"processed,omitempty" json:"processed,omitempty"`
+	RunAt       time.Time  `firestore:"run_at" json:"run_at"`
+	LeaseUntil  time.Time  `firestore:"lease_until" json:"-"`
+	CreatedAt   time.Time  `firestore:"created_at" json:"created_at"`
+	UpdatedAt   time.Time  `firestore:"updated_at" json:"updated_at"`
+	FinishedAt  *time.Time `firestore:"finished_at,omitempty" json:"finished_at,omitempty"`
+
+	ref *firestore.DocumentRef
+}
+
+// MarshalJSON exposes the result of the job as JSON rather than as the
+// encoded string it is stored as.
+func (j *job) MarshalJSON() ([]byte, error) {
+	type plain job
+	out := struct {
+		*plain
+		Result json.RawMessage `json:"result,omitempty"`
+	}{plain: (*plain)(j)}
+	if j.Result != "" {
+		out.Result = json.RawMessage(j.Result)
+	}
+	return json.Marshal(out)
+}
+
+// decodePayload unmarshals the payload of the job into v.
+func (j *job) decodePayload(v interface{}) error {
+	if err := json.Unmarshal([]byte(j.Payload), v); err != nil {
+		return permanent(fmt.Errorf("invalid payload: %v", err))
+	}
+	return nil
+}
+
+// reportProgress records how many of the items of the job were processed.
+func (j *job) reportProgress(ctx context.Context, processed, total int) {
+	j.Processed, j.Total = processed, total
+	err := updateDoc(ctx, j.ref, []firestore.Update{
+		{Path: "processed", Value: processed},
+		{Path: "total", Value: total},
+		{Path: "updated_at", Value: appClock.Now()},
+	})
+	if err != nil {
+		logWarn("Failed to report job progress", "job_id", j.ID, "err", err)
+	}
+}
+
+// enqueueJob persists a new job of the given kind, payload being encoded as
+// JSON.
+func enqueueJob(ctx context.Context, kind string, payload interface{}) (*job, error) {
+	jobHandlersMu.RLock()
+	registered, ok := jobHandlers[kind]
+	jobHandlersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown job kind %q", kind)
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	now := appClock.Now()
+	j := &job{
+		Kind:        kind,
+		Status:      jobQueued,
+		Payload:     string(b),
+		MaxAttempts: registered.policy.MaxAttempts,
+		RunAt:       now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	if err := waitForWrite(ctx, jobsCollection); err != nil {
+		return nil, err
+	}
+	j.ref = collection(jobsCollection).NewDoc()
+	if _, err := j.ref.Create(ctx, j); err != nil {
+		return nil, err
+	}
+	j.ID = j.ref.ID
+	jobsEnqueued.WithLabelValues(kind).Inc()
+
+	select {
+	case jobsWake <- struct{}{}:
+	default:
+	}
+	return j, nil
+}
+
+// getJobByID returns the job with the given id, or nil if there is none.
+func getJobByID(ctx context.Context, id string) (*job, error) {
+	s, err := collection(jobsCollection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return jobFromSnapshot(s)
+}
+
+func jobFromSnapshot(s *firestore.DocumentSnapshot) (*job, error) {
+	var j job
+	if err := s.DataTo(&j); err != nil {
+		return nil, err
+	}
+	j.ID = s.Ref.ID
+	j.ref = s.Ref
+	return &j, nil
+}
+
+// runJobs processes queued jobs until ctx is done, the jobs already claimed
+// then running to completion rather than failing with ctx.
+func runJobs(ctx context.Context) {
+	work := make(chan *job)
+	var wg sync.WaitGroup
+	for i := 0; i < jobWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				runJob(context.Background(), j)
+			}
+		}()
+	}
+	defer func() {
+		close(work)
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		for _, j := range claimJobs(ctx) {
+			select {
+			case work <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-jobsWake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// claimJobs leases the jobs that are due, either queued ones whose run time
+// has come or running ones whose lease expired.
+func claimJobs(ctx context.Context) []*job {
+	var claimed []*job
+	now := appClock.Now()
+	for _, st := range []string{jobQueued, jobRunning} {
+		snapshot, err := collection(jobsCollection).Where("status", "==", st).Documents(ctx).GetAll()
+		if err != nil {
+			logError("Failed to list jobs", "err", err)
+			return claimed
+		}
+		for _, s := range snapshot {
+			j, err := jobFromSnapshot(s)
+			if err != nil {
+				logWarn("Skipping malformed job", "job_id", s.Ref.ID, "err", err)
+				continue
+			}
+			if st == jobQueued && j.RunAt.After(now) {
+				continue
+			}
+			if st == jobRunning && j.LeaseUntil.After(now) {
+				continue
+			}
+			if claimJob(ctx, j) {
+				claimed = append(claimed, j)
+			}
+		}
+	}
+
+	sort.Slice(claimed, func(a, b int) bool {
+		return claimed[a].RunAt.Before(claimed[b].RunAt)
+	})
+	return claimed
+}
+
+// claimJob transactionally marks j as running, which fails if another
+// worker claimed it first.
+func claimJob(ctx context.Context, j *job) bool {
+	now := appClock.Now()
+	err := firebaseDb.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		s, err := tx.Get(j.ref)
+		if err != nil {
+			return err
+		}
+		current, err := jobFromSnapshot(s)
+		if err != nil {
+			return err
+		}
+		if current.Status != j.Status || !current.UpdatedAt.Equal(j.UpdatedAt) {
+			return errJobClaimed
+		}
+		if current.Status == jobRunning && current.LeaseUntil.After(now) {
+			return errJobClaimed
+		}
+		j.Status = jobRunning
+		j.Attempts = current.Attempts + 1
+		j.LeaseUntil = now.Add(jobLease)
+		j.UpdatedAt = now
+		return tx.Update(j.ref, []firestore.Update{
+			{Path: "status", Value: j.Status},
+			{Path: "attempts", Value: j.Attempts},
+			{Path: "lease_until", Value: j.LeaseUntil},
+			{Path: "updated_at", Value: j.UpdatedAt},
+		})
+	})
+	if err != nil && err != errJobClaimed {
+		logWarn("Failed to claim job", "job_id", j.ID, "err", err)
+	}
+	return err == nil
+}
+
+var errJobClaimed = errors.New("job already claimed")
+
+// runJob runs a claimed job and records its outcome, scheduling a retry if
+// it failed and attempts are left.
+func runJob(ctx context.Context, j *job) {
+	jobHandlersMu.RLock()
+	registered, ok := jobHandlers[j.Kind]
+	jobHandlersMu.RUnlock()
+
+	var (
+		result interface{}
+		err    error
+	)
+	start := time.Now()
+	if ok {
+		stop := make(chan struct{})
+		go renewLease(j, stop)
+		result, err = registered.handler(ctx, j)
+		close(stop)
+	} else {
+		err = permanent(fmt.Errorf("unknown job kind %q", j.Kind))
+	}
+	jobDuration.WithLabelValues(j.Kind).Observe(time.Since(start).Seconds())
+
+	now := appClock.Now()
+	updates := []firestore.Update{{Path: "updated_at", Value: now}}
+	outcome := jobDone
+	switch {
+	case err == nil:
+		updates = append(updates,
+			firestore.Update{Path: "status", Value: jobDone},
+			firestore.Update{Path: "finished_at", Value: now},
+			firestore.Update{Path: "last_error", Value: firestore.Delete})
+		if result != nil {
+			b, err := json.Marshal(result)
+			if err != nil {
+				logError("Failed to encode job result", "job_id", j.ID, "err", err)
+			} else {
+				updates = append(updates, firestore.Update{Path: "result", Value: string(b)})
+			}
+		}
+
+	case isPermanent(err) || j.Attempts >= j.MaxAttempts:
+		outcome = jobFailed
+		updates = append(updates,
+			firestore.Update{Path: "status", Value: jobFailed},
+			firestore.Update{Path: "finished_at", Value: now},
+			firestore.Update{Path: "last_error", Value: err.Error()})
+
+	default:
+		outcome = "retry"
+		updates = append(updates,
+			firestore.Update{Path: "status", Value: jobQueued},
+			firestore.Update{Path: "run_at", Value: now.Add(registered.policy.delay(j.Attempts))},
+			firestore.Update{Path: "last_error", Value: err.Error()})
+	}
+	jobsFinished.WithLabelValues(j.Kind, outcome).Inc()
+	if err != nil {
+		logWarn("Job attempt failed", "job_id", j.ID, "kind", j.Kind, "attempt", j.Attempts, "err", err)
+	}
+
+	// Record the outcome even if we are shutting down, otherwise the job
+	// would only be retried once its lease expires.
+	if err := updateDoc(context.Background(), j.ref, updates); err != nil {
+		logError("Failed to record job outcome", "job_id", j.ID, "err", err)
+	}
+}
+
+// renewLease extends the lease of the running job j every jobLeaseRenewal
+// until stop is closed, so that long jobs aren't claimed again by another
+// worker while they run.
+func renewLease(j *job, stop <-chan struct{}) {
+	ticker := time.NewTicker(jobLeaseRenewal)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		err := updateDoc(context.Background(), j.ref, []firestore.Update{
+			{Path: "lease_until", Value: appClock.Now().Add(jobLease)},
+		})
+		if err != nil {
+			logWarn("Failed to renew job lease", "job_id", j.ID, "err", err)
+		}
+	}
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(errPermanent)
+	return ok
+}
+
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	q := collection(jobsCollection).Query
+	if st := r.URL.Query().Get("status"); st != "" {
+		q = q.Where("status", "==", st)
+	}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		q = q.Where("kind", "==", kind)
+	}
+	snapshot, err := q.Limit(100).Documents(r.Context()).GetAll()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	list := make([]*job, 0, len(snapshot))
+	for _, s := range snapshot {
+		j, err := jobFromSnapshot(s)
+		if err != nil {
+			continue
+		}
+		list = append(list, j)
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].CreatedAt.After(list[b].CreatedAt)
+	})
+	writeJSON(w, map[string]interface{}{"jobs": list})
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) {
+	j, err := getJobByID(r.Context(), pathParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if j == nil {
+		writeError(w, http.StatusNotFound, "unknown job")
+		return
+	}
+	writeJSON(w, j)
+}
+
+// postJobRetry requeues a failed job for an immediate new round of
+// attempts.
+func postJobRetry(w http.ResponseWriter, r *http.Request) {
+	j, err := getJobByID(r.Context(), pathParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if j == nil {
+		writeError(w, http.StatusNotFound, "unknown job")
+		return
+	}
+	if j.Status != jobFailed {
+		writeError(w, http.StatusConflict, "only failed jobs can be retried")
+		return
+	}
+	jobHandlersMu.RLock()
+	registered, ok := jobHandlers[j.Kind]
+	jobHandlersMu.RUnlock()
+	if !ok {
+		writeError(w, http.StatusConflict, fmt.Sprintf("unknown job kind %q", j.Kind))
+		return
+	}
+
+	now := appClock.Now()
+	err = updateDoc(r.Context(), j.ref, []firestore.Update{
+		{Path: "status", Value: jobQueued},
+		{Path: "run_at", Value: now},
+		{Path: "updated_at", Value: now},
+		{Path: "max_attempts", Value: j.Attempts + registered.policy.MaxAttempts},
+		{Path: "finished_at", Value: firestore.Delete},
+	})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	select {
+	case jobsWake <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string]string{"id": j.ID, "status": jobQueued})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+)
+
+const (
+	// keysendMessageRecord is the TLV record carrying the chat message of a
+	// keysend payment, the one used by the other lightning chat apps.
+	keysendMessageRecord = 34349334
+
+	// keysendSenderRecord is the record of the pubkey of the sender sent
+	// along the plain message.
+	keysendSenderRecord = 34349339
+
+	// sphinxRecord is the record of the JSON envelopes of Sphinx chat,
+	// carrying the alias of the sender and how to reply along the message.
+	sphinxRecord = 133773310
+
+	// sphinxTypeMessage is the type of the Sphinx envelopes of messages.
+	sphinxTypeMessage = 0
+
+	// keysendInvoicePrefix prefixes the payment hash standing in for the
+	// payment request of keysend messages, which have none.
+	keysendInvoicePrefix = "keysend:"
+)
+
+// sphinxEnvelope is the part of a Sphinx chat envelope mapped to messages.
+type sphinxEnvelope struct {
+	Type    int           `json:"type"`
+	Chat    *sphinxChat   `json:"chat,omitempty"`
+	Message sphinxMessage `json:"message"`
+	Sender  sphinxSender  `json:"sender"`
+}
+
+type sphinxChat struct {
+	UUID string `json:"uuid"`
+}
+
+type sphinxMessage struct {
+	UUID    string `json:"uuid,omitempty"`
+	Content string `json:"content"`
+}
+
+type sphinxSender struct {
+	PubKey    string `json:"pub_key,omitempty"`
+	Alias     string `json:"alias,omitempty"`
+	RouteHint string `json:"route_hint,omitempty"`
+}
+
+// keysendMessage returns the chat message carried by the htlcs of a keysend
+// payment, empty if there is none, and its sender if known. Sphinx envelopes
+// take precedence over the plain message records.
+func keysendMessage(invoice *lnrpc.Invoice) (string, *lnurlPayerData, error) {
+	var memo string
+	var sender *lnurlPayerData
+	for _, htlc := range invoice.GetHtlcs() {
+		records := htlc.GetCustomRecords()
+		if raw, ok := records[sphinxRecord]; ok {
+			var env sphinxEnvelope
+			if err := json.Unmarshal(raw, &env); err != nil {
+				return "", nil, fmt.Errorf("invalid sphinx envelope: %v", err)
+			}
+			if env.Type != sphinxTypeMessage {
+				return "", nil, fmt.Errorf("unsupported sphinx envelope type %d", env.Type)
+			}
+			sender = &lnurlPayerData{
+				Name:      env.Sender.Alias,
+				Pubkey:    env.Sender.PubKey,
+				RouteHint: env.Sender.RouteHint,
+			}
+			return env.Message.Content, sender, sender.validate()
+		}
+		if text, ok := records[keysendMessageRecord]; ok && len(text) > 0 && memo == "" {
+			memo = string(text)
+			if pubkey, ok := records[keysendSenderRecord]; ok && len(pubkey) == 33 {
+				sender = &lnurlPayerData{Pubkey: hex.EncodeToString(pubkey)}
+			}
+		}
+	}
+	return memo, sender, nil
+}
+
+// sphinxEnvelopeOf returns the Sphinx envelope of m, so that the clients
+// speaking it can relay the messages of the chat.
+func sphinxEnvelopeOf(m *Message) *sphinxEnvelope {
+	env := &sphinxEnvelope{
+		Type:    sphinxTypeMessage,
+		Chat:    &sphinxChat{UUID: m.Room},
+		Message: sphinxMessage{UUID: publicIDs.Encode(m.ID), Content: m.Memo},
+	}
+	if env.Chat.UUID == "" {
+		env.Chat.UUID = defaultRoom
+	}
+	if m.Author != nil {
+		env.Sender = sphinxSender{PubKey: m.Author.Pubkey, Alias: m.Author.Name, RouteHint: m.Author.RouteHint}
+	}
+	return env
+}
+
+// keysendRequest validates the chat message of a keysend payment like the
+// invoice requests, hooks included, since the payment skipped them, and
+// returns it with its sender.
+func keysendRequest(invoice *lnrpc.Invoice) (*invoiceRequest, *lnurlPayerData, error) {
+	memo, sender, err := keysendMessage(invoice)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &invoiceRequest{Memo: memo, Amount: invoice.GetAmtPaidMsat() / 1000}
+	if req.Memo == "" || len(req.Memo) > maxMemoLength || !utf8.ValidString(req.Memo) {
+		return nil, nil, fmt.Errorf("message must be between 1 and %d bytes of utf-8", maxMemoLength)
+	}
+	_, min, err := currentSettings().quote(req.Memo, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.Amount < min {
+		return nil, nil, fmt.Errorf("amount must be at least %d", min)
+	}
+	if err := runInvoiceHooks(req); err != nil {
+		return nil, nil, err
+	}
+	return req, sender, nil
+}
+
+// handleKeysend posts the chat message of a settled keysend payment, which
+// has no message yet since no invoice was requested for it. Payments without
+// a valid message, or below the minimum amount, are quarantined instead.
+func handleKeysend(ctx context.Context, invoice *lnrpc.Invoice) {
+	hash := hex.EncodeToString(invoice.GetRHash())
+	key := keysendInvoicePrefix + hash
+	logInfo("Received keysend", "payment_hash", hash)
+
+	// Subscriptions replay settlements when resuming, the message may exist.
+	m, err := store.FindByInvoice(ctx, key)
+	if err != nil && err != errMessageNotFound {
+		logError("Failed to find the message of the keysend", "payment_hash", hash, "err", err)
+		return
+	}
+	if err == errMessageNotFound {
+		req, sender, err := keysendRequest(invoice)
+		if err != nil {
+			logWarn("Rejected keysend", "payment_hash", hash, "err", err)
+			quarantineSettlement(ctx, invoice)
+			return
+		}
+		m = &Message{
+			Invoice:    key,
+			RHash:      hash,
+			Memo:       req.Memo,
+			Amount:     req.Amount,
+			AmountMsat: invoice.GetAmtPaidMsat(),
+			Tags:       req.Tags,
+			Author:     sender,
+			CreatedAt:  time.Unix(invoice.GetCreationDate(), 0),
+		}
+		tagLanguage(m)
+		if err := store.CreateMessage(ctx, m); err != nil {
+			logError("Failed to store the message of the keysend", "payment_hash", hash, "err", err)
+			return
+		}
+	}
+	if err := markSettled(ctx, m, invoice); err != nil {
+		logError("Failed to mark the message settled", "doc_id", m.ID, "payment_hash", hash, "err", err)
+	}
+}
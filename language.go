@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// languageRooms are the languages whose messages posted to the default room
+// go to a room of their own, e.g. main-es, set with -languageRooms.
+var languageRooms = make(map[string]bool)
+
+// languageScripts are the languages told apart by their script alone.
+var languageScripts = []struct {
+	lang  string
+	table *unicode.RangeTable
+}{
+	{"ja", unicode.Hiragana},
+	{"ja", unicode.Katakana},
+	{"ko", unicode.Hangul},
+	{"zh", unicode.Han},
+	{"ru", unicode.Cyrillic},
+	{"el", unicode.Greek},
+	{"he", unicode.Hebrew},
+	{"ar", unicode.Arabic},
+	{"hi", unicode.Devanagari},
+	{"th", unicode.Thai},
+}
+
+// languageWords are the most frequent words of the languages written in
+// latin script, which short chat messages are classified by.
+var languageWords = map[string][]string{
+	"en": {"the", "and", "is", "are", "you", "to", "of", "it", "this", "that", "what", "for", "with", "my", "i", "hello", "thanks"},
+	"es": {"el", "la", "los", "las", "y", "es", "que", "de", "en", "un", "una", "por", "para", "con", "hola", "gracias", "muy"},
+	"fr": {"le", "la", "les", "et", "est", "que", "de", "des", "un", "une", "pour", "avec", "je", "tu", "bonjour", "merci", "pas"},
+	"de": {"der", "die", "das", "und", "ist", "ich", "du", "nicht", "ein", "eine", "mit", "für", "auf", "hallo", "danke", "sehr"},
+	"pt": {"o", "a", "os", "as", "e", "é", "que", "de", "em", "um", "uma", "para", "com", "não", "olá", "obrigado", "muito"},
+	"it": {"il", "lo", "la", "gli", "e", "è", "che", "di", "un", "una", "per", "con", "non", "ciao", "grazie", "molto", "sono"},
+	"nl": {"de", "het", "een", "en", "is", "dat", "van", "ik", "je", "niet", "met", "voor", "op", "hallo", "bedankt", "heel"},
+}
+
+// languageIndex maps the words of languageWords to their languages.
+var languageIndex = func() map[string][]string {
+	index := make(map[string][]string)
+	for lang, words := range languageWords {
+		for _, w := range words {
+			index[w] = append(index[w], lang)
+		}
+	}
+	return index
+}()
+
+// detectLanguage returns the ISO 639-1 code of the language text is most
+// likely written in, by its script or else its frequent words, empty when it
+// can't tell.
+func detectLanguage(text string) string {
+	scripts := make(map[string]int)
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, s := range languageScripts {
+			if unicode.Is(s.table, r) {
+				scripts[s.lang]++
+				break
+			}
+		}
+	}
+	// Japanese mixes kana with Han characters, so any kana wins.
+	if scripts["ja"] > 0 {
+		return "ja"
+	}
+	if lang, n := top(scripts); n*2 > letters {
+		return lang
+	}
+
+	scores := make(map[string]int)
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		for _, lang := range languageIndex[w] {
+			scores[lang]++
+		}
+	}
+	lang, n := top(scores)
+	for other, m := range scores {
+		// Ties are too close to call.
+		if other != lang && m == n {
+			return ""
+		}
+	}
+	return lang
+}
+
+// top returns the key with the highest count, empty for no counts.
+func top(counts map[string]int) (string, int) {
+	best, max := "", 0
+	for k, n := range counts {
+		if n > max {
+			best, max = k, n
+		}
+	}
+	return best, max
+}
+
+// tagLanguage sets the language of m, a new message, and moves it to the
+// room of its language if it was posted to the default room and the
+// language has one. Direct messages are encrypted and boosts belong to the
+// room of the message they boost, so both are left alone.
+func tagLanguage(m *Message) {
+	if m.DM != nil || m.BoostOf != "" {
+		return
+	}
+	m.Language = detectLanguage(m.Memo)
+	// Replies stay in the room of their thread.
+	if languageRooms[m.Language] && m.ParentID == "" && (m.Room == "" || m.Room == defaultRoom) {
+		m.Room = defaultRoom + "-" + m.Language
+	}
+}
+
+// filterLanguage returns the messages of list written in lang, all of them
+// for an empty lang.
+func filterLanguage(list []*Message, lang string) []*Message {
+	if lang == "" {
+		return list
+	}
+	filtered := list[:0]
+	for _, m := range list {
+		if m.Language == lang {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+// filterRoom returns the messages of list posted to room, all of them for an
+// empty room.
+func filterRoom(list []*Message, room string) []*Message {
+	if room == "" {
+		return list
+	}
+	filtered := list[:0]
+	for _, m := range list {
+		if m.Room == room || (m.Room == "" && room == defaultRoom) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+)
+
+const (
+	backendLnd    = "lnd"
+	backendCLN    = "cln"
+	backendLNDHub = "lndhub"
+)
+
+// lightning is the node the invoices are created on and watched, selected
+// with -backend. The lnd node additionally backs moderation, refunds,
+// keysends, channel backups and the admin invoice routes.
+var lightning LightningBackend = lndBackend{}
+
+var errLndOnly = errors.New("only supported by the lnd backend, see -backend")
+
+// LightningBackend is the node the messages are paid to. Its calls take and
+// return the lnd types, which the other implementations convert to.
+type LightningBackend interface {
+	AddInvoice(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error)
+	DecodePayReq(ctx context.Context, payReq string) (*lnrpc.PayReq, error)
+
+	// LookupInvoice returns the invoice of the hex payment hash, failing
+	// with a codes.NotFound status when there is none.
+	LookupInvoice(ctx context.Context, hash string) (*lnrpc.Invoice, error)
+
+	// SubscribeInvoices streams the invoices added and settled after the
+	// indexes of resume, until ctx is done.
+	SubscribeInvoices(ctx context.Context, resume *lnrpc.InvoiceSubscription) (invoiceStream, error)
+
+	GetInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error)
+
+	// SignMessage signs msg with the node key, returning the zbase32
+	// signature lnd's verifymessage checks.
+	SignMessage(ctx context.Context, msg []byte) (string, error)
+}
+
+// backendName returns the -backend of lightning.
+func backendName() string {
+	switch lightning.(type) {
+	case *clnBackend:
+		return backendCLN
+	case *lndhubBackend:
+		return backendLNDHub
+	}
+	return backendLnd
+}
+
+// invoiceStream is an invoice subscription.
+type invoiceStream interface {
+	Recv() (*lnrpc.Invoice, error)
+}
+
+// checkLnd fails with errLndOnly unless the backend is lnd, which the
+// features relying on the other lnd RPCs need.
+func checkLnd() error {
+	if _, ok := lightning.(lndBackend); !ok {
+		return errLndOnly
+	}
+	return nil
+}
+
+// lndBackend is the LightningBackend of an lnd node, c, the -rpcServer one
+// when nil.
+type lndBackend struct {
+	c lnrpc.LightningClient
+}
+
+func (b lndBackend) client() lnrpc.LightningClient {
+	if b.c != nil {
+		return b.c
+	}
+	c, _ := getClient()
+	return c
+}
+
+func (b lndBackend) AddInvoice(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+	return b.client().AddInvoice(ctx, invoice)
+}
+
+func (b lndBackend) DecodePayReq(ctx context.Context, payReq string) (*lnrpc.PayReq, error) {
+	return b.client().DecodePayReq(ctx, &lnrpc.PayReqString{PayReq: payReq})
+}
+
+func (b lndBackend) LookupInvoice(ctx context.Context, hash string) (*lnrpc.Invoice, error) {
+	return b.client().LookupInvoice(ctx, &lnrpc.PaymentHash{RHashStr: hash})
+}
+
+func (b lndBackend) SubscribeInvoices(ctx context.Context, resume *lnrpc.InvoiceSubscription) (invoiceStream, error) {
+	return b.client().SubscribeInvoices(ctx, resume)
+}
+
+func (b lndBackend) GetInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error) {
+	return b.client().GetInfo(ctx, &lnrpc.GetInfoRequest{})
+}
+
+func (b lndBackend) SignMessage(ctx context.Context, msg []byte) (string, error) {
+	res, err := b.client().SignMessage(ctx, &lnrpc.SignMessageRequest{Msg: msg})
+	if err != nil {
+		return "", err
+	}
+	return res.GetSignature(), nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPageMessages is the number of messages of a page of GET
+	// /messages without a limit.
+	defaultPageMessages = 50
+
+	// maxPinnedMessages is the number of pinned messages listed on top of
+	// the first page of GET /messages.
+	maxPinnedMessages = 5
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor returns the opaque cursor of the page after m.
+func encodeCursor(m *Message) string {
+	c := fmt.Sprintf("%d.%v", m.SettledAt.UnixNano(), publicIDs.Encode(m.ID))
+	return base64.RawURLEncoding.EncodeToString([]byte(c))
+}
+
+func decodeCursor(s string) (messageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return messageCursor{}, errInvalidCursor
+	}
+	parts := strings.SplitN(string(b), ".", 2)
+	if len(parts) != 2 {
+		return messageCursor{}, errInvalidCursor
+	}
+	ns, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return messageCursor{}, errInvalidCursor
+	}
+	id, err := publicIDs.Decode(parts[1])
+	if err != nil || id == "" {
+		return messageCursor{}, errInvalidCursor
+	}
+	return messageCursor{SettledAt: time.Unix(0, ns).UTC(), ID: id}, nil
+}
+
+// defaultTopWindow is how far back GET /messages/top ranks the messages
+// without a since.
+const defaultTopWindow = 7 * 24 * time.Hour
+
+// getTopMessages lists at most limit settled messages of a room, the default
+// one unless room is given, by decreasing value, their amount paid and
+// boosts, among those settled over the last since, a week by default.
+func getTopMessages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("room")
+	if id == "" {
+		id = defaultRoom
+	}
+	if !roomReadable(r, id) {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	limit := defaultPageMessages
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxRoomMessages {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	window := defaultTopWindow
+	if v := q.Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid since")
+			return
+		}
+		window = d
+	}
+
+	room := id
+	if room == defaultRoom {
+		room = ""
+	}
+	list, err := store.ListTopSettled(r.Context(), room, appClock.Now().Add(-window), limit)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	for _, m := range list {
+		publicMessage(m)
+	}
+	writeJSON(w, map[string]interface{}{"room": id, "messages": list})
+}
+
+// getMessages lists the settled messages of a room, the default one unless
+// room is given, latest first, a page of at most limit at a time. next is
+// the cursor of the following page, passed as before, and is missing on the
+// last one. The first page also lists the latest pinned messages of the
+// room apart, for the clients to show on top.
+func getMessages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("room")
+	if id == "" {
+		id = defaultRoom
+	}
+	if !roomReadable(r, id) {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	limit := defaultPageMessages
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxRoomMessages {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	var cursor messageCursor
+	if v := q.Get("before"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		cursor = c
+	}
+
+	room := id
+	if room == defaultRoom {
+		room = ""
+	}
+	list, err := store.ListSettledPage(r.Context(), room, cursor, limit)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	j := map[string]interface{}{"room": id}
+	if len(list) == limit {
+		j["next"] = encodeCursor(list[len(list)-1])
+	}
+	for _, m := range list {
+		publicMessage(m)
+	}
+	j["messages"] = list
+	if cursor.ID == "" {
+		pinned, err := store.ListPinned(r.Context(), room, maxPinnedMessages)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		for _, m := range pinned {
+			publicMessage(m)
+		}
+		j["pinned"] = pinned
+	}
+	writeJSON(w, j)
+}
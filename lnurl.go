@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const (
+	lnurlMaxSendableMsat = 1000000 * 1000
+
+	// lnurlCommentAllowed is the length of the LUD-12 comments accepted,
+	// which become the text of the message.
+	lnurlCommentAllowed = 280
+
+	maxPayerDataField = 256
+)
+
+// lnurlMetadata is the LUD-06 metadata of the pay request, whose hash, with
+// the payer data, is committed to by the invoices.
+var lnurlMetadata = `[["text/plain","Message on the rawtx chat"]]`
+
+// lnurlPayerData are the LUD-18 fields a wallet may attach to a payment,
+// stored as the author of the message. Keysend senders set the route hint,
+// pubkey:channel, through which their node is reached for replies.
+type lnurlPayerData struct {
+	Name      string `json:"name,omitempty" firestore:"name,omitempty"`
+	Pubkey    string `json:"pubkey,omitempty" firestore:"pubkey,omitempty"`
+	Email     string `json:"email,omitempty" firestore:"email,omitempty"`
+	RouteHint string `json:"route_hint,omitempty" firestore:"route_hint,omitempty"`
+}
+
+func (p *lnurlPayerData) validate() error {
+	if len(p.Name) > maxPayerDataField || len(p.Email) > maxPayerDataField || len(p.RouteHint) > maxPayerDataField {
+		return fmt.Errorf("payer data longer than %d bytes", maxPayerDataField)
+	}
+	if p.Pubkey != "" {
+		if key, err := hex.DecodeString(p.Pubkey); err != nil || len(key) != 33 {
+			return fmt.Errorf("invalid payer pubkey")
+		}
+	}
+	if p.Email != "" {
+		if _, err := mail.ParseAddress(p.Email); err != nil {
+			return fmt.Errorf("invalid payer email")
+		}
+	}
+	return nil
+}
+
+// lnurlRoomMetadata returns the metadata of the pay request of room, which
+// is also its LUD-16 lightning address room@host. The default pay request
+// keeps the plain metadata.
+func lnurlRoomMetadata(r *http.Request, room string) string {
+	if room == "" {
+		return lnurlMetadata
+	}
+	host := r.Host
+	if u, err := url.Parse(publicURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	b, _ := json.Marshal([][]string{
+		{"text/plain", "Message on the " + room + " room of the rawtx chat"},
+		{"text/identifier", room + "@" + host},
+	})
+	return string(b)
+}
+
+// lnurlRoom returns the room of a room pay request, rejecting the rooms that
+// can't be posted to publicly.
+func lnurlRoom(r *http.Request) (string, error) {
+	room := pathParam(r, "room")
+	if strings.HasPrefix(room, dmRoomPrefix) || len(room) > maxPayerDataField {
+		return "", fmt.Errorf("invalid room")
+	}
+	if !roomOpen(room) {
+		return "", fmt.Errorf("unknown room")
+	}
+	return room, nil
+}
+
+// lnurlError writes a LNURL error, which wallets expect with a 200 status.
+func lnurlError(w http.ResponseWriter, reason string) {
+	writeJSON(w, map[string]string{"status": "ERROR", "reason": reason})
+}
+
+// getLnurlPay returns the LNURL-pay request of the chat.
+func getLnurlPay(w http.ResponseWriter, r *http.Request) {
+	writeLnurlPay(w, r, "", "/lnurlp/callback")
+}
+
+// getLnurlPayRoom returns the LNURL-pay request of a room, served under
+// /.well-known/lnurlp so that the room is also a lightning address.
+func getLnurlPayRoom(w http.ResponseWriter, r *http.Request) {
+	room, err := lnurlRoom(r)
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+	writeLnurlPay(w, r, room, "/lnurlp/callback/"+url.PathEscape(room))
+}
+
+func writeLnurlPay(w http.ResponseWriter, r *http.Request, room, callback string) {
+	_, min, err := currentSettings().basePrices()
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+	optional := map[string]bool{"mandatory": false}
+	writeJSON(w, map[string]interface{}{
+		"tag":            "payRequest",
+		"callback":       baseURL(r).String() + callback,
+		"minSendable":    min * 1000,
+		"maxSendable":    lnurlMaxSendableMsat,
+		"metadata":       lnurlRoomMetadata(r, room),
+		"commentAllowed": lnurlCommentAllowed,
+		"payerData": map[string]interface{}{
+			"name":   optional,
+			"pubkey": optional,
+			"email":  optional,
+		},
+	})
+}
+
+// getLnurlPayCallback creates the message paid through LNURL-pay, with the
+// comment as its text and the payer data as its author, and returns its
+// invoice.
+func getLnurlPayCallback(w http.ResponseWriter, r *http.Request) {
+	lnurlPayCallback(w, r, "")
+}
+
+// getLnurlPayRoomCallback is getLnurlPayCallback for the messages of a room.
+func getLnurlPayRoomCallback(w http.ResponseWriter, r *http.Request) {
+	room, err := lnurlRoom(r)
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+	lnurlPayCallback(w, r, room)
+}
+
+func lnurlPayCallback(w http.ResponseWriter, r *http.Request, room string) {
+	q := r.URL.Query()
+	_, min, err := currentSettings().basePrices()
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+	amount, err := strconv.ParseInt(q.Get("amount"), 10, 64)
+	if err != nil || amount < min*1000 || amount > lnurlMaxSendableMsat {
+		lnurlError(w, "invalid amount")
+		return
+	}
+	comment := q.Get("comment")
+	if comment != "" {
+		if comment, err = sanitizeMemo(comment, lnurlCommentAllowed); err != nil {
+			lnurlError(w, err.Error())
+			return
+		}
+	}
+	// The comment is only known now, its characters are priced here.
+	if _, min, err := currentSettings().quote(comment, false); err != nil || amount < min*1000 {
+		lnurlError(w, fmt.Sprintf("amount must be at least %d msat for this comment", min*1000))
+		return
+	}
+
+	// The description hash commits to the payer data exactly as sent by
+	// the wallet.
+	rawPayerData := q.Get("payerdata")
+	var payer lnurlPayerData
+	if rawPayerData != "" {
+		if err := json.Unmarshal([]byte(rawPayerData), &payer); err != nil {
+			lnurlError(w, "invalid payerdata")
+			return
+		}
+		if err := payer.validate(); err != nil {
+			lnurlError(w, err.Error())
+			return
+		}
+		// Route hints aren't LUD-18 payer data.
+		payer.RouteHint = ""
+	}
+	hash := sha256.Sum256([]byte(lnurlRoomMetadata(r, room) + rawPayerData))
+
+	// Hooks may pick the node and tag the message, but the amount is set
+	// by the payer.
+	req, err := newInvoiceRequest(r, comment, amount/1000)
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+	_, res, err := createMessage(r.Context(), req, &lnrpc.Invoice{
+		ValueMsat:       amount,
+		DescriptionHash: hash[:],
+	}, &Message{
+		Memo:   req.Memo,
+		Room:   room,
+		Author: &payer,
+	})
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"pr":     res.PaymentRequest,
+		"routes": []string{},
+	})
+}
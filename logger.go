@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log entry.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+var (
+	// minLogLevel is the lowest level logged and logJSON whether entries
+	// are written as JSON objects rather than text lines.
+	minLogLevel = levelInfo
+	logJSON     bool
+
+	logOutput io.Writer = os.Stderr
+	logMu     sync.Mutex
+)
+
+// parseLogLevel parses the -logLevel flag.
+func parseLogLevel(s string) (logLevel, error) {
+	for level, name := range logLevelNames {
+		if name == s {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// setupLogging applies the logging flags, the output of the standard logger,
+// which the libraries use, being logged at info level.
+func setupLogging(level, format string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	minLogLevel, logJSON = l, format == "json"
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+	return nil
+}
+
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logAt(levelInfo, strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+func logDebug(msg string, kv ...interface{}) { logAt(levelDebug, msg, kv...) }
+func logInfo(msg string, kv ...interface{})  { logAt(levelInfo, msg, kv...) }
+func logWarn(msg string, kv ...interface{})  { logAt(levelWarn, msg, kv...) }
+func logError(msg string, kv ...interface{}) { logAt(levelError, msg, kv...) }
+
+// logAt writes an entry of msg and the fields given as key value pairs, the
+// keys being named alike across the code: payment_hash, doc_id, route...
+func logAt(level logLevel, msg string, kv ...interface{}) {
+	if level < minLogLevel {
+		return
+	}
+	fields := make(map[string]interface{}, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := kv[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		fields[fmt.Sprint(kv[i])] = v
+	}
+
+	now := appClock.Now().UTC().Format(time.RFC3339Nano)
+	var line []byte
+	if logJSON {
+		fields["time"], fields["level"], fields["msg"] = now, logLevelNames[level], msg
+		line, _ = json.Marshal(fields)
+	} else {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		fmt.Fprintf(&b, "%v %-5v %v", now, strings.ToUpper(logLevelNames[level]), msg)
+		for _, k := range keys {
+			v := fmt.Sprint(fields[k])
+			if strings.ContainsAny(v, " =\"") {
+				v = strconv.Quote(v)
+			}
+			fmt.Fprintf(&b, " %v=%v", k, v)
+		}
+		line = []byte(b.String())
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(append(line, '\n'))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// maxAttachments is the maximum number of attachments of a message.
+	maxAttachments = 4
+
+	defaultMediaURLTTL = 15 * time.Minute
+)
+
+var (
+	// mediaDest is the S3 compatible storage of the attachments, parsed
+	// from -media, nil disabling attachments. The objects are private, read
+	// and written through urls signed for mediaURLTTL.
+	mediaDest   *s3Dest
+	mediaURLTTL = defaultMediaURLTTL
+
+	// mediaTypes are the content types attachments may have.
+	mediaTypes = map[string]bool{
+		"image/png":  true,
+		"image/jpeg": true,
+		"image/gif":  true,
+		"image/webp": true,
+		"video/mp4":  true,
+		"audio/mpeg": true,
+	}
+)
+
+// postMedia returns a url signed for uploading an attachment, and the key
+// messages then attach it by. The upload must send the returned headers.
+func postMedia(w http.ResponseWriter, r *http.Request) {
+	if mediaDest == nil {
+		writeError(w, http.StatusNotFound, "attachments disabled")
+		return
+	}
+	var body struct {
+		ContentType string `json:"content_type"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !mediaTypes[body.ContentType] {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported content type %q", body.ContentType))
+		return
+	}
+	key, err := ids.NewID(messageIDAlphabet, 20)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	headers := mediaDest.sseHeaders()
+	headers["Content-Type"] = body.ContentType
+	now := appClock.Now().UTC()
+	writeJSON(w, map[string]interface{}{
+		"key":            key,
+		"upload_url":     mediaDest.presign(http.MethodPut, key, headers, mediaURLTTL, now),
+		"upload_headers": headers,
+		"expires_at":     now.Add(mediaURLTTL),
+	})
+}
+
+// validAttachments checks that the attachments of a new message were
+// uploaded.
+func validAttachments(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if mediaDest == nil {
+		return fmt.Errorf("attachments disabled")
+	}
+	if len(keys) > maxAttachments {
+		return fmt.Errorf("at most %d attachments", maxAttachments)
+	}
+	for _, key := range keys {
+		if len(key) != 20 || strings.Trim(key, messageIDAlphabet) != "" {
+			return fmt.Errorf("invalid attachment %q", key)
+		}
+		ok, err := mediaDest.exists(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("attachment %q wasn't uploaded", key)
+		}
+	}
+	return nil
+}
+
+// signAttachments sets the urls of the attachments of m, signed anew on
+// every read so that links leaked or kept expire.
+func signAttachments(m *Message) {
+	if mediaDest == nil || len(m.Attachments) == 0 {
+		return
+	}
+	now := appClock.Now().UTC()
+	m.AttachmentURLs = make([]string, len(m.Attachments))
+	for i, key := range m.Attachments {
+		m.AttachmentURLs[i] = mediaDest.presign(http.MethodGet, key, nil, mediaURLTTL, now)
+	}
+}
+
+// getAttachments returns the signed urls of the attachments of a settled
+// public message, for the clients reading the messages from Firestore.
+func getAttachments(w http.ResponseWriter, r *http.Request) {
+	id, err := publicIDs.Decode(pathParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	m, err := store.GetMessage(r.Context(), id)
+	if err == errMessageNotFound || (err == nil && (!m.Settled || m.DM != nil || isPrivateRoom(m.Room))) {
+		writeErrorCode(w, http.StatusNotFound, codeUnknownMessage, errMessageNotFound.Error(), nil)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	signAttachments(m)
+	writeJSON(w, map[string]interface{}{
+		"attachments": m.AttachmentURLs,
+		"expires_at":  appClock.Now().UTC().Add(mediaURLTTL),
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxInvoiceMemoLength is the longest description lnd accepts in an
+// invoice, in bytes.
+const maxInvoiceMemoLength = 639
+
+// The codes of the memos rejected by sanitizeMemo.
+const (
+	memoEmpty       = "memo_empty"
+	memoTooLong     = "memo_too_long"
+	memoInvalidUTF8 = "memo_invalid_utf8"
+	memoBannedWord  = "memo_banned_word"
+)
+
+// memoError is a memo rejected before its invoice is created, answered with
+// a 400 telling why by Code.
+type memoError struct {
+	Code    string
+	Message string
+}
+
+func (e *memoError) Error() string {
+	return e.Message
+}
+
+// writeMemoError answers err, returned by sanitizeMemo.
+func writeMemoError(w http.ResponseWriter, err error) {
+	code := codeInvalidRequest
+	if e, ok := err.(*memoError); ok {
+		code = e.Code
+	}
+	writeErrorCode(w, http.StatusBadRequest, code, err.Error(), map[string]string{"field": "memo"})
+}
+
+// invisibleRune reports whether r is stripped from the memos: the control
+// characters but new lines, and the bidirectional overrides which reorder
+// the text around them.
+func invisibleRune(r rune) bool {
+	switch {
+	case r == '\n':
+		return false
+	case unicode.IsControl(r):
+		return true
+	case r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+		return true
+	}
+	return false
+}
+
+// sanitizeMemo returns memo without its control characters and surrounding
+// spaces, failing with a memoError when it is empty, longer than max bytes,
+// not utf-8 or has a banned word.
+func sanitizeMemo(memo string, max int) (string, error) {
+	if !utf8.ValidString(memo) {
+		return "", &memoError{memoInvalidUTF8, "memo must be valid utf-8"}
+	}
+	memo = strings.Replace(memo, "\r\n", "\n", -1)
+	memo = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if invisibleRune(r) {
+			return -1
+		}
+		return r
+	}, memo))
+	if memo == "" {
+		return "", &memoError{memoEmpty, "memo must not be empty"}
+	}
+	if len(memo) > max {
+		return "", &memoError{memoTooLong, fmt.Sprintf("memo must be at most %d bytes", max)}
+	}
+	if err := rejectBannedWords(&invoiceRequest{Memo: memo}); err != nil {
+		return "", &memoError{memoBannedWord, err.Error()}
+	}
+	return memo, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"golang.org/x/net/context"
+)
+
+const maxMemoLength = 280
+
+var (
+	// messagePrice is the default and minimum amount of a message, in
+	// satoshis, unless the remote config sets them.
+	messagePrice int64 = defaultMessagePrice
+
+	defaultMessagePrice int64 = 100
+)
+
+// createMessage adds invoice on the node of req and stores m, the message
+// it pays. The invoice is cancelled if the message can't be stored, so that
+// nothing can be paid without a message to show for it. With moderation,
+// the invoice is a hold invoice on the default node. Invoices the default
+// node lacks the inbound liquidity for are created on the fallback wallet,
+// the message being tagged with it. Failures are an invoiceError or a
+// storeError.
+func createMessage(ctx context.Context, req *invoiceRequest, invoice *lnrpc.Invoice, m *Message) (*Message, *lnrpc.AddInvoiceResponse, error) {
+	prefixMemo(invoice)
+	var res *lnrpc.AddInvoiceResponse
+	var backend, node string
+	if moderationMode != "" {
+		var err error
+		res, m.HoldNonce, err = addHoldInvoice(ctx, invoice)
+		if err != nil {
+			return nil, nil, invoiceError{err}
+		}
+	} else {
+		var err error
+		switch {
+		case req.Node != "":
+			c, clean, nerr := getNodeClient(req.Node)
+			if nerr != nil {
+				return nil, nil, invoiceError{nerr}
+			}
+			defer clean()
+			res, err = c.AddInvoice(ctx, invoice)
+			node = req.Node
+		case needsFallback(ctx, invoice):
+			backend = backendLnbits
+			res, err = addFallbackInvoice(ctx, invoice)
+		default:
+			res, node, err = addInvoiceFailover(ctx, invoice)
+		}
+		if err != nil {
+			return nil, nil, invoiceError{err}
+		}
+	}
+
+	m.Invoice = res.PaymentRequest
+	m.RHash = hex.EncodeToString(res.RHash)
+	// The payment hash ties the trace of the request to the one of the
+	// settlement.
+	spanFrom(ctx).set("r_hash", m.RHash)
+	m.AmountMsat = invoice.GetValue() * 1000
+	if invoice.GetValueMsat() != 0 {
+		m.AmountMsat = invoice.GetValueMsat()
+	}
+	m.Amount = m.AmountMsat / 1000
+	priceFiat(m)
+	if wantsOnchainFallback(m, backend) {
+		// The message can still be paid with its invoice.
+		addr, err := newOnchainAddress(ctx)
+		if err != nil {
+			logWarn("Failed to get an on-chain fallback address", "payment_hash", m.RHash, "err", err)
+		}
+		m.OnchainAddress = addr
+	}
+	m.Tags = req.Tags
+	m.UID = req.User
+	if backend != "" || node != "" || lndNetwork != "" {
+		m.Tags = make(map[string]string, len(req.Tags)+3)
+		for k, v := range req.Tags {
+			if k != backendTag && k != nodeTag && k != networkTag {
+				m.Tags[k] = v
+			}
+		}
+		if backend != "" {
+			m.Tags[backendTag] = backend
+		}
+		if node != "" {
+			m.Tags[nodeTag] = node
+		}
+		if lndNetwork != "" {
+			m.Tags[networkTag] = lndNetwork
+		}
+	}
+	m.CreatedAt = appClock.Now()
+	tagLanguage(m)
+	if err := store.CreateMessage(ctx, m); err != nil {
+		// LNbits, Core Lightning and LNDHub invoices aren't cancelled, they
+		// expire unpaid.
+		if backend != "" || checkLnd() != nil {
+			return nil, nil, storeError{err}
+		}
+		inv := messageInvoicesClient(m)
+		if _, cerr := inv.CancelInvoice(context.Background(), &invoicesrpc.CancelInvoiceMsg{PaymentHash: res.RHash}); cerr != nil {
+			logError("Failed to cancel the invoice of an unstored message", "payment_hash", hex.EncodeToString(res.RHash), "err", cerr)
+		}
+		return nil, nil, storeError{err}
+	}
+	invoicesCreated.WithLabelValues(messageBackend(m)).Inc()
+	audit(auditInvoiceCreated, m, nil, messageBackend(m))
+	payers.requested(payerKey(req.User, req.IP), m.ID, m.CreatedAt)
+	if m.HoldNonce != "" {
+		watchHold(m)
+	}
+	if backend != "" {
+		trackFallback(m)
+	}
+	return m, res, nil
+}
+
+// messageRequest is the body of postMessage.
+type messageRequest struct {
+	Memo   string `json:"memo"`
+	Room   string `json:"room"`
+	Amount int64  `json:"amount"`
+	Pinned bool   `json:"pinned"`
+
+	// Promo is a promo code discounting the message.
+	Promo string `json:"promo"`
+
+	// Attachments are the keys of media uploaded through /media.
+	Attachments []string `json:"attachments"`
+
+	// parent is the message replied to, set by postReply.
+	parent *Message
+}
+
+// postMessage creates a message and the invoice paying it.
+func postMessage(w http.ResponseWriter, r *http.Request) {
+	var m messageRequest
+	if err := decodeJSON(r, &m); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	postMessageRequest(w, r, &m)
+}
+
+// postMessageRequest creates the message of the decoded body of postMessage
+// and the invoice paying it.
+func postMessageRequest(w http.ResponseWriter, r *http.Request, m *messageRequest) {
+	memo, err := sanitizeMemo(m.Memo, maxMemoLength)
+	if err != nil {
+		writeMemoError(w, err)
+		return
+	}
+	m.Memo = memo
+	if strings.HasPrefix(m.Room, dmRoomPrefix) {
+		writeError(w, http.StatusBadRequest, "direct messages must be sent encrypted to /dm")
+		return
+	}
+	if !roomOpen(m.Room) {
+		writeError(w, http.StatusNotFound, "unknown room")
+		return
+	}
+	if err := validAttachments(r.Context(), m.Attachments); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Users with chat access post for free, but pinned messages.
+	if user := stateOf(r).User; !m.Pinned && hasAccess(r.Context(), user) {
+		postWithAccess(w, r, user, m)
+		return
+	}
+	price, min, err := currentSettings().quote(m.Memo, m.Pinned)
+	if err == errRateUnavailable {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if m.Promo != "" {
+		percent, err := redeemPromo(r.Context(), m.Promo)
+		if err == errPromoUnavailable {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		price, min = discounted(price, percent), discounted(min, percent)
+	}
+	// Spammy messages cost more rather than being rejected.
+	user := stateOf(r).User
+	score, multiplier := scoreSpam(m.Memo, payerKey(user, clientIP(r)))
+	price, min = multiplied(price, multiplier), multiplied(min, multiplier)
+	if m.Amount == 0 {
+		m.Amount = price
+	}
+	if m.Amount < min {
+		if m.Promo != "" {
+			releasePromo(m.Promo)
+		}
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("amount must be at least %d", min))
+		return
+	}
+
+	req, err := newInvoiceRequest(r, m.Memo, m.Amount)
+	if err != nil {
+		if m.Promo != "" {
+			releasePromo(m.Promo)
+		}
+		writeCreateError(w, err)
+		return
+	}
+	msg, res, err := createMessage(r.Context(), req, &lnrpc.Invoice{
+		Memo:  req.Memo,
+		Value: req.Amount,
+	}, replyTo(&Message{
+		Memo:            m.Memo,
+		Room:            m.Room,
+		Pinned:          m.Pinned,
+		Attachments:     m.Attachments,
+		SpamScore:       score,
+		PriceMultiplier: multiplier,
+	}, m.parent))
+	if err != nil {
+		if m.Promo != "" {
+			releasePromo(m.Promo)
+		}
+		writeCreateError(w, err)
+		return
+	}
+	if m.Promo != "" {
+		recordPromoMessage(r.Context(), m.Promo, msg.ID)
+	}
+	j := map[string]interface{}{
+		"id":          publicIDs.Encode(msg.ID),
+		"pay_req":     res.PaymentRequest,
+		"amount":      msg.Amount,
+		"payer_token": payerToken(msg.RHash),
+	}
+	if len(req.Tags) > 0 {
+		j["tags"] = req.Tags
+	}
+	// The room may be the one of the language of the message.
+	if msg.Room != "" {
+		j["room"] = msg.Room
+	}
+	if msg.Language != "" {
+		j["language"] = msg.Language
+	}
+	if multiplier > 1 {
+		j["price_multiplier"] = multiplier
+	}
+	if msg.OnchainAddress != "" {
+		j["address"] = msg.OnchainAddress
+		j["bip21"] = bip21URI(msg)
+	}
+	writeJSON(w, j)
+}
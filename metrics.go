@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "chat_backend"
+
+var (
+	// settleLagAlert is the lag after which a settlement is considered to
+	// have breached the SLA. A zero value disables alerting.
+	settleLagAlert = defaultSettleLagAlert
+
+	defaultSettleLagAlert = 30 * time.Second
+
+	// processStart is when the process started. Invoices settled before are
+	// caught up with at startup, their lag measuring the downtime rather
+	// than the watcher.
+	processStart = appClock.Now()
+
+	settleLagSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "settle_lag_seconds",
+		Help:      "Time between an invoice settling in lnd and its message being marked settled.",
+		Buckets:   []float64{0.25, 0.5, 1, 2, 5, 10, 30, 60, 300, 900, 3600},
+	})
+
+	settleLagAlerts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "settle_lag_alerts_total",
+		Help:      "Number of settlements whose lag exceeded the alert threshold.",
+	})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	invoiceResubscriptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "invoice_resubscriptions_total",
+		Help:      "Number of times the lnd invoice subscription failed and was reopened.",
+	})
+
+	invoicesCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "invoices_created_total",
+		Help:      "Number of message invoices created by backend (lnd, cln, lnbits).",
+	}, []string{"backend"})
+
+	invoicesSettled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "invoices_settled_total",
+		Help:      "Number of message invoices marked settled by backend (lnd, cln, lnbits, keysend).",
+	}, []string{"backend"})
+
+	firestoreUpdateFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "firestore_update_failures_total",
+		Help:      "Number of failed Firestore document updates by collection.",
+	}, []string{"collection"})
+
+	lndRPCErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "lnd_rpc_errors_total",
+		Help:      "Number of failed lnd RPCs by method and gRPC code.",
+	}, []string{"method", "code"})
+
+	malformedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "malformed_messages_total",
+		Help:      "Number of stored messages skipped while listing them for failing validation, by field.",
+	}, []string{"field"})
+
+	deadLetterSettlements = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "dead_letter_settlements",
+		Help:      "Number of settled invoices the watcher failed to record, retried until recorded.",
+	})
+
+	deadLetterRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dead_letter_retries_total",
+		Help:      "Number of retries of the dead letter settlements, by outcome: recorded or failed.",
+	}, []string{"outcome"})
+
+	invoiceSubscriptionGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "invoice_subscription_up",
+		Help:      "Whether the lnd invoice subscription is open.",
+	}, func() float64 {
+		return float64(atomic.LoadInt32(&invoiceSubscriptionUp))
+	})
+)
+
+func init() {
+	prometheus.MustRegister(settleLagSeconds, settleLagAlerts,
+		httpRequestDuration, httpRequests, invoiceResubscriptions,
+		invoicesCreated, invoicesSettled, firestoreUpdateFailures,
+		lndRPCErrors, malformedMessages, deadLetterSettlements, deadLetterRetries, invoiceSubscriptionGauge)
+}
+
+// messageBackend returns the backend the invoice of m was paid through, for
+// the invoice metrics.
+func messageBackend(m *Message) string {
+	if backend := m.Tags[backendTag]; backend != "" {
+		return backend
+	}
+	if strings.HasPrefix(m.Invoice, keysendInvoicePrefix) {
+		return "keysend"
+	}
+	if strings.HasPrefix(m.Invoice, accessInvoicePrefix) {
+		return "access"
+	}
+	return backendName()
+}
+
+// countUpdateFailure counts err, returned updating a document of
+// collection, unless it is one of the outcomes the callers expect.
+func countUpdateFailure(collection string, err error) {
+	switch err {
+	case nil, errMessageNotFound, errAlreadySettled, errPromoUnavailable:
+		return
+	}
+	firestoreUpdateFailures.WithLabelValues(unnamespaced(collection)).Inc()
+}
+
+// countRPCError counts err, returned by the lnd RPC method.
+func countRPCError(method string, err error) {
+	if err != nil && err != io.EOF {
+		lndRPCErrors.WithLabelValues(method, status.Code(err).String()).Inc()
+	}
+}
+
+// lndUnaryInterceptor counts the errors of the unary lnd RPCs and records
+// the health of their subsystem.
+func lndUnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	countRPCError(method, err)
+	recordSubsystemCall(cc, method, err)
+	return err
+}
+
+// lndStreamInterceptor counts the errors of the streaming lnd RPCs, on
+// opening them and while receiving.
+func lndStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	recordSubsystemCall(cc, method, err)
+	if err != nil {
+		countRPCError(method, err)
+		return nil, err
+	}
+	return &countingStream{ClientStream: stream, method: method}, nil
+}
+
+type countingStream struct {
+	grpc.ClientStream
+	method string
+}
+
+func (s *countingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	countRPCError(s.method, err)
+	return err
+}
+
+// instrumentRoutes tags every request handled by the given routes with the
+// route's path expression so that metrics are reported per route rather
+// than per (unbounded) request path.
+func instrumentRoutes(routes ...*route) []*route {
+	for _, route := range routes {
+		pattern, handler := route.Pattern, route.Handler
+		route.Handler = func(w http.ResponseWriter, r *http.Request) {
+			stateOf(r).Route = pattern
+			handler(w, r)
+		}
+	}
+	return routes
+}
+
+// requestMetricsMiddleware records latency and status metrics for every
+// request, as well as the per client breakdown kept by topOrigins.
+func requestMetricsMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		elapsed := time.Since(start)
+
+		s := stateOf(r)
+		route, code := s.Route, s.Status
+		if route == "" {
+			// Preflight requests answered by the CORS middleware and
+			// requests for unknown paths never reach a route.
+			route = "unmatched"
+		}
+
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(elapsed.Seconds())
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(code)).Inc()
+		topOrigins.record(clientOf(r), code)
+		recordStatusRequest(code)
+		logDebug("Request", "route", route, "method", r.Method, "code", code, "duration", elapsed)
+	})
+}
+
+// observeSettleLag records how long it took for a settled invoice to be
+// reflected in the database and raises an alert if the lag is above the
+// configured threshold.
+func observeSettleLag(invoice *lnrpc.Invoice) {
+	// Invoices settled by older lnd versions may not carry a settle date,
+	// in which case there is nothing meaningful to measure.
+	if invoice.GetSettleDate() == 0 {
+		return
+	}
+	if time.Unix(invoice.GetSettleDate(), 0).Before(processStart) {
+		return
+	}
+
+	lag := appClock.Now().Sub(time.Unix(invoice.GetSettleDate(), 0))
+	if lag < 0 {
+		// Clock skew between us and lnd; count it as immediate.
+		lag = 0
+	}
+	settleLagSeconds.Observe(lag.Seconds())
+	recordStatusLag(lag)
+
+	if settleLagAlert > 0 && lag > settleLagAlert {
+		settleLagAlerts.Inc()
+		logWarn("Settlement lag above the alert threshold", "payment_hash", hex.EncodeToString(invoice.GetRHash()),
+			"lag", lag, "threshold", settleLagAlert)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// mirroredHeader is set on the mirrored requests so that the shadow can
+	// tell them apart.
+	mirroredHeader = "X-Chat-Mirrored"
+
+	// mirrorConcurrency bounds the mirrored requests in flight, the others
+	// being dropped rather than queued.
+	mirrorConcurrency = 16
+)
+
+var (
+	// mirrorURL is the base url of the shadow instance mirrorPercent percent
+	// of the read requests are replayed to, for canary releases.
+	mirrorURL     string
+	mirrorPercent float64
+
+	mirrorClient = &http.Client{Timeout: 10 * time.Second}
+	mirrorSlots  = make(chan struct{}, mirrorConcurrency)
+
+	mirroredRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirrored_requests_total",
+		Help:      "Number of requests replayed to the shadow by route and outcome (match, mismatch, error, dropped).",
+	}, []string{"route", "outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(mirroredRequests)
+}
+
+// mirrorMiddleware replays a sample of the GET requests to mirrorURL once
+// answered, comparing the status codes.
+func mirrorMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+
+		if r.Method != http.MethodGet || r.Header.Get("Upgrade") != "" || r.Header.Get(mirroredHeader) != "" {
+			return
+		}
+		s := stateOf(r)
+		if s.Invoice {
+			return
+		}
+		route, code := s.Route, s.Status
+		if route == "" || rand.Float64()*100 >= mirrorPercent {
+			return
+		}
+		select {
+		case mirrorSlots <- struct{}{}:
+		default:
+			mirroredRequests.WithLabelValues(route, "dropped").Inc()
+			return
+		}
+		req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(mirrorURL, "/")+r.URL.RequestURI(), nil)
+		if err != nil {
+			<-mirrorSlots
+			logWarn("Failed to mirror request", "route", route, "err", err)
+			return
+		}
+		for k, v := range r.Header {
+			req.Header[k] = v
+		}
+		req.Header.Set(mirroredHeader, "1")
+		go func() {
+			defer func() { <-mirrorSlots }()
+			mirror(route, req, code)
+		}()
+	})
+}
+
+func mirror(route string, req *http.Request, code int) {
+	res, err := mirrorClient.Do(req)
+	if err != nil {
+		mirroredRequests.WithLabelValues(route, "error").Inc()
+		logDebug("Mirrored request failed", "route", route, "err", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != code {
+		mirroredRequests.WithLabelValues(route, "mismatch").Inc()
+		logWarn("Mirrored request answered differently", "route", route, "path", req.URL.Path,
+			"code", code, "shadow_code", res.StatusCode)
+		return
+	}
+	mirroredRequests.WithLabelValues(route, "match").Inc()
+}
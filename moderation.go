@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"golang.org/x/net/context"
+)
+
+const (
+	moderationAuto   = "auto"
+	moderationManual = "manual"
+
+	// Event type of the moderated messages paid and awaiting review.
+	eventPendingReview = "pending_review"
+
+	// Event type of the messages hidden by a moderator, which the clients
+	// should drop.
+	eventMessageHidden = "message_hidden"
+
+	// moderationTag is the pseudo tag of the rollups counting the
+	// moderation decisions, by value approved or rejected.
+	moderationTag = "_moderation"
+)
+
+var (
+	// moderationMode is how the messages paid with hold invoices are
+	// reviewed, empty meaning messages aren't moderated. In auto mode the
+	// messages passing the filters are settled right away, in manual mode
+	// they wait for a moderator.
+	moderationMode string
+
+	// holdKey derives the preimages of the hold invoices from the nonces
+	// of the messages.
+	holdKey []byte
+
+	errNotPendingReview = errors.New("message isn't pending review")
+	errAnonymousAuthor  = errors.New("message has no author to ban")
+	errBannedUser       = errors.New("user is banned")
+
+	// holdWatches are the payment hashes of the hold invoices followed by
+	// watchHold.
+	holdWatches = struct {
+		sync.Mutex
+		hashes map[string]bool
+	}{hashes: make(map[string]bool)}
+)
+
+// holdResubscribeDelay is how long watchHold waits before subscribing again
+// to a hold invoice whose subscription failed.
+const holdResubscribeDelay = 5 * time.Second
+
+// moderationFilter rejects a paid message by returning an error.
+type moderationFilter func(m *Message) error
+
+var moderationFilters []moderationFilter
+
+// registerModerationFilter adds a filter run, in registration order, on the
+// moderated messages once paid.
+func registerModerationFilter(f moderationFilter) {
+	moderationFilters = append(moderationFilters, f)
+}
+
+func init() {
+	// The banned words may have changed since the invoice was requested.
+	registerModerationFilter(func(m *Message) error {
+		return rejectBannedWords(&invoiceRequest{Memo: strings.TrimSpace(m.Memo + " " + m.Reaction)})
+	})
+	registerInvoiceHook(rejectBannedUser)
+}
+
+// rejectBannedUser rejects the invoice requests of the users banned by the
+// moderators. It fails closed: while the bans can't be looked up, signed-in
+// users are answered the store is unavailable rather than let through.
+func rejectBannedUser(req *invoiceRequest) error {
+	if req.User == "" {
+		return nil
+	}
+	banned, err := store.IsBanned(context.Background(), req.User)
+	if err != nil {
+		return storeError{err}
+	}
+	if banned {
+		return errBannedUser
+	}
+	return nil
+}
+
+// holdPreimage returns the preimage of the hold invoice of a message.
+func holdPreimage(nonce string) []byte {
+	mac := hmac.New(sha256.New, holdKey)
+	mac.Write([]byte(nonce))
+	return mac.Sum(nil)
+}
+
+// addHoldInvoice adds invoice on the node as a hold invoice, which lnd only
+// settles once told so, and returns it with the nonce of its preimage.
+func addHoldInvoice(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	nonce := hex.EncodeToString(b)
+	hash := sha256.Sum256(holdPreimage(nonce))
+
+	inv, clean := getInvoicesClient()
+	defer clean()
+	res, err := inv.AddHoldInvoice(ctx, &invoicesrpc.AddHoldInvoiceRequest{
+		Memo:            invoice.GetMemo(),
+		Hash:            hash[:],
+		Value:           invoice.GetValue(),
+		ValueMsat:       invoice.GetValueMsat(),
+		DescriptionHash: invoice.GetDescriptionHash(),
+		Expiry:          invoice.GetExpiry(),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &lnrpc.AddInvoiceResponse{RHash: hash[:], PaymentRequest: res.GetPaymentRequest()}, nonce, nil
+}
+
+// watchHold follows the hold invoice of m until it is settled or cancelled,
+// queueing m for review once paid, since lnd doesn't stream the accepted
+// invoices to SubscribeInvoices. The replica creating m follows it, and the
+// leader the hold invoices left open when reconciling, at most once each.
+func watchHold(m *Message) {
+	holdWatches.Lock()
+	defer holdWatches.Unlock()
+	if holdWatches.hashes[m.RHash] {
+		return
+	}
+	holdWatches.hashes[m.RHash] = true
+	// The caller keeps using m.
+	copied := *m
+	m = &copied
+	goBackground(func(ctx context.Context) {
+		defer func() {
+			holdWatches.Lock()
+			delete(holdWatches.hashes, m.RHash)
+			holdWatches.Unlock()
+		}()
+		for {
+			err := followHold(ctx, m)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			logWarn("Lost the hold invoice subscription, resubscribing", "doc_id", m.ID, "payment_hash", m.RHash, "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(holdResubscribeDelay):
+			}
+		}
+	})
+}
+
+// followHold subscribes to the hold invoice of m, returning once it is
+// settled or cancelled.
+func followHold(ctx context.Context, m *Message) error {
+	hash, err := hex.DecodeString(m.RHash)
+	if err != nil {
+		return err
+	}
+	inv, clean := getInvoicesClient()
+	defer clean()
+	stream, err := inv.SubscribeSingleInvoice(ctx, &invoicesrpc.SubscribeSingleInvoiceRequest{RHash: hash})
+	if err != nil {
+		return err
+	}
+	for {
+		invoice, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch invoice.GetState() {
+		case lnrpc.Invoice_ACCEPTED:
+			if err := markAccepted(ctx, m, invoice); err != nil {
+				logError("Failed to queue the message for review", "doc_id", m.ID, "payment_hash", m.RHash, "err", err)
+			}
+		case lnrpc.Invoice_SETTLED, lnrpc.Invoice_CANCELED:
+			return nil
+		}
+	}
+}
+
+// markAccepted queues m, whose hold invoice was paid, for review. Messages
+// failing the filters are rejected, and in auto mode the others approved.
+// Messages already pending review, e.g. queued before a restart, go through
+// the filters and the auto approval again, the moderators and the payer
+// only being notified once.
+func markAccepted(ctx context.Context, m *Message, invoice *lnrpc.Invoice) error {
+	if m.HoldNonce == "" {
+		return nil
+	}
+	first, err := store.MarkPendingReview(ctx, m.ID)
+	if err != nil {
+		return err
+	}
+	m.PendingReview = true
+	if first {
+		logInfo("Message paid, pending review", "doc_id", m.ID, "payment_hash", hex.EncodeToString(invoice.GetRHash()))
+	}
+
+	for _, f := range moderationFilters {
+		if ferr := f(m); ferr != nil {
+			logInfo("Message rejected", "doc_id", m.ID, "reason", ferr)
+			return rejectMessage(ctx, m)
+		}
+	}
+	// Boosts have no text to review beyond their reaction.
+	if moderationMode == moderationAuto || m.BoostOf != "" {
+		return approveMessage(ctx, m)
+	}
+	if !first {
+		return nil
+	}
+
+	// The operator is told there is something to review, and the payer
+	// that the payment went through.
+	ev := event{
+		Type:        eventPendingReview,
+		Room:        m.Room,
+		PaymentHash: hex.EncodeToString(invoice.GetRHash()),
+		Data:        map[string]interface{}{"id": publicIDs.Encode(m.ID)},
+	}
+	publishEvent(ev)
+	postWebhooks(ev)
+	return nil
+}
+
+// approveMessage settles the hold invoice of m, the watcher then marking m
+// settled as for any other payment. Approving it again is a no-op.
+func approveMessage(ctx context.Context, m *Message) error {
+	inv, clean := getInvoicesClient()
+	defer clean()
+	_, err := inv.SettleInvoice(ctx, &invoicesrpc.SettleInvoiceMsg{Preimage: holdPreimage(m.HoldNonce)})
+	if err != nil && strings.Contains(err.Error(), "invoice already settled") {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	recordModeration(ctx, m, "approved")
+	return nil
+}
+
+// rejectMessage cancels the hold invoice of m, which returns the payment to
+// the payer, and expires m.
+func rejectMessage(ctx context.Context, m *Message) error {
+	hash := sha256.Sum256(holdPreimage(m.HoldNonce))
+	inv, clean := getInvoicesClient()
+	defer clean()
+	if _, err := inv.CancelInvoice(ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: hash[:]}); err != nil {
+		return err
+	}
+	recordModeration(ctx, m, "rejected")
+	if err := store.Expire(ctx, m.ID); err != nil {
+		return err
+	}
+	postSystemMessage(ctx, templateMessageHidden, m, templateData{})
+	return nil
+}
+
+// recordModeration adds a moderation decision to the daily rollups.
+func recordModeration(ctx context.Context, m *Message, decision string) {
+	if !firestoreEnabled() {
+		return
+	}
+	day := appClock.Now().UTC().Format(dayFormat)
+	if err := incrementRollup(ctx, day, moderationTag, decision, m.Amount*1000); err != nil {
+		logError("Failed to update rollup", "tag", moderationTag, "day", day, "err", err)
+	}
+}
+
+// getReviewQueue lists the paid messages awaiting a moderator.
+func getReviewQueue(w http.ResponseWriter, r *http.Request) {
+	list, err := store.ListPendingReview(r.Context())
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	list = filterLanguage(list, r.URL.Query().Get("language"))
+	list = filterRoom(list, r.URL.Query().Get("room"))
+	for _, m := range list {
+		m.ID = publicIDs.Encode(m.ID)
+		signAttachments(m)
+	}
+	writeJSON(w, map[string]interface{}{"messages": list})
+}
+
+// postReview approves or rejects a message pending review, depending on the
+// :decision of the route.
+func postReview(w http.ResponseWriter, r *http.Request) {
+	decide := approveMessage
+	switch pathParam(r, "decision") {
+	case "approve":
+	case "reject":
+		decide = rejectMessage
+	default:
+		writeError(w, http.StatusNotFound, "unknown decision")
+		return
+	}
+
+	id, err := publicIDs.Decode(pathParam(r, "id"))
+	if err == nil {
+		var m *Message
+		m, err = store.GetMessage(r.Context(), id)
+		if err == nil && !m.PendingReview {
+			err = errNotPendingReview
+		}
+		if err == nil {
+			err = decide(r.Context(), m)
+		}
+	}
+	switch err {
+	case nil:
+		writeJSON(w, map[string]string{"status": "OK"})
+	case errInvalidID:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errMessageNotFound:
+		writeErrorCode(w, http.StatusNotFound, codeUnknownMessage, err.Error(), nil)
+	case errNotPendingReview:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, err.Error())
+	}
+}
+
+// postModerate hides, flags or bans the author of a message, depending on
+// the :action of the route. The optional body gives the reason of a flag or
+// a ban. Banning an author also hides the message.
+func postModerate(w http.ResponseWriter, r *http.Request) {
+	action := pathParam(r, "action")
+	switch action {
+	case "hide", "flag", "ban":
+	default:
+		writeError(w, http.StatusNotFound, "unknown action")
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := decodeJSON(r, &body); err != nil && err != errEmptyPayload {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id, err := publicIDs.Decode(pathParam(r, "id"))
+	if err == nil {
+		var m *Message
+		m, err = store.GetMessage(r.Context(), id)
+		if err == nil {
+			switch action {
+			case "hide":
+				err = hideMessage(r.Context(), m)
+			case "flag":
+				err = store.Flag(r.Context(), m.ID, body.Reason)
+			case "ban":
+				err = banAuthor(r.Context(), m, body.Reason)
+			}
+		}
+	}
+	switch err {
+	case nil:
+		logInfo("Moderated message", "doc_id", id, "action", action)
+		writeJSON(w, map[string]string{"status": "OK"})
+	case errInvalidID:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errMessageNotFound:
+		writeErrorCode(w, http.StatusNotFound, codeUnknownMessage, err.Error(), nil)
+	case errAnonymousAuthor:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, err.Error())
+	}
+}
+
+// hideMessage hides m from the listings and tells its room, once.
+func hideMessage(ctx context.Context, m *Message) error {
+	hidden, err := store.Hide(ctx, m.ID)
+	if err != nil || !hidden {
+		return err
+	}
+	unindexMessage(m.ID)
+	ev := event{
+		Type: eventMessageHidden,
+		Room: m.Room,
+		Data: map[string]interface{}{"id": publicIDs.Encode(m.ID)},
+	}
+	publishEvent(ev)
+	postWebhooks(ev)
+	postSystemMessage(ctx, templateMessageHidden, m, templateData{})
+	return nil
+}
+
+// banAuthor bans the author of m from posting and hides m.
+func banAuthor(ctx context.Context, m *Message, reason string) error {
+	if m.UID == "" {
+		return errAnonymousAuthor
+	}
+	if err := store.Ban(ctx, m.UID, reason); err != nil {
+		return err
+	}
+	return hideMessage(ctx, m)
+}
+
+// getFlagged lists the messages flagged by the moderators.
+func getFlagged(w http.ResponseWriter, r *http.Request) {
+	list, err := store.ListFlagged(r.Context())
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	list = filterRoom(list, r.URL.Query().Get("room"))
+	for _, m := range list {
+		m.ID = publicIDs.Encode(m.ID)
+		signAttachments(m)
+	}
+	writeJSON(w, map[string]interface{}{"messages": list})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// networkTag is the tag naming the bitcoin network, e.g. testnet, the
+	// invoice of a message was created on.
+	networkTag = "network"
+
+	mainnet = "mainnet"
+)
+
+var (
+	// bitcoinNetwork is the network of -network. The messages of the other
+	// networks than mainnet are kept in their own Firestore collection, e.g.
+	// messages-testnet.
+	bitcoinNetwork string
+
+	// lndNetwork is the network of the node, from GetInfo, the messages are
+	// tagged with.
+	lndNetwork string
+)
+
+// networkCollection returns the name of the collection for -network.
+func networkCollection(name string) string {
+	if bitcoinNetwork == "" || bitcoinNetwork == mainnet {
+		return name
+	}
+	return name + "-" + bitcoinNetwork
+}
+
+// detectNetwork asks the node which network it runs on, failing when it
+// isn't the -network one. It falls back to -network when the node doesn't
+// answer.
+func detectNetwork(ctx context.Context) error {
+	info, err := lightning.GetInfo(ctx)
+	if err != nil {
+		logWarn("Failed to get the network of the node", "network", bitcoinNetwork, "err", err)
+		lndNetwork = bitcoinNetwork
+		return nil
+	}
+	if chains := info.GetChains(); len(chains) > 0 {
+		lndNetwork = chains[0].GetNetwork()
+	}
+	if bitcoinNetwork != "" && lndNetwork != bitcoinNetwork {
+		return fmt.Errorf("-network is %v but the node runs on %v", bitcoinNetwork, lndNetwork)
+	}
+	return nil
+}
+
+// foreignNetwork reports whether m was created on another network than the
+// node's, its invoice not to be looked up. Untagged messages aren't.
+func foreignNetwork(m *Message) bool {
+	tag := m.Tags[networkTag]
+	return tag != "" && lndNetwork != "" && tag != lndNetwork
+}
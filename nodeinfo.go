@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+)
+
+var (
+	// nodeInfoTTL is how long the GetInfo of the node is served from memory
+	// before being refreshed, 0 disabling the cache.
+	nodeInfoTTL = defaultNodeInfoTTL
+
+	defaultNodeInfoTTL = 30 * time.Second
+)
+
+// nodeInfoTimeout bounds the GetInfo refreshing the cache in the background.
+const nodeInfoTimeout = 10 * time.Second
+
+var nodeInfoCache struct {
+	sync.Mutex
+	info       *lnrpc.GetInfoResponse
+	at         time.Time
+	refreshing bool
+
+	// fetch serializes the GetInfo of the callers finding the cache
+	// empty, so that a burst of them issues a single one.
+	fetch sync.Mutex
+}
+
+// nodeInfo returns the GetInfo of the primary node, from memory while
+// fresher than nodeInfoTTL. Once older, it is still served while a single
+// GetInfo refreshes it in the background; only the first callers wait for
+// the node. Health checks, which must reach the node, call GetInfo instead.
+func nodeInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error) {
+	if nodeInfoTTL <= 0 {
+		return lightning.GetInfo(ctx)
+	}
+	c := &nodeInfoCache
+	c.Lock()
+	info := c.info
+	if info != nil && time.Since(c.at) >= nodeInfoTTL && !c.refreshing {
+		c.refreshing = true
+		go refreshNodeInfo()
+	}
+	c.Unlock()
+	if info != nil {
+		return info, nil
+	}
+
+	c.fetch.Lock()
+	defer c.fetch.Unlock()
+	c.Lock()
+	info = c.info
+	c.Unlock()
+	if info != nil {
+		return info, nil
+	}
+	return fetchNodeInfo(ctx)
+}
+
+// fetchNodeInfo calls GetInfo and caches its answer.
+func fetchNodeInfo(ctx context.Context) (*lnrpc.GetInfoResponse, error) {
+	info, err := lightning.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &nodeInfoCache
+	c.Lock()
+	c.info, c.at = info, time.Now()
+	c.Unlock()
+	return info, nil
+}
+
+// refreshNodeInfo refreshes the cached GetInfo, the stale one being kept if
+// the node doesn't answer.
+func refreshNodeInfo() {
+	ctx, cancel := context.WithTimeout(context.Background(), nodeInfoTimeout)
+	defer cancel()
+	if _, err := fetchNodeInfo(ctx); err != nil {
+		logWarn("Failed to refresh the node info", "err", err)
+	}
+	nodeInfoCache.Lock()
+	nodeInfoCache.refreshing = false
+	nodeInfoCache.Unlock()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// nodeTag is the tag of the messages whose invoice was created on a
+// secondary node, naming it.
+const nodeTag = "node"
+
+// lndNodes are the secondary lnd nodes loaded with -nodes, in order of
+// preference, the invoices failing over to them while the -rpcServer one,
+// the primary, is unreachable.
+var lndNodes []*lndNode
+
+// lndNode is a secondary node of the nodes file.
+type lndNode struct {
+	Name      string `json:"name"`
+	RPCServer string `json:"rpc_server"`
+	TLSCert   string `json:"tls_cert"`
+	Macaroon  string `json:"macaroon"`
+
+	conn *grpc.ClientConn
+
+	// subscriptionUp is 1 while the invoice subscription of the node is
+	// open.
+	subscriptionUp int32
+}
+
+func (n *lndNode) lightning() lnrpc.LightningClient {
+	return lnrpc.NewLightningClient(n.conn)
+}
+
+// loadNodes reads a JSON list of lndNode from path and dials them.
+func loadNodes(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var nodes []*lndNode
+	if err := json.Unmarshal(b, &nodes); err != nil {
+		return fmt.Errorf("invalid nodes %v: %v", path, err)
+	}
+	names := make(map[string]bool)
+	for i, n := range nodes {
+		if n.Name == "" || names[n.Name] {
+			return fmt.Errorf("node %d: missing or duplicate name", i)
+		}
+		names[n.Name] = true
+		if n.RPCServer == "" || n.TLSCert == "" || n.Macaroon == "" {
+			return fmt.Errorf("node %v: needs rpc_server, tls_cert and macaroon", n.Name)
+		}
+		if n.conn, err = dialNode(n.RPCServer, n.TLSCert, n.Macaroon); err != nil {
+			return fmt.Errorf("node %v: %v", n.Name, err)
+		}
+	}
+	lndNodes = nodes
+	return nil
+}
+
+func findNode(name string) *lndNode {
+	for _, n := range lndNodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// messageNode returns the secondary node the invoice of m was created on,
+// nil for the primary.
+func messageNode(m *Message) *lndNode {
+	if name := m.Tags[nodeTag]; name != "" {
+		return findNode(name)
+	}
+	return nil
+}
+
+// messageLightning returns the backend of the node the invoice of m was
+// created on.
+func messageLightning(m *Message) LightningBackend {
+	if n := messageNode(m); n != nil {
+		return lndBackend{n.lightning()}
+	}
+	return lightning
+}
+
+// messageInvoicesClient returns a client of the invoices RPCs of the lnd
+// node the invoice of m was created on.
+func messageInvoicesClient(m *Message) invoicesrpc.InvoicesClient {
+	if n := messageNode(m); n != nil {
+		return invoicesrpc.NewInvoicesClient(n.conn)
+	}
+	c, _ := getInvoicesClient()
+	return c
+}
+
+// unreachable reports whether err tells lnd couldn't be reached, rather than
+// it rejected the call.
+func unreachable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// addInvoiceFailover adds invoice on the primary node or, while it is
+// unreachable, on the first secondary node accepting it, whose name it
+// returns.
+func addInvoiceFailover(ctx context.Context, invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, string, error) {
+	res, err := lightning.AddInvoice(ctx, invoice)
+	if err == nil || !unreachable(err) {
+		return res, "", err
+	}
+	for _, n := range lndNodes {
+		logWarn("Failing the invoice over to a secondary node", "node", n.Name, "err", err)
+		res, nerr := n.lightning().AddInvoice(ctx, invoice)
+		if nerr == nil {
+			return res, n.Name, nil
+		}
+		logWarn("Secondary node failed to add the invoice", "node", n.Name, "err", nerr)
+	}
+	return nil, "", err
+}
+
+// subscriptionsUp reports whether an invoice subscription, of the primary
+// or of a secondary node, is open.
+func subscriptionsUp() bool {
+	if atomic.LoadInt32(&invoiceSubscriptionUp) == 1 {
+		return true
+	}
+	for _, n := range lndNodes {
+		if atomic.LoadInt32(&n.subscriptionUp) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// watchNodes watches the invoices of every secondary node like
+// watchInvoices does those of the primary.
+func watchNodes() {
+	for _, n := range lndNodes {
+		n := n
+		goBackground(func(ctx context.Context) {
+			watchNodeInvoices(ctx, n, lnrpc.InvoiceSubscription{})
+		})
+	}
+}
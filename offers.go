@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	accessCollection = "access"
+
+	// bolt12InvoicePrefix prefixes the invoices paying an offer, which have
+	// no message of their own until paid.
+	bolt12InvoicePrefix = "lni1"
+
+	// accessInvoicePrefix prefixes the key standing in for the payment
+	// request of the messages posted with chat access, which are not paid
+	// one by one.
+	accessInvoicePrefix = "access:"
+
+	// The labels of the offers tell what their payments are for.
+	roomOfferPrefix   = "chat-room:"
+	accessOfferPrefix = "chat-access:"
+)
+
+var (
+	// accessPrice is the price of a period of chat access, in satoshis, 0
+	// disabling access offers, and accessPeriod the period of
+	// -accessPeriod.
+	accessPrice  int64
+	accessPeriod = "month"
+
+	// offers caches the offers created, by label and amount.
+	offersMu sync.Mutex
+	offers   = make(map[string]string)
+
+	errNoOffers = errors.New("BOLT12 offers need -backend=cln")
+)
+
+// offerBackend is implemented by the LightningBackends supporting BOLT12
+// offers.
+type offerBackend interface {
+	// Offer returns the offer of label, creating it unless it exists, for
+	// amountMsat and recurring every period of recurrence, e.g. 1month,
+	// unless empty.
+	Offer(ctx context.Context, label, description string, amountMsat int64, recurrence string) (string, error)
+
+	// OfferPayment returns the label of the offer the invoice of the hex
+	// payment hash paid, and the note of its payer.
+	OfferPayment(ctx context.Context, hash string) (label, payerNote string, err error)
+}
+
+// accessPeriods are the values of -accessPeriod.
+var accessPeriods = map[string]bool{"day": true, "week": true, "month": true, "year": true}
+
+// addPeriod returns t one access period later.
+func addPeriod(t time.Time) time.Time {
+	switch accessPeriod {
+	case "day":
+		return t.AddDate(0, 0, 1)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	case "year":
+		return t.AddDate(1, 0, 0)
+	}
+	return t.AddDate(0, 1, 0)
+}
+
+// cachedOffer returns the offer of label and amountMsat from b, created once.
+func cachedOffer(ctx context.Context, b offerBackend, label, description string, amountMsat int64, recurrence string) (string, error) {
+	key := fmt.Sprintf("%v/%d", label, amountMsat)
+	offersMu.Lock()
+	offer, ok := offers[key]
+	offersMu.Unlock()
+	if ok {
+		return offer, nil
+	}
+	offer, err := b.Offer(ctx, label, description, amountMsat, recurrence)
+	if err != nil {
+		return "", err
+	}
+	offersMu.Lock()
+	offers[key] = offer
+	offersMu.Unlock()
+	return offer, nil
+}
+
+// getRoomOffer returns the offer whose payments post their payer note as a
+// message to the room, at the price of a message.
+func getRoomOffer(w http.ResponseWriter, r *http.Request) {
+	b, ok := lightning.(offerBackend)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errNoOffers.Error())
+		return
+	}
+	room := pathParam(r, "room")
+	if room == defaultRoom {
+		room = ""
+	}
+	if strings.HasPrefix(room, dmRoomPrefix) || !roomOpen(room) {
+		writeError(w, http.StatusNotFound, "unknown room")
+		return
+	}
+	name := room
+	if name == "" {
+		name = defaultRoom
+	}
+	price := currentSettings().Price
+	offer, err := cachedOffer(r.Context(), b, roomOfferPrefix+room, "Message to "+name, price*1000, "")
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, map[string]interface{}{"offer": offer, "room": name, "amount": price})
+}
+
+// accessRef returns the reference of the access offer of user, which its
+// description carries so that each user gets an offer of its own.
+func accessRef(user string) string {
+	h := sha256.Sum256([]byte(user))
+	return hex.EncodeToString(h[:6])
+}
+
+// getAccessOffer returns the recurring offer of the user, each payment of
+// which grants it an access period during which its messages are free.
+func getAccessOffer(w http.ResponseWriter, r *http.Request) {
+	b, ok := lightning.(offerBackend)
+	if !ok || accessPrice == 0 {
+		writeError(w, http.StatusNotImplemented, "chat access needs -backend=cln and -accessPrice")
+		return
+	}
+	user := stateOf(r).User
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	description := fmt.Sprintf("Chat access, 1 %v (%v)", accessPeriod, accessRef(user))
+	offer, err := cachedOffer(r.Context(), b, accessOfferPrefix+user, description, accessPrice*1000, "1"+accessPeriod)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	until, err := accessUntil(r.Context(), user)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	j := map[string]interface{}{"offer": offer, "amount": accessPrice, "period": accessPeriod}
+	if !until.IsZero() {
+		j["access_until"] = until
+	}
+	writeJSON(w, j)
+}
+
+// chatAccess is the document of accessCollection of a user, by uid.
+type chatAccess struct {
+	PaidUntil time.Time `firestore:"paid_until"`
+	Periods   int64     `firestore:"periods"`
+}
+
+// accessUntil returns when the chat access of user ends, zero if it never
+// paid for any.
+func accessUntil(ctx context.Context, user string) (time.Time, error) {
+	s, err := collection(accessCollection).Doc(user).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	var a chatAccess
+	if err := s.DataTo(&a); err != nil {
+		return time.Time{}, err
+	}
+	return a.PaidUntil, nil
+}
+
+// hasAccess reports whether user has chat access, failing open to paying
+// for the message when it can't be told.
+func hasAccess(ctx context.Context, user string) bool {
+	if user == "" || accessPrice == 0 || !firestoreEnabled() {
+		return false
+	}
+	until, err := accessUntil(ctx, user)
+	if err != nil {
+		logWarn("Failed to get the chat access", "uid", user, "err", err)
+		return false
+	}
+	return appClock.Now().Before(until)
+}
+
+// grantAccess extends the chat access of user by a period for the payment
+// of hash, once.
+func grantAccess(ctx context.Context, user, hash string) (time.Time, error) {
+	if err := waitForWrite(ctx, accessCollection); err != nil {
+		return time.Time{}, err
+	}
+	ref := collection(accessCollection).Doc(user)
+	payment := ref.Collection("payments").Doc(hash)
+	var until time.Time
+	err := firebaseDb.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var a chatAccess
+		s, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			if err := s.DataTo(&a); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Get(payment); err == nil {
+			until = a.PaidUntil
+			return nil
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		now := appClock.Now()
+		from := a.PaidUntil
+		if from.Before(now) {
+			from = now
+		}
+		a.PaidUntil = addPeriod(from)
+		a.Periods++
+		until = a.PaidUntil
+		if err := tx.Create(payment, map[string]interface{}{"paid_at": now}); err != nil {
+			return err
+		}
+		return tx.Set(ref, a)
+	})
+	return until, err
+}
+
+// handleOfferPayment maps the settled invoice of an offer to what it paid
+// for: a message to a room or a period of chat access.
+func handleOfferPayment(ctx context.Context, invoice *lnrpc.Invoice) error {
+	b, ok := lightning.(offerBackend)
+	if !ok {
+		return errNoOffers
+	}
+	hash := hex.EncodeToString(invoice.GetRHash())
+	label, note, err := b.OfferPayment(ctx, hash)
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(label, accessOfferPrefix):
+		user := strings.TrimPrefix(label, accessOfferPrefix)
+		if !firestoreEnabled() {
+			return fmt.Errorf("chat access needs -firebaseCreds")
+		}
+		until, err := grantAccess(ctx, user, hash)
+		if err != nil {
+			return err
+		}
+		logInfo("Chat access paid", "uid", user, "payment_hash", hash, "access_until", until)
+		return nil
+	case strings.HasPrefix(label, roomOfferPrefix):
+		if _, err := store.FindByInvoice(ctx, invoice.GetPaymentRequest()); err != errMessageNotFound {
+			return err
+		}
+		m := &Message{
+			Invoice:    invoice.GetPaymentRequest(),
+			RHash:      hash,
+			Memo:       note,
+			Room:       strings.TrimPrefix(label, roomOfferPrefix),
+			Amount:     invoice.GetAmtPaidMsat() / 1000,
+			AmountMsat: invoice.GetAmtPaidMsat(),
+			CreatedAt:  appClock.Now(),
+		}
+		if lndNetwork != "" {
+			m.Tags = map[string]string{networkTag: lndNetwork}
+		}
+		tagLanguage(m)
+		if err := store.CreateMessage(ctx, m); err != nil {
+			return err
+		}
+		return markSettled(ctx, m, invoice)
+	}
+	quarantineSettlement(ctx, invoice)
+	return nil
+}
+
+// postWithAccess answers postMessage for a user with chat access, the
+// invoice hooks still vetting the message.
+func postWithAccess(w http.ResponseWriter, r *http.Request, user string, m *messageRequest) {
+	req, err := newInvoiceRequest(r, m.Memo, 0)
+	if err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	msg := replyTo(&Message{Memo: m.Memo, Room: m.Room, Tags: req.Tags, Attachments: m.Attachments}, m.parent)
+	if err := postAccessMessage(r.Context(), user, msg); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	j := map[string]interface{}{
+		"id":      publicIDs.Encode(msg.ID),
+		"amount":  0,
+		"settled": true,
+	}
+	if msg.Room != "" {
+		j["room"] = msg.Room
+	}
+	writeJSON(w, j)
+}
+
+// postAccessMessage posts m, written by a user with chat access, settled
+// without an invoice.
+func postAccessMessage(ctx context.Context, user string, m *Message) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	m.Invoice = accessInvoicePrefix + hex.EncodeToString(nonce)
+	m.UID = user
+	m.CreatedAt = appClock.Now()
+	tagLanguage(m)
+	if err := store.CreateMessage(ctx, m); err != nil {
+		return err
+	}
+	return markSettled(ctx, m, &lnrpc.Invoice{})
+}
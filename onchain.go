@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var (
+	// onchainMinSats is the price from which messages can also be paid to
+	// a fresh on-chain address of the lnd wallet, 0 disabling it, and
+	// onchainConfirmations the confirmations settling them.
+	onchainMinSats       int64
+	onchainConfirmations = defaultOnchainConfirmations
+
+	defaultOnchainConfirmations = 1
+)
+
+const (
+	// onchainPollInterval is how often the transactions of the wallet are
+	// checked for payments of the messages.
+	onchainPollInterval = time.Minute
+
+	// onchainLookback is how many blocks before the tip the watcher looks
+	// back at startup, for the payments confirmed while it was down.
+	onchainLookback = 144
+)
+
+var onchainSettlements = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "onchain_payments_total",
+	Help:      "Number of on-chain payments to the fallback addresses of the messages, by outcome: settled or underpaid.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(onchainSettlements)
+}
+
+// wantsOnchainFallback reports whether m, whose invoice was created on
+// backend, gets an on-chain fallback address. The hold invoices of
+// moderation and the invoices of the fallback wallet don't, as the payments
+// to lnd addresses can't be held nor made to LNbits.
+func wantsOnchainFallback(m *Message, backend string) bool {
+	return onchainMinSats > 0 && m.Amount >= onchainMinSats && backend == "" && moderationMode == "" && checkLnd() == nil
+}
+
+// newOnchainAddress returns a fresh address of the wallet of lnd.
+func newOnchainAddress(ctx context.Context) (string, error) {
+	c, clean := getClient()
+	defer clean()
+	res, err := c.NewAddress(ctx, &lnrpc.NewAddressRequest{Type: lnrpc.AddressType_WITNESS_PUBKEY_HASH})
+	if err != nil {
+		return "", err
+	}
+	return res.GetAddress(), nil
+}
+
+// bip21URI returns the unified bitcoin: URI paying m either on-chain or with
+// its invoice, which wallets supporting neither fall back from.
+func bip21URI(m *Message) string {
+	q := url.Values{}
+	q.Set("amount", formatBTC(m.Amount))
+	q.Set("lightning", strings.ToUpper(m.Invoice))
+	return "bitcoin:" + m.OnchainAddress + "?" + q.Encode()
+}
+
+// formatBTC formats an amount of sats in bitcoin, without trailing zeros.
+func formatBTC(sats int64) string {
+	s := strings.TrimRight(fmt.Sprintf("%d.%08d", sats/1e8, sats%1e8), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// watchOnchain settles the messages paid to their on-chain fallback address
+// once the payment has onchainConfirmations, polling the transactions of the
+// wallet until ctx is done.
+func watchOnchain(ctx context.Context) {
+	w := &onchainWatcher{handled: map[string]int32{}}
+	for {
+		if err := w.poll(ctx); err != nil && ctx.Err() == nil {
+			logWarn("Failed to check the on-chain payments", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(onchainPollInterval):
+		}
+	}
+}
+
+// onchainWatcher is the state of watchOnchain: the height its polls start
+// from and the heights of the transactions handled since.
+type onchainWatcher struct {
+	height  int32
+	handled map[string]int32
+}
+
+func (w *onchainWatcher) poll(ctx context.Context) error {
+	c, clean := getClient()
+	defer clean()
+	if w.height == 0 {
+		info, err := c.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+		if err != nil {
+			return err
+		}
+		w.height = int32(info.GetBlockHeight()) - onchainLookback
+		if w.height < 1 {
+			w.height = 1
+		}
+	}
+	res, err := c.GetTransactions(ctx, &lnrpc.GetTransactionsRequest{StartHeight: w.height, EndHeight: -1})
+	if err != nil {
+		return err
+	}
+	// The next poll starts from the lowest block of the payments left
+	// unsettled, else from the highest block seen, the unconfirmed
+	// transactions being listed anyway.
+	var lowest, highest int32
+	for _, tx := range res.GetTransactions() {
+		h := tx.GetBlockHeight()
+		if h > highest {
+			highest = h
+		}
+		if tx.GetAmount() <= 0 || w.handled[tx.GetTxHash()] != 0 {
+			continue
+		}
+		settled := int(tx.GetNumConfirmations()) >= onchainConfirmations
+		if settled {
+			if err := settleOnchain(ctx, tx); err != nil {
+				logError("Failed to settle the on-chain payment", "tx_hash", tx.GetTxHash(), "err", err)
+				settled = false
+			}
+		}
+		if settled {
+			w.handled[tx.GetTxHash()] = h
+		} else if h > 0 && (lowest == 0 || h < lowest) {
+			lowest = h
+		}
+	}
+	switch {
+	case lowest != 0:
+		w.height = lowest
+	case highest > w.height:
+		w.height = highest
+	}
+	for hash, h := range w.handled {
+		if h < w.height {
+			delete(w.handled, hash)
+		}
+	}
+	return nil
+}
+
+// settleOnchain marks settled the message whose fallback address tx pays,
+// if any, and cancels its invoice so that it isn't paid twice. Payments
+// below the price of the message are logged and left to the operators.
+func settleOnchain(ctx context.Context, tx *lnrpc.Transaction) error {
+	for _, addr := range tx.GetDestAddresses() {
+		m, err := store.FindByOnchainAddress(ctx, addr)
+		if err == errMessageNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if m.Settled {
+			return nil
+		}
+		invoice := &lnrpc.Invoice{
+			PaymentRequest: m.Invoice,
+			AmtPaidMsat:    tx.GetAmount() * 1000,
+			SettleDate:     tx.GetTimeStamp(),
+		}
+		invoice.RHash, _ = hex.DecodeString(m.RHash)
+		audit(auditSettleReceived, m, invoice, "onchain "+tx.GetTxHash())
+		if tx.GetAmount() < m.Amount {
+			onchainSettlements.WithLabelValues("underpaid").Inc()
+			logWarn("Underpaid on-chain payment", "doc_id", m.ID, "tx_hash", tx.GetTxHash(), "amount", tx.GetAmount(), "price", m.Amount)
+			return nil
+		}
+		if err := markSettled(ctx, m, invoice); err != nil {
+			return err
+		}
+		onchainSettlements.WithLabelValues("settled").Inc()
+		logInfo("Message paid on-chain", "doc_id", m.ID, "tx_hash", tx.GetTxHash(), "address", addr)
+		if len(invoice.RHash) > 0 {
+			_, err := messageInvoicesClient(m).CancelInvoice(ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: invoice.RHash})
+			if err != nil {
+				logWarn("Failed to cancel the invoice of a message paid on-chain", "doc_id", m.ID, "err", err)
+			}
+		}
+		return nil
+	}
+	return nil
+}
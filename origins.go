@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxTrackedOrigins bounds the memory used by the origin report. Any
+	// client showing up once the limit is reached is folded into
+	// otherOrigin.
+	maxTrackedOrigins = 1000
+
+	directOrigin = "direct"
+	otherOrigin  = "other"
+)
+
+// topOrigins keeps per client request and error counts for the top-talker
+// report.
+var topOrigins = newOriginStats()
+
+// originCount is a single row of the top-talker report.
+type originCount struct {
+	Origin   string `json:"origin"`
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+}
+
+type originStats struct {
+	mu     sync.Mutex
+	counts map[string]*originCount
+}
+
+func newOriginStats() *originStats {
+	return &originStats{counts: make(map[string]*originCount)}
+}
+
+// clientOf returns a coarse identifier for the client that made the request.
+// To respect the privacy of users we never look at remote addresses: browser
+// frontends are identified by the host of their Origin (or Referer) header,
+// and everything else by the product name of its User-Agent, which is
+// enough to tell bots and scripts apart.
+func clientOf(r *http.Request) string {
+	for _, header := range []string{"Origin", "Referer"} {
+		if u, err := url.Parse(r.Header.Get(header)); err == nil && u.Host != "" {
+			return strings.ToLower(u.Host)
+		}
+	}
+
+	agent := r.Header.Get("User-Agent")
+	if agent == "" {
+		return directOrigin
+	}
+	product := strings.SplitN(agent, "/", 2)[0]
+	if fields := strings.Fields(product); len(fields) > 0 {
+		product = fields[0]
+	}
+	if len(product) > 64 {
+		product = product[:64]
+	}
+	return "ua:" + product
+}
+
+// record accounts a request from origin that completed with the given
+// status code.
+func (s *originStats) record(origin string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.counts[origin]
+	if !ok {
+		if len(s.counts) >= maxTrackedOrigins {
+			origin = otherOrigin
+		}
+		if c, ok = s.counts[origin]; !ok {
+			c = &originCount{Origin: origin}
+			s.counts[origin] = c
+		}
+	}
+	c.Requests++
+	if code >= 400 {
+		c.Errors++
+	}
+}
+
+// top returns at most n origins ordered by request count.
+func (s *originStats) top(n int) []originCount {
+	s.mu.Lock()
+	res := make([]originCount, 0, len(s.counts))
+	for _, c := range s.counts {
+		res = append(res, *c)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Requests == res[j].Requests {
+			return res[i].Origin < res[j].Origin
+		}
+		return res[i].Requests > res[j].Requests
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
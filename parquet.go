@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A minimal Parquet writer, enough for DuckDB and the other readers to load
+// the analytics exports: one row group of required columns, each a single
+// uncompressed, plain encoded data page. The metadata is Thrift compact
+// encoded, see https://github.com/apache/parquet-format.
+
+const parquetMagic = "PAR1"
+
+// Parquet physical and converted types.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+)
+
+// parquetColumn is a column of a Parquet file, holding the values of its
+// type.
+type parquetColumn struct {
+	name      string
+	kind      int32
+	converted int32 // -1 for none
+
+	int64s  []int64
+	strings []string
+	bools   []bool
+}
+
+func int64Column(name string, values []int64) *parquetColumn {
+	return &parquetColumn{name: name, kind: parquetInt64, converted: -1, int64s: values}
+}
+
+func stringColumn(name string, values []string) *parquetColumn {
+	return &parquetColumn{name: name, kind: parquetByteArray, converted: parquetUTF8, strings: values}
+}
+
+func boolColumn(name string, values []bool) *parquetColumn {
+	return &parquetColumn{name: name, kind: parquetBoolean, converted: -1, bools: values}
+}
+
+func timestampColumn(name string, values []time.Time) *parquetColumn {
+	millis := make([]int64, len(values))
+	for i, t := range values {
+		millis[i] = t.UnixNano() / int64(time.Millisecond)
+	}
+	return &parquetColumn{name: name, kind: parquetInt64, converted: parquetTimestampMillis, int64s: millis}
+}
+
+func (c *parquetColumn) len() int {
+	switch c.kind {
+	case parquetInt64:
+		return len(c.int64s)
+	case parquetByteArray:
+		return len(c.strings)
+	default:
+		return len(c.bools)
+	}
+}
+
+// plain returns the values of c, plain encoded.
+func (c *parquetColumn) plain() []byte {
+	var b bytes.Buffer
+	switch c.kind {
+	case parquetInt64:
+		for _, v := range c.int64s {
+			binary.Write(&b, binary.LittleEndian, v)
+		}
+	case parquetByteArray:
+		for _, v := range c.strings {
+			binary.Write(&b, binary.LittleEndian, uint32(len(v)))
+			b.WriteString(v)
+		}
+	default:
+		packed := make([]byte, (len(c.bools)+7)/8)
+		for i, v := range c.bools {
+			if v {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		b.Write(packed)
+	}
+	return b.Bytes()
+}
+
+// writeParquet writes the columns, of the same length, as a Parquet file.
+func writeParquet(w io.Writer, columns []*parquetColumn) error {
+	rows := 0
+	if len(columns) > 0 {
+		rows = columns[0].len()
+	}
+	for _, c := range columns {
+		if c.len() != rows {
+			return fmt.Errorf("parquet column %v has %d values, want %d", c.name, c.len(), rows)
+		}
+	}
+
+	var file bytes.Buffer
+	file.WriteString(parquetMagic)
+	type chunk struct {
+		offset, size int64
+	}
+	chunks := make([]chunk, len(columns))
+	for i, c := range columns {
+		data := c.plain()
+		var header thriftWriter
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(data)))
+		header.i32(3, int32(len(data)))
+		header.structBegin(5)
+		header.i32(1, int32(rows))
+		header.i32(2, 0) // PLAIN
+		header.i32(3, 3) // RLE, no levels being written for required columns
+		header.i32(4, 3)
+		header.structEnd()
+		header.stop()
+
+		chunks[i] = chunk{offset: int64(file.Len()), size: int64(header.buf.Len() + len(data))}
+		file.Write(header.buf.Bytes())
+		file.Write(data)
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.listBegin(2, thriftStruct, len(columns)+1)
+	meta.elemBegin()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.elemEnd()
+	for _, c := range columns {
+		meta.elemBegin()
+		meta.i32(1, c.kind)
+		meta.i32(3, 0) // REQUIRED
+		meta.binary(4, c.name)
+		if c.converted >= 0 {
+			meta.i32(6, c.converted)
+		}
+		meta.elemEnd()
+	}
+	meta.i64(3, int64(rows))
+	meta.listBegin(4, thriftStruct, 1)
+	meta.elemBegin()
+	meta.listBegin(1, thriftStruct, len(columns))
+	var total int64
+	for i, c := range columns {
+		total += chunks[i].size
+		meta.elemBegin()
+		meta.i64(2, chunks[i].offset)
+		meta.structBegin(3)
+		meta.i32(1, c.kind)
+		meta.listBegin(2, thriftI32, 1)
+		meta.varint(0) // PLAIN
+		meta.listBegin(3, thriftBinary, 1)
+		meta.rawBinary(c.name)
+		meta.i32(4, 0) // UNCOMPRESSED
+		meta.i64(5, int64(rows))
+		meta.i64(6, chunks[i].size)
+		meta.i64(7, chunks[i].size)
+		meta.i64(9, chunks[i].offset)
+		meta.structEnd()
+		meta.elemEnd()
+	}
+	meta.i64(2, total)
+	meta.i64(3, int64(rows))
+	meta.elemEnd()
+	meta.binary(6, "chat-backend")
+	meta.stop()
+
+	file.Write(meta.buf.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(meta.buf.Len()))
+	file.WriteString(parquetMagic)
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter writes a Thrift struct in the compact protocol, tracking the
+// last field id of each nested struct for the field id deltas.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16
+	id   int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	if delta := id - t.id; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.buf.WriteByte(kind)
+		t.zigzag(int64(id))
+	}
+	t.id = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binary(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.rawBinary(v)
+}
+
+func (t *thriftWriter) rawBinary(v string) {
+	t.varint(uint64(len(v)))
+	t.buf.WriteString(v)
+}
+
+func (t *thriftWriter) listBegin(id int16, elem byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elem)
+		return
+	}
+	t.buf.WriteByte(0xf0 | elem)
+	t.varint(uint64(size))
+}
+
+// structBegin starts the struct field id, ended by structEnd.
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.elemBegin()
+}
+
+func (t *thriftWriter) structEnd() {
+	t.elemEnd()
+}
+
+// elemBegin starts a struct element of a list, ended by elemEnd.
+func (t *thriftWriter) elemBegin() {
+	t.last = append(t.last, t.id)
+	t.id = 0
+}
+
+func (t *thriftWriter) elemEnd() {
+	t.stop()
+	t.id = t.last[len(t.last)-1]
+	t.last = t.last[:len(t.last)-1]
+}
+
+// stop ends the current struct.
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
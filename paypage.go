@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	// payPageKeepAlive is the interval of the comments keeping the event
+	// streams of the payment pages open, the state being checked again in
+	// case an event was missed.
+	payPageKeepAlive = 15 * time.Second
+
+	payPageQRSize = 256
+)
+
+// The states of a payment shown by its page.
+const (
+	paymentUnpaid        = "unpaid"
+	paymentPendingReview = "pending_review"
+	paymentHeld          = "held"
+	paymentPublished     = "published"
+	paymentExpired       = "expired"
+)
+
+var payPageTemplate = template.Must(template.New("pay").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Payment</title>
+<style>
+body { font-family: sans-serif; max-width: 24em; margin: 2em auto; padding: 0 1em; text-align: center; }
+img { width: 100%; max-width: 256px; image-rendering: pixelated; }
+code { display: block; word-break: break-all; font-size: .7em; margin: 1em 0; }
+blockquote { border-left: 3px solid #ccc; margin: 1em 0; padding: .5em 1em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Amount}} sats{{if .Room}} to {{.Room}}{{end}}</h1>
+{{if .QR}}<div id="invoice"{{if ne .State "unpaid"}} hidden{{end}}>
+<a href="lightning:{{.Invoice}}"><img src="{{.QR}}" alt="Invoice QR code"></a>
+<code>{{.Invoice}}</code>
+</div>{{end}}
+<p id="state">{{.Label}}</p>
+<blockquote id="message"{{if not .Memo}} hidden{{end}}>{{.Memo}}</blockquote>
+<script>
+var labels = {{.Labels}};
+var source = new EventSource(location.pathname.replace(/\/$/, "") + "/events");
+source.addEventListener("status", function(e) {
+	var s = JSON.parse(e.data);
+	document.getElementById("state").textContent = labels[s.state] || s.state;
+	var invoice = document.getElementById("invoice");
+	if (invoice) {
+		invoice.hidden = s.state !== "unpaid";
+	}
+	var message = document.getElementById("message");
+	if (s.memo) {
+		message.textContent = s.memo;
+		message.hidden = false;
+	}
+	if (s.state === "published" || s.state === "expired") {
+		source.close();
+	}
+});
+</script>
+</body>
+</html>
+`))
+
+// paymentLabels are the texts of the payment states on the page.
+var paymentLabels = map[string]string{
+	paymentUnpaid:        "Waiting for the payment…",
+	paymentPendingReview: "Paid, the message awaits moderation.",
+	paymentHeld:          "Paid, the message will be shown when the next session starts.",
+	paymentPublished:     "Paid, the message is published.",
+	paymentExpired:       "The invoice expired.",
+}
+
+// paymentStatus is the state of the payment of a message, sent on the
+// event stream of its page.
+type paymentStatus struct {
+	ID        string     `json:"id"`
+	State     string     `json:"state"`
+	Memo      string     `json:"memo,omitempty"`
+	SettledAt *time.Time `json:"settled_at,omitempty"`
+}
+
+// paymentStatusOf returns the state of the payment of m. The memo is only
+// shown once published, and never for the private rooms, which knowing a
+// payment hash doesn't grant.
+func paymentStatusOf(m *Message) paymentStatus {
+	s := paymentStatus{ID: publicIDs.Encode(m.ID), State: paymentUnpaid}
+	switch {
+	case m.Settled && m.Held:
+		s.State = paymentHeld
+	case m.Settled:
+		s.State = paymentPublished
+	case m.PendingReview:
+		s.State = paymentPendingReview
+	case m.Expired:
+		s.State = paymentExpired
+	}
+	if m.Settled {
+		at := m.SettledAt.UTC()
+		s.SettledAt = &at
+	}
+	if s.State == paymentPublished && m.DM == nil && !isPrivateRoom(m.Room) {
+		s.Memo = m.Memo
+	}
+	return s
+}
+
+// payPageMessage returns the message of the payment hash of the route,
+// replying with an error page when there's none.
+func payPageMessage(w http.ResponseWriter, r *http.Request) (*Message, bool) {
+	hash := strings.ToLower(pathParam(r, "rhash"))
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 {
+		http.Error(w, "invalid payment hash", http.StatusBadRequest)
+		return nil, false
+	}
+	m, err := store.FindByPaymentHash(r.Context(), hash)
+	if err == errMessageNotFound {
+		http.Error(w, "payment not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return m, true
+}
+
+// getPayPage serves the page of a payment, on which wallets opening a
+// browser after scanning an invoice land: the invoice QR code, the state of
+// the payment, updated live through getPayPageEvents, and the message once
+// published.
+func getPayPage(w http.ResponseWriter, r *http.Request) {
+	m, ok := payPageMessage(w, r)
+	if !ok {
+		return
+	}
+	s := paymentStatusOf(m)
+	data := map[string]interface{}{
+		"Amount": m.Amount,
+		"State":  s.State,
+		"Label":  paymentLabels[s.State],
+		"Memo":   s.Memo,
+		"Labels": paymentLabels,
+	}
+	if m.DM == nil && !isPrivateRoom(m.Room) {
+		data["Room"] = m.Room
+		if m.Room == "" {
+			data["Room"] = defaultRoom
+		}
+	}
+	if strings.HasPrefix(m.Invoice, "ln") {
+		png, err := qrcode.Encode("lightning:"+strings.ToUpper(m.Invoice), qrcode.Medium, payPageQRSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data["Invoice"] = m.Invoice
+		data["QR"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := payPageTemplate.Execute(w, data); err != nil {
+		logWarn("Failed to render the payment page", "doc_id", m.ID, "err", err)
+	}
+}
+
+// getPayPageEvents streams the state of a payment as server-sent status
+// events, a first one right away then one on every event of its payment
+// hash, until it is published or expired.
+func getPayPageEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	m, ok := payPageMessage(w, r)
+	if !ok {
+		return
+	}
+	hash := strings.ToLower(pathParam(r, "rhash"))
+
+	// The stream subscribes to the events of the hash like a websocket
+	// client without a connection, no room being readable by it.
+	c := &wsClient{
+		send:   make(chan []byte, wsSendBuffer),
+		claims: &streamClaims{},
+		hashes: make(map[string]bool),
+		done:   make(chan struct{}),
+	}
+	if err := eventHub.subscribeHash(c, hash, false); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer func() {
+		eventHub.remove(c)
+		c.close()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	var last string
+	send := func(m *Message) bool {
+		s := paymentStatusOf(m)
+		b, err := json.Marshal(s)
+		if err != nil {
+			return false
+		}
+		if string(b) != last {
+			last = string(b)
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", b)
+		} else {
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+		return s.State != paymentPublished && s.State != paymentExpired
+	}
+	if !send(m) {
+		return
+	}
+
+	keepAlive := time.NewTicker(payPageKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.done:
+			return
+		case <-c.send:
+		case <-keepAlive.C:
+		}
+		m, err := store.FindByPaymentHash(r.Context(), hash)
+		if err != nil {
+			return
+		}
+		if !send(m) {
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+
+	// Registers the postgres driver.
+	_ "github.com/lib/pq"
+)
+
+// postgresMigrations are the schema migrations of the postgres store, in
+// order. Released migrations must never be edited, add new ones instead.
+var postgresMigrations = []string{
+	`CREATE TABLE messages (
+		id TEXT PRIMARY KEY,
+		invoice TEXT NOT NULL UNIQUE,
+		r_hash TEXT NOT NULL DEFAULT '',
+		memo TEXT NOT NULL DEFAULT '',
+		room TEXT NOT NULL DEFAULT '',
+		amount BIGINT NOT NULL DEFAULT 0,
+		tags TEXT NOT NULL DEFAULT '',
+		dm TEXT NOT NULL DEFAULT '',
+		author TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ,
+		settled BOOLEAN NOT NULL DEFAULT FALSE,
+		expired BOOLEAN NOT NULL DEFAULT FALSE,
+		held BOOLEAN NOT NULL DEFAULT FALSE,
+		settled_at TIMESTAMPTZ,
+		amount_paid_msat BIGINT NOT NULL DEFAULT 0,
+		session_id TEXT NOT NULL DEFAULT '',
+		published_at TIMESTAMPTZ
+	);
+	CREATE INDEX messages_unsettled ON messages (id) WHERE NOT settled;
+	CREATE INDEX messages_held ON messages (id) WHERE held;
+	CREATE INDEX messages_settled_at ON messages (settled_at);
+	CREATE INDEX messages_room ON messages (room);`,
+	`ALTER TABLE messages ADD COLUMN hold_nonce TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN pending_review BOOLEAN NOT NULL DEFAULT FALSE;
+	CREATE INDEX messages_pending_review ON messages (id) WHERE pending_review;`,
+	`ALTER TABLE messages ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE messages ADD COLUMN boost_of TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN reaction TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN boost_total_msat BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN reactions TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE messages ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE messages ADD COLUMN flagged BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE messages ADD COLUMN flag_reason TEXT NOT NULL DEFAULT '';
+	CREATE INDEX messages_flagged ON messages (created_at) WHERE flagged;`,
+	`ALTER TABLE messages ADD COLUMN language TEXT NOT NULL DEFAULT '';`,
+	`CREATE INDEX messages_r_hash ON messages (r_hash);`,
+	`ALTER TABLE messages ADD COLUMN preimage TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE messages ADD COLUMN attachments TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE messages ADD COLUMN uid TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE bans (
+		uid TEXT PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL
+	);`,
+	`ALTER TABLE messages ADD COLUMN spam_score DOUBLE PRECISION NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN price_multiplier DOUBLE PRECISION NOT NULL DEFAULT 0;`,
+	`CREATE INDEX messages_room_settled_at ON messages (room, settled_at) WHERE settled;`,
+	`CREATE INDEX messages_pinned ON messages (settled_at) WHERE pinned;`,
+	`CREATE TABLE audit (
+		id BIGSERIAL PRIMARY KEY,
+		at TIMESTAMPTZ NOT NULL,
+		action TEXT NOT NULL,
+		message_id TEXT NOT NULL DEFAULT '',
+		r_hash TEXT NOT NULL DEFAULT '',
+		amount_msat BIGINT NOT NULL DEFAULT 0,
+		detail TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX audit_message_id ON audit (message_id);
+	CREATE INDEX audit_r_hash ON audit (r_hash);
+	CREATE RULE audit_no_update AS ON UPDATE TO audit DO INSTEAD NOTHING;
+	CREATE RULE audit_no_delete AS ON DELETE TO audit DO INSTEAD NOTHING;`,
+	`ALTER TABLE messages ADD COLUMN amount_msat BIGINT NOT NULL DEFAULT 0;`,
+	`ALTER TABLE messages ADD COLUMN onchain_address TEXT NOT NULL DEFAULT '';
+	CREATE INDEX messages_onchain_address ON messages (onchain_address) WHERE onchain_address <> '';`,
+	`ALTER TABLE messages ADD COLUMN fiat_currency TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN fiat_amount DOUBLE PRECISION NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN fiat_rate DOUBLE PRECISION NOT NULL DEFAULT 0;`,
+	`ALTER TABLE messages ADD COLUMN parent_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN thread_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX messages_thread_id ON messages (thread_id, settled_at) WHERE thread_id <> '';`,
+}
+
+// openPostgres connects to the postgres database of dsn, e.g.
+// "postgres://chat@localhost/chat?sslmode=disable", and migrates it.
+func openPostgres(dsn string) (*sqlStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	if err := migrate(db, rebindDollar, postgresMigrations); err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: db, rebind: rebindDollar, forUpdate: " FOR UPDATE"}, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// priceTiers are the preset amounts configured with -tiers.
+	priceTiers []priceTier
+
+	// pricePerChar is added to the price of a message for every character
+	// of its text, and pinnedPremium for pinning it, in satoshis. A zero
+	// premium means messages can't be pinned.
+	pricePerChar  int64
+	pinnedPremium int64
+
+	errPinningDisabled = errors.New("pinned messages aren't offered")
+)
+
+// priceTier is a preset message amount, in satoshis, offered by the
+// frontends as a button.
+type priceTier struct {
+	Amount int64  `firestore:"amount" json:"amount"`
+	Label  string `firestore:"label" json:"label"`
+}
+
+// parsePriceTiers parses the tiers of the -tiers flag, e.g.
+// "100:standard,1000:highlight,10000:pinned".
+func parsePriceTiers(s string) ([]priceTier, error) {
+	var tiers []priceTier
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, ":", 2)
+		amount, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || amount <= 0 {
+			return nil, fmt.Errorf("invalid tier amount %q", parts[0])
+		}
+		t := priceTier{Amount: amount}
+		if len(parts) == 2 {
+			t.Label = parts[1]
+		}
+		tiers = append(tiers, t)
+	}
+	return tiers, nil
+}
+
+// tiers returns the tiers of s which can be paid, by increasing amount. The
+// default price is the only tier when none is configured.
+func (s settings) tiers() []priceTier {
+	var tiers []priceTier
+	for _, t := range s.Tiers {
+		if t.Amount >= s.MinAmount {
+			tiers = append(tiers, t)
+		}
+	}
+	if len(tiers) == 0 {
+		return []priceTier{{Amount: s.Price, Label: "standard"}}
+	}
+	sort.SliceStable(tiers, func(i, j int) bool { return tiers[i].Amount < tiers[j].Amount })
+	return tiers
+}
+
+// extras returns what the text of a message and its pinning add to its
+// price.
+func (s settings) extras(memo string, pinned bool) (int64, error) {
+	extras := s.PricePerChar * int64(utf8.RuneCountInString(memo))
+	if pinned {
+		if s.PinnedPremium == 0 {
+			return 0, errPinningDisabled
+		}
+		extras += s.PinnedPremium
+	}
+	return extras, nil
+}
+
+// basePrices returns the default amount and the minimum amount of a message
+// before its extras, in sats, both converted from fiatPrice at the current
+// rate when the messages are priced in fiat.
+func (s settings) basePrices() (price, min int64, err error) {
+	if fiatPrice <= 0 {
+		return s.Price, s.MinAmount, nil
+	}
+	rate, err := currentRate()
+	if err != nil {
+		return 0, 0, err
+	}
+	price = fiatToSats(fiatPrice, rate)
+	return price, price, nil
+}
+
+// quote returns the default amount and the minimum amount of a message,
+// discounted during the happy hours.
+func (s settings) quote(memo string, pinned bool) (price, min int64, err error) {
+	extras, err := s.extras(memo, pinned)
+	if err != nil {
+		return 0, 0, err
+	}
+	price, min, err = s.basePrices()
+	if err != nil {
+		return 0, 0, err
+	}
+	percent := s.happyHourDiscount(appClock.Now())
+	return discounted(price+extras, percent), discounted(min+extras, percent), nil
+}
+
+// getPricing returns the amounts the frontends should offer.
+func getPricing(w http.ResponseWriter, r *http.Request) {
+	s := currentSettings()
+	var err error
+	// The tiers start from the converted price too.
+	s.Price, s.MinAmount, err = s.basePrices()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	j := map[string]interface{}{
+		"price":          s.Price,
+		"min_amount":     s.MinAmount,
+		"price_per_char": s.PricePerChar,
+		"pinned_premium": s.PinnedPremium,
+		"discount":       s.happyHourDiscount(appClock.Now()),
+		"happy_hours":    s.HappyHours,
+		"tiers":          s.tiers(),
+		"spam_pricing":   spamPricing,
+	}
+	if fiatPrice > 0 {
+		rate, _ := currentRate()
+		j["fiat"] = map[string]interface{}{"currency": fiatCurrency, "price": fiatPrice, "rate": rate}
+	}
+	writeJSON(w, j)
+}
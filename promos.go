@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	promosCollection = "promos"
+
+	promoCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	promoCodeLength   = 8
+	maxPromoBatch     = 1000
+)
+
+var (
+	// happyHours are the discounts scheduled with -happyHours.
+	happyHours []happyHour
+
+	errPromoUnavailable = errors.New("promo code unknown, expired or already used")
+)
+
+// happyHour is a daily time window, in UTC, during which messages are
+// discounted by Percent. Windows may span midnight. Days restricts the
+// window to some weekdays, Sunday being 0.
+type happyHour struct {
+	From    string         `firestore:"from" json:"from"`
+	To      string         `firestore:"to" json:"to"`
+	Percent int64          `firestore:"percent" json:"percent"`
+	Days    []time.Weekday `firestore:"days" json:"days,omitempty"`
+}
+
+// minuteOfDay parses a HH:MM time of day.
+func minuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (h happyHour) validate() error {
+	if h.Percent <= 0 || h.Percent > 100 {
+		return fmt.Errorf("invalid happy hour discount %d%%", h.Percent)
+	}
+	if _, err := minuteOfDay(h.From); err != nil {
+		return err
+	}
+	_, err := minuteOfDay(h.To)
+	return err
+}
+
+// active reports whether t falls in the window.
+func (h happyHour) active(t time.Time) bool {
+	from, ferr := minuteOfDay(h.From)
+	to, terr := minuteOfDay(h.To)
+	if ferr != nil || terr != nil {
+		return false
+	}
+	t = t.UTC()
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	// The hours after midnight of a window spanning it belong to the day
+	// it started.
+	if from > to && minute < to {
+		day = (day + 6) % 7
+	}
+	if len(h.Days) > 0 {
+		found := false
+		for _, d := range h.Days {
+			found = found || d == day
+		}
+		if !found {
+			return false
+		}
+	}
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// parseHappyHours parses the -happyHours flag, e.g. "18:00-20:00=50" for
+// half price from 6 to 8pm UTC.
+func parseHappyHours(s string) ([]happyHour, error) {
+	var hours []happyHour
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		var h happyHour
+		window := strings.SplitN(field, "=", 2)
+		times := strings.SplitN(window[0], "-", 2)
+		if len(window) != 2 || len(times) != 2 {
+			return nil, fmt.Errorf("invalid happy hour %q", field)
+		}
+		h.From, h.To = times[0], times[1]
+		percent, err := strconv.ParseInt(window[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid happy hour %q", field)
+		}
+		h.Percent = percent
+		if err := h.validate(); err != nil {
+			return nil, err
+		}
+		hours = append(hours, h)
+	}
+	return hours, nil
+}
+
+// happyHourDiscount returns the percentage off the messages created at t,
+// the largest of the active windows.
+func (s settings) happyHourDiscount(t time.Time) int64 {
+	var percent int64
+	for _, h := range s.HappyHours {
+		if h.active(t) && h.Percent > percent {
+			percent = h.Percent
+		}
+	}
+	return percent
+}
+
+// discounted returns amount less percent, at least 1 satoshi.
+func discounted(amount, percent int64) int64 {
+	amount -= amount * percent / 100
+	if amount < 1 {
+		amount = 1
+	}
+	return amount
+}
+
+// promo is a single-use promo code, which is its document ID.
+type promo struct {
+	Code       string     `firestore:"-" json:"code"`
+	Percent    int64      `firestore:"percent" json:"percent"`
+	CreatedAt  time.Time  `firestore:"created_at" json:"created_at"`
+	ExpiresAt  *time.Time `firestore:"expires_at,omitempty" json:"expires_at,omitempty"`
+	Redeemed   bool       `firestore:"redeemed" json:"redeemed"`
+	RedeemedAt *time.Time `firestore:"redeemed_at,omitempty" json:"redeemed_at,omitempty"`
+	MessageID  string     `firestore:"message_id,omitempty" json:"message_id,omitempty"`
+}
+
+func promoFromSnapshot(s *firestore.DocumentSnapshot) (*promo, error) {
+	var p promo
+	if err := s.DataTo(&p); err != nil {
+		return nil, err
+	}
+	p.Code = s.Ref.ID
+	return &p, nil
+}
+
+// redeemPromo redeems a promo code and returns its discount. Codes are
+// redeemed when the invoice is requested, releasePromo puts them back if it
+// can't be created.
+func redeemPromo(ctx context.Context, code string) (int64, error) {
+	if !firestoreEnabled() {
+		return 0, errPromoUnavailable
+	}
+	if err := waitForWrite(ctx, promosCollection); err != nil {
+		return 0, err
+	}
+	ref := collection(promosCollection).Doc(strings.ToUpper(code))
+	var percent int64
+	err := firebaseDb.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		s, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return errPromoUnavailable
+		}
+		if err != nil {
+			return err
+		}
+		p, err := promoFromSnapshot(s)
+		if err != nil {
+			return err
+		}
+		now := appClock.Now()
+		if p.Redeemed || (p.ExpiresAt != nil && now.After(*p.ExpiresAt)) {
+			return errPromoUnavailable
+		}
+		percent = p.Percent
+		return tx.Update(ref, []firestore.Update{
+			{Path: "redeemed", Value: true},
+			{Path: "redeemed_at", Value: now},
+		})
+	})
+	return percent, err
+}
+
+// releasePromo makes a code redeemed for a message which couldn't be created
+// available again.
+func releasePromo(code string) {
+	err := updateDoc(context.Background(), collection(promosCollection).Doc(strings.ToUpper(code)), []firestore.Update{
+		{Path: "redeemed", Value: false},
+		{Path: "redeemed_at", Value: firestore.Delete},
+	})
+	if err != nil {
+		logError("Failed to release promo code", "code", code, "err", err)
+	}
+}
+
+// recordPromoMessage records the message a code was redeemed for.
+func recordPromoMessage(ctx context.Context, code, messageID string) {
+	err := updateDoc(ctx, collection(promosCollection).Doc(strings.ToUpper(code)), []firestore.Update{
+		{Path: "message_id", Value: messageID},
+	})
+	if err != nil {
+		logError("Failed to record the message of promo code", "code", code, "doc_id", messageID, "err", err)
+	}
+}
+
+func newPromoCode() (string, error) {
+	return ids.NewID(promoCodeAlphabet, promoCodeLength)
+}
+
+// promoRequest is the body of postPromos.
+type promoRequest struct {
+	Percent   int64      `json:"percent"`
+	Count     int        `json:"count"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// postPromos generates a batch of promo codes.
+func postPromos(w http.ResponseWriter, r *http.Request) {
+	var req promoRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Count == 0 {
+		req.Count = 1
+	}
+	if req.Percent <= 0 || req.Percent > 100 || req.Count < 0 || req.Count > maxPromoBatch {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("percent must be between 1 and 100 and count at most %d", maxPromoBatch))
+		return
+	}
+
+	list := make([]*promo, 0, req.Count)
+	for len(list) < req.Count {
+		code, err := newPromoCode()
+		if err == nil {
+			err = waitForWrite(r.Context(), promosCollection)
+		}
+		p := &promo{Code: code, Percent: req.Percent, CreatedAt: appClock.Now(), ExpiresAt: req.ExpiresAt}
+		if err == nil {
+			_, err = collection(promosCollection).Doc(code).Create(r.Context(), p)
+		}
+		if status.Code(err) == codes.AlreadyExists {
+			continue
+		}
+		if err != nil {
+			// The promos created before the failure are still returned.
+			writeErrorCode(w, http.StatusServiceUnavailable, codeStoreUnavailable, err.Error(), map[string]interface{}{"promos": list})
+			return
+		}
+		list = append(list, p)
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]interface{}{"promos": list})
+}
+
+// getPromos lists the promo codes, the latest first.
+func getPromos(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := collection(promosCollection).
+		OrderBy("created_at", firestore.Desc).
+		Limit(500).
+		Documents(r.Context()).GetAll()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	list := make([]*promo, 0, len(snapshot))
+	for _, s := range snapshot {
+		p, err := promoFromSnapshot(s)
+		if err != nil {
+			continue
+		}
+		list = append(list, p)
+	}
+	writeJSON(w, map[string]interface{}{"promos": list})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// paymentProof is the body of postVerifyPayment.
+type paymentProof struct {
+	RHash    string `json:"r_hash"`
+	Preimage string `json:"preimage"`
+}
+
+// postVerifyPayment checks a proof of payment presented by a user, the
+// preimage of the payment hash of a settled message, and returns the message
+// and the amount paid, so that other services can grant perks to payers.
+// The proof holds as the preimage is only handed to the payer, see
+// getInvoiceStatus. Direct messages and the messages of the private rooms
+// the caller can't read are only acknowledged, their content staying
+// private.
+func postVerifyPayment(w http.ResponseWriter, r *http.Request) {
+	var p paymentProof
+	if err := decodeJSON(r, &p); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hash, err := hex.DecodeString(p.RHash)
+	if err != nil || len(hash) != sha256.Size {
+		writeError(w, http.StatusBadRequest, "invalid r_hash")
+		return
+	}
+	preimage, err := hex.DecodeString(p.Preimage)
+	if err != nil || len(preimage) != 32 {
+		writeError(w, http.StatusBadRequest, "invalid preimage")
+		return
+	}
+	if sum := sha256.Sum256(preimage); !bytes.Equal(sum[:], hash) {
+		writeJSON(w, map[string]interface{}{"valid": false})
+		return
+	}
+
+	m, err := store.FindByPaymentHash(r.Context(), hex.EncodeToString(hash))
+	if err == errMessageNotFound {
+		writeErrorCode(w, http.StatusNotFound, codeUnknownMessage, "no message for this payment", nil)
+		return
+	}
+	if err == nil && !m.Settled {
+		writeError(w, http.StatusPaymentRequired, "the message of this payment isn't settled")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	j := map[string]interface{}{
+		"valid":            true,
+		"id":               publicIDs.Encode(m.ID),
+		"amount":           m.Amount,
+		"amount_paid_msat": m.AmountPaidMsat,
+		"settled_at":       m.SettledAt,
+	}
+	if m.DM == nil && roomReadable(r, m.Room) {
+		j["room"] = m.Room
+		j["memo"] = m.Memo
+	}
+	writeJSON(w, j)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/messaging"
+	"golang.org/x/net/context"
+)
+
+// pushTimeout bounds the delivery of a push notification to FCM.
+const pushTimeout = 10 * time.Second
+
+// messagingClient sends the push notifications of the settled messages, set
+// up in main with -push, nil disabling them.
+var messagingClient *messaging.Client
+
+// pushTopic returns the FCM topic of room, escaping the characters topics
+// can't have.
+func pushTopic(room string) string {
+	if room == "" {
+		room = defaultRoom
+	}
+	var b strings.Builder
+	b.WriteString("room-")
+	for i := 0; i < len(room); i++ {
+		c := room[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// pushSettled notifies the devices subscribed to the room of m of its
+// settlement, in the background. Deliveries are best effort. DMs only tell
+// that one arrived, their memo being encrypted.
+func pushSettled(m *Message) {
+	if messagingClient == nil {
+		return
+	}
+	room := m.Room
+	if room == "" {
+		room = defaultRoom
+	}
+	n := &messaging.Notification{
+		Title: fmt.Sprintf("%d sats in %v", m.AmountPaidMsat/1000, room),
+		Body:  m.Memo,
+	}
+	if m.DM != nil {
+		n = &messaging.Notification{Title: "New direct message"}
+	}
+	msg := &messaging.Message{
+		Topic:        pushTopic(m.Room),
+		Notification: n,
+		Data: map[string]string{
+			"id":               publicIDs.Encode(m.ID),
+			"room":             room,
+			"amount_paid_msat": strconv.FormatInt(m.AmountPaidMsat, 10),
+		},
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+		defer cancel()
+		if _, err := messagingClient.Send(ctx, msg); err != nil {
+			logWarn("Push notification failed", "doc_id", m.ID, "topic", msg.Topic, "err", err)
+		}
+	}()
+}
+
+// pushSystemMessage notifies the devices subscribed to the room of m, a
+// system message, of it, in the background.
+func pushSystemMessage(m *Message) {
+	if messagingClient == nil {
+		return
+	}
+	room := m.Room
+	if room == "" {
+		room = defaultRoom
+	}
+	msg := &messaging.Message{
+		Topic:        pushTopic(m.Room),
+		Notification: &messaging.Notification{Title: room, Body: m.Memo},
+		Data: map[string]string{
+			"id":     publicIDs.Encode(m.ID),
+			"room":   room,
+			"system": m.Tags[systemTag],
+		},
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+		defer cancel()
+		if _, err := messagingClient.Send(ctx, msg); err != nil {
+			logWarn("Push notification failed", "doc_id", m.ID, "topic", msg.Topic, "err", err)
+		}
+	}()
+}
+
+// pushSubscription is the body of the push subscription routes.
+type pushSubscription struct {
+	Token string `json:"token"`
+	Room  string `json:"room"`
+}
+
+// postPushSubscribe subscribes the FCM registration token of a device to the
+// notifications of a room. Private rooms need a stream token granting them.
+func postPushSubscribe(w http.ResponseWriter, r *http.Request) {
+	updatePushSubscription(w, r, messagingClient.SubscribeToTopic)
+}
+
+// postPushUnsubscribe undoes postPushSubscribe.
+func postPushUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	updatePushSubscription(w, r, messagingClient.UnsubscribeFromTopic)
+}
+
+func updatePushSubscription(w http.ResponseWriter, r *http.Request, update func(context.Context, []string, string) (*messaging.TopicManagementResponse, error)) {
+	var s pushSubscription
+	if err := decodeJSON(r, &s); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if s.Token == "" {
+		writeError(w, http.StatusBadRequest, "missing token")
+		return
+	}
+	if isPrivateRoom(s.Room) {
+		claims, err := streamClaimsOf(r)
+		if err != nil || !claims.canRead(s.Room) {
+			writeError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+	}
+	res, err := update(r.Context(), []string{s.Token}, pushTopic(s.Room))
+	if err != nil {
+		writeErrorCode(w, http.StatusBadGateway, codeUpstreamUnavailable, err.Error(), nil)
+		return
+	}
+	if res.FailureCount > 0 && len(res.Errors) > 0 {
+		writeError(w, http.StatusBadRequest, res.Errors[0].Reason)
+		return
+	}
+	writeJSON(w, map[string]string{"topic": pushTopic(s.Room)})
+}
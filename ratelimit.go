@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// maxTrackedClients bounds the per client limiters kept, the idle ones
+	// being dropped once it is reached.
+	maxTrackedClients = 10000
+	clientIdleTimeout = 10 * time.Minute
+)
+
+var (
+	// invoiceRate and invoiceBurst are the token bucket of the invoice
+	// creations of each client IP, invoiceGlobalRate and invoiceGlobalBurst
+	// the one of all of them. A rate of zero disables the limit.
+	invoiceRate        = defaultInvoiceRate
+	invoiceBurst       = defaultInvoiceBurst
+	invoiceGlobalRate  = defaultInvoiceGlobalRate
+	invoiceGlobalBurst = defaultInvoiceGlobalBurst
+
+	defaultInvoiceRate        = 1.0
+	defaultInvoiceBurst       = 10
+	defaultInvoiceGlobalRate  = 20.0
+	defaultInvoiceGlobalBurst = 50
+
+	// trustedProxies are the reverse proxies the backend runs behind, whose
+	// X-Forwarded-For hops are trusted to name the client.
+	trustedProxies []*net.IPNet
+
+	invoiceLimiters = &clientLimiters{clients: make(map[string]*clientLimiter)}
+
+	globalInvoiceLimiter     *rate.Limiter
+	globalInvoiceLimiterOnce sync.Once
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_total",
+		Help:      "Number of invoice creations rejected by the rate limits, by scope: client or global.",
+	}, []string{"scope"})
+)
+
+func init() {
+	prometheus.MustRegister(rateLimited)
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// clientLimiters lazily creates one limiter per client IP.
+type clientLimiters struct {
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+}
+
+func (c *clientLimiters) allow(ip string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := c.clients[ip]
+	if !ok {
+		if len(c.clients) >= maxTrackedClients {
+			c.evict(now)
+		}
+		l = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(invoiceRate), invoiceBurst)}
+		c.clients[ip] = l
+	}
+	l.lastSeen = now
+	return l.limiter.AllowN(now, 1)
+}
+
+// evict drops the idle limiters or, when none is, the least recently seen
+// one, so that at most maxTrackedClients are kept whoever floods the
+// backend.
+func (c *clientLimiters) evict(now time.Time) {
+	var oldest string
+	for k, l := range c.clients {
+		if now.Sub(l.lastSeen) > clientIdleTimeout {
+			delete(c.clients, k)
+		} else if oldest == "" || l.lastSeen.Before(c.clients[oldest].lastSeen) {
+			oldest = k
+		}
+	}
+	if len(c.clients) >= maxTrackedClients {
+		delete(c.clients, oldest)
+	}
+}
+
+// parseTrustedProxies parses a comma separated list of IP addresses and
+// CIDR ranges.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client of r. The X-Forwarded-For
+// header is only read from a trusted proxy, from its right: each hop was
+// appended by the proxy before it, so the first one not added by a trusted
+// proxy is the client as far as the backend can tell, the ones on its left
+// being whatever the client sent.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// limitInvoices wraps a handler creating invoices so that it answers 429
+// once the client, or all of them, exceed the invoice rate limits, sparing
+// lnd the AddInvoice calls.
+func limitInvoices(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stateOf(r).Invoice = true
+		now := time.Now()
+		if invoiceRate > 0 && !invoiceLimiters.allow(clientIP(r), now) {
+			rateLimited.WithLabelValues("client").Inc()
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, "too many invoices requested, retry later")
+			return
+		}
+		if invoiceGlobalRate > 0 {
+			globalInvoiceLimiterOnce.Do(func() {
+				globalInvoiceLimiter = rate.NewLimiter(rate.Limit(invoiceGlobalRate), invoiceGlobalBurst)
+			})
+			if !globalInvoiceLimiter.AllowN(now, 1) {
+				rateLimited.WithLabelValues("global").Inc()
+				w.Header().Set("Retry-After", "1")
+				writeError(w, http.StatusTooManyRequests, "too many invoices requested, retry later")
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(saved []*net.IPNet) { trustedProxies = saved }(trustedProxies)
+	var err error
+	if trustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.168.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote string
+		fwd    []string
+		want   string
+	}{
+		{"203.0.113.7:1234", nil, "203.0.113.7"},
+		{"203.0.113.7:1234", []string{"1.2.3.4"}, "203.0.113.7"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"1.2.3.4", "203.0.113.7, 192.168.1.1"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"garbage, 203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"203.0.113.7, garbage"}, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"10.0.0.2"}, "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/invoice/hi", nil)
+		r.RemoteAddr = tt.remote
+		for _, f := range tt.fwd {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%v, %q) = %v, want %v", tt.remote, tt.fwd, got, tt.want)
+		}
+	}
+}
+
+func TestClientLimitersBound(t *testing.T) {
+	c := &clientLimiters{clients: make(map[string]*clientLimiter)}
+	now := time.Now()
+	for i := 0; i < maxTrackedClients+10; i++ {
+		c.allow(fmt.Sprint(i), now.Add(time.Duration(i)))
+	}
+	if len(c.clients) != maxTrackedClients {
+		t.Fatalf("tracking %d clients, want %d", len(c.clients), maxTrackedClients)
+	}
+	if _, ok := c.clients["0"]; ok {
+		t.Error("the least recently seen client was kept")
+	}
+	if _, ok := c.clients[fmt.Sprint(maxTrackedClients+9)]; !ok {
+		t.Error("the latest client was dropped")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+)
+
+const (
+	ratesCollection = "rates"
+
+	// rateInterval is how often the exchange rate is recorded.
+	rateInterval = time.Hour
+
+	rateDocFormat = "2006010215"
+)
+
+var (
+	// fiatCurrency is the currency, e.g. usd, the exchange rate of bitcoin
+	// is recorded and the fiat prices are given in, from rateSource. Empty
+	// disables the rate history.
+	fiatCurrency string
+	fiatRateURL  = defaultFiatRateURL
+
+	defaultFiatRateURL = "https://api.coingecko.com/api/v3/simple/price"
+
+	// rateSource is the provider of the exchange rates, selected with
+	// -rateProvider.
+	rateSource rateProvider = coingeckoRates{}
+
+	rateClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// rateSample is the exchange rate of bitcoin at a time, in units of the
+// currency per bitcoin.
+type rateSample struct {
+	Currency string    `firestore:"currency" json:"currency"`
+	Rate     float64   `firestore:"rate" json:"rate"`
+	At       time.Time `firestore:"at" json:"at"`
+}
+
+// rateProvider returns the current exchange rate of bitcoin in a currency,
+// in units of the currency per bitcoin.
+type rateProvider interface {
+	Rate(ctx context.Context, currency string) (float64, error)
+}
+
+// newRateProvider returns the provider named by the -rateProvider flag:
+// coingecko, at -fiatRateUrl, coinbase, kraken, or a static rate, e.g.
+// 50000.
+func newRateProvider(name string) (rateProvider, error) {
+	switch strings.ToLower(name) {
+	case "", "coingecko":
+		return coingeckoRates{}, nil
+	case "coinbase":
+		return coinbaseRates{}, nil
+	case "kraken":
+		return krakenRates{}, nil
+	}
+	rate, err := strconv.ParseFloat(name, 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("unknown rate provider %q", name)
+	}
+	return staticRate(rate), nil
+}
+
+// fetchRate returns the current exchange rate of bitcoin in fiatCurrency.
+func fetchRate(ctx context.Context) (float64, error) {
+	return rateSource.Rate(ctx, fiatCurrency)
+}
+
+// getRateJSON gets the JSON of u into v.
+func getRateJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := rateClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("exchange rate api: %v", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// coingeckoRates gets the rates from the CoinGecko compatible simple price
+// api of fiatRateURL.
+type coingeckoRates struct{}
+
+func (coingeckoRates) Rate(ctx context.Context, currency string) (float64, error) {
+	u, err := url.Parse(fiatRateURL)
+	if err != nil {
+		return 0, err
+	}
+	q := u.Query()
+	q.Set("ids", "bitcoin")
+	q.Set("vs_currencies", strings.ToLower(currency))
+	u.RawQuery = q.Encode()
+
+	var prices map[string]map[string]float64
+	if err := getRateJSON(ctx, u.String(), &prices); err != nil {
+		return 0, err
+	}
+	rate := prices["bitcoin"][strings.ToLower(currency)]
+	if rate <= 0 {
+		return 0, fmt.Errorf("no %v rate in the exchange rate api response", currency)
+	}
+	return rate, nil
+}
+
+// coinbaseRates gets the spot rates of Coinbase.
+type coinbaseRates struct{}
+
+func (coinbaseRates) Rate(ctx context.Context, currency string) (float64, error) {
+	var res struct {
+		Data struct {
+			Amount string `json:"amount"`
+		} `json:"data"`
+	}
+	u := "https://api.coinbase.com/v2/prices/BTC-" + url.PathEscape(strings.ToUpper(currency)) + "/spot"
+	if err := getRateJSON(ctx, u, &res); err != nil {
+		return 0, err
+	}
+	rate, err := strconv.ParseFloat(res.Data.Amount, 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("no %v rate in the coinbase response", currency)
+	}
+	return rate, nil
+}
+
+// krakenRates gets the last trade prices of Kraken.
+type krakenRates struct{}
+
+func (krakenRates) Rate(ctx context.Context, currency string) (float64, error) {
+	var res struct {
+		Error  []string `json:"error"`
+		Result map[string]struct {
+			// C is the price and the volume of the last trade.
+			C []string `json:"c"`
+		} `json:"result"`
+	}
+	u := "https://api.kraken.com/0/public/Ticker?pair=XBT" + url.QueryEscape(strings.ToUpper(currency))
+	if err := getRateJSON(ctx, u, &res); err != nil {
+		return 0, err
+	}
+	if len(res.Error) > 0 {
+		return 0, fmt.Errorf("kraken: %v", strings.Join(res.Error, ", "))
+	}
+	// The pairs are answered by their own names, e.g. XXBTZUSD.
+	for _, ticker := range res.Result {
+		if len(ticker.C) > 0 {
+			if rate, err := strconv.ParseFloat(ticker.C[0], 64); err == nil && rate > 0 {
+				return rate, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no %v rate in the kraken response", currency)
+}
+
+// staticRate is a fixed rate, for development or pegged prices.
+type staticRate float64
+
+func (r staticRate) Rate(ctx context.Context, currency string) (float64, error) {
+	return float64(r), nil
+}
+
+// recordRates records the exchange rate every rateInterval until ctx is
+// done, one document per currency and hour so that replicas record it once.
+func recordRates(ctx context.Context) {
+	ticker := time.NewTicker(rateInterval)
+	defer ticker.Stop()
+	for {
+		if err := recordRate(ctx); err != nil {
+			logWarn("Failed to record the exchange rate", "currency", fiatCurrency, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func recordRate(ctx context.Context) error {
+	rate, err := fetchRate(ctx)
+	if err != nil {
+		return err
+	}
+	now := appClock.Now().UTC()
+	if err := waitForWrite(ctx, ratesCollection); err != nil {
+		return err
+	}
+	id := strings.ToLower(fiatCurrency) + "-" + now.Format(rateDocFormat)
+	_, err = collection(ratesCollection).Doc(id).Set(ctx, rateSample{
+		Currency: strings.ToLower(fiatCurrency),
+		Rate:     rate,
+		At:       now,
+	})
+	return err
+}
+
+// rateHistory returns the rates of currency recorded from a day before from
+// to to, in time order.
+func rateHistory(ctx context.Context, currency string, from, to time.Time) ([]*rateSample, error) {
+	snapshot, err := collection(ratesCollection).
+		Where("at", ">=", from.Add(-24*time.Hour)).
+		Where("at", "<", to).
+		OrderBy("at", firestore.Asc).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var samples []*rateSample
+	for _, s := range snapshot {
+		var r rateSample
+		if err := s.DataTo(&r); err != nil || r.Currency != strings.ToLower(currency) {
+			continue
+		}
+		samples = append(samples, &r)
+	}
+	return samples, nil
+}
+
+// rateAt returns the last rate of samples recorded by t, or the first one
+// after it, 0 if there is none.
+func rateAt(samples []*rateSample, t time.Time) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].At.After(t) })
+	if i == 0 {
+		return samples[0].Rate
+	}
+	return samples[i-1].Rate
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var (
+	// reconcileInterval is how often the leader reconciles the unsettled
+	// messages with the node besides at startup, 0 disabling it, and
+	// reconcileBatchSize how many of them are read from the store at once.
+	reconcileInterval  = defaultReconcileInterval
+	reconcileBatchSize = defaultReconcileBatchSize
+
+	defaultReconcileInterval  = 15 * time.Minute
+	defaultReconcileBatchSize = 500
+
+	// reconciling is set while a reconciliation runs, whatever triggered
+	// it, so that they never overlap.
+	reconciling int32
+)
+
+// reconcileJitter is the fraction of reconcileInterval the reconciliations
+// are spread by, so that the replicas restarted together don't hit the node
+// and the store at the same time.
+const reconcileJitter = 0.1
+
+// The triggers of the reconciliations.
+const (
+	reconcileStartup   = "startup"
+	reconcileScheduled = "scheduled"
+	reconcileAdmin     = "admin"
+)
+
+var (
+	reconciliations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconciliations_total",
+		Help:      "Number of reconciliations of the unsettled messages, by trigger and outcome: completed, failed or skipped while another ran.",
+	}, []string{"trigger", "outcome"})
+
+	reconcileDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of the reconciliations of the unsettled messages.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+	})
+
+	reconcileDiscrepancies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconcile_discrepancies_total",
+		Help:      "Number of unsettled messages the reconciliation found paid, by invoice state: settled or accepted.",
+	}, []string{"state"})
+)
+
+func init() {
+	prometheus.MustRegister(reconciliations, reconcileDuration, reconcileDiscrepancies)
+}
+
+func startReconcile() bool {
+	return atomic.CompareAndSwapInt32(&reconciling, 0, 1)
+}
+
+func endReconcile() {
+	atomic.StoreInt32(&reconciling, 0)
+}
+
+// reconcile runs a reconciliation triggered by trigger, unless one is already
+// running.
+func reconcile(trigger string) {
+	if !startReconcile() {
+		reconciliations.WithLabelValues(trigger, "skipped").Inc()
+		logWarn("Skipped the reconciliation, another is running", "trigger", trigger)
+		return
+	}
+	defer endReconcile()
+	runReconcile(trigger)
+}
+
+// runReconcile runs checkPayments, once the caller made sure no other
+// reconciliation is running.
+func runReconcile(trigger string) {
+	start := time.Now()
+	err := checkPayments()
+	reconcileDuration.Observe(time.Since(start).Seconds())
+	outcome := "completed"
+	if err != nil {
+		outcome = "failed"
+	}
+	reconciliations.WithLabelValues(trigger, outcome).Inc()
+	logInfo("Reconciled the unsettled messages", "trigger", trigger, "outcome", outcome, "duration", time.Since(start))
+}
+
+// scheduleReconcile reconciles the unsettled messages every
+// reconcileInterval, give or take reconcileJitter, until ctx is done. A
+// reconciliation outlasting the interval delays the next one rather than
+// overlapping it.
+func scheduleReconcile(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitter(reconcileInterval, reconcileJitter)):
+		}
+		reconcile(reconcileScheduled)
+	}
+}
+
+// jitter returns d moved by up to fraction of it, either way.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
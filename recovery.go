@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultStuckAge is how old an unpaid message is listed as stuck by
+	// default.
+	defaultStuckAge = time.Hour
+
+	// Event type of the messages whose settlement was reverted, which the
+	// clients should drop.
+	eventMessageUnsettled = "message_unsettled"
+)
+
+var (
+	errNotSettled       = errors.New("message isn't settled")
+	errNotCancellable   = errors.New("the invoice of the message can't be cancelled")
+	errExpiredMessage   = errors.New("message expired, its payments are refunded")
+	errReconcileRunning = errors.New("a reconciliation is already running")
+)
+
+// postReconcile runs in the background the reconciliation otherwise run at
+// startup and every -reconcileInterval.
+func postReconcile(w http.ResponseWriter, r *http.Request) {
+	if !startReconcile() {
+		reconciliations.WithLabelValues(reconcileAdmin, "skipped").Inc()
+		writeError(w, http.StatusConflict, errReconcileRunning.Error())
+		return
+	}
+	go func() {
+		defer endReconcile()
+		runReconcile(reconcileAdmin)
+	}()
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string]string{"status": "reconciling"})
+}
+
+// getStuck lists the messages still unpaid ?older_than=1h after their
+// creation, whether their invoice is open or they await review.
+func getStuck(w http.ResponseWriter, r *http.Request) {
+	age := defaultStuckAge
+	if v := r.URL.Query().Get("older_than"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "invalid older_than")
+			return
+		}
+		age = d
+	}
+	unsettled, err := store.ListUnsettled(r.Context())
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	before := appClock.Now().Add(-age)
+	list := make([]*Message, 0, len(unsettled))
+	for _, m := range unsettled {
+		if m.CreatedAt.After(before) {
+			continue
+		}
+		m.ID = publicIDs.Encode(m.ID)
+		signAttachments(m)
+		list = append(list, m)
+	}
+	writeJSON(w, map[string]interface{}{"messages": list})
+}
+
+// forceSettlement is the optional body of the settle action, the amount
+// defaulting to the one of the message.
+type forceSettlement struct {
+	AmountPaidMsat int64 `json:"amount_paid_msat"`
+}
+
+// invalidBodyError is a body of a message action that can't be decoded.
+type invalidBodyError struct{ error }
+
+// postMessageAction recovers a message depending on the :action of the
+// route: cancel cancels its open invoice and expires it, settle marks it
+// settled, with its side effects, for a payment lnd doesn't report, and
+// unsettle reverts a settlement recorded by mistake, the stats and the
+// transparency log still counting it.
+func postMessageAction(w http.ResponseWriter, r *http.Request) {
+	var act func(ctx context.Context, r *http.Request, m *Message) error
+	switch pathParam(r, "action") {
+	case "cancel":
+		act = cancelOpenInvoice
+	case "settle":
+		act = forceSettle
+	case "unsettle":
+		act = forceUnsettle
+	default:
+		writeError(w, http.StatusNotFound, "unknown action")
+		return
+	}
+
+	id, err := publicIDs.Decode(pathParam(r, "id"))
+	if err == nil {
+		var m *Message
+		m, err = store.GetMessage(r.Context(), id)
+		if err == nil {
+			err = act(r.Context(), r, m)
+		}
+	}
+	if _, ok := err.(invalidBodyError); ok {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch err {
+	case nil:
+		logInfo("Recovered message", "doc_id", id, "action", pathParam(r, "action"))
+		writeJSON(w, map[string]string{"status": "OK"})
+	case errInvalidID:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errMessageNotFound:
+		writeErrorCode(w, http.StatusNotFound, codeUnknownMessage, err.Error(), nil)
+	case errAlreadySettled, errNotSettled, errNotCancellable, errExpiredMessage:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, err.Error())
+	}
+}
+
+// cancelOpenInvoice cancels the lnd invoice of an unpaid message and expires
+// it. LNbits invoices, keysends and bot replies have none to cancel.
+func cancelOpenInvoice(ctx context.Context, r *http.Request, m *Message) error {
+	if m.Settled {
+		return errAlreadySettled
+	}
+	if checkLnd() != nil || m.Tags[backendTag] == backendLnbits || strings.HasPrefix(m.Invoice, keysendInvoicePrefix) || strings.HasPrefix(m.Invoice, botInvoicePrefix) {
+		return errNotCancellable
+	}
+	hash, err := paymentHash(ctx, messageLightning(m), newReconcileLimiter(), m)
+	if err != nil {
+		return err
+	}
+	rHash, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	if _, err := messageInvoicesClient(m).CancelInvoice(ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: rHash}); err != nil {
+		return err
+	}
+	if err := store.Expire(ctx, m.ID); err != nil {
+		return err
+	}
+	audit(auditInvoiceCancelled, m, nil, stateOf(r).User)
+	return nil
+}
+
+// forceSettle marks a message settled like the watcher would, for a payment
+// received lnd doesn't know of, e.g. one made out of band. Expired messages
+// are refused, settling them would refund the payer from the node funds.
+func forceSettle(ctx context.Context, r *http.Request, m *Message) error {
+	if m.Settled {
+		return errAlreadySettled
+	}
+	if m.Expired {
+		return errExpiredMessage
+	}
+	var s forceSettlement
+	if r.ContentLength > 0 {
+		if err := decodeJSON(r, &s); err != nil {
+			return invalidBodyError{err}
+		}
+	}
+	if s.AmountPaidMsat == 0 {
+		s.AmountPaidMsat = m.AmountMsat
+	}
+	rHash, _ := hex.DecodeString(m.RHash)
+	invoice := &lnrpc.Invoice{
+		PaymentRequest: m.Invoice,
+		RHash:          rHash,
+		AmtPaidMsat:    s.AmountPaidMsat,
+	}
+	audit(auditForceSettled, m, invoice, stateOf(r).User)
+	return markSettled(ctx, m, invoice)
+}
+
+func forceUnsettle(ctx context.Context, r *http.Request, m *Message) error {
+	reverted, err := store.MarkUnsettled(ctx, m.ID)
+	if err == nil && !reverted {
+		err = errNotSettled
+	}
+	if err == nil {
+		audit(auditForceUnsettled, m, nil, stateOf(r).User)
+		unindexMessage(m.ID)
+		ev := event{
+			Type: eventMessageUnsettled,
+			Room: m.Room,
+			Data: map[string]interface{}{"id": publicIDs.Encode(m.ID)},
+		}
+		publishEvent(ev)
+		postWebhooks(ev)
+	}
+	return err
+}
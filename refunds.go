@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/btcsuite/btcutil/bech32"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	vouchersCollection = "vouchers"
+
+	// Event type of the refund vouchers issued for late payments.
+	eventRefund = "refund"
+
+	voucherTTL = 30 * 24 * time.Hour
+
+	// minRefundFeeLimit is the smallest routing fee budget of a refund, in
+	// satoshis, the operator paying the fees.
+	minRefundFeeLimit = 10
+)
+
+var (
+	// publicURL is the URL the backend is reachable at, needed in the
+	// vouchers handed out outside of a request.
+	publicURL string
+
+	errVoucherUnavailable = errors.New("voucher already claimed or expired")
+
+	refundVouchers = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "refund_vouchers_total",
+		Help:      "Number of refund vouchers issued for payments of expired messages.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(refundVouchers)
+}
+
+// voucher is an LNURL-withdraw voucher refunding the payment of a message
+// which had expired, the k1 secret being its document ID.
+type voucher struct {
+	K1         string    `firestore:"-" json:"k1"`
+	MessageID  string    `firestore:"message_id" json:"message_id"`
+	AmountMsat int64     `firestore:"amount_msat" json:"amount_msat"`
+	Claimed    bool      `firestore:"claimed" json:"claimed"`
+	CreatedAt  time.Time `firestore:"created_at" json:"created_at"`
+	ExpiresAt  time.Time `firestore:"expires_at" json:"expires_at"`
+	ClaimedAt  time.Time `firestore:"claimed_at,omitempty" json:"claimed_at,omitempty"`
+
+	// FeeMsat is the routing fee the operator paid refunding the voucher.
+	FeeMsat int64 `firestore:"fee_msat,omitempty" json:"fee_msat,omitempty"`
+}
+
+func (v *voucher) available() bool {
+	return !v.Claimed && appClock.Now().Before(v.ExpiresAt)
+}
+
+// lnurl returns the bech32 encoded LNURL of the voucher.
+func (v *voucher) lnurl() (string, error) {
+	data, err := bech32.ConvertBits([]byte(publicURL+"/lnurlw/"+v.K1), 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	s, err := bech32.Encode("lnurl", data)
+	return strings.ToUpper(s), err
+}
+
+// issueRefund hands out a voucher refunding the payment of m, which settled
+// after m had expired. The payer gets it in a payer event, on the payment
+// hash subscriptions of its invoice made with the payer token, or from the
+// status of the invoice. The room and the webhooks are told a refund was
+// issued, without the withdraw link anyone holding could claim.
+func issueRefund(ctx context.Context, m *Message, invoice *lnrpc.Invoice) {
+	logInfo("Payment settled an expired message", "doc_id", m.ID, "payment_hash", hex.EncodeToString(invoice.GetRHash()))
+	if publicURL == "" || !firestoreEnabled() {
+		logWarn("Vouchers need -publicUrl and firebase, the payment must be refunded manually", "doc_id", m.ID, "amount_msat", invoice.GetAmtPaidMsat())
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		logError("Failed to issue refund voucher", "doc_id", m.ID, "err", err)
+		return
+	}
+	now := appClock.Now()
+	v := voucher{
+		K1:         hex.EncodeToString(b),
+		MessageID:  m.ID,
+		AmountMsat: invoice.GetAmtPaidMsat(),
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(voucherTTL),
+	}
+	lnurl, err := v.lnurl()
+	if err == nil {
+		err = waitForWrite(ctx, vouchersCollection)
+	}
+	if err == nil {
+		_, err = collection(vouchersCollection).Doc(v.K1).Create(ctx, v)
+	}
+	if err != nil {
+		logError("Failed to issue refund voucher", "doc_id", m.ID, "err", err)
+		return
+	}
+	refundVouchers.Inc()
+
+	data := map[string]interface{}{
+		"id":          publicIDs.Encode(m.ID),
+		"amount_msat": v.AmountMsat,
+		"expires_at":  v.ExpiresAt,
+	}
+	ev := event{
+		Type:        eventRefund,
+		Room:        m.Room,
+		PaymentHash: hex.EncodeToString(invoice.GetRHash()),
+		Data:        data,
+	}
+	postWebhooks(ev)
+	payerData := map[string]interface{}{"lnurl": lnurl}
+	for k, v := range data {
+		payerData[k] = v
+	}
+	ev.Data, ev.Payer = payerData, true
+	publishEvent(ev)
+	postSystemMessage(ctx, templateRefundIssued, m, templateData{AmountPaid: v.AmountMsat / 1000})
+}
+
+func getVoucher(ctx context.Context, k1 string) (*voucher, error) {
+	s, err := collection(vouchersCollection).Doc(k1).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, errVoucherUnavailable
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v voucher
+	if err := s.DataTo(&v); err != nil {
+		return nil, err
+	}
+	v.K1 = k1
+	return &v, nil
+}
+
+// refundOf returns the LNURL of the voucher refunding the message id, if
+// one is still available.
+func refundOf(ctx context.Context, id string) (string, bool, error) {
+	snapshot, err := collection(vouchersCollection).Where("message_id", "==", id).Documents(ctx).GetAll()
+	if err != nil {
+		return "", false, err
+	}
+	for _, s := range snapshot {
+		var v voucher
+		if err := s.DataTo(&v); err != nil {
+			continue
+		}
+		v.K1 = s.Ref.ID
+		if !v.available() {
+			continue
+		}
+		lnurl, err := v.lnurl()
+		return lnurl, err == nil, err
+	}
+	return "", false, nil
+}
+
+// setVoucherClaimed flips the claimed state of a voucher, failing with
+// errVoucherUnavailable if it already was in that state.
+func setVoucherClaimed(ctx context.Context, k1 string, claimed bool) error {
+	if err := waitForWrite(ctx, vouchersCollection); err != nil {
+		return err
+	}
+	ref := collection(vouchersCollection).Doc(k1)
+	return firebaseDb.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		s, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if current, _ := s.Data()["claimed"].(bool); current == claimed {
+			return errVoucherUnavailable
+		}
+		updates := []firestore.Update{{Path: "claimed", Value: claimed}}
+		if claimed {
+			updates = append(updates, firestore.Update{Path: "claimed_at", Value: appClock.Now()})
+		}
+		return tx.Update(ref, updates)
+	})
+}
+
+// getLnurlWithdraw returns the LNURL-withdraw request of a voucher.
+func getLnurlWithdraw(w http.ResponseWriter, r *http.Request) {
+	v, err := getVoucher(r.Context(), pathParam(r, "k1"))
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+	if !v.available() {
+		lnurlError(w, errVoucherUnavailable.Error())
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"tag":                "withdrawRequest",
+		"callback":           publicURL + "/lnurlw/callback",
+		"k1":                 v.K1,
+		"minWithdrawable":    v.AmountMsat,
+		"maxWithdrawable":    v.AmountMsat,
+		"defaultDescription": "Refund of a late payment to the rawtx chat",
+	})
+}
+
+// getLnurlWithdrawCallback pays the invoice of the voucher holder.
+func getLnurlWithdrawCallback(w http.ResponseWriter, r *http.Request) {
+	k1, payReq := r.URL.Query().Get("k1"), r.URL.Query().Get("pr")
+	v, err := getVoucher(r.Context(), k1)
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+	if !v.available() {
+		lnurlError(w, errVoucherUnavailable.Error())
+		return
+	}
+	if err := checkLnd(); err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+
+	c, clean := getClient()
+	defer clean()
+	decoded, err := c.DecodePayReq(r.Context(), &lnrpc.PayReqString{PayReq: payReq})
+	if err != nil {
+		lnurlError(w, "invalid invoice")
+		return
+	}
+	// A voucher is paid out once, for its whole value.
+	amountMsat := decoded.GetNumMsat()
+	if amountMsat != v.AmountMsat {
+		lnurlError(w, fmt.Sprintf("invoice amount must be %d msat", v.AmountMsat))
+		return
+	}
+	hash, err := hex.DecodeString(decoded.GetPaymentHash())
+	if err != nil {
+		lnurlError(w, "invalid invoice")
+		return
+	}
+
+	// Claiming first guarantees a voucher is paid out once.
+	if err := setVoucherClaimed(r.Context(), k1, true); err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+	feeLimit := amountMsat / 1000 / 100
+	if feeLimit < minRefundFeeLimit {
+		feeLimit = minRefundFeeLimit
+	}
+	res, err := c.SendPaymentSync(context.Background(), &lnrpc.SendRequest{
+		PaymentRequest: payReq,
+		FeeLimit:       &lnrpc.FeeLimit{Limit: &lnrpc.FeeLimit_Fixed{Fixed: feeLimit}},
+	})
+	if err == nil && res.GetPaymentError() != "" {
+		err = errors.New(res.GetPaymentError())
+	}
+	if err != nil {
+		// The payment may still be in flight, e.g. when lnd answers that
+		// it is in transition or the call is cut, so the voucher is only
+		// released once the payment is known to have failed.
+		go resolvePayout(v, hash)
+		lnurlError(w, err.Error())
+		return
+	}
+	recordPayout(v, res.GetPaymentRoute().GetTotalFeesMsat())
+	writeJSON(w, map[string]string{"status": "OK"})
+}
+
+// recordPayout records the routing fee of the paid out voucher v.
+func recordPayout(v *voucher, fee int64) {
+	if err := updateDoc(context.Background(), collection(vouchersCollection).Doc(v.K1), []firestore.Update{{Path: "fee_msat", Value: fee}}); err != nil {
+		logError("Failed to record the fee of a refund", "k1", v.K1, "fee_msat", fee, "err", err)
+	}
+	logInfo("Refunded message", "doc_id", v.MessageID, "amount_msat", v.AmountMsat, "fee_msat", fee)
+}
+
+// resolvePayout waits for the final state of the payment of hash paying out
+// the claimed voucher v, which is released if the payment failed or never
+// started, and kept claimed otherwise. The payments lnd can't track, without
+// routerrpc, are left to the operators.
+func resolvePayout(v *voucher, hash []byte) {
+	ctx := context.Background()
+	stream, err := getRouterClient().TrackPaymentV2(ctx, &routerrpc.TrackPaymentRequest{PaymentHash: hash, NoInflightUpdates: true})
+	var p *lnrpc.Payment
+	if err == nil {
+		p, err = stream.Recv()
+	}
+	switch {
+	case status.Code(err) == codes.NotFound || err == nil && p.GetStatus() == lnrpc.Payment_FAILED:
+		if err := setVoucherClaimed(ctx, v.K1, false); err != nil {
+			logError("Failed to release voucher after a failed payment", "k1", v.K1, "err", err)
+			return
+		}
+		logInfo("Released voucher after a failed payment", "doc_id", v.MessageID, "k1", v.K1)
+	case err != nil:
+		logError("Failed to track the payment of a voucher, it stays claimed", "doc_id", v.MessageID, "k1", v.K1, "payment_hash", hex.EncodeToString(hash), "err", err)
+	case p.GetStatus() == lnrpc.Payment_SUCCEEDED:
+		recordPayout(v, p.GetFeeMsat())
+	default:
+		logError("Unexpected state of the payment of a voucher, it stays claimed", "doc_id", v.MessageID, "k1", v.K1, "state", p.GetStatus())
+	}
+}
+
+// getVouchers lists the refund vouchers issued, for the operator to follow
+// up on.
+func getVouchers(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := collection(vouchersCollection).
+		OrderBy("created_at", firestore.Desc).
+		Limit(100).
+		Documents(r.Context()).GetAll()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	list := make([]*voucher, 0, len(snapshot))
+	for _, s := range snapshot {
+		var v voucher
+		if err := s.DataTo(&v); err != nil {
+			continue
+		}
+		v.K1 = s.Ref.ID
+		list = append(list, &v)
+	}
+	writeJSON(w, map[string]interface{}{"vouchers": list})
+}
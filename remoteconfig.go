@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/net/context"
+)
+
+// remoteConfigDoc is the document of metaCollection holding the settings
+// operators may change while the backend runs, e.g.
+//
+//	{"price": 210, "min_amount": 100, "price_per_char": 1,
+//	 "pinned_premium": 5000, "banned_words": ["spam"],
+//	 "happy_hours": [{"from": "18:00", "to": "20:00", "percent": 50}],
+//	 "tiers": [{"amount": 1000, "label": "highlight"}]}
+const remoteConfigDoc = "config"
+
+var (
+	liveSettings   settings
+	liveSettingsMu sync.RWMutex
+
+	// bannedWords are the words of -bannedWords, which those of the remote
+	// config add to.
+	bannedWords []string
+
+	errBannedWord = errors.New("message contains a banned word")
+)
+
+// settings are the operator-tunable settings. Zero fields of the remote
+// config document keep the value configured at startup.
+type settings struct {
+	// Price is the default amount of a message and MinAmount the smallest
+	// one accepted, in satoshis.
+	Price     int64 `firestore:"price"`
+	MinAmount int64 `firestore:"min_amount"`
+
+	// PricePerChar and PinnedPremium are added to the price, see quote.
+	PricePerChar  int64 `firestore:"price_per_char"`
+	PinnedPremium int64 `firestore:"pinned_premium"`
+
+	BannedWords []string `firestore:"banned_words"`
+
+	// Tiers are the preset amounts offered by the frontends.
+	Tiers []priceTier `firestore:"tiers"`
+
+	// HappyHours are the scheduled discounts.
+	HappyHours []happyHour `firestore:"happy_hours"`
+}
+
+func init() {
+	registerInvoiceHook(rejectBannedWords)
+}
+
+// defaultSettings returns the settings configured at startup.
+func defaultSettings() settings {
+	return settings{
+		Price:         messagePrice,
+		MinAmount:     messagePrice,
+		PricePerChar:  pricePerChar,
+		PinnedPremium: pinnedPremium,
+		Tiers:         priceTiers,
+		HappyHours:    happyHours,
+		BannedWords:   append([]string(nil), bannedWords...),
+	}
+}
+
+// currentSettings returns the settings in effect.
+func currentSettings() settings {
+	liveSettingsMu.RLock()
+	defer liveSettingsMu.RUnlock()
+	if liveSettings.Price == 0 {
+		return defaultSettings()
+	}
+	return liveSettings
+}
+
+func setSettings(remote settings) {
+	s := defaultSettings()
+	if remote.Price > 0 {
+		s.Price = remote.Price
+	}
+	if remote.MinAmount > 0 {
+		s.MinAmount = remote.MinAmount
+	}
+	if remote.PricePerChar > 0 {
+		s.PricePerChar = remote.PricePerChar
+	}
+	if remote.PinnedPremium > 0 {
+		s.PinnedPremium = remote.PinnedPremium
+	}
+	if len(remote.HappyHours) > 0 {
+		s.HappyHours = nil
+		for _, h := range remote.HappyHours {
+			if err := h.validate(); err != nil {
+				logWarn("Ignoring remote happy hour", "err", err)
+				continue
+			}
+			s.HappyHours = append(s.HappyHours, h)
+		}
+	}
+	if len(remote.Tiers) > 0 {
+		s.Tiers = remote.Tiers
+	}
+	for _, w := range remote.BannedWords {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+			s.BannedWords = append(s.BannedWords, w)
+		}
+	}
+
+	liveSettingsMu.Lock()
+	liveSettings = s
+	liveSettingsMu.Unlock()
+}
+
+// watchRemoteConfig applies the remote config document, and its updates,
+// until ctx is done.
+func watchRemoteConfig(ctx context.Context) {
+	backoff := minSubscriptionBackoff
+	for ctx.Err() == nil {
+		it := collection(metaCollection).Doc(remoteConfigDoc).Snapshots(ctx)
+		for {
+			snap, err := it.Next()
+			if err != nil {
+				logWarn("Remote config watch failed", "err", err, "retry_in", backoff)
+				break
+			}
+			backoff = minSubscriptionBackoff
+
+			var remote settings
+			if snap.Exists() {
+				if err := snap.DataTo(&remote); err != nil {
+					logError("Invalid remote config", "err", err)
+					continue
+				}
+			}
+			setSettings(remote)
+			logInfo("Applied remote config", "settings", fmt.Sprintf("%+v", currentSettings()))
+		}
+		it.Stop()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxSubscriptionBackoff {
+			backoff = maxSubscriptionBackoff
+		}
+	}
+}
+
+// rejectBannedWords is the invoice hook rejecting messages containing one of
+// the banned words.
+func rejectBannedWords(req *invoiceRequest) error {
+	banned := currentSettings().BannedWords
+	if len(banned) == 0 {
+		return nil
+	}
+	words := strings.FieldsFunc(strings.ToLower(req.Memo), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, w := range words {
+		for _, b := range banned {
+			if w == b {
+				return errBannedWord
+			}
+		}
+	}
+	return nil
+}
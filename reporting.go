@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/errorreporting"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+)
+
+// panicReport is a panic of the handler of a request.
+type panicReport struct {
+	Value     interface{}
+	Stack     []byte
+	Request   *http.Request
+	Route     string
+	RequestID string
+	User      string
+}
+
+// errorReporter reports the panics to an error tracking service, such as
+// Sentry or Cloud Error Reporting. Report must not block the request, the
+// reports being sent in the background, and Flush sends those pending, on
+// shutdown.
+type errorReporter interface {
+	Report(p panicReport)
+	Flush()
+}
+
+var (
+	// errorReporters are the services the panics are reported to, besides
+	// being logged.
+	errorReporters []errorReporter
+
+	handlerPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "handler_panics_total",
+		Help:      "Number of requests whose handler panicked, by route.",
+	}, []string{"route"})
+)
+
+func init() {
+	prometheus.MustRegister(handlerPanics)
+}
+
+// reportPanic counts p and reports it to the errorReporters.
+func reportPanic(p panicReport) {
+	route := p.Route
+	if route == "" {
+		route = "unmatched"
+	}
+	handlerPanics.WithLabelValues(route).Inc()
+	for _, reporter := range errorReporters {
+		reporter.Report(p)
+	}
+}
+
+// flushErrorReports sends the pending reports, on shutdown.
+func flushErrorReports() {
+	for _, reporter := range errorReporters {
+		reporter.Flush()
+	}
+}
+
+// sentryReporter posts the panics to the store endpoint of a Sentry project.
+type sentryReporter struct {
+	storeURL string
+	auth     string
+	client   *http.Client
+	pending  sync.WaitGroup
+}
+
+// newSentryReporter returns the reporter of the project of dsn, e.g.
+// https://<key>@o0.ingest.sentry.io/<project>.
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || i < 0 || u.Path[i+1:] == "" {
+		return nil, fmt.Errorf("invalid sentry dsn %q", dsn)
+	}
+	store := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path[:i] + "/api/" + u.Path[i+1:] + "/store/"}
+	return &sentryReporter{
+		storeURL: store.String(),
+		auth:     "Sentry sentry_version=7, sentry_client=" + serviceName + "/1.0, sentry_key=" + u.User.Username(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// sentryEvent is the part of the Sentry event payload reported. The headers
+// and query of the requests, which can hold tokens, are left out.
+type sentryEvent struct {
+	EventID   string            `json:"event_id"`
+	Timestamp string            `json:"timestamp"`
+	Level     string            `json:"level"`
+	Platform  string            `json:"platform"`
+	Logger    string            `json:"logger"`
+	Message   string            `json:"message"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	User      map[string]string `json:"user,omitempty"`
+	Request   map[string]string `json:"request,omitempty"`
+	Extra     map[string]string `json:"extra,omitempty"`
+}
+
+func (s *sentryReporter) Report(p panicReport) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	ev := sentryEvent{
+		EventID:   hex.EncodeToString(id),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Level:     "error",
+		Platform:  "go",
+		Logger:    serviceName,
+		Message:   fmt.Sprintf("panic: %v", p.Value),
+		Tags:      map[string]string{"route": p.Route, "request_id": p.RequestID},
+		Extra:     map[string]string{"stack": string(p.Stack)},
+	}
+	if p.User != "" {
+		ev.User = map[string]string{"id": p.User}
+	}
+	if p.Request != nil {
+		ev.Request = map[string]string{"method": p.Request.Method, "url": p.Request.URL.Path}
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logError("Failed to encode the sentry event", "err", err)
+		return
+	}
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		req, err := http.NewRequest(http.MethodPost, s.storeURL, bytes.NewReader(body))
+		if err != nil {
+			logWarn("Failed to report to sentry", "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", s.auth)
+		res, err := s.client.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode/100 != 2 {
+				err = fmt.Errorf("sentry answered %v", res.Status)
+			}
+		}
+		if err != nil {
+			logWarn("Failed to report to sentry", "err", err)
+		}
+	}()
+}
+
+func (s *sentryReporter) Flush() {
+	s.pending.Wait()
+}
+
+// gcpReporter reports the panics to Cloud Error Reporting.
+type gcpReporter struct {
+	client *errorreporting.Client
+}
+
+// newGCPReporter returns the reporter of the GCP project, authenticated with
+// opts.
+func newGCPReporter(ctx context.Context, project string, opts ...option.ClientOption) (*gcpReporter, error) {
+	c, err := errorreporting.NewClient(ctx, project, errorreporting.Config{
+		ServiceName: serviceName,
+		OnError: func(err error) {
+			logWarn("Failed to report to Cloud Error Reporting", "err", err)
+		},
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcpReporter{client: c}, nil
+}
+
+func (g *gcpReporter) Report(p panicReport) {
+	var req *http.Request
+	if r := p.Request; r != nil {
+		// The query and headers, which can hold tokens, are left out.
+		req = &http.Request{Method: r.Method, Host: r.Host, RequestURI: r.URL.Path, RemoteAddr: r.RemoteAddr,
+			Header: http.Header{"User-Agent": r.Header["User-Agent"]}}
+	}
+	g.client.Report(errorreporting.Entry{
+		Error: fmt.Errorf("panic: %v", p.Value),
+		Req:   req,
+		User:  p.User,
+		Stack: p.Stack,
+	})
+}
+
+func (g *gcpReporter) Flush() {
+	g.client.Flush()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	roomsCollection = "rooms"
+
+	// maxRoomMessages is the maximum number of messages listed per room.
+	maxRoomMessages = 200
+)
+
+var (
+	// rooms caches the rooms collection, kept up to date by watchRooms.
+	// While it is empty any room may be posted to, like before rooms were
+	// registered.
+	rooms   = make(map[string]*room)
+	roomsMu sync.RWMutex
+
+	validRoomID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+)
+
+// room is a chat of its own, the messages of which carry its id. Its
+// document id is the room id.
+type room struct {
+	ID        string    `firestore:"-" json:"id"`
+	Name      string    `firestore:"name" json:"name"`
+	Topic     string    `firestore:"topic,omitempty" json:"topic,omitempty"`
+	Private   bool      `firestore:"private,omitempty" json:"private,omitempty"`
+	Archived  bool      `firestore:"archived,omitempty" json:"archived,omitempty"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+}
+
+// roomOpen reports whether messages may be posted to the room id. The
+// default room always is.
+func roomOpen(id string) bool {
+	if id == "" || id == defaultRoom {
+		return true
+	}
+	roomsMu.RLock()
+	defer roomsMu.RUnlock()
+	if len(rooms) == 0 {
+		return true
+	}
+	r, ok := rooms[id]
+	return ok && !r.Archived
+}
+
+// privateRoom reports whether the room id is registered as private.
+func privateRoom(id string) bool {
+	roomsMu.RLock()
+	defer roomsMu.RUnlock()
+	r, ok := rooms[id]
+	return ok && r.Private
+}
+
+// watchRooms keeps the rooms cache in sync with the rooms collection until
+// ctx is done.
+func watchRooms(ctx context.Context) {
+	backoff := minSubscriptionBackoff
+	for ctx.Err() == nil {
+		it := collection(roomsCollection).Snapshots(ctx)
+		for {
+			snap, err := it.Next()
+			if err != nil {
+				logWarn("Rooms watch failed", "err", err, "retry_in", backoff)
+				break
+			}
+			backoff = minSubscriptionBackoff
+
+			docs, err := snap.Documents.GetAll()
+			if err != nil {
+				logWarn("Failed to read the rooms", "err", err)
+				continue
+			}
+			next := make(map[string]*room, len(docs))
+			for _, d := range docs {
+				var r room
+				if err := d.DataTo(&r); err != nil {
+					logError("Invalid room", "room", d.Ref.ID, "err", err)
+					continue
+				}
+				r.ID = d.Ref.ID
+				next[r.ID] = &r
+			}
+			roomsMu.Lock()
+			prev := rooms
+			rooms = next
+			roomsMu.Unlock()
+			for id, r := range next {
+				if r.Private && (prev[id] == nil || !prev[id].Private) && messageIndex != nil {
+					messageIndex.removeRoom(id)
+				}
+			}
+		}
+		it.Stop()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxSubscriptionBackoff {
+			backoff = maxSubscriptionBackoff
+		}
+	}
+}
+
+// getRooms lists the public rooms which aren't archived.
+func getRooms(w http.ResponseWriter, r *http.Request) {
+	roomsMu.RLock()
+	list := make([]*room, 0, len(rooms))
+	for _, rm := range rooms {
+		if !rm.Private && !rm.Archived {
+			list = append(list, rm)
+		}
+	}
+	roomsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	writeJSON(w, map[string]interface{}{"rooms": list})
+}
+
+// roomReadable reports whether the messages of room id can be listed by r,
+// private rooms needing a stream token granting them.
+func roomReadable(r *http.Request, id string) bool {
+	if !isPrivateRoom(id) {
+		return true
+	}
+	claims, err := streamClaimsOf(r)
+	return err == nil && claims.canRead(id)
+}
+
+// getRoomMessages lists the latest settled messages of a room, at most
+// limit, for the clients without Firestore access. Private rooms need a
+// stream token granting them.
+func getRoomMessages(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "room")
+	if !roomReadable(r, id) {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	limit := maxRoomMessages
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxRoomMessages {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	room := id
+	if room == defaultRoom {
+		// The messages of the default room may carry no room, which the
+		// Firestore queries can't match, the clients of Firestore reading
+		// it directly anyway.
+		room = ""
+	}
+	list, err := store.ListSettledInRoom(r.Context(), room)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if id == defaultRoom {
+		named, err := store.ListSettledInRoom(r.Context(), defaultRoom)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		list = append(list, named...)
+		sort.Slice(list, func(i, j int) bool { return list[i].SettledAt.Before(list[j].SettledAt) })
+	}
+	visible := list[:0]
+	for _, m := range list {
+		if !m.Held && m.BoostOf == "" {
+			visible = append(visible, m)
+		}
+	}
+	if len(visible) > limit {
+		visible = visible[len(visible)-limit:]
+	}
+	for _, m := range visible {
+		publicMessage(m)
+	}
+	writeJSON(w, map[string]interface{}{"messages": visible})
+}
+
+// publicMessage readies m to be listed to the clients, with its public id,
+// signed attachment urls and without its secrets.
+func publicMessage(m *Message) {
+	m.ID = publicIDs.Encode(m.ID)
+	if m.ParentID != "" {
+		m.ParentID, m.ThreadID = publicIDs.Encode(m.ParentID), publicIDs.Encode(m.ThreadID)
+	}
+	m.HoldNonce, m.Preimage, m.UID = "", "", ""
+	m.SpamScore, m.PriceMultiplier = 0, 0
+	signAttachments(m)
+}
+
+// postRoom creates or updates a room, the body being a room whose id is the
+// one of the route.
+func postRoom(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "room")
+	if !validRoomID.MatchString(id) || id == defaultRoom {
+		writeError(w, http.StatusBadRequest, "room ids are lowercase letters, digits, - and _, and not the default room")
+		return
+	}
+	var body room
+	if err := decodeJSON(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Name == "" {
+		body.Name = id
+	}
+	updates := []firestore.Update{
+		{Path: "name", Value: body.Name},
+		{Path: "topic", Value: body.Topic},
+		{Path: "private", Value: body.Private},
+		{Path: "archived", Value: body.Archived},
+	}
+	ref := collection(roomsCollection).Doc(id)
+	err := firebaseDb.RunTransaction(r.Context(), func(ctx context.Context, tx *firestore.Transaction) error {
+		if _, err := tx.Get(ref); status.Code(err) == codes.NotFound {
+			body.CreatedAt = appClock.Now()
+			return tx.Create(ref, body)
+		} else if err != nil {
+			return err
+		}
+		return tx.Update(ref, updates)
+	})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	body.ID = id
+	writeJSON(w, body)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// route is a handler of the api, serving the requests of Method on Pattern, a
+// chi pattern such as /invoice/{memo}.
+type route struct {
+	Method  string
+	Pattern string
+	Handler http.HandlerFunc
+}
+
+func get(pattern string, handler http.HandlerFunc) *route {
+	return &route{Method: http.MethodGet, Pattern: pattern, Handler: handler}
+}
+
+func post(pattern string, handler http.HandlerFunc) *route {
+	return &route{Method: http.MethodPost, Pattern: pattern, Handler: handler}
+}
+
+func put(pattern string, handler http.HandlerFunc) *route {
+	return &route{Method: http.MethodPut, Pattern: pattern, Handler: handler}
+}
+
+// requestState is what the middlewares and handlers of a request learn of it
+// along the way, shared by all of them whatever their order.
+type requestState struct {
+	// Route is the pattern of the matched route, by its legacy path, empty
+	// if none matched.
+	Route string
+	// Status and Bytes are those of the answer.
+	Status int
+	Bytes  int
+	// User is the uid of the Firebase ID token of the request, if any.
+	User string
+	// Version is the version of the api negotiated for the request.
+	Version int
+	// RequestID is the id of the request, answered in X-Request-ID, and
+	// TraceID the id of its trace when tracing.
+	RequestID string
+	TraceID   string
+	// Invoice is set by limitInvoices, marking the requests which may
+	// create an invoice, reads or not, so that they are never mirrored.
+	Invoice bool
+}
+
+type requestStateKey struct{}
+
+// stateOf returns the state of r, a throwaway one if r didn't go through the
+// router.
+func stateOf(r *http.Request) *requestState {
+	if s, ok := r.Context().Value(requestStateKey{}).(*requestState); ok {
+		return s
+	}
+	return &requestState{}
+}
+
+// apiMiddlewares returns the middlewares every request of the api goes
+// through, the outermost first. The features applying to all the routes are
+// layered here, those applying to some wrap their handlers instead, e.g.
+// withAuth or limitInvoices.
+func apiMiddlewares() []func(http.Handler) http.Handler {
+	middlewares := []func(http.Handler) http.Handler{requestIDMiddleware, tracingMiddleware, requestMetricsMiddleware}
+	if mirrorURL != "" {
+		middlewares = append(middlewares, mirrorMiddleware)
+	}
+	return append(middlewares,
+		accessLogMiddleware,
+		recoverMiddleware,
+		contentTypeMiddleware,
+		corsMiddleware,
+		versionMiddleware,
+	)
+}
+
+// newRouter returns the handler of the api serving routes behind
+// middlewares.
+func newRouter(routes []*route, middlewares ...func(http.Handler) http.Handler) http.Handler {
+	router := chi.NewRouter()
+	router.Use(trackRequests)
+	router.Use(middlewares...)
+	router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "resource not found")
+	})
+	router.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	})
+	for _, route := range routes {
+		router.Method(route.Method, route.Pattern, route.Handler)
+	}
+	return router
+}
+
+// trackRequests sets up the state of every request and records the status
+// of its answer there.
+func trackRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &requestState{}
+		ctx := context.WithValue(r.Context(), requestStateKey{}, s)
+		h.ServeHTTP(&statusWriter{ResponseWriter: w, state: s}, r.WithContext(ctx))
+	})
+}
+
+// statusWriter records the status and size of an answer, JSON unless the
+// handler tells otherwise.
+type statusWriter struct {
+	http.ResponseWriter
+	state       *requestState
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	w.ResponseWriter.WriteHeader(code)
+	w.wroteHeader = true
+	w.state.Status = code
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.state.Bytes += n
+	return n, err
+}
+
+// Flush makes statusWriter implement http.Flusher, for the event streams.
+func (w *statusWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// jsonWriter is a writer rewriting the values written with writeJSON, such as
+// sparseWriter.
+type jsonWriter interface {
+	WriteJSON(v interface{}) error
+}
+
+// writeJSON answers v indented.
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	if jw, ok := w.(jsonWriter); ok {
+		return jw.WriteJSON(v)
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+var (
+	errEmptyPayload    = errors.New("JSON payload is empty")
+	errPayloadTooLarge = fmt.Errorf("JSON payload is larger than %d bytes", maxJSONPayload)
+)
+
+// maxJSONPayload bounds the JSON bodies read by decodeJSON.
+const maxJSONPayload = 1 << 20
+
+// decodeJSON decodes the JSON body of r into v, at most maxJSONPayload
+// bytes of it.
+func decodeJSON(r *http.Request, v interface{}) error {
+	// Without the ResponseWriter, the connection is just not closed once
+	// the limit is hit.
+	content, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxJSONPayload))
+	r.Body.Close()
+	if err != nil && strings.Contains(err.Error(), "request body too large") {
+		return errPayloadTooLarge
+	}
+	if err != nil {
+		return err
+	}
+	if len(content) == 0 {
+		return errEmptyPayload
+	}
+	return json.Unmarshal(content, v)
+}
+
+// pathParam returns the unescaped value of the parameter name of the route
+// of r.
+func pathParam(r *http.Request, name string) string {
+	v := chi.URLParam(r, name)
+	// chi matches the escaped path when it can't be told from the
+	// unescaped one, e.g. with an escaped slash.
+	if r.URL.RawPath != "" {
+		if u, err := url.PathUnescape(v); err == nil {
+			return u
+		}
+	}
+	return v
+}
+
+// baseURL returns the URL of the api r was sent to: -publicUrl when set,
+// else the host of r, over https when r came over TLS.
+func baseURL(r *http.Request) *url.URL {
+	if publicURL != "" {
+		if u, err := url.Parse(strings.TrimSuffix(publicURL, "/")); err == nil {
+			return u
+		}
+	}
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return &url.URL{Scheme: scheme, Host: strings.TrimSuffix(r.Host, "/")}
+}
+
+// accessLogMiddleware logs every request once answered.
+func accessLogMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		s := stateOf(r)
+		logInfo("Access", "request_id", s.RequestID, "trace_id", s.TraceID, "remote", r.RemoteAddr, "user", s.User,
+			"method", r.Method, "uri", r.URL.RequestURI(), "code", s.Status, "bytes", s.Bytes, "duration", time.Since(start))
+	})
+}
+
+// recoverMiddleware answers 500 to the requests whose handler panicked,
+// rather than dropping the connection, logging the panic and its stack and
+// reporting it to the errorReporters.
+func recoverMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			stack, s := debug.Stack(), stateOf(r)
+			logError("Handler panicked", "request_id", s.RequestID, "method", r.Method, "uri", r.URL.RequestURI(),
+				"err", fmt.Sprint(rec), "stack", string(stack))
+			reportPanic(panicReport{Value: rec, Stack: stack, Request: r, Route: s.Route, RequestID: s.RequestID, User: s.User})
+			if s.Status == 0 {
+				writeError(w, http.StatusInternalServerError, "internal server error")
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// contentTypeMiddleware rejects the requests with a body other than UTF-8
+// JSON, which is all the api takes.
+func contentTypeMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediatype, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		charset, ok := params["charset"]
+		if !ok {
+			charset = "UTF-8"
+		}
+		if r.ContentLength > 0 && !(mediatype == "application/json" && strings.ToUpper(charset) == "UTF-8") {
+			writeError(w, http.StatusUnsupportedMediaType, "bad Content-Type or charset, expected 'application/json'")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
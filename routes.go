@@ -1,39 +1,181 @@
 package main
 
 import (
-	"github.com/ant0ine/go-json-rest/rest"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/lightningnetwork/lnd/lnrpc"
-	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func getInvoice(w rest.ResponseWriter, r *rest.Request) {
-	c, clean := getClient()
-	defer clean()
+func getInvoice(w http.ResponseWriter, r *http.Request) {
+	memo, err := sanitizeMemo(pathParam(r, "memo"), maxInvoiceMemoLength)
+	if err != nil {
+		writeMemoError(w, err)
+		return
+	}
+	pinned := r.URL.Query().Get("pinned") == "true"
+	price, _, err := currentSettings().quote(memo, pinned)
+	if err == errRateUnavailable {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req, err := newInvoiceRequest(r, memo, price)
+	if err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	// Moderated invoices are hold invoices only the backend can settle,
+	// so it stores their message itself, as it does for the pinned ones
+	// whose pin was paid for and the tagged ones, whose tags the clients
+	// don't write.
+	if moderationMode != "" || pinned || len(req.Tags) > 0 {
+		m, res, err := createMessage(r.Context(), req, &lnrpc.Invoice{
+			Memo:  req.Memo,
+			Value: req.Amount,
+		}, &Message{Memo: memo, Pinned: pinned})
+		if err != nil {
+			writeCreateError(w, err)
+			return
+		}
+		j := map[string]interface{}{
+			"id":          publicIDs.Encode(m.ID),
+			"pay_req":     res.PaymentRequest,
+			"amount":      m.Amount,
+			"payer_token": payerToken(m.RHash),
+		}
+		if len(req.Tags) > 0 {
+			j["tags"] = req.Tags
+		}
+		writeJSON(w, j)
+		return
+	}
 
-	memo := r.PathParam("memo")
-	res, err := c.AddInvoice(context.Background(), &lnrpc.Invoice{
-		Memo:  memo,
-		Value: 100,
-	})
+	b := lightning
+	if req.Node != "" {
+		c, clean, err := getNodeClient(req.Node)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer clean()
+		b = lndBackend{c}
+	}
+
+	invoice := &lnrpc.Invoice{
+		Memo:  req.Memo,
+		Value: req.Amount,
+	}
+	prefixMemo(invoice)
+	res, err := b.AddInvoice(r.Context(), invoice)
 	if err != nil {
-		w.WriteJson(map[string]string{"error": err.Error()})
+		writeError(w, http.StatusBadGateway, err.Error())
 		return
 	}
-	w.WriteJson(map[string]string{"pay_req": res.PaymentRequest})
+	j := map[string]interface{}{
+		"pay_req":     res.PaymentRequest,
+		"amount":      req.Amount,
+		"payer_token": payerToken(hex.EncodeToString(res.RHash)),
+	}
+	writeJSON(w, j)
 }
 
-func getPubkey(w rest.ResponseWriter, r *rest.Request) {
-	c, clean := getClient()
-	defer clean()
-
-	res, err := c.GetInfo(context.Background(), &lnrpc.GetInfoRequest{})
+func getPubkey(w http.ResponseWriter, r *http.Request) {
+	res, err := nodeInfo(r.Context())
 	if err != nil {
-		w.WriteJson(map[string]string{"error": err.Error()})
+		writeError(w, http.StatusBadGateway, err.Error())
 		return
 	}
 	j := map[string]string{"pubkey": res.GetIdentityPubkey()}
 	if len(res.GetUris()) > 0 {
 		j["uri"] = res.GetUris()[0]
 	}
-	w.WriteJson(j)
+	writeJSON(w, j)
+}
+
+// getInvoiceStatus returns the state of the invoice of a payment hash, so
+// that clients can poll it without Firestore access. The settled messages
+// answer with the receipt stored at settlement, the others with the invoice
+// looked up in lnd, or LNbits for fallback invoices. The preimage, the proof
+// of payment, is only returned once settled and to the payer, with the
+// payer token of the invoice.
+func getInvoiceStatus(w http.ResponseWriter, r *http.Request) {
+	// The router wants the placeholder named like the one of getInvoice.
+	hash := pathParam(r, "memo")
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 {
+		writeError(w, http.StatusBadRequest, "invalid payment hash")
+		return
+	}
+
+	m, err := store.FindByPaymentHash(r.Context(), hash)
+	if err != nil && err != errMessageNotFound {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	payer := isPayer(r, hash)
+	if m != nil && m.Settled && m.Preimage != "" {
+		j := map[string]interface{}{
+			"id":               publicIDs.Encode(m.ID),
+			"state":            strings.ToLower(lnrpc.Invoice_SETTLED.String()),
+			"amount_paid_msat": m.AmountPaidMsat,
+			"settled_at":       m.SettledAt.UTC(),
+		}
+		if payer {
+			j["preimage"] = m.Preimage
+		}
+		// The refund of a late payment is only handed to its payer.
+		if m.Expired && firestoreEnabled() && payer {
+			lnurl, ok, err := refundOf(r.Context(), m.ID)
+			if err != nil {
+				writeError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			if ok {
+				j["refund"] = lnurl
+			}
+		}
+		writeJSON(w, j)
+		return
+	}
+
+	var invoice *lnrpc.Invoice
+	switch {
+	case m != nil && m.Tags[backendTag] == backendLnbits:
+		invoice, err = lookupFallbackInvoice(r.Context(), m)
+	case m != nil:
+		invoice, err = messageLightning(m).LookupInvoice(r.Context(), hash)
+	default:
+		invoice, err = lightning.LookupInvoice(r.Context(), hash)
+	}
+	if status.Code(err) == codes.NotFound || (err != nil && strings.Contains(err.Error(), "unable to locate invoice")) {
+		writeErrorCode(w, http.StatusNotFound, codeUnknownInvoice, "invoice not found", nil)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	j := map[string]interface{}{
+		"state":            strings.ToLower(invoice.GetState().String()),
+		"amount_paid_msat": invoice.GetAmtPaidMsat(),
+	}
+	if m != nil {
+		j["id"] = publicIDs.Encode(m.ID)
+	}
+	if invoice.GetState() == lnrpc.Invoice_SETTLED {
+		if invoice.GetSettleDate() != 0 {
+			j["settled_at"] = time.Unix(invoice.GetSettleDate(), 0).UTC()
+		}
+		if payer {
+			j["preimage"] = hex.EncodeToString(invoice.GetRPreimage())
+		}
+	}
+	writeJSON(w, j)
 }
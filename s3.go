@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	sseAES256 = "AES256"
+	sseKMS    = "aws:kms"
+)
+
+// s3Client talks to the S3 compatible stores.
+var s3Client = &http.Client{Timeout: time.Minute}
+
+// s3Dest is a bucket and key prefix of an S3 compatible storage, AWS or
+// MinIO for instance. The credentials are the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY of the environment.
+type s3Dest struct {
+	Bucket   string
+	Prefix   string
+	Region   string
+	Endpoint string
+
+	// SSE is the server-side encryption of the objects, AES256 or
+	// aws:kms with the key KMSKeyID, empty for the bucket default.
+	SSE      string
+	KMSKeyID string
+
+	accessKey, secretKey string
+}
+
+// parseS3Dest parses an s3 destination flag, e.g.
+// s3://bucket/prefix?region=eu-west-1&sse=aws:kms&kms_key_id=..., with
+// endpoint=https://minio.example.com for the other S3 compatible stores.
+func parseS3Dest(s string) (*s3Dest, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 destination %q, expected s3://bucket/prefix", s)
+	}
+	q := u.Query()
+	d := &s3Dest{
+		Bucket:    u.Host,
+		Prefix:    strings.Trim(u.Path, "/"),
+		Region:    q.Get("region"),
+		Endpoint:  strings.TrimSuffix(q.Get("endpoint"), "/"),
+		SSE:       q.Get("sse"),
+		KMSKeyID:  q.Get("kms_key_id"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	if d.Region == "" {
+		d.Region = "us-east-1"
+	}
+	switch d.SSE {
+	case "", sseAES256:
+	case sseKMS:
+	default:
+		return nil, fmt.Errorf("unknown server-side encryption %q", d.SSE)
+	}
+	if d.KMSKeyID != "" && d.SSE != sseKMS {
+		return nil, fmt.Errorf("kms_key_id needs sse=%v", sseKMS)
+	}
+	if d.accessKey == "" || d.secretKey == "" {
+		return nil, fmt.Errorf("s3 destinations need AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return d, nil
+}
+
+// objectURL returns the url of the object key, path-style for custom
+// endpoints, which MinIO expects, virtual-hosted for AWS.
+func (d *s3Dest) objectURL(key string) string {
+	escaped := (&url.URL{Path: "/" + key}).EscapedPath()
+	if d.Endpoint != "" {
+		return d.Endpoint + "/" + d.Bucket + escaped
+	}
+	return fmt.Sprintf("https://%v.s3.%v.amazonaws.com%v", d.Bucket, d.Region, escaped)
+}
+
+// sseHeaders are the server-side encryption headers of the uploads.
+func (d *s3Dest) sseHeaders() map[string]string {
+	headers := make(map[string]string)
+	if d.SSE != "" {
+		headers["X-Amz-Server-Side-Encryption"] = d.SSE
+	}
+	if d.KMSKeyID != "" {
+		headers["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = d.KMSKeyID
+	}
+	return headers
+}
+
+// do sends a request on the object name under the prefix, signed with AWS
+// Signature Version 4, and returns the object key.
+func (d *s3Dest) do(ctx context.Context, method, name string, headers map[string]string, body []byte) (string, error) {
+	key := path.Join(d.Prefix, name)
+	req, err := http.NewRequest(method, d.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	d.sign(req, body, appClock.Now().UTC())
+
+	res, err := s3Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return "", fmt.Errorf("s3 %v %v: %v %s", strings.ToLower(method), key, res.Status, bytes.TrimSpace(msg))
+	}
+	return key, nil
+}
+
+// put uploads body as the object name under the prefix and returns its
+// s3:// url.
+func (d *s3Dest) put(ctx context.Context, name, contentType string, body []byte) (string, error) {
+	headers := d.sseHeaders()
+	headers["Content-Type"] = contentType
+	key, err := d.do(ctx, http.MethodPut, name, headers, body)
+	if err != nil {
+		return "", err
+	}
+	return "s3://" + d.Bucket + "/" + key, nil
+}
+
+// exists reports whether the object name exists under the prefix.
+func (d *s3Dest) exists(ctx context.Context, name string) (bool, error) {
+	_, err := d.do(ctx, http.MethodHead, name, nil, nil)
+	if err != nil && strings.Contains(err.Error(), "404") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// presign returns a url granting method on the object name under the prefix
+// for expiry, without credentials, the requests having to carry headers.
+func (d *s3Dest) presign(method, name string, headers map[string]string, expiry time.Duration, t time.Time) string {
+	u, _ := url.Parse(d.objectURL(path.Join(d.Prefix, name)))
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	scope := day + "/" + d.Region + "/s3/aws4_request"
+
+	signed := map[string]string{"host": u.Host}
+	for k, v := range headers {
+		signed[strings.ToLower(k)] = v
+	}
+	canonicalHeaders, signedHeaders := canonicalize(signed)
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", d.accessKey+"/"+scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expiry/time.Second)))
+	q.Set("X-Amz-SignedHeaders", signedHeaders)
+	query := strings.Replace(q.Encode(), "+", "%20", -1)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		query,
+		canonicalHeaders,
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	u.RawQuery = query + "&X-Amz-Signature=" + d.signature(day, amzDate, scope, canonicalRequest)
+	return u.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalize returns the canonical headers of the lower case headers, and
+// the list of their names.
+func canonicalize(headers map[string]string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	return canonical.String(), strings.Join(names, ";")
+}
+
+// signature returns the signature of a canonical request.
+func (d *s3Dest) signature(day, amzDate, scope, canonicalRequest string) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+d.secretKey), day)
+	key = hmacSHA256(key, d.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// sign adds the AWS Signature Version 4 of req to its headers, every x-amz
+// header included.
+func (d *s3Dest) sign(req *http.Request, body []byte, t time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") || k == "content-type" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	canonicalHeaders, signedHeaders := canonicalize(headers)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := day + "/" + d.Region + "/s3/aws4_request"
+	signature := d.signature(day, amzDate, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		d.accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// searchRefreshInterval is the interval at which the index catches up
+	// with the messages settled by the other replicas, and searchOverlap how
+	// far back each refresh looks.
+	searchRefreshInterval = time.Minute
+	searchOverlap         = 5 * time.Minute
+
+	// maxSearchTerms bounds the words of a query.
+	maxSearchTerms = 10
+)
+
+// messageIndex is the in-memory full text index of the settled public
+// messages of -search, nil without it.
+var messageIndex *searchIndex
+
+// searchIndex maps the words of the memos to the messages using them.
+type searchIndex struct {
+	mu       sync.RWMutex
+	messages map[string]*Message
+	terms    map[string]map[string]bool
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		messages: make(map[string]*Message),
+		terms:    make(map[string]map[string]bool),
+	}
+}
+
+// searchTerms returns the lowercase words of s.
+func searchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// add indexes m, a copy of it, unless it isn't shown publicly: held,
+// hidden, a boost, a direct message or in a private room.
+func (x *searchIndex) add(m *Message) {
+	if !m.Settled || m.Held || m.Hidden || m.BoostOf != "" || m.DM != nil || isPrivateRoom(m.Room) {
+		return
+	}
+	c := *m
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.messages[c.ID]; ok {
+		return
+	}
+	x.messages[c.ID] = &c
+	for _, t := range searchTerms(c.Memo) {
+		ids := x.terms[t]
+		if ids == nil {
+			ids = make(map[string]bool)
+			x.terms[t] = ids
+		}
+		ids[c.ID] = true
+	}
+}
+
+// remove drops the message id from the index.
+func (x *searchIndex) remove(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	m, ok := x.messages[id]
+	if !ok {
+		return
+	}
+	delete(x.messages, id)
+	for _, t := range searchTerms(m.Memo) {
+		if ids := x.terms[t]; ids != nil {
+			delete(ids, id)
+			if len(ids) == 0 {
+				delete(x.terms, t)
+			}
+		}
+	}
+}
+
+// removeRoom drops the messages of room from the index, once it turned
+// private.
+func (x *searchIndex) removeRoom(room string) {
+	x.mu.RLock()
+	var ids []string
+	for id, m := range x.messages {
+		if m.Room == room {
+			ids = append(ids, id)
+		}
+	}
+	x.mu.RUnlock()
+	for _, id := range ids {
+		x.remove(id)
+	}
+}
+
+// search returns at most limit messages whose memo has all the terms, in
+// room unless "*", latest first after cursor, and in the rooms readable
+// reports readable, which are checked again since they may have turned
+// private since indexed.
+func (x *searchIndex) search(terms []string, room string, cursor messageCursor, limit int, readable func(room string) bool) []*Message {
+	x.mu.RLock()
+	sets := make([]map[string]bool, 0, len(terms))
+	for _, t := range terms {
+		ids := x.terms[t]
+		if len(ids) == 0 {
+			x.mu.RUnlock()
+			return nil
+		}
+		sets = append(sets, ids)
+	}
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+
+	var list []*Message
+	for id := range sets[0] {
+		found := true
+		for _, ids := range sets[1:] {
+			if !ids[id] {
+				found = false
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		m := x.messages[id]
+		switch {
+		case room == "*":
+		case room == "":
+			if m.Room != "" && m.Room != defaultRoom {
+				continue
+			}
+		case m.Room != room:
+			continue
+		}
+		if cursor.ID != "" && !afterCursor(m, cursor) || !readable(m.Room) {
+			continue
+		}
+		c := *m
+		list = append(list, &c)
+	}
+	x.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return afterCursor(list[j], messageCursor{SettledAt: list[i].SettledAt, ID: list[i].ID})
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// afterCursor reports whether m comes after cursor, latest first.
+func afterCursor(m *Message, cursor messageCursor) bool {
+	if m.SettledAt.Equal(cursor.SettledAt) {
+		return m.ID < cursor.ID
+	}
+	return m.SettledAt.Before(cursor.SettledAt)
+}
+
+// indexMessage adds m to the index of -search, if any.
+func indexMessage(m *Message) {
+	if messageIndex != nil {
+		messageIndex.add(m)
+	}
+}
+
+// unindexMessage drops the message id, unsettled or hidden, from the index
+// of -search, if any.
+func unindexMessage(id string) {
+	if messageIndex != nil {
+		messageIndex.remove(id)
+	}
+}
+
+// unindexEvent drops from the index the message of an event of another
+// replica unsettling or hiding it.
+func unindexEvent(ev event) {
+	if ev.Type != eventMessageHidden && ev.Type != eventMessageUnsettled {
+		return
+	}
+	data, _ := ev.Data.(map[string]interface{})
+	public, _ := data["id"].(string)
+	if id, err := publicIDs.Decode(public); err == nil {
+		unindexMessage(id)
+	}
+}
+
+// indexMessages fills the index with the settled messages of the store,
+// then keeps catching up with those settled by the other replicas, or
+// posted without settling through markSettled, until ctx is done.
+func indexMessages(ctx context.Context) {
+	var from time.Time
+	for {
+		to := appClock.Now()
+		list, err := store.ListSettled(ctx, from, to)
+		if err != nil {
+			logWarn("Failed to index the messages", "err", err)
+		} else {
+			for _, m := range list {
+				messageIndex.add(m)
+			}
+			from = to.Add(-searchOverlap)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(searchRefreshInterval):
+		}
+	}
+}
+
+// getSearch lists the settled public messages whose memo has all the words
+// of q, latest first, in room, the default one being main and all rooms
+// being *, a page of at most limit at a time like getMessages.
+func getSearch(w http.ResponseWriter, r *http.Request) {
+	if messageIndex == nil {
+		writeError(w, http.StatusNotImplemented, "search is disabled, see -search")
+		return
+	}
+	q := r.URL.Query()
+	terms := searchTerms(q.Get("q"))
+	if len(terms) == 0 || len(terms) > maxSearchTerms {
+		writeError(w, http.StatusBadRequest, "q needs 1 to 10 words")
+		return
+	}
+	room := q.Get("room")
+	if room == "" {
+		room = "*"
+	}
+	if room == defaultRoom {
+		room = ""
+	}
+	limit := defaultPageMessages
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxRoomMessages {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	var cursor messageCursor
+	if v := q.Get("before"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		cursor = c
+	}
+
+	list := messageIndex.search(terms, room, cursor, limit, func(room string) bool {
+		return roomReadable(r, room)
+	})
+	j := map[string]interface{}{}
+	if len(list) == limit {
+		j["next"] = encodeCursor(list[len(list)-1])
+	}
+	for _, m := range list {
+		publicMessage(m)
+	}
+	if list == nil {
+		list = []*Message{}
+	}
+	j["messages"] = list
+	writeJSON(w, j)
+}
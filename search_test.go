@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSearchIndexRemoval(t *testing.T) {
+	now := time.Now()
+	x := newSearchIndex()
+	for i, room := range []string{"", "a", "b"} {
+		x.add(&Message{ID: fmt.Sprint(i), Memo: "hello world", Room: room, Settled: true, SettledAt: now})
+	}
+	x.add(&Message{ID: "hidden", Memo: "hello", Settled: true, Hidden: true, SettledAt: now})
+	all := func(string) bool { return true }
+	found := func(readable func(string) bool) []string {
+		return messageIDs(x.search([]string{"hello"}, "*", messageCursor{}, 10, readable))
+	}
+
+	if got := fmt.Sprint(found(all)); got != "[2 1 0]" {
+		t.Fatalf("search = %v, want the 3 messages not hidden", got)
+	}
+	x.remove("1")
+	x.remove("missing")
+	if got := fmt.Sprint(found(all)); got != "[2 0]" {
+		t.Fatalf("search after remove = %v, want [2 0]", got)
+	}
+	if got := fmt.Sprint(found(func(room string) bool { return room != "b" })); got != "[0]" {
+		t.Fatalf("search of the readable rooms = %v, want [0]", got)
+	}
+	x.removeRoom("b")
+	if len(x.messages) != 1 || len(x.terms["world"]) != 1 {
+		t.Fatalf("index left with %d messages and %d for world, want 1", len(x.messages), len(x.terms["world"]))
+	}
+	x.remove("0")
+	if len(x.terms) != 0 {
+		t.Fatalf("terms left after removing every message: %v", x.terms)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const sessionsCollection = "sessions"
+
+var (
+	// holdOutsideSessions holds the messages paid while no live session
+	// is running, until the next one starts.
+	holdOutsideSessions bool
+
+	errSessionActive = errors.New("a session is already running")
+)
+
+func init() {
+	registerJob("publish_held", publishHeld, defaultRetryPolicy)
+}
+
+// session is a live stream. Messages settled while it runs, or held until
+// it started, are attributed to it.
+type session struct {
+	ID         string     `firestore:"-" json:"id"`
+	Title      string     `firestore:"title" json:"title,omitempty"`
+	Active     bool       `firestore:"active" json:"active"`
+	StartedAt  time.Time  `firestore:"started_at" json:"started_at"`
+	StoppedAt  *time.Time `firestore:"stopped_at,omitempty" json:"stopped_at,omitempty"`
+	Count      int64      `firestore:"count" json:"count"`
+	AmountMsat int64      `firestore:"amount_msat" json:"amount_msat"`
+}
+
+func sessionFromSnapshot(s *firestore.DocumentSnapshot) (*session, error) {
+	var sess session
+	if err := s.DataTo(&sess); err != nil {
+		return nil, err
+	}
+	sess.ID = s.Ref.ID
+	return &sess, nil
+}
+
+// activeSession returns the running session, nil if there is none.
+func activeSession(ctx context.Context) (*session, error) {
+	if !firestoreEnabled() {
+		return nil, nil
+	}
+	snapshot, err := collection(sessionsCollection).Where("active", "==", true).Limit(1).Documents(ctx).GetAll()
+	if err != nil || len(snapshot) == 0 {
+		return nil, err
+	}
+	return sessionFromSnapshot(snapshot[0])
+}
+
+// recordSessionRevenue adds a settled message to the totals of a session.
+func recordSessionRevenue(ctx context.Context, id string, amountMsat int64) {
+	err := waitForWrite(ctx, sessionsCollection)
+	if err == nil {
+		ref := collection(sessionsCollection).Doc(id)
+		err = firebaseDb.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			s, err := tx.Get(ref)
+			if err != nil {
+				return err
+			}
+			sess, err := sessionFromSnapshot(s)
+			if err != nil {
+				return err
+			}
+			return tx.Update(ref, []firestore.Update{
+				{Path: "count", Value: sess.Count + 1},
+				{Path: "amount_msat", Value: sess.AmountMsat + amountMsat},
+			})
+		})
+	}
+	if err != nil {
+		logError("Failed to update the revenue of session", "session_id", id, "err", err)
+	}
+}
+
+// sessionPayload is the payload of publish_held jobs.
+type sessionPayload struct {
+	Session string `json:"session"`
+}
+
+// publishHeld is the job handler publishing the messages held until the
+// start of a session.
+func publishHeld(ctx context.Context, j *job) (interface{}, error) {
+	var p sessionPayload
+	if err := j.decodePayload(&p); err != nil {
+		return nil, err
+	}
+	held, err := store.ListHeld(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	published := 0
+	for i, m := range held {
+		first, err := store.Publish(ctx, m.ID, p.Session)
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			published++
+			m.Held = false
+			m.SessionID = p.Session
+			notifySettled(m, &lnrpc.Invoice{PaymentRequest: m.Invoice, RHash: heldPaymentHash(m)})
+			indexMessage(m)
+			if m.DM == nil {
+				runBots(ctx, m)
+			}
+			recordSessionRevenue(ctx, p.Session, m.AmountPaidMsat)
+		}
+		j.reportProgress(ctx, i+1, len(held))
+	}
+	return map[string]int{"published": published}, nil
+}
+
+// heldPaymentHash returns the payment hash of a held message, nil if it
+// isn't known.
+func heldPaymentHash(m *Message) []byte {
+	hash, _ := hex.DecodeString(m.RHash)
+	return hash
+}
+
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := collection(sessionsCollection).
+		OrderBy("started_at", firestore.Desc).
+		Limit(100).
+		Documents(r.Context()).GetAll()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	list := make([]*session, 0, len(snapshot))
+	for _, s := range snapshot {
+		sess, err := sessionFromSnapshot(s)
+		if err != nil {
+			continue
+		}
+		list = append(list, sess)
+	}
+	writeJSON(w, map[string]interface{}{"sessions": list})
+}
+
+// postSession starts a session and the job publishing the messages held
+// until then.
+func postSession(w http.ResponseWriter, r *http.Request) {
+	var sess session
+	if err := decodeJSON(r, &sess); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sess = session{Title: sess.Title, Active: true, StartedAt: appClock.Now()}
+
+	if err := waitForWrite(r.Context(), sessionsCollection); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	col := collection(sessionsCollection)
+	ref := col.NewDoc()
+	err := firebaseDb.RunTransaction(r.Context(), func(ctx context.Context, tx *firestore.Transaction) error {
+		running, err := tx.Documents(col.Where("active", "==", true).Limit(1)).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(running) > 0 {
+			return errSessionActive
+		}
+		return tx.Create(ref, sess)
+	})
+	if err == errSessionActive {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	sess.ID = ref.ID
+
+	j, err := enqueueJob(r.Context(), "publish_held", sessionPayload{Session: sess.ID})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]interface{}{"session": sess, "job": j})
+}
+
+// postSessionStop stops a running session.
+func postSessionStop(w http.ResponseWriter, r *http.Request) {
+	ref := collection(sessionsCollection).Doc(pathParam(r, "id"))
+	s, err := ref.Get(r.Context())
+	if status.Code(err) == codes.NotFound {
+		writeError(w, http.StatusNotFound, "unknown session")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	sess, err := sessionFromSnapshot(s)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !sess.Active {
+		writeError(w, http.StatusConflict, "session already stopped")
+		return
+	}
+
+	now := appClock.Now()
+	err = updateDoc(r.Context(), ref, []firestore.Update{
+		{Path: "active", Value: false},
+		{Path: "stopped_at", Value: now},
+	})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	sess.Active = false
+	sess.StoppedAt = &now
+	writeJSON(w, sess)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// drainProgressInterval is how often the progress of a drain stage is
+// logged.
+const drainProgressInterval = 5 * time.Second
+
+var (
+	// drainTimeout bounds how long the in-flight invoice updates, requests
+	// and webhook deliveries are drained for on shutdown.
+	drainTimeout = defaultDrainTimeout
+
+	defaultDrainTimeout = 30 * time.Second
+
+	// backgroundCtx is done once the process is shutting down, stopping
+	// the loops started with goBackground.
+	backgroundCtx, stopBackground = context.WithCancel(context.Background())
+	backgroundLoops               sync.WaitGroup
+	backgroundRunning             int64
+
+	// draining is set once shutting down, failing /readyz so that load
+	// balancers stop sending requests.
+	draining int32
+
+	drainPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "shutdown_drain_pending",
+		Help:      "Work left to drain on shutdown by stage (background, dead_letters, requests, webhooks).",
+	}, []string{"stage"})
+
+	drainSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "shutdown_drain_seconds",
+		Help:      "Time the stages of the shutdown drain took.",
+	}, []string{"stage"})
+)
+
+func init() {
+	prometheus.MustRegister(drainPending, drainSeconds)
+}
+
+// goBackground runs loop in its own goroutine with backgroundCtx, shutdown
+// waiting for it to return.
+func goBackground(loop func(ctx context.Context)) {
+	backgroundLoops.Add(1)
+	atomic.AddInt64(&backgroundRunning, 1)
+	go func() {
+		defer func() {
+			atomic.AddInt64(&backgroundRunning, -1)
+			backgroundLoops.Done()
+		}()
+		loop(backgroundCtx)
+	}()
+}
+
+// listen runs listenAndServe in its own goroutine, exiting the process if it
+// fails for another reason than its server being shut down.
+func listen(listenAndServe func() error) {
+	go func() {
+		if err := listenAndServe(); err != http.ErrServerClosed {
+			logError("Server failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then drains, within
+// drainTimeout:
+//   - the background loops, the watcher finishing the settlement it was
+//     recording;
+//   - the dead letters, retried once;
+//   - the requests in flight, the servers no longer accepting new ones;
+//   - the webhook deliveries in flight;
+//   - the pending error reports.
+//
+// It then saves the invoice checkpoint and closes the stores. The servers
+// are stopped after the background loops so that the metrics of the drain
+// can still be scraped. A second signal kills the process right away.
+func waitForShutdown(servers ...*http.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	logInfo("Shutting down", "signal", <-sig, "drain_timeout", drainTimeout)
+	signal.Stop(sig)
+	atomic.StoreInt32(&draining, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	drain(ctx, "background", func() int64 { return atomic.LoadInt64(&backgroundRunning) }, func() {
+		stopBackground()
+		backgroundLoops.Wait()
+	})
+	drain(ctx, "dead_letters", func() int64 { return int64(pendingDeadLetters()) }, func() {
+		flushDeadLetters(ctx)
+	})
+	drain(ctx, "requests", nil, func() {
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				logError("Failed to drain the requests", "err", err)
+			}
+		}
+	})
+	drain(ctx, "webhooks", func() int64 { return atomic.LoadInt64(&webhooksPending) }, webhookDeliveries.Wait)
+	drain(ctx, "error_reports", nil, flushErrorReports)
+	saveCheckpoint()
+	if eventTopic != nil {
+		eventTopic.Stop()
+	}
+
+	if s, ok := store.(*sqlStore); ok {
+		if err := s.db.Close(); err != nil {
+			logError("Failed to close the message store", "err", err)
+		}
+	}
+	if firestoreEnabled() {
+		if err := firebaseDb.Close(); err != nil {
+			logError("Failed to close Firestore", "err", err)
+		}
+	}
+}
+
+// drain runs wait until it returns or ctx is done, logging the progress of
+// stage and reporting it in the metrics, pending returning the work left
+// when it can be counted.
+func drain(ctx context.Context, stage string, pending func() int64, wait func()) {
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+
+	report := func() {
+		if pending == nil {
+			logInfo("Draining", "stage", stage)
+			return
+		}
+		left := pending()
+		drainPending.WithLabelValues(stage).Set(float64(left))
+		logInfo("Draining", "stage", stage, "pending", left)
+	}
+	report()
+	ticker := time.NewTicker(drainProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			if pending != nil {
+				drainPending.WithLabelValues(stage).Set(0)
+			}
+			drainSeconds.WithLabelValues(stage).Set(time.Since(start).Seconds())
+			logInfo("Drained", "stage", stage, "duration", time.Since(start))
+			return
+		case <-ctx.Done():
+			if pending != nil {
+				drainPending.WithLabelValues(stage).Set(float64(pending()))
+			}
+			drainSeconds.WithLabelValues(stage).Set(time.Since(start).Seconds())
+			logWarn("Drain timed out", "stage", stage, "after", drainTimeout)
+			return
+		case <-ticker.C:
+			report()
+		}
+	}
+}
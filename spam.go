@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// payerIdleTimeout is how long the history of a payer is kept after its
+	// last invoice.
+	payerIdleTimeout = 24 * time.Hour
+
+	// maxPendingPayers bounds the unpaid messages whose payer is kept to
+	// credit it once they settle.
+	maxPendingPayers = 100000
+)
+
+var (
+	// spamPricing are the multipliers of -spamPricing applied to the price
+	// of the messages scoring at least their score, by increasing score.
+	// Without any, messages are scored but priced as usual.
+	spamPricing []spamTier
+
+	spamScorers []spamScorer
+
+	payers = &payerHistory{
+		payers:  make(map[string]*payerRecord),
+		pending: make(map[string]string),
+	}
+
+	spamScores = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "spam_score",
+		Help:      "Spam score of the messages requested.",
+		Buckets:   []float64{0.25, 0.5, 1, 1.5, 2, 3},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(spamScores)
+	registerSpamScorer("url_density", 1, scoreURLDensity)
+	registerSpamScorer("repetition", 1, scoreRepetition)
+	registerSpamScorer("banned_proximity", 1, scoreBannedProximity)
+	registerSpamScorer("payer_history", 1, scorePayerHistory)
+}
+
+// spamScorer scores how much a message looks like spam, from 0 to 1, its
+// weight telling how much it adds to the score of the message. payer is the
+// requester the history is kept for, see payerKey.
+type spamScorer struct {
+	name   string
+	weight float64
+	score  func(memo, payer string) float64
+}
+
+// registerSpamScorer adds a scorer to the ones the score of the messages
+// sums.
+func registerSpamScorer(name string, weight float64, score func(memo, payer string) float64) {
+	spamScorers = append(spamScorers, spamScorer{name: name, weight: weight, score: score})
+}
+
+// spamTier multiplies the price of the messages scoring at least Score.
+type spamTier struct {
+	Score      float64 `json:"score"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+// parseSpamPricing parses the tiers of the -spamPricing flag, e.g.
+// "1:2,2:5" doubling the price from a score of 1 and multiplying it by 5
+// from 2.
+func parseSpamPricing(s string) ([]spamTier, error) {
+	var tiers []spamTier
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid spam tier %q, want score:multiplier", field)
+		}
+		score, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || score <= 0 {
+			return nil, fmt.Errorf("invalid spam tier score %q", parts[0])
+		}
+		multiplier, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || multiplier < 1 {
+			return nil, fmt.Errorf("invalid spam tier multiplier %q, must be at least 1", parts[1])
+		}
+		tiers = append(tiers, spamTier{Score: score, Multiplier: multiplier})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Score < tiers[j].Score })
+	return tiers, nil
+}
+
+// scoreSpam returns the score of a message and the multiplier of its price.
+func scoreSpam(memo, payer string) (score, multiplier float64) {
+	for _, s := range spamScorers {
+		score += s.weight * math.Max(0, math.Min(1, s.score(memo, payer)))
+	}
+	spamScores.Observe(score)
+	multiplier = 1
+	for _, t := range spamPricing {
+		if score >= t.Score {
+			multiplier = t.Multiplier
+		}
+	}
+	return score, multiplier
+}
+
+// multiplied returns amount multiplied, rounded up.
+func multiplied(amount int64, multiplier float64) int64 {
+	if multiplier <= 1 {
+		return amount
+	}
+	return int64(math.Ceil(float64(amount) * multiplier))
+}
+
+// memoWords returns the lowercase words of memo.
+func memoWords(memo string) []string {
+	return strings.FieldsFunc(strings.ToLower(memo), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// scoreURLDensity scores the share of the words of memo which are urls, a
+// message of links scoring 1.
+func scoreURLDensity(memo, payer string) float64 {
+	fields := strings.Fields(strings.ToLower(memo))
+	if len(fields) == 0 {
+		return 0
+	}
+	urls := 0
+	for _, f := range fields {
+		if strings.Contains(f, "://") || strings.HasPrefix(f, "www.") {
+			urls++
+		}
+	}
+	return 2 * float64(urls) / float64(len(fields))
+}
+
+// scoreRepetition scores the words repeated in memo and the characters
+// repeated in a row, e.g. "buy buy buy" or "!!!!!!".
+func scoreRepetition(memo, payer string) float64 {
+	var words float64
+	if w := memoWords(memo); len(w) >= 4 {
+		distinct := make(map[string]bool, len(w))
+		for _, word := range w {
+			distinct[word] = true
+		}
+		words = 1 - float64(len(distinct))/float64(len(w))
+	}
+
+	var runes, repeated, run int
+	var last rune
+	for _, r := range memo {
+		runes++
+		if r == last && !unicode.IsSpace(r) {
+			run++
+		} else {
+			run = 1
+		}
+		last = r
+		// Runs count from their 4th character on.
+		if run > 3 {
+			repeated++
+		}
+	}
+	var chars float64
+	if runes > 0 {
+		chars = 2 * float64(repeated) / float64(runes)
+	}
+	return math.Max(words, chars)
+}
+
+// scoreBannedProximity scores the words coming close to a banned word, the
+// exact ones being rejected, e.g. spamm or s.p.a.m.
+func scoreBannedProximity(memo, payer string) float64 {
+	banned := currentSettings().BannedWords
+	if len(banned) == 0 {
+		return 0
+	}
+	words := memoWords(memo)
+	// Words spelled out letter by letter are joined back.
+	var spelled []string
+	var letters string
+	for _, w := range append(words, "") {
+		if utf8.RuneCountInString(w) == 1 {
+			letters += w
+			continue
+		}
+		if utf8.RuneCountInString(letters) > 1 {
+			spelled = append(spelled, letters)
+		}
+		letters = ""
+	}
+	for _, b := range banned {
+		// Shorter words are too close to too many others.
+		if len(b) < 4 {
+			continue
+		}
+		for _, w := range append(words, spelled...) {
+			if strings.Contains(w, b) || editDistance(w, b) == 1 {
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// scorePayerHistory scores the invoices the payer requested and left
+// unpaid, the paid ones vouching for it.
+func scorePayerHistory(memo, payer string) float64 {
+	requested, paid := payers.history(payer)
+	unpaid := requested - paid
+	if unpaid <= 0 {
+		return 0
+	}
+	return float64(unpaid) / float64(unpaid+5*paid+5)
+}
+
+// payerKey returns the key the history of a requester is kept under, its
+// user or its IP address for anonymous requests.
+func payerKey(user, ip string) string {
+	if user != "" {
+		return "uid:" + user
+	}
+	return "ip:" + ip
+}
+
+type payerRecord struct {
+	requested, paid int
+	lastSeen        time.Time
+}
+
+// payerHistory counts the invoices each payer requested and paid, in memory
+// like the rate limits.
+type payerHistory struct {
+	mu     sync.Mutex
+	payers map[string]*payerRecord
+
+	// pending are the payers of the unpaid messages, by message ID.
+	pending map[string]string
+}
+
+func (h *payerHistory) history(payer string) (requested, paid int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if p, ok := h.payers[payer]; ok {
+		return p.requested, p.paid
+	}
+	return 0, 0
+}
+
+// requested records that payer requested the invoice of message id.
+func (h *payerHistory) requested(payer, id string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.payers[payer]
+	if !ok {
+		if len(h.payers) >= maxTrackedClients {
+			for k, idle := range h.payers {
+				if now.Sub(idle.lastSeen) > payerIdleTimeout {
+					delete(h.payers, k)
+				}
+			}
+		}
+		p = &payerRecord{}
+		h.payers[payer] = p
+	}
+	p.requested++
+	p.lastSeen = now
+	if len(h.pending) >= maxPendingPayers {
+		for k := range h.pending {
+			delete(h.pending, k)
+			if len(h.pending) < maxPendingPayers/2 {
+				break
+			}
+		}
+	}
+	h.pending[id] = payer
+}
+
+// paid credits the payer of message id once it settled.
+func (h *payerHistory) paid(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	payer, ok := h.pending[id]
+	if !ok {
+		return
+	}
+	delete(h.pending, id)
+	if p, ok := h.payers[payer]; ok {
+		p.paid++
+	}
+}
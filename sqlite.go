@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+
+	// Registers the sqlite3 driver, which needs cgo.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const defaultSqlitePath = "chat-backend.db"
+
+// sqliteMigrations are the schema migrations of the sqlite store, in order.
+// Released migrations must never be edited, add new ones instead.
+var sqliteMigrations = []string{
+	`CREATE TABLE messages (
+		id TEXT PRIMARY KEY,
+		invoice TEXT NOT NULL UNIQUE,
+		r_hash TEXT NOT NULL DEFAULT '',
+		memo TEXT NOT NULL DEFAULT '',
+		room TEXT NOT NULL DEFAULT '',
+		amount INTEGER NOT NULL DEFAULT 0,
+		tags TEXT NOT NULL DEFAULT '',
+		dm TEXT NOT NULL DEFAULT '',
+		author TEXT NOT NULL DEFAULT '',
+		created_at DATETIME,
+		settled BOOLEAN NOT NULL DEFAULT FALSE,
+		expired BOOLEAN NOT NULL DEFAULT FALSE,
+		held BOOLEAN NOT NULL DEFAULT FALSE,
+		settled_at DATETIME,
+		amount_paid_msat INTEGER NOT NULL DEFAULT 0,
+		session_id TEXT NOT NULL DEFAULT '',
+		published_at DATETIME
+	);
+	CREATE INDEX messages_unsettled ON messages (id) WHERE NOT settled;
+	CREATE INDEX messages_held ON messages (id) WHERE held;
+	CREATE INDEX messages_settled_at ON messages (settled_at);
+	CREATE INDEX messages_room ON messages (room);`,
+	`ALTER TABLE messages ADD COLUMN hold_nonce TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN pending_review BOOLEAN NOT NULL DEFAULT FALSE;
+	CREATE INDEX messages_pending_review ON messages (id) WHERE pending_review;`,
+	`ALTER TABLE messages ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE messages ADD COLUMN boost_of TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN reaction TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN boost_total_msat INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN reactions TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE messages ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE messages ADD COLUMN flagged BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE messages ADD COLUMN flag_reason TEXT NOT NULL DEFAULT '';
+	CREATE INDEX messages_flagged ON messages (created_at) WHERE flagged;`,
+	`ALTER TABLE messages ADD COLUMN language TEXT NOT NULL DEFAULT '';`,
+	`CREATE INDEX messages_r_hash ON messages (r_hash);`,
+	`ALTER TABLE messages ADD COLUMN preimage TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE messages ADD COLUMN attachments TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE messages ADD COLUMN uid TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE bans (
+		uid TEXT PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);`,
+	`ALTER TABLE messages ADD COLUMN spam_score REAL NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN price_multiplier REAL NOT NULL DEFAULT 0;`,
+	`CREATE INDEX messages_room_settled_at ON messages (room, settled_at) WHERE settled;`,
+	`CREATE INDEX messages_pinned ON messages (settled_at) WHERE pinned;`,
+	`CREATE TABLE audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		at DATETIME NOT NULL,
+		action TEXT NOT NULL,
+		message_id TEXT NOT NULL DEFAULT '',
+		r_hash TEXT NOT NULL DEFAULT '',
+		amount_msat INTEGER NOT NULL DEFAULT 0,
+		detail TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX audit_message_id ON audit (message_id);
+	CREATE INDEX audit_r_hash ON audit (r_hash);
+	CREATE TRIGGER audit_no_update BEFORE UPDATE ON audit BEGIN SELECT RAISE(ABORT, 'the audit log is append only'); END;
+	CREATE TRIGGER audit_no_delete BEFORE DELETE ON audit BEGIN SELECT RAISE(ABORT, 'the audit log is append only'); END;`,
+	`ALTER TABLE messages ADD COLUMN amount_msat INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE messages ADD COLUMN onchain_address TEXT NOT NULL DEFAULT '';
+	CREATE INDEX messages_onchain_address ON messages (onchain_address) WHERE onchain_address <> '';`,
+	`ALTER TABLE messages ADD COLUMN fiat_currency TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN fiat_amount REAL NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN fiat_rate REAL NOT NULL DEFAULT 0;`,
+	`ALTER TABLE messages ADD COLUMN parent_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN thread_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX messages_thread_id ON messages (thread_id, settled_at) WHERE thread_id <> '';`,
+}
+
+// openSqlite opens, creating it if needed, the sqlite database at path and
+// migrates it.
+func openSqlite(path string) (*sqlStore, error) {
+	if path == "" {
+		path = defaultSqlitePath
+	}
+	db, err := sql.Open("sqlite3", "file:"+cleanAndExpandPath(path)+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	// Writes are serialized by sqlite anyway, a single connection avoids
+	// busy errors.
+	db.SetMaxOpenConns(1)
+	noRebind := func(query string) string { return query }
+	if err := migrate(db, noRebind, sqliteMigrations); err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: db, rebind: noRebind}, nil
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// sqlStore is the MessageStore of the SQL databases. Queries are written
+// with ? placeholders, which rebind rewrites for the databases using
+// another syntax. Times are stored in UTC so that they compare as text in
+// sqlite.
+type sqlStore struct {
+	db     *sql.DB
+	rebind func(query string) string
+
+	// forUpdate locks the rows selected in transactions, for the databases
+	// which don't serialize them anyway.
+	forUpdate string
+}
+
+// migrate brings the schema up to date by applying, in order, the
+// migrations not recorded in the schema_migrations table yet.
+func migrate(db *sql.DB, rebind func(string) string, migrations []string) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for i := current; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		if _, err := tx.Exec(rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebindDollar rewrites ? placeholders as $1, $2...
+func rebindDollar(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+const messageColumns = `id, invoice, r_hash, memo, room, amount, tags, dm, author, created_at,
+	settled, expired, held, settled_at, amount_paid_msat, session_id, hold_nonce, pending_review, pinned,
+	boost_of, reaction, boost_total_msat, reactions, language, preimage, attachments, uid, spam_score, price_multiplier, amount_msat, onchain_address,
+	fiat_currency, fiat_amount, fiat_rate, parent_id, thread_id, hidden, flagged, flag_reason`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMessage(row rowScanner) (*Message, error) {
+	var (
+		m                                        Message
+		tags, dm, author, reactions, attachments string
+		createdAt, settle                        sql.NullTime
+	)
+	err := row.Scan(&m.ID, &m.Invoice, &m.RHash, &m.Memo, &m.Room, &m.Amount, &tags, &dm, &author, &createdAt,
+		&m.Settled, &m.Expired, &m.Held, &settle, &m.AmountPaidMsat, &m.SessionID, &m.HoldNonce, &m.PendingReview, &m.Pinned,
+		&m.BoostOf, &m.Reaction, &m.BoostTotalMsat, &reactions, &m.Language, &m.Preimage, &attachments, &m.UID,
+		&m.SpamScore, &m.PriceMultiplier, &m.AmountMsat, &m.OnchainAddress,
+		&m.FiatCurrency, &m.FiatAmount, &m.FiatRate, &m.ParentID, &m.ThreadID,
+		&m.Hidden, &m.Flagged, &m.FlagReason)
+	if err != nil {
+		return nil, err
+	}
+	m.CreatedAt = createdAt.Time
+	m.SettledAt = settle.Time
+	if tags != "" {
+		if err := json.Unmarshal([]byte(tags), &m.Tags); err != nil {
+			return nil, &messageValidationError{ID: m.ID, Field: "tags", Reason: err.Error()}
+		}
+	}
+	if dm != "" {
+		if err := json.Unmarshal([]byte(dm), &m.DM); err != nil {
+			return nil, &messageValidationError{ID: m.ID, Field: "dm", Reason: err.Error()}
+		}
+	}
+	if author != "" {
+		if err := json.Unmarshal([]byte(author), &m.Author); err != nil {
+			return nil, &messageValidationError{ID: m.ID, Field: "author", Reason: err.Error()}
+		}
+	}
+	if reactions != "" {
+		if err := json.Unmarshal([]byte(reactions), &m.Reactions); err != nil {
+			return nil, &messageValidationError{ID: m.ID, Field: "reactions", Reason: err.Error()}
+		}
+	}
+	if attachments != "" {
+		if err := json.Unmarshal([]byte(attachments), &m.Attachments); err != nil {
+			return nil, &messageValidationError{ID: m.ID, Field: "attachments", Reason: err.Error()}
+		}
+	}
+	if err := validateMessage(&m); err != nil {
+		return nil, err
+	}
+	fillAmountMsat(&m)
+	return &m, nil
+}
+
+// jsonColumn encodes the value of a JSON text column, empty for nil values.
+func jsonColumn(v interface{}, isNil bool) (string, error) {
+	if isNil {
+		return "", nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (st *sqlStore) queryMessages(ctx context.Context, query string, args ...interface{}) ([]*Message, error) {
+	rows, err := st.db.QueryContext(ctx, st.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if skipMalformed(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+func (st *sqlStore) queryMessage(ctx context.Context, query string, args ...interface{}) (*Message, error) {
+	m, err := scanMessage(st.db.QueryRowContext(ctx, st.rebind(query), args...))
+	if err == sql.ErrNoRows {
+		return nil, errMessageNotFound
+	}
+	return m, err
+}
+
+func (st *sqlStore) CreateMessage(ctx context.Context, m *Message) error {
+	id, err := newMessageID()
+	if err != nil {
+		return err
+	}
+	tags, err := jsonColumn(m.Tags, len(m.Tags) == 0)
+	if err != nil {
+		return err
+	}
+	dm, err := jsonColumn(m.DM, m.DM == nil)
+	if err != nil {
+		return err
+	}
+	author, err := jsonColumn(m.Author, m.Author == nil)
+	if err != nil {
+		return err
+	}
+	attachments, err := jsonColumn(m.Attachments, len(m.Attachments) == 0)
+	if err != nil {
+		return err
+	}
+	_, err = st.db.ExecContext(ctx, st.rebind(`INSERT INTO messages
+		(id, invoice, r_hash, memo, room, amount, tags, dm, author, created_at, hold_nonce, pinned, boost_of, reaction, language,
+		attachments, uid, spam_score, price_multiplier, amount_msat, onchain_address, fiat_currency, fiat_amount, fiat_rate,
+		parent_id, thread_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		id, m.Invoice, m.RHash, m.Memo, m.Room, m.Amount, tags, dm, author, m.CreatedAt.UTC(), m.HoldNonce, m.Pinned,
+		m.BoostOf, m.Reaction, m.Language, attachments, m.UID, m.SpamScore, m.PriceMultiplier, m.AmountMsat, m.OnchainAddress,
+		m.FiatCurrency, m.FiatAmount, m.FiatRate, m.ParentID, m.ThreadID)
+	if err != nil {
+		return err
+	}
+	m.ID = id
+	return nil
+}
+
+func (st *sqlStore) GetMessage(ctx context.Context, id string) (*Message, error) {
+	return st.queryMessage(ctx, `SELECT `+messageColumns+` FROM messages WHERE id = ?`, id)
+}
+
+func (st *sqlStore) FindByInvoice(ctx context.Context, invoice string) (*Message, error) {
+	return st.queryMessage(ctx, `SELECT `+messageColumns+` FROM messages WHERE invoice = ?`, invoice)
+}
+
+func (st *sqlStore) FindByPaymentHash(ctx context.Context, hash string) (*Message, error) {
+	return st.queryMessage(ctx, `SELECT `+messageColumns+` FROM messages WHERE r_hash = ?`, hash)
+}
+
+func (st *sqlStore) FindByOnchainAddress(ctx context.Context, address string) (*Message, error) {
+	return st.queryMessage(ctx, `SELECT `+messageColumns+` FROM messages WHERE onchain_address = ?`, address)
+}
+
+func (st *sqlStore) ListUnsettled(ctx context.Context) ([]*Message, error) {
+	return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages WHERE NOT settled AND NOT expired`)
+}
+
+func (st *sqlStore) ListUnsettledPage(ctx context.Context, after string, limit int) ([]*Message, error) {
+	return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE NOT settled AND id > ? ORDER BY id LIMIT ?`, after, limit)
+}
+
+func (st *sqlStore) ListHeld(ctx context.Context) ([]*Message, error) {
+	return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages WHERE held ORDER BY settled_at`)
+}
+
+func (st *sqlStore) ListSettledInRoom(ctx context.Context, room string) ([]*Message, error) {
+	return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE room = ? AND settled AND NOT hidden ORDER BY settled_at`, room)
+}
+
+func (st *sqlStore) ListSettledPage(ctx context.Context, room string, cursor messageCursor, limit int) ([]*Message, error) {
+	other := room
+	if room == "" {
+		other = defaultRoom
+	}
+	if cursor.ID == "" {
+		return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages
+			WHERE room IN (?, ?) AND settled AND NOT held AND NOT hidden AND boost_of = ''
+			ORDER BY settled_at DESC, id DESC LIMIT ?`, room, other, limit)
+	}
+	at := cursor.SettledAt.UTC()
+	return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE room IN (?, ?) AND settled AND NOT held AND NOT hidden AND boost_of = ''
+		AND (settled_at < ? OR (settled_at = ? AND id < ?))
+		ORDER BY settled_at DESC, id DESC LIMIT ?`, room, other, at, at, cursor.ID, limit)
+}
+
+func (st *sqlStore) ListTopSettled(ctx context.Context, room string, since time.Time, limit int) ([]*Message, error) {
+	other := room
+	if room == "" {
+		other = defaultRoom
+	}
+	return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE room IN (?, ?) AND settled AND NOT held AND NOT hidden AND boost_of = '' AND settled_at >= ?
+		ORDER BY amount_paid_msat + boost_total_msat DESC, settled_at DESC LIMIT ?`, room, other, since.UTC(), limit)
+}
+
+func (st *sqlStore) ListPinned(ctx context.Context, room string, limit int) ([]*Message, error) {
+	other := room
+	if room == "" {
+		other = defaultRoom
+	}
+	return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE room IN (?, ?) AND pinned AND settled AND NOT held AND NOT hidden AND boost_of = ''
+		ORDER BY settled_at DESC, id DESC LIMIT ?`, room, other, limit)
+}
+
+func (st *sqlStore) ListThread(ctx context.Context, threadID string, limit int) ([]*Message, error) {
+	return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE thread_id = ? AND settled AND NOT held AND NOT hidden ORDER BY settled_at, id LIMIT ?`, threadID, limit)
+}
+
+func (st *sqlStore) ListPendingReview(ctx context.Context) ([]*Message, error) {
+	return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages WHERE pending_review`)
+}
+
+func (st *sqlStore) ListSettled(ctx context.Context, from, to time.Time) ([]*Message, error) {
+	return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE settled_at >= ? AND settled_at < ? ORDER BY settled_at`, from.UTC(), to.UTC())
+}
+
+func (st *sqlStore) MarkSettled(ctx context.Context, id string, s Settlement) (bool, error) {
+	res, err := st.db.ExecContext(ctx, st.rebind(`UPDATE messages
+		SET settled = TRUE, settled_at = ?, amount_paid_msat = ?, session_id = ?, held = ?, preimage = ?, pending_review = FALSE
+		WHERE id = ? AND NOT settled`),
+		s.SettledAt.UTC(), s.AmountPaidMsat, s.SessionID, s.Held, s.Preimage, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return n > 0, err
+	}
+	// Nothing updated, the message is either missing or already settled.
+	_, err = st.GetMessage(ctx, id)
+	return false, err
+}
+
+func (st *sqlStore) MarkUnsettled(ctx context.Context, id string) (bool, error) {
+	res, err := st.db.ExecContext(ctx, st.rebind(`UPDATE messages
+		SET settled = FALSE, settled_at = NULL, amount_paid_msat = 0, session_id = '', held = FALSE, preimage = ''
+		WHERE id = ? AND settled`), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return n > 0, err
+	}
+	_, err = st.GetMessage(ctx, id)
+	return false, err
+}
+
+func (st *sqlStore) MarkPendingReview(ctx context.Context, id string) (bool, error) {
+	res, err := st.db.ExecContext(ctx, st.rebind(`UPDATE messages SET pending_review = TRUE
+		WHERE id = ? AND NOT settled AND NOT expired AND NOT pending_review`), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (st *sqlStore) Hide(ctx context.Context, id string) (bool, error) {
+	res, err := st.db.ExecContext(ctx, st.rebind(`UPDATE messages SET hidden = TRUE WHERE id = ? AND NOT hidden`), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		_, err = st.GetMessage(ctx, id)
+	}
+	return n > 0, err
+}
+
+func (st *sqlStore) Flag(ctx context.Context, id, reason string) error {
+	res, err := st.db.ExecContext(ctx, st.rebind(`UPDATE messages SET flagged = TRUE, flag_reason = ? WHERE id = ?`), reason, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = errMessageNotFound
+	}
+	return err
+}
+
+func (st *sqlStore) ListFlagged(ctx context.Context) ([]*Message, error) {
+	return st.queryMessages(ctx, `SELECT `+messageColumns+` FROM messages WHERE flagged ORDER BY created_at`)
+}
+
+func (st *sqlStore) Ban(ctx context.Context, uid, reason string) error {
+	_, err := st.db.ExecContext(ctx, st.rebind(`INSERT INTO bans (uid, reason, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (uid) DO UPDATE SET reason = excluded.reason`), uid, reason, appClock.Now().UTC())
+	return err
+}
+
+func (st *sqlStore) IsBanned(ctx context.Context, uid string) (bool, error) {
+	var n int
+	err := st.db.QueryRowContext(ctx, st.rebind(`SELECT COUNT(*) FROM bans WHERE uid = ?`), uid).Scan(&n)
+	return n > 0, err
+}
+
+func (st *sqlStore) SetPaymentHash(ctx context.Context, id, hash string) error {
+	_, err := st.db.ExecContext(ctx, st.rebind(`UPDATE messages SET r_hash = ? WHERE id = ? AND r_hash = ''`), hash, id)
+	return err
+}
+
+func (st *sqlStore) Expire(ctx context.Context, id string) error {
+	res, err := st.db.ExecContext(ctx, st.rebind(`UPDATE messages SET expired = TRUE, pending_review = FALSE
+		WHERE id = ? AND NOT settled`), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, err := st.GetMessage(ctx, id); err != nil {
+		return err
+	}
+	return errAlreadySettled
+}
+
+func (st *sqlStore) Delete(ctx context.Context, id string) error {
+	res, err := st.db.ExecContext(ctx, st.rebind(`DELETE FROM messages WHERE id = ? AND NOT settled`), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, err := st.GetMessage(ctx, id); err != nil {
+		return err
+	}
+	return errAlreadySettled
+}
+
+func (st *sqlStore) Publish(ctx context.Context, id, sessionID string) (bool, error) {
+	res, err := st.db.ExecContext(ctx, st.rebind(`UPDATE messages
+		SET held = FALSE, session_id = ?, published_at = ?
+		WHERE id = ? AND held`),
+		sessionID, appClock.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (st *sqlStore) AddBoost(ctx context.Context, id string, amountMsat int64, reaction string) (*Message, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	m, err := scanMessage(tx.QueryRowContext(ctx, st.rebind(`SELECT `+messageColumns+` FROM messages WHERE id = ?`+st.forUpdate), id))
+	if err == sql.ErrNoRows {
+		return nil, errMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.BoostTotalMsat += amountMsat
+	if reaction != "" {
+		if m.Reactions == nil {
+			m.Reactions = make(map[string]int64)
+		}
+		m.Reactions[reaction]++
+	}
+	reactions, err := jsonColumn(m.Reactions, len(m.Reactions) == 0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, st.rebind(`UPDATE messages SET boost_total_msat = ?, reactions = ? WHERE id = ?`),
+		m.BoostTotalMsat, reactions, id)
+	if err != nil {
+		return nil, err
+	}
+	return m, tx.Commit()
+}
+
+func (st *sqlStore) AppendAudit(ctx context.Context, e *auditEntry) error {
+	_, err := st.db.ExecContext(ctx, st.rebind(`INSERT INTO audit (at, action, message_id, r_hash, amount_msat, detail)
+		VALUES (?, ?, ?, ?, ?, ?)`), e.At.UTC(), e.Action, e.MessageID, e.RHash, e.AmountMsat, e.Detail)
+	return err
+}
+
+func (st *sqlStore) ListAudit(ctx context.Context, id, hash string) ([]*auditEntry, error) {
+	rows, err := st.db.QueryContext(ctx, st.rebind(`SELECT id, at, action, message_id, r_hash, amount_msat, detail FROM audit
+		WHERE (message_id = ? AND message_id <> '') OR (r_hash = ? AND r_hash <> '') ORDER BY at, id`), id, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*auditEntry
+	for rows.Next() {
+		var e auditEntry
+		var entryID int64
+		if err := rows.Scan(&entryID, &e.At, &e.Action, &e.MessageID, &e.RHash, &e.AmountMsat, &e.Detail); err != nil {
+			return nil, err
+		}
+		e.ID = strconv.FormatInt(entryID, 10)
+		list = append(list, &e)
+	}
+	return list, rows.Err()
+}
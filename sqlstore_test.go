@@ -0,0 +1,432 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// openTestStore opens a fresh sqlite store in the temporary directory of t.
+func openTestStore(t *testing.T) *sqlStore {
+	t.Helper()
+	st, err := openSqlite(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.db.Close() })
+	return st
+}
+
+// testInvoices numbers the invoices of the test messages.
+var testInvoices int
+
+// createUnsettled stores a message of room created at createdAt.
+func createUnsettled(t *testing.T, st *sqlStore, room string, createdAt time.Time) *Message {
+	t.Helper()
+	testInvoices++
+	n := testInvoices
+	m := &Message{
+		Invoice:   fmt.Sprintf("lnbc%d", n),
+		RHash:     fmt.Sprintf("%064x", n),
+		Memo:      "hello",
+		Room:      room,
+		Amount:    10,
+		CreatedAt: createdAt,
+	}
+	if err := st.CreateMessage(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// createSettled stores a message of room settled at settledAt.
+func createSettled(t *testing.T, st *sqlStore, room string, settledAt time.Time) *Message {
+	t.Helper()
+	m := createUnsettled(t, st, room, settledAt)
+	if _, err := st.MarkSettled(context.Background(), m.ID, Settlement{SettledAt: settledAt, AmountPaidMsat: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// messageIDs returns the IDs of list.
+func messageIDs(list []*Message) []string {
+	var ids []string
+	for _, m := range list {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestSqlStoreCreateMessage(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	m := &Message{
+		Invoice:    "lnbc1",
+		RHash:      fmt.Sprintf("%064x", 1),
+		Memo:       "hello",
+		Room:       "room",
+		Amount:     21,
+		AmountMsat: 21500,
+		Tags:       map[string]string{"campaign": "launch"},
+		Author:     &lnurlPayerData{Name: "alice"},
+		UID:        "uid",
+		ParentID:   "parent",
+		ThreadID:   "thread",
+		CreatedAt:  now,
+	}
+	if err := st.CreateMessage(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID == "" {
+		t.Fatal("CreateMessage left the ID empty")
+	}
+
+	for name, find := range map[string]func() (*Message, error){
+		"GetMessage":        func() (*Message, error) { return st.GetMessage(ctx, m.ID) },
+		"FindByInvoice":     func() (*Message, error) { return st.FindByInvoice(ctx, m.Invoice) },
+		"FindByPaymentHash": func() (*Message, error) { return st.FindByPaymentHash(ctx, m.RHash) },
+	} {
+		got, err := find()
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if got.ID != m.ID || got.Memo != m.Memo || got.Room != m.Room || got.Amount != m.Amount ||
+			got.AmountMsat != m.AmountMsat || got.Tags["campaign"] != "launch" || got.Author == nil ||
+			got.Author.Name != "alice" || got.UID != m.UID || got.ParentID != m.ParentID ||
+			got.ThreadID != m.ThreadID || !got.CreatedAt.Equal(now) || got.Settled {
+			t.Errorf("%v = %+v, want %+v", name, got, m)
+		}
+	}
+
+	if _, err := st.GetMessage(ctx, "missing"); err != errMessageNotFound {
+		t.Errorf("GetMessage of a missing message = %v, want %v", err, errMessageNotFound)
+	}
+	if err := st.CreateMessage(ctx, &Message{Invoice: m.Invoice, RHash: fmt.Sprintf("%064x", 2)}); err == nil {
+		t.Error("CreateMessage stored a second message of the same invoice")
+	}
+
+	old := &Message{Invoice: "lnbc-old", RHash: fmt.Sprintf("%064x", 3), Amount: 10}
+	if err := st.CreateMessage(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	got, err := st.GetMessage(ctx, old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AmountMsat != 10000 {
+		t.Errorf("AmountMsat of a message stored without one = %v, want 10000", got.AmountMsat)
+	}
+}
+
+func TestSqlStoreMarkSettled(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	m := createUnsettled(t, st, "room", now)
+	s := Settlement{SettledAt: now, AmountPaidMsat: 10000, Preimage: "preimage", SessionID: "session"}
+
+	tests := []struct {
+		name    string
+		id      string
+		want    bool
+		wantErr error
+	}{
+		{"first settlement", m.ID, true, nil},
+		{"settled again", m.ID, false, nil},
+		{"missing message", "missing", false, errMessageNotFound},
+	}
+	for _, tt := range tests {
+		settled, err := st.MarkSettled(ctx, tt.id, s)
+		if settled != tt.want || err != tt.wantErr {
+			t.Errorf("%v: MarkSettled = %v, %v, want %v, %v", tt.name, settled, err, tt.want, tt.wantErr)
+		}
+	}
+
+	got, err := st.GetMessage(ctx, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Settled || !got.SettledAt.Equal(now) || got.AmountPaidMsat != s.AmountPaidMsat ||
+		got.Preimage != s.Preimage || got.SessionID != s.SessionID {
+		t.Errorf("settled message = %+v, want the settlement %+v", got, s)
+	}
+	if unsettled, err := st.ListUnsettled(ctx); err != nil || len(unsettled) != 0 {
+		t.Errorf("ListUnsettled = %v, %v, want no message", messageIDs(unsettled), err)
+	}
+}
+
+func TestSqlStoreMarkUnsettled(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	settled := createSettled(t, st, "room", now)
+	unsettled := createUnsettled(t, st, "room", now.Add(time.Second))
+
+	tests := []struct {
+		name    string
+		id      string
+		want    bool
+		wantErr error
+	}{
+		{"settled message", settled.ID, true, nil},
+		{"unsettled again", settled.ID, false, nil},
+		{"never settled", unsettled.ID, false, nil},
+		{"missing message", "missing", false, errMessageNotFound},
+	}
+	for _, tt := range tests {
+		reverted, err := st.MarkUnsettled(ctx, tt.id)
+		if reverted != tt.want || err != tt.wantErr {
+			t.Errorf("%v: MarkUnsettled = %v, %v, want %v, %v", tt.name, reverted, err, tt.want, tt.wantErr)
+		}
+	}
+
+	got, err := st.GetMessage(ctx, settled.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Settled || !got.SettledAt.IsZero() || got.AmountPaidMsat != 0 || got.Preimage != "" {
+		t.Errorf("unsettled message = %+v, want its settlement reverted", got)
+	}
+	if ok, err := st.MarkSettled(ctx, settled.ID, Settlement{SettledAt: now, AmountPaidMsat: 1}); err != nil || !ok {
+		t.Errorf("MarkSettled after MarkUnsettled = %v, %v, want true", ok, err)
+	}
+}
+
+func TestSqlStoreExpire(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	unpaid := createUnsettled(t, st, "room", now)
+	paid := createUnsettled(t, st, "room", now)
+	if _, err := st.MarkSettled(ctx, paid.ID, Settlement{SettledAt: now, AmountPaidMsat: 10000}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		id      string
+		wantErr error
+	}{
+		{"unpaid message", unpaid.ID, nil},
+		{"paid message", paid.ID, errAlreadySettled},
+		{"missing message", "missing", errMessageNotFound},
+	}
+	for _, tt := range tests {
+		if err := st.Expire(ctx, tt.id); err != tt.wantErr {
+			t.Errorf("%v: Expire = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if unsettled, err := st.ListUnsettled(ctx); err != nil || len(unsettled) != 0 {
+		t.Errorf("ListUnsettled = %v, %v, want no message", messageIDs(unsettled), err)
+	}
+}
+
+func TestSqlStorePublish(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	held := createUnsettled(t, st, "room", now)
+	if _, err := st.MarkSettled(ctx, held.ID, Settlement{SettledAt: now, AmountPaidMsat: 10000, Held: true}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := st.ListHeld(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(messageIDs(list)) != fmt.Sprint([]string{held.ID}) {
+		t.Errorf("ListHeld = %v, want %v", messageIDs(list), []string{held.ID})
+	}
+
+	for _, want := range []bool{true, false} {
+		published, err := st.Publish(ctx, held.ID, "session")
+		if err != nil || published != want {
+			t.Errorf("Publish = %v, %v, want %v", published, err, want)
+		}
+	}
+	got, err := st.GetMessage(ctx, held.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Held || got.SessionID != "session" {
+		t.Errorf("published message = %+v, want it in the session", got)
+	}
+	if list, err := st.ListHeld(ctx); err != nil || len(list) != 0 {
+		t.Errorf("ListHeld after Publish = %v, %v, want no message", messageIDs(list), err)
+	}
+}
+
+func TestSqlStoreListSettledPage(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// Five messages of the default room, latest first, two sharing their
+	// settlement time, and others which are left out.
+	var want []*Message
+	for _, d := range []time.Duration{4, 3, 3, 2, 1} {
+		want = append(want, createSettled(t, st, defaultRoom, now.Add(d*time.Second)))
+	}
+	if want[1].ID < want[2].ID {
+		want[1], want[2] = want[2], want[1]
+	}
+	createSettled(t, st, "other", now.Add(5*time.Second))
+	createUnsettled(t, st, defaultRoom, now.Add(6*time.Second))
+
+	tests := []struct {
+		name  string
+		room  string
+		limit int
+		want  []*Message
+	}{
+		{"one page", defaultRoom, 10, want},
+		{"empty room is the default one", "", 10, want},
+		{"pages of two", defaultRoom, 2, want},
+		{"pages of one", defaultRoom, 1, want},
+	}
+	for _, tt := range tests {
+		var got []*Message
+		var cursor messageCursor
+		for pages := 0; pages <= len(tt.want); pages++ {
+			page, err := st.ListSettledPage(ctx, tt.room, cursor, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) > tt.limit {
+				t.Fatalf("%v: page of %d messages, over the limit of %d", tt.name, len(page), tt.limit)
+			}
+			if len(page) == 0 {
+				break
+			}
+			got = append(got, page...)
+			last := page[len(page)-1]
+			cursor = messageCursor{SettledAt: last.SettledAt, ID: last.ID}
+		}
+		if fmt.Sprint(messageIDs(got)) != fmt.Sprint(messageIDs(tt.want)) {
+			t.Errorf("%v: listed %v, want %v", tt.name, messageIDs(got), messageIDs(tt.want))
+		}
+	}
+}
+
+func TestSqlStoreListUnsettledPage(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	var want []string
+	for i := 0; i < 5; i++ {
+		want = append(want, createUnsettled(t, st, defaultRoom, now.Add(time.Duration(i)*time.Second)).ID)
+	}
+	createSettled(t, st, defaultRoom, now.Add(time.Minute))
+
+	for _, limit := range []int{1, 2, 10} {
+		var got []string
+		for after := ""; ; {
+			page, err := st.ListUnsettledPage(ctx, after, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) == 0 {
+				break
+			}
+			got = append(got, messageIDs(page)...)
+			after = page[len(page)-1].ID
+		}
+		sorted := append([]string(nil), want...)
+		sort.Strings(sorted)
+		if fmt.Sprint(got) != fmt.Sprint(sorted) {
+			t.Errorf("limit %d: listed %v, want %v", limit, got, sorted)
+		}
+	}
+}
+
+func TestSqlStoreModeration(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	kept := createUnsettled(t, st, "room", now)
+	hidden := createUnsettled(t, st, "room", now)
+	for i, m := range []*Message{kept, hidden} {
+		s := Settlement{SettledAt: now.Add(time.Duration(i) * time.Second), AmountPaidMsat: 10000}
+		if _, err := st.MarkSettled(ctx, m.ID, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ok, err := st.Hide(ctx, hidden.ID); err != nil || !ok {
+		t.Fatalf("Hide = %v, %v, want true", ok, err)
+	}
+	if ok, err := st.Hide(ctx, hidden.ID); err != nil || ok {
+		t.Fatalf("second Hide = %v, %v, want false", ok, err)
+	}
+	if _, err := st.Hide(ctx, "missing"); err != errMessageNotFound {
+		t.Fatalf("Hide of a missing message = %v, want %v", err, errMessageNotFound)
+	}
+	list, err := st.ListSettledInRoom(ctx, "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(messageIDs(list)) != fmt.Sprint([]string{kept.ID}) {
+		t.Errorf("ListSettledInRoom = %v, want only %v", messageIDs(list), kept.ID)
+	}
+
+	if err := st.Flag(ctx, kept.ID, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Flag(ctx, "missing", "spam"); err != errMessageNotFound {
+		t.Fatalf("Flag of a missing message = %v, want %v", err, errMessageNotFound)
+	}
+	flagged, err := st.ListFlagged(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flagged) != 1 || flagged[0].ID != kept.ID || flagged[0].FlagReason != "spam" {
+		t.Fatalf("ListFlagged = %+v, want %v flagged for spam", flagged, kept.ID)
+	}
+
+	for _, reason := range []string{"spam", "abuse"} {
+		if err := st.Ban(ctx, "uid", reason); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for uid, want := range map[string]bool{"uid": true, "other": false} {
+		if banned, err := st.IsBanned(ctx, uid); err != nil || banned != want {
+			t.Errorf("IsBanned(%q) = %v, %v, want %v", uid, banned, err, want)
+		}
+	}
+}
+
+func TestSqlStoreListPinned(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	pin := func(m *Message) *Message {
+		if _, err := st.db.Exec(`UPDATE messages SET pinned = TRUE WHERE id = ?`, m.ID); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	older := pin(createSettled(t, st, defaultRoom, now))
+	latest := pin(createSettled(t, st, defaultRoom, now.Add(time.Second)))
+	createSettled(t, st, defaultRoom, now.Add(2*time.Second))
+	pin(createSettled(t, st, "other", now.Add(3*time.Second)))
+	pin(createUnsettled(t, st, defaultRoom, now.Add(4*time.Second)))
+	hidden := pin(createSettled(t, st, defaultRoom, now.Add(5*time.Second)))
+	if _, err := st.Hide(ctx, hidden.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for limit, want := range map[int][]*Message{1: {latest}, 5: {latest, older}} {
+		list, err := st.ListPinned(ctx, "", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(messageIDs(list)) != fmt.Sprint(messageIDs(want)) {
+			t.Errorf("ListPinned(%d) = %v, want %v", limit, messageIDs(list), messageIDs(want))
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	statsCollection = "stats"
+
+	// totalTag is the pseudo tag of the rollups counting every message.
+	totalTag = "_total"
+
+	maxTagLength = 64
+	dayFormat    = "2006-01-02"
+)
+
+// tagKeys are the message tags accepted at creation, as query parameters
+// of the invoice request, and reported on.
+var tagKeys = []string{"campaign", "source", "widget"}
+
+// tagsFromQuery returns the tags set in the query of r.
+func tagsFromQuery(r *http.Request) (map[string]string, error) {
+	tags := make(map[string]string)
+	q := r.URL.Query()
+	for _, k := range tagKeys {
+		v := q.Get(k)
+		if v == "" {
+			continue
+		}
+		if len(v) > maxTagLength {
+			return nil, fmt.Errorf("tag %v longer than %d bytes", k, maxTagLength)
+		}
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+// rollup is the daily count and revenue of the messages with a given tag
+// value.
+type rollup struct {
+	Day        string `firestore:"day" json:"day,omitempty"`
+	Tag        string `firestore:"tag" json:"-"`
+	Value      string `firestore:"value" json:"value"`
+	Count      int64  `firestore:"count" json:"count"`
+	AmountMsat int64  `firestore:"amount_msat" json:"amount_msat"`
+}
+
+// recordSettlementStats adds a settled message to the daily rollups of its
+// tags.
+func recordSettlementStats(ctx context.Context, m *Message, invoice *lnrpc.Invoice, settledAt time.Time) {
+	if !firestoreEnabled() {
+		return
+	}
+	day := settledAt.UTC().Format(dayFormat)
+	tags := map[string]string{totalTag: ""}
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	for tag, value := range tags {
+		err := incrementRollup(ctx, day, tag, value, invoice.GetAmtPaidMsat())
+		if err != nil {
+			logError("Failed to update rollup", "tag", tag, "day", day, "err", err)
+		}
+	}
+}
+
+func incrementRollup(ctx context.Context, day, tag, value string, amountMsat int64) error {
+	if err := waitForWrite(ctx, statsCollection); err != nil {
+		return err
+	}
+	id := day + "_" + url.PathEscape(tag) + "_" + url.PathEscape(value)
+	ref := collection(statsCollection).Doc(id)
+	return firebaseDb.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		r := rollup{Day: day, Tag: tag, Value: value}
+		s, err := tx.Get(ref)
+		switch {
+		case status.Code(err) == codes.NotFound:
+		case err != nil:
+			return err
+		default:
+			if err := s.DataTo(&r); err != nil {
+				return err
+			}
+		}
+		r.Count++
+		r.AmountMsat += amountMsat
+		return tx.Set(ref, r)
+	})
+}
+
+// dateRange parses the "from" and "to" query parameters, both inclusive
+// days, defaulting to the last 30 days.
+func dateRange(r *http.Request) (time.Time, time.Time, error) {
+	to := appClock.Now().UTC().Truncate(24 * time.Hour)
+	from := to.AddDate(0, 0, -30)
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(dayFormat, v); err != nil {
+			return from, to, fmt.Errorf("invalid from date: %v", v)
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(dayFormat, v); err != nil {
+			return from, to, fmt.Errorf("invalid to date: %v", v)
+		}
+	}
+	if to.Before(from) {
+		return from, to, fmt.Errorf("to date before from date")
+	}
+	return from, to, nil
+}
+
+// sumRollups returns the totals per value of a tag over the days from
+// fromDay to toDay inclusive, by decreasing revenue.
+func sumRollups(ctx context.Context, tag, fromDay, toDay string) ([]*rollup, error) {
+	snapshot, err := collection(statsCollection).Where("tag", "==", tag).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	byValue := make(map[string]*rollup)
+	for _, s := range snapshot {
+		var day rollup
+		if err := s.DataTo(&day); err != nil || day.Day < fromDay || day.Day > toDay {
+			continue
+		}
+		total, ok := byValue[day.Value]
+		if !ok {
+			total = &rollup{Value: day.Value}
+			byValue[day.Value] = total
+		}
+		total.Count += day.Count
+		total.AmountMsat += day.AmountMsat
+	}
+
+	res := make([]*rollup, 0, len(byValue))
+	for _, v := range byValue {
+		res = append(res, v)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].AmountMsat > res[j].AmountMsat
+	})
+	return res, nil
+}
+
+// getStats returns the message count and revenue per value of a tag over a
+// date range, e.g. "/admin/stats?tag=campaign&from=2018-06-01".
+func getStats(w http.ResponseWriter, r *http.Request) {
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		tag = totalTag
+	}
+	from, to, err := dateRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fromDay, toDay := from.Format(dayFormat), to.Format(dayFormat)
+	res, err := sumRollups(r.Context(), tag, fromDay, toDay)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"tag":    tag,
+		"from":   fromDay,
+		"to":     toDay,
+		"values": res,
+	})
+}
+
+// getExport returns the messages settled over a date range as CSV, one
+// column per tag.
+func getExport(w http.ResponseWriter, r *http.Request) {
+	from, to, err := dateRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	messages, err := store.ListSettled(r.Context(), from, to.AddDate(0, 0, 1))
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	messages = filterLanguage(messages, r.URL.Query().Get("language"))
+	messages = filterRoom(messages, r.URL.Query().Get("room"))
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename="+exportName(from, to))
+	writeExport(w, messages)
+}
+
+// exportName is the file name of the export of the messages settled from
+// the day from to the day to.
+func exportName(from, to time.Time) string {
+	return fmt.Sprintf("messages-%v-%v.csv", from.Format(dayFormat), to.Format(dayFormat))
+}
+
+// writeExport writes messages as CSV, one column per tag.
+func writeExport(w io.Writer, messages []*Message) error {
+	out := csv.NewWriter(w)
+	out.Write(append([]string{"id", "settled_at", "amount_paid_msat", "invoice", "language"}, tagKeys...))
+	for _, m := range messages {
+		row := []string{
+			publicIDs.Encode(m.ID),
+			m.SettledAt.UTC().Format(time.RFC3339),
+			strconv.FormatInt(m.AmountPaidMsat, 10),
+			m.Invoice,
+			m.Language,
+		}
+		for _, k := range tagKeys {
+			row = append(row, m.Tags[k])
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
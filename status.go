@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// statusHours is how many hours of history /status reports, sampling
+	// the invoice subscription every statusSampleInterval.
+	statusHours          = 24
+	statusSampleInterval = time.Minute
+
+	// The status is degraded below statusMinUptime of invoice subscription
+	// uptime, above statusMaxErrorRate of requests answered with a 5xx
+	// status, or with a settle lag p95 above -settleLagAlert.
+	statusMinUptime    = 0.99
+	statusMaxErrorRate = 0.05
+
+	// statusMaxLags bounds the settle lags kept per hour.
+	statusMaxLags = 10000
+)
+
+// statusHour is the health recorded over an hour.
+type statusHour struct {
+	start    time.Time
+	sampled  int
+	up       int
+	requests int64
+	errors   int64
+	lags     []float64
+}
+
+// statusHistory is the health of the backend over the last statusHours,
+// kept in memory by each replica, one statusHour per hour of the day.
+var statusHistory struct {
+	sync.Mutex
+	hours [statusHours]statusHour
+}
+
+// statusHourAt returns the statusHour of t, reset when it was last used a
+// day or more before. statusHistory must be locked.
+func statusHourAt(t time.Time) *statusHour {
+	start := t.Truncate(time.Hour)
+	h := &statusHistory.hours[start.Unix()/3600%statusHours]
+	if !h.start.Equal(start) {
+		*h = statusHour{start: start}
+	}
+	return h
+}
+
+// recordStatusRequest records a request answered with code.
+func recordStatusRequest(code int) {
+	statusHistory.Lock()
+	defer statusHistory.Unlock()
+	h := statusHourAt(appClock.Now())
+	h.requests++
+	if code >= 500 {
+		h.errors++
+	}
+}
+
+// recordStatusLag records the lag of a settlement.
+func recordStatusLag(lag time.Duration) {
+	statusHistory.Lock()
+	defer statusHistory.Unlock()
+	h := statusHourAt(appClock.Now())
+	if len(h.lags) < statusMaxLags {
+		h.lags = append(h.lags, lag.Seconds())
+	}
+}
+
+// sampleStatus samples the invoice subscription every statusSampleInterval
+// until ctx is done.
+func sampleStatus(ctx context.Context) {
+	ticker := time.NewTicker(statusSampleInterval)
+	defer ticker.Stop()
+	for {
+		up := subscriptionsUp()
+		statusHistory.Lock()
+		h := statusHourAt(appClock.Now())
+		h.sampled++
+		if up {
+			h.up++
+		}
+		statusHistory.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// statusReport is the health over an hour, or over the whole history.
+type statusReport struct {
+	Start     *time.Time `json:"start,omitempty"`
+	Uptime    *float64   `json:"lnd_stream_uptime,omitempty"`
+	LagP95    float64    `json:"settle_lag_p95_seconds"`
+	Requests  int64      `json:"requests"`
+	ErrorRate float64    `json:"api_error_rate"`
+}
+
+// summarizeStatus sums up hours, with the invoice subscription uptime unless
+// withUptime is false.
+func summarizeStatus(hours []statusHour, withUptime bool) statusReport {
+	var r statusReport
+	var sampled, up int
+	var errors int64
+	var lags []float64
+	for _, h := range hours {
+		sampled += h.sampled
+		up += h.up
+		r.Requests += h.requests
+		errors += h.errors
+		lags = append(lags, h.lags...)
+	}
+	if withUptime && sampled > 0 {
+		uptime := float64(up) / float64(sampled)
+		r.Uptime = &uptime
+	}
+	if r.Requests > 0 {
+		r.ErrorRate = float64(errors) / float64(r.Requests)
+	}
+	if len(lags) > 0 {
+		sort.Float64s(lags)
+		r.LagP95 = lags[(len(lags)*95-1)/100]
+	}
+	return r
+}
+
+// currentStatus returns the overall status, ok, degraded or down, the
+// report of the history and those of its hours, oldest first.
+func currentStatus() (string, statusReport, []statusReport) {
+	since := appClock.Now().Truncate(time.Hour).Add(-(statusHours - 1) * time.Hour)
+	statusHistory.Lock()
+	var hours []statusHour
+	for _, h := range statusHistory.hours {
+		if !h.start.Before(since) {
+			h.lags = append([]float64(nil), h.lags...)
+			hours = append(hours, h)
+		}
+	}
+	statusHistory.Unlock()
+	sort.Slice(hours, func(i, j int) bool { return hours[i].start.Before(hours[j].start) })
+
+	// Followers leave the invoice subscription to the leader.
+	withUptime := !follower
+	total := summarizeStatus(hours, withUptime)
+	perHour := make([]statusReport, len(hours))
+	for i := range hours {
+		perHour[i] = summarizeStatus(hours[i:i+1], withUptime)
+		perHour[i].Start = &hours[i].start
+	}
+
+	state := healthOK
+	switch {
+	case lndHealth() == healthDown, withUptime && streamHealth() != healthOK:
+		state = healthDown
+	case total.Uptime != nil && *total.Uptime < statusMinUptime,
+		total.ErrorRate > statusMaxErrorRate,
+		settleLagAlert > 0 && total.LagP95 > settleLagAlert.Seconds():
+		state = healthDegraded
+	}
+	return state, total, perHour
+}
+
+// getStatus serves the public status of the backend: the health of lnd, and
+// of its subsystems, and of the invoice subscription now and over the last
+// day, with the settle lag p95 and the rate of api errors, overall and per
+// hour.
+func getStatus(w http.ResponseWriter, r *http.Request) {
+	state, total, hours := currentStatus()
+	j := map[string]interface{}{
+		"status":   state,
+		"lnd":      lndHealth(),
+		"stream":   streamHealth(),
+		"last_24h": total,
+		"hours":    hours,
+	}
+	if backendName() == backendLnd {
+		j["lnd_subsystems"] = subsystemsHealth()
+	}
+	writeJSON(w, j)
+}
+
+// badgeColors are the colors of the status badge.
+var badgeColors = map[string]string{
+	healthOK:       "#4c1",
+	healthDegraded: "#dfb317",
+	healthDown:     "#e05d44",
+}
+
+// getStatusBadge serves the status as an SVG badge for community pages.
+func getStatusBadge(w http.ResponseWriter, r *http.Request) {
+	state, _, _ := currentStatus()
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "max-age=60")
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="104" height="20" role="img" aria-label="chat: %[1]s">`+
+		`<title>chat: %[1]s</title>`+
+		`<rect width="36" height="20" fill="#555"/><rect x="36" width="68" height="20" fill="%[2]s"/>`+
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,DejaVu Sans,sans-serif" font-size="11">`+
+		`<text x="18" y="14">chat</text><text x="70" y="14">%[1]s</text></g></svg>`,
+		state, badgeColors[state])
+}
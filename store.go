@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var errMessageNotFound = errors.New("message not found")
+
+// messageValidationError is a stored message which can't be read as a
+// Message or misses what the backend relies on, Field telling which.
+type messageValidationError struct {
+	ID     string
+	Field  string
+	Reason string
+}
+
+func (e *messageValidationError) Error() string {
+	return fmt.Sprintf("malformed message %v: %v: %v", e.ID, e.Field, e.Reason)
+}
+
+// validateMessage checks the fields of a stored message the backend relies
+// on. The messages written by the first clients lack most of the others,
+// which stay optional.
+func validateMessage(m *Message) error {
+	invalid := func(field, reason string) error {
+		return &messageValidationError{ID: m.ID, Field: field, Reason: reason}
+	}
+	switch {
+	case m.Invoice == "":
+		return invalid("invoice", "missing")
+	case m.Amount < 0:
+		return invalid("amount", "negative")
+	case m.AmountMsat < 0:
+		return invalid("amount_msat", "negative")
+	case m.AmountPaidMsat < 0:
+		return invalid("amount_paid_msat", "negative")
+	}
+	if m.RHash != "" {
+		if b, err := hex.DecodeString(m.RHash); err != nil || len(b) != 32 {
+			return invalid("r_hash", "not a hex payment hash")
+		}
+	}
+	if m.Author != nil {
+		if err := m.Author.validate(); err != nil {
+			return invalid("author", err.Error())
+		}
+	}
+	return nil
+}
+
+// fillAmountMsat sets the AmountMsat of the messages stored before it was
+// recorded from their Amount in sats.
+func fillAmountMsat(m *Message) {
+	if m.AmountMsat == 0 {
+		m.AmountMsat = m.Amount * 1000
+	}
+}
+
+// skipMalformed reports whether err, returned reading a message of a list,
+// is a malformed message, counted and logged, which the list goes on
+// without rather than failing.
+func skipMalformed(err error) bool {
+	e, ok := err.(*messageValidationError)
+	if !ok {
+		return false
+	}
+	malformedMessages.WithLabelValues(e.Field).Inc()
+	logWarn("Skipping a malformed message", "doc_id", e.ID, "field", e.Field, "err", e.Reason)
+	return true
+}
+
+// store persists the messages, set up in main.
+var store MessageStore
+
+// Message is a chat message and the invoice paying it.
+type Message struct {
+	ID        string            `firestore:"-" json:"id"`
+	Invoice   string            `firestore:"invoice" json:"invoice,omitempty"`
+	RHash     string            `firestore:"r_hash,omitempty" json:"r_hash,omitempty"`
+	Memo      string            `firestore:"memo,omitempty" json:"memo,omitempty"`
+	Room      string            `firestore:"room,omitempty" json:"room,omitempty"`
+	Amount    int64             `firestore:"amount,omitempty" json:"amount,omitempty"`
+	Pinned    bool              `firestore:"pinned,omitempty" json:"pinned,omitempty"`
+	Tags      map[string]string `firestore:"tags,omitempty" json:"tags,omitempty"`
+	CreatedAt time.Time         `firestore:"created_at,omitempty" json:"created_at,omitempty"`
+
+	// AmountMsat is the value of the invoice, Amount being rounded down to
+	// the sat. The messages created before it was recorded have none.
+	AmountMsat int64 `firestore:"amount_msat,omitempty" json:"amount_msat,omitempty"`
+
+	// OnchainAddress is the address of the lnd wallet the message can also
+	// be paid to, with -onchainMinSats.
+	OnchainAddress string `firestore:"onchain_address,omitempty" json:"onchain_address,omitempty"`
+
+	// FiatAmount is the value of Amount in FiatCurrency at the FiatRate of
+	// its invoice, when the messages are priced in fiat.
+	FiatCurrency string  `firestore:"fiat_currency,omitempty" json:"fiat_currency,omitempty"`
+	FiatAmount   float64 `firestore:"fiat_amount,omitempty" json:"fiat_amount,omitempty"`
+	FiatRate     float64 `firestore:"fiat_rate,omitempty" json:"fiat_rate,omitempty"`
+
+	// DM is the encrypted payload of direct messages and Author the payer
+	// data of the messages paid through LNURL-pay.
+	DM     *dmPayload      `firestore:"dm,omitempty" json:"dm,omitempty"`
+	Author *lnurlPayerData `firestore:"author,omitempty" json:"author,omitempty"`
+
+	Settled        bool      `firestore:"settled" json:"settled,omitempty"`
+	Expired        bool      `firestore:"expired,omitempty" json:"expired,omitempty"`
+	Held           bool      `firestore:"held,omitempty" json:"held,omitempty"`
+	SettledAt      time.Time `firestore:"settled_at,omitempty" json:"settled_at,omitempty"`
+	AmountPaidMsat int64     `firestore:"amount_paid_msat,omitempty" json:"amount_paid_msat,omitempty"`
+	SessionID      string    `firestore:"session_id,omitempty" json:"session_id,omitempty"`
+
+	// Preimage is the hex preimage of the settled invoice, the receipt of
+	// the payment.
+	Preimage string `firestore:"preimage,omitempty" json:"preimage,omitempty"`
+
+	// HoldNonce derives the preimage of the hold invoices of moderated
+	// messages, which are PendingReview once paid until a moderator settles
+	// or cancels them.
+	HoldNonce     string `firestore:"hold_nonce,omitempty" json:"-"`
+	PendingReview bool   `firestore:"pending_review,omitempty" json:"pending_review,omitempty"`
+
+	// BoostOf is the message boosted by this one, which only pays for the
+	// boost and the Reaction it may carry. Boosted messages keep the totals
+	// of their settled boosts, the reactions being counted by reaction.
+	BoostOf        string           `firestore:"boost_of,omitempty" json:"boost_of,omitempty"`
+	Reaction       string           `firestore:"reaction,omitempty" json:"reaction,omitempty"`
+	BoostTotalMsat int64            `firestore:"boost_total_msat,omitempty" json:"boost_total_msat,omitempty"`
+	Reactions      map[string]int64 `firestore:"reactions,omitempty" json:"reactions,omitempty"`
+
+	// ParentID is the message this one replies to, and ThreadID the first
+	// message of its thread, so that a whole thread is read at once.
+	ParentID string `firestore:"parent_id,omitempty" json:"parent_id,omitempty"`
+	ThreadID string `firestore:"thread_id,omitempty" json:"thread_id,omitempty"`
+
+	// Attachments are the keys of the media attached to the message, in
+	// the private storage of -media, and AttachmentURLs their urls, signed
+	// when the message is read through the api.
+	Attachments    []string `firestore:"attachments,omitempty" json:"attachments,omitempty"`
+	AttachmentURLs []string `firestore:"-" json:"attachment_urls,omitempty"`
+
+	// Language is the ISO 639-1 code of the language of the memo, empty
+	// when unknown.
+	Language string `firestore:"language,omitempty" json:"language,omitempty"`
+
+	// UID is the Firebase uid of the user who wrote the message, empty for
+	// anonymous ones.
+	UID string `firestore:"uid,omitempty" json:"uid,omitempty"`
+
+	// SpamScore is the score of the message by the spam scorers and
+	// PriceMultiplier the multiplier of -spamPricing it applied to its
+	// price.
+	SpamScore       float64 `firestore:"spam_score,omitempty" json:"spam_score,omitempty"`
+	PriceMultiplier float64 `firestore:"price_multiplier,omitempty" json:"price_multiplier,omitempty"`
+
+	// Hidden is set by the moderators to leave a message out of the
+	// listings, and Flagged to set it aside for FlagReason.
+	Hidden     bool   `firestore:"hidden,omitempty" json:"hidden,omitempty"`
+	Flagged    bool   `firestore:"flagged,omitempty" json:"flagged,omitempty"`
+	FlagReason string `firestore:"flag_reason,omitempty" json:"flag_reason,omitempty"`
+}
+
+// Settlement describes the settlement of a message.
+type Settlement struct {
+	SettledAt      time.Time
+	AmountPaidMsat int64
+	Preimage       string
+
+	// SessionID is the live session the message is attributed to, and
+	// Held whether it waits for the next one.
+	SessionID string
+	Held      bool
+}
+
+// messageCursor is the position of a message in the settled messages of a
+// room, latest first, the zero cursor being before all of them.
+type messageCursor struct {
+	SettledAt time.Time
+	ID        string
+}
+
+// messageValue is what m was paid, boosts included, in msat.
+func messageValue(m *Message) int64 {
+	return m.AmountPaidMsat + m.BoostTotalMsat
+}
+
+// MessageStore is the storage of the messages. Lookups of a missing message
+// fail with errMessageNotFound.
+type MessageStore interface {
+	// CreateMessage stores a new message and sets its ID.
+	CreateMessage(ctx context.Context, m *Message) error
+
+	GetMessage(ctx context.Context, id string) (*Message, error)
+	FindByInvoice(ctx context.Context, invoice string) (*Message, error)
+
+	// FindByPaymentHash returns the message of the hex payment hash.
+	FindByPaymentHash(ctx context.Context, hash string) (*Message, error)
+
+	// FindByOnchainAddress returns the message of an on-chain fallback
+	// address.
+	FindByOnchainAddress(ctx context.Context, address string) (*Message, error)
+
+	// SetPaymentHash records the hex payment hash of a message created
+	// before they were stored, unless it has one.
+	SetPaymentHash(ctx context.Context, id, hash string) error
+
+	// ListUnsettled returns the messages neither settled nor expired.
+	ListUnsettled(ctx context.Context) ([]*Message, error)
+
+	// ListUnsettledPage returns up to limit messages not settled, expired
+	// or not, by id after the id after, empty for the first page.
+	ListUnsettledPage(ctx context.Context, after string, limit int) ([]*Message, error)
+
+	// ListHeld returns the settled messages held until the next session.
+	ListHeld(ctx context.Context) ([]*Message, error)
+
+	// ListSettledInRoom returns the settled messages of a room.
+	ListSettledInRoom(ctx context.Context, room string) ([]*Message, error)
+
+	// ListSettledPage returns at most limit settled messages of room after
+	// cursor, latest first, leaving out the held ones and the boosts. The
+	// empty room is the default one, whose messages may carry no room.
+	ListSettledPage(ctx context.Context, room string, cursor messageCursor, limit int) ([]*Message, error)
+
+	// ListTopSettled returns at most limit messages of room settled since
+	// since, by decreasing value, their amount paid and boosts, leaving out
+	// the held ones and the boosts like ListSettledPage.
+	ListTopSettled(ctx context.Context, room string, since time.Time, limit int) ([]*Message, error)
+
+	// ListPinned returns at most limit pinned messages of room, latest
+	// first, leaving out the held ones and the boosts like ListSettledPage.
+	ListPinned(ctx context.Context, room string, limit int) ([]*Message, error)
+
+	// ListThread returns at most limit settled replies of the thread of
+	// threadID, its first message, oldest first, leaving out the held ones.
+	ListThread(ctx context.Context, threadID string, limit int) ([]*Message, error)
+
+	// ListSettled returns the messages settled in [from, to), in
+	// settlement order.
+	ListSettled(ctx context.Context, from, to time.Time) ([]*Message, error)
+
+	// ListPendingReview returns the paid messages awaiting moderation.
+	ListPendingReview(ctx context.Context) ([]*Message, error)
+
+	// Hide leaves a message out of the listings and reports whether this
+	// call hid it.
+	Hide(ctx context.Context, id string) (bool, error)
+
+	// Flag sets a message aside for the moderators, and ListFlagged returns
+	// the messages flagged.
+	Flag(ctx context.Context, id, reason string) error
+	ListFlagged(ctx context.Context) ([]*Message, error)
+
+	// Ban bans the user uid from posting, and IsBanned reports whether uid
+	// is banned.
+	Ban(ctx context.Context, uid, reason string) error
+	IsBanned(ctx context.Context, uid string) (bool, error)
+
+	// MarkSettled records the settlement of a message and reports whether
+	// this call flipped it to settled, false meaning it already was. It
+	// ends the review of moderated messages.
+	MarkSettled(ctx context.Context, id string, s Settlement) (bool, error)
+
+	// MarkUnsettled reverts the settlement of a message marked settled by
+	// mistake and reports whether this call reverted it.
+	MarkUnsettled(ctx context.Context, id string) (bool, error)
+
+	// MarkPendingReview queues a message whose hold invoice was paid for
+	// moderation and reports whether this call queued it.
+	MarkPendingReview(ctx context.Context, id string) (bool, error)
+
+	// Expire marks an unpaid message as expired, failing with
+	// errAlreadySettled if it was paid. It ends the review of moderated
+	// messages.
+	Expire(ctx context.Context, id string) error
+
+	// Delete removes an unpaid message, failing with errAlreadySettled if
+	// it was paid.
+	Delete(ctx context.Context, id string) error
+
+	// Publish releases a held message into a session and reports whether
+	// this call released it.
+	Publish(ctx context.Context, id, sessionID string) (bool, error)
+
+	// AddBoost adds a settled boost of amountMsat, and its reaction unless
+	// empty, to the totals of a message and returns the message updated.
+	AddBoost(ctx context.Context, id string, amountMsat int64, reaction string) (*Message, error)
+
+	// AppendAudit appends e to the audit log, whose entries are never
+	// updated nor deleted.
+	AppendAudit(ctx context.Context, e *auditEntry) error
+
+	// ListAudit returns the audit entries of the message id or of the hex
+	// payment hash, oldest first.
+	ListAudit(ctx context.Context, id, hash string) ([]*auditEntry, error)
+}
+
+const messageIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// newMessageID returns a random message ID shaped like the ones Firestore
+// generates, or a UUIDv7 with the uuidv7 public ids.
+func newMessageID() (string, error) {
+	if _, ok := publicIDs.(uuidIDs); ok {
+		return ids.NewUUIDv7(appClock.Now())
+	}
+	return ids.NewID(messageIDAlphabet, 20)
+}
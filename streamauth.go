@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// dmRoomPrefix is the prefix of direct message rooms, which are always
+	// private.
+	dmRoomPrefix = "dm:"
+
+	streamTokenTTL    = 5 * time.Minute
+	maxStreamTokenTTL = time.Hour
+
+	payerTokenHeader = "X-Payer-Token"
+
+	defaultStreamTokenKeyPath = "chat-backend.key"
+)
+
+var (
+	// streamTokenKey signs the tokens required to open event streams and
+	// the payer tokens. Unless one is configured, which is required when
+	// running several instances, a random key is generated once and kept
+	// in a file so that the payer tokens outlive restarts.
+	streamTokenKey []byte
+
+	// privateRooms are the rooms only readable with a token granting
+	// them, in addition to the direct message rooms.
+	privateRooms = make(map[string]bool)
+
+	errInvalidToken = errors.New("invalid or expired token")
+)
+
+// streamClaims are the claims of a stream token.
+type streamClaims struct {
+	// User is the identity of the holder, empty for anonymous tokens.
+	User string `json:"sub,omitempty"`
+
+	// Rooms are the private rooms the holder may subscribe to, on top of
+	// the public ones.
+	Rooms []string `json:"rooms,omitempty"`
+
+	Expiry int64 `json:"exp"`
+}
+
+// canRead reports whether the claims allow subscribing to room.
+func (c *streamClaims) canRead(room string) bool {
+	if !isPrivateRoom(room) {
+		return true
+	}
+	if c.User != "" && room == dmRoomPrefix+c.User {
+		return true
+	}
+	for _, r := range c.Rooms {
+		if r == room {
+			return true
+		}
+	}
+	return false
+}
+
+func isPrivateRoom(room string) bool {
+	return strings.HasPrefix(room, dmRoomPrefix) || privateRooms[room] || privateRoom(room)
+}
+
+// initStreamTokenKey sets the signing key of the stream tokens. If key is
+// empty, it is read from the file at path, generated and saved there on the
+// first start, or generated for the run only without a path.
+func initStreamTokenKey(key, path string) error {
+	if key != "" {
+		streamTokenKey = []byte(key)
+		return nil
+	}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err == nil && len(b) > 0 {
+			streamTokenKey = b
+			return nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	streamTokenKey = make([]byte, 32)
+	if _, err := rand.Read(streamTokenKey); err != nil {
+		return err
+	}
+	if path == "" {
+		logWarn("Generated a stream token key for this run only, the payer tokens won't survive a restart")
+		return nil
+	}
+	if err := ioutil.WriteFile(path, streamTokenKey, 0600); err != nil {
+		return err
+	}
+	logWarn("Generated a stream token key, replicas must share it with -streamTokenKey", "path", path)
+	return nil
+}
+
+// payerToken returns the token proving that its holder created the invoice
+// of hash, handed out with the invoice. It is derived from streamTokenKey
+// so that it needs no storage.
+func payerToken(hash string) string {
+	mac := hmac.New(sha256.New, streamTokenKey)
+	mac.Write([]byte("payer:" + strings.ToLower(hash)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validPayerToken reports whether token is the payer token of hash.
+func validPayerToken(hash, token string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(payerToken(hash)))
+}
+
+// isPayer reports whether r carries the payer token of hash, in the
+// "payer_token" query parameter or the X-Payer-Token header.
+func isPayer(r *http.Request, hash string) bool {
+	token := r.URL.Query().Get("payer_token")
+	if token == "" {
+		token = r.Header.Get(payerTokenHeader)
+	}
+	return validPayerToken(hash, token)
+}
+
+func signStreamToken(c streamClaims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, streamTokenKey)
+	mac.Write(payload)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+func verifyStreamToken(token string) (*streamClaims, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidToken
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, streamTokenKey)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errInvalidToken
+	}
+
+	var c streamClaims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, errInvalidToken
+	}
+	if appClock.Now().Unix() > c.Expiry {
+		return nil, errInvalidToken
+	}
+	return &c, nil
+}
+
+// getStreamToken issues an anonymous token, good for the public rooms.
+func getStreamToken(w http.ResponseWriter, r *http.Request) {
+	writeStreamToken(w, streamClaims{}, streamTokenTTL)
+}
+
+// streamTokenRequest is the body of postStreamToken.
+type streamTokenRequest struct {
+	User       string   `json:"user"`
+	Rooms      []string `json:"rooms"`
+	TTLSeconds int      `json:"ttl_seconds"`
+}
+
+// postStreamToken issues a token for a given user and set of private rooms.
+// It is meant to be called by the service authenticating the users.
+func postStreamToken(w http.ResponseWriter, r *http.Request) {
+	var req streamTokenRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ttl := streamTokenTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl > maxStreamTokenTTL {
+		writeError(w, http.StatusBadRequest, "ttl too long")
+		return
+	}
+	writeStreamToken(w, streamClaims{User: req.User, Rooms: req.Rooms}, ttl)
+}
+
+func writeStreamToken(w http.ResponseWriter, c streamClaims, ttl time.Duration) {
+	expiry := appClock.Now().Add(ttl)
+	c.Expiry = expiry.Unix()
+	token, err := signStreamToken(c)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"token":      token,
+		"expires_at": expiry.UTC().Format(time.RFC3339),
+	})
+}
+
+// streamClaimsOf verifies the token of a stream request, passed in the
+// "token" query parameter since browsers can't set headers on websocket
+// requests.
+func streamClaimsOf(r *http.Request) (*streamClaims, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+	}
+	if token == "" {
+		return nil, errInvalidToken
+	}
+	return verifyStreamToken(token)
+}
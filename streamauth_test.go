@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitStreamTokenKey(t *testing.T) {
+	defer func(key []byte) { streamTokenKey = key }(streamTokenKey)
+	path := filepath.Join(t.TempDir(), "chat-backend.key")
+
+	if err := initStreamTokenKey("secret", path); err != nil {
+		t.Fatal(err)
+	}
+	if string(streamTokenKey) != "secret" {
+		t.Errorf("configured key not used: %q", streamTokenKey)
+	}
+
+	if err := initStreamTokenKey("", path); err != nil {
+		t.Fatal(err)
+	}
+	generated := streamTokenKey
+	if len(generated) != 32 {
+		t.Fatalf("generated a %d bytes key, want 32", len(generated))
+	}
+	if err := initStreamTokenKey("", path); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(streamTokenKey, generated) {
+		t.Error("the generated key wasn't kept across restarts")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/signrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// lndSubsystem is an RPC subsystem of lnd reached over the shared
+// connection, whose client is created on first use. lnd only serves the
+// subsystems it was built with, routerrpc and signrpc needing the build tags
+// of the same name, so each subsystem keeps the health of its last call and
+// the features needing it can tell why they fail.
+type lndSubsystem struct {
+	// name is the package of the services of the subsystem, which prefixes
+	// the names of their methods, e.g. /routerrpc.Router/SendPaymentV2.
+	name      string
+	newClient func(*grpc.ClientConn) interface{}
+
+	once   sync.Once
+	client interface{}
+
+	mu     sync.Mutex
+	called bool
+	err    error
+}
+
+var (
+	lightningSubsystem = &lndSubsystem{name: "lnrpc", newClient: func(c *grpc.ClientConn) interface{} {
+		return lnrpc.NewLightningClient(c)
+	}}
+	invoicesSubsystem = &lndSubsystem{name: "invoicesrpc", newClient: func(c *grpc.ClientConn) interface{} {
+		return invoicesrpc.NewInvoicesClient(c)
+	}}
+	routerSubsystem = &lndSubsystem{name: "routerrpc", newClient: func(c *grpc.ClientConn) interface{} {
+		return routerrpc.NewRouterClient(c)
+	}}
+	signerSubsystem = &lndSubsystem{name: "signrpc", newClient: func(c *grpc.ClientConn) interface{} {
+		return signrpc.NewSignerClient(c)
+	}}
+
+	lndSubsystems = []*lndSubsystem{lightningSubsystem, invoicesSubsystem, routerSubsystem, signerSubsystem}
+
+	lndSubsystemUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "lnd_subsystem_up",
+		Help:      "Whether the last call to the lnd RPC subsystem (lnrpc, invoicesrpc, routerrpc, signrpc) reached it.",
+	}, []string{"subsystem"})
+)
+
+func init() {
+	prometheus.MustRegister(lndSubsystemUp)
+}
+
+// get returns the client of the subsystem over the shared connection.
+func (s *lndSubsystem) get() interface{} {
+	s.once.Do(func() {
+		s.client = s.newClient(getClientConn())
+	})
+	return s.client
+}
+
+// record keeps the outcome of a call to the subsystem. Only the errors of
+// the subsystem itself count, not those of the call, e.g. an unknown
+// invoice.
+func (s *lndSubsystem) record(err error) {
+	up := true
+	switch status.Code(err) {
+	case codes.Unimplemented, codes.Unavailable, codes.DeadlineExceeded:
+		up = false
+	}
+	s.mu.Lock()
+	s.called = true
+	if up {
+		s.err = nil
+	} else {
+		s.err = err
+	}
+	s.mu.Unlock()
+	if up {
+		lndSubsystemUp.WithLabelValues(s.name).Set(1)
+	} else {
+		lndSubsystemUp.WithLabelValues(s.name).Set(0)
+	}
+}
+
+// health returns the health of the subsystem: the one of the connection
+// until it is first called, down while lnd doesn't serve it or its last
+// call didn't reach it.
+func (s *lndSubsystem) health() string {
+	s.mu.Lock()
+	called, err := s.called, s.err
+	s.mu.Unlock()
+	switch {
+	case !called:
+		return lndHealth()
+	case err != nil:
+		return healthDown
+	}
+	return healthOK
+}
+
+// recordSubsystemCall records the outcome of a call of method over cc to the
+// health of its subsystem, for the -rpcServer node only.
+func recordSubsystemCall(cc *grpc.ClientConn, method string, err error) {
+	lndConnMu.Lock()
+	primary := cc == lndConn
+	lndConnMu.Unlock()
+	if !primary {
+		return
+	}
+	name := strings.TrimPrefix(method, "/")
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	for _, s := range lndSubsystems {
+		if s.name == name {
+			s.record(err)
+			return
+		}
+	}
+}
+
+// subsystemsHealth returns the health of the lnd subsystems by name.
+func subsystemsHealth() map[string]string {
+	health := make(map[string]string, len(lndSubsystems))
+	for _, s := range lndSubsystems {
+		health[s.name] = s.health()
+	}
+	return health
+}
+
+// getRouterClient returns the routerrpc client of the shared lnd
+// connection, for the payments sent by the backend.
+func getRouterClient() routerrpc.RouterClient {
+	return routerSubsystem.get().(routerrpc.RouterClient)
+}
+
+// getSignerClient returns the signrpc client of the shared lnd connection,
+// for signing with the keys of the node.
+func getSignerClient() signrpc.SignerClient {
+	return signerSubsystem.get().(signrpc.SignerClient)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	registerJob("tax_export", runTaxExport, defaultRetryPolicy)
+}
+
+// taxPayload is the payload of tax_export jobs, the quarter being 1 to 4.
+type taxPayload struct {
+	Year    int `json:"year"`
+	Quarter int `json:"quarter"`
+}
+
+// parseQuarter parses a quarter given as 2006-Q1.
+func parseQuarter(v string) (taxPayload, error) {
+	var p taxPayload
+	parts := strings.Split(strings.ToUpper(v), "-Q")
+	if len(parts) != 2 {
+		return p, fmt.Errorf("invalid quarter %q, want e.g. 2020-Q1", v)
+	}
+	var err error
+	if p.Year, err = strconv.Atoi(parts[0]); err != nil {
+		return p, fmt.Errorf("invalid quarter %q, want e.g. 2020-Q1", v)
+	}
+	if p.Quarter, err = strconv.Atoi(parts[1]); err != nil || p.Quarter < 1 || p.Quarter > 4 {
+		return p, fmt.Errorf("invalid quarter %q, want e.g. 2020-Q1", v)
+	}
+	return p, nil
+}
+
+// bounds returns the start of the quarter and of the next one, in UTC.
+func (p taxPayload) bounds() (time.Time, time.Time) {
+	from := time.Date(p.Year, time.Month(3*(p.Quarter-1)+1), 1, 0, 0, 0, 0, time.UTC)
+	return from, from.AddDate(0, 3, 0)
+}
+
+// runTaxExport is the job handler uploading the tax report of a quarter to
+// the archive destination: one row per settled message with its fiat value
+// at the rate recorded around its settlement, the routing fees paid
+// refunding it and whether it was refunded.
+func runTaxExport(ctx context.Context, j *job) (interface{}, error) {
+	if archiveDest == nil {
+		return nil, permanent(fmt.Errorf("no archive destination, see -archive"))
+	}
+	if fiatCurrency == "" {
+		return nil, permanent(fmt.Errorf("no exchange rate history, see -fiat"))
+	}
+	var p taxPayload
+	if err := j.decodePayload(&p); err != nil {
+		return nil, err
+	}
+	from, to := p.bounds()
+	messages, err := store.ListSettled(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	rates, err := rateHistory(ctx, fiatCurrency, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	out := csv.NewWriter(&body)
+	fiat := "fiat_" + strings.ToLower(fiatCurrency)
+	out.Write([]string{"date", "id", "sats", fiat, "rate", "fee_share_sats", "refund"})
+	missing := 0
+	for i, m := range messages {
+		rate := rateAt(rates, m.SettledAt)
+		value := ""
+		if rate == 0 {
+			missing++
+		} else {
+			value = strconv.FormatFloat(float64(m.AmountPaidMsat)/1e11*rate, 'f', 2, 64)
+		}
+		var feeMsat int64
+		if m.Expired {
+			if feeMsat, err = refundFees(ctx, m.ID); err != nil {
+				return nil, err
+			}
+		}
+		out.Write([]string{
+			m.SettledAt.UTC().Format(time.RFC3339),
+			publicIDs.Encode(m.ID),
+			strconv.FormatFloat(float64(m.AmountPaidMsat)/1000, 'f', 3, 64),
+			value,
+			strconv.FormatFloat(rate, 'f', -1, 64),
+			strconv.FormatFloat(float64(feeMsat)/1000, 'f', 3, 64),
+			strconv.FormatBool(m.Expired),
+		})
+		j.reportProgress(ctx, i+1, len(messages))
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("tax/tax-%d-Q%d.csv", p.Year, p.Quarter)
+	object, err := archiveDest.put(ctx, name, "text/csv", body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"object": object, "messages": len(messages), "missing_rates": missing}, nil
+}
+
+// refundFees returns the routing fees paid refunding the message id.
+func refundFees(ctx context.Context, id string) (int64, error) {
+	snapshot, err := collection(vouchersCollection).Where("message_id", "==", id).Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+	var fees int64
+	for _, s := range snapshot {
+		var v voucher
+		if err := s.DataTo(&v); err == nil {
+			fees += v.FeeMsat
+		}
+	}
+	return fees, nil
+}
+
+// postTaxExport enqueues the tax report of ?quarter=2006-Q1, the last one by
+// default.
+func postTaxExport(w http.ResponseWriter, r *http.Request) {
+	if archiveDest == nil {
+		writeError(w, http.StatusNotFound, "no archive destination, see -archive")
+		return
+	}
+	now := appClock.Now().UTC()
+	p := taxPayload{Year: now.Year(), Quarter: (int(now.Month())-1)/3 + 1}
+	if p.Quarter--; p.Quarter == 0 {
+		p.Year, p.Quarter = p.Year-1, 4
+	}
+	if v := r.URL.Query().Get("quarter"); v != "" {
+		var err error
+		if p, err = parseQuarter(v); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	j, err := enqueueJob(r.Context(), "tax_export", p)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, j)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// systemInvoicePrefix prefixes the key standing in for the payment
+	// request of the system messages, which are posted once per event and
+	// message.
+	systemInvoicePrefix = "system:"
+
+	// systemTag names the event of the system messages.
+	systemTag = "system"
+
+	// eventSystemMessage is the event type of the system messages.
+	eventSystemMessage = "system_message"
+
+	// defaultTemplateLanguage is the key of the template of the languages
+	// without one of their own.
+	defaultTemplateLanguage = "default"
+
+	templatePaymentReceived = "payment_received"
+	templateMessageHidden   = "message_hidden"
+	templateRefundIssued    = "refund_issued"
+)
+
+// systemTemplates are the templates of -templates, by event then language.
+// The events without a template post no system message.
+var systemTemplates map[string]map[string]*template.Template
+
+// templateData is what the system message templates are executed with, on
+// behalf of the message the event is about.
+type templateData struct {
+	ID       string
+	Room     string
+	Memo     string
+	Language string
+
+	// Amount is the price of the message, and AmountPaid what was paid,
+	// in satoshis.
+	Amount     int64
+	AmountPaid int64
+}
+
+// loadTemplates reads the system message templates of path, a JSON object
+// of Go templates by event and language, e.g.
+//
+//	{"payment_received": {"default": "{{.AmountPaid}} sats received, thanks!",
+//	                      "es": "¡{{.AmountPaid}} sats recibidos, gracias!"}}
+func loadTemplates(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var sources map[string]map[string]string
+	if err := json.Unmarshal(b, &sources); err != nil {
+		return fmt.Errorf("invalid templates %v: %v", path, err)
+	}
+	templates := make(map[string]map[string]*template.Template)
+	for ev, languages := range sources {
+		switch ev {
+		case templatePaymentReceived, templateMessageHidden, templateRefundIssued:
+		default:
+			return fmt.Errorf("unknown template event %q", ev)
+		}
+		templates[ev] = make(map[string]*template.Template)
+		for lang, source := range languages {
+			t, err := template.New(ev + "/" + lang).Option("missingkey=error").Parse(source)
+			if err != nil {
+				return err
+			}
+			// Templates referring to unknown fields fail now rather
+			// than on the first event.
+			if err := t.Execute(ioutil.Discard, templateData{}); err != nil {
+				return err
+			}
+			templates[ev][lang] = t
+		}
+	}
+	systemTemplates = templates
+	return nil
+}
+
+// systemTemplate returns the template of ev in language, or the default
+// one, nil if there is none.
+func systemTemplate(ev, language string) *template.Template {
+	if t, ok := systemTemplates[ev][language]; ok {
+		return t
+	}
+	return systemTemplates[ev][defaultTemplateLanguage]
+}
+
+// postSystemMessage posts the system message of ev about m to its room, in
+// its language, unless there is no template for ev or it was already
+// posted for a replayed event. Direct messages get none.
+func postSystemMessage(ctx context.Context, ev string, m *Message, data templateData) {
+	t := systemTemplate(ev, m.Language)
+	if t == nil || m.DM != nil {
+		return
+	}
+	if err := postSystemMessageOnce(ctx, ev, t, m, data); err != nil {
+		logError("Failed to post the system message", "event", ev, "doc_id", m.ID, "err", err)
+	}
+}
+
+func postSystemMessageOnce(ctx context.Context, ev string, t *template.Template, m *Message, data templateData) error {
+	key := systemInvoicePrefix + ev + ":" + m.ID
+	if _, err := store.FindByInvoice(ctx, key); err != errMessageNotFound {
+		return err
+	}
+	data.ID = publicIDs.Encode(m.ID)
+	data.Room, data.Memo, data.Language, data.Amount = m.Room, m.Memo, m.Language, m.Amount
+	if data.Room == "" {
+		data.Room = defaultRoom
+	}
+	var memo bytes.Buffer
+	if err := t.Execute(&memo, data); err != nil {
+		return err
+	}
+	text := memo.String()
+	for len(text) > maxMemoLength {
+		_, size := utf8.DecodeLastRuneInString(text)
+		text = text[:len(text)-size]
+	}
+
+	now := appClock.Now()
+	msg := &Message{
+		Invoice:   key,
+		Memo:      text,
+		Room:      m.Room,
+		Language:  m.Language,
+		Tags:      map[string]string{systemTag: ev, replyToTag: data.ID},
+		CreatedAt: now,
+	}
+	if err := store.CreateMessage(ctx, msg); err != nil {
+		return err
+	}
+	if _, err := store.MarkSettled(ctx, msg.ID, Settlement{SettledAt: now}); err != nil {
+		return err
+	}
+	e := event{
+		Type: eventSystemMessage,
+		Room: m.Room,
+		Data: map[string]interface{}{
+			"id":       publicIDs.Encode(msg.ID),
+			"reply_to": data.ID,
+			"event":    ev,
+			"memo":     text,
+		},
+	}
+	publishEvent(e)
+	postWebhooks(e)
+	pushSystemMessage(msg)
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+)
+
+// maxThreadReplies bounds the replies of a thread returned by getThread.
+const maxThreadReplies = 500
+
+// threadNode is a message of a thread with its replies, oldest first.
+type threadNode struct {
+	*Message
+	Replies []*threadNode `json:"replies,omitempty"`
+}
+
+// replyTo makes m a reply to parent, if any, and returns it.
+func replyTo(m, parent *Message) *Message {
+	if parent == nil {
+		return m
+	}
+	m.Room, m.ParentID, m.ThreadID = parent.Room, parent.ID, parent.ThreadID
+	if m.ThreadID == "" {
+		m.ThreadID = parent.ID
+	}
+	return m
+}
+
+// threadMessage returns the message of the public id of the route, which
+// must be a settled public message readable by the caller. It writes the
+// error and returns nil otherwise.
+func threadMessage(w http.ResponseWriter, r *http.Request) *Message {
+	id, err := publicIDs.Decode(pathParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	m, err := store.GetMessage(r.Context(), id)
+	if err == errMessageNotFound || (err == nil && (!m.Settled || m.Held || m.DM != nil || m.BoostOf != "" || !roomReadable(r, m.Room))) {
+		writeErrorCode(w, http.StatusNotFound, codeUnknownMessage, errMessageNotFound.Error(), nil)
+		return nil
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return nil
+	}
+	return m
+}
+
+// postReply creates a reply to a settled message, in its room, and the
+// invoice paying it, the body being the one of postMessage but its room.
+func postReply(w http.ResponseWriter, r *http.Request) {
+	var m messageRequest
+	if err := decodeJSON(r, &m); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	parent := threadMessage(w, r)
+	if parent == nil {
+		return
+	}
+	m.Room, m.parent = parent.Room, parent
+	postMessageRequest(w, r, &m)
+}
+
+// getThread returns the thread of a message, from its first message down
+// through the settled replies.
+func getThread(w http.ResponseWriter, r *http.Request) {
+	m := threadMessage(w, r)
+	if m == nil {
+		return
+	}
+	root := m
+	if m.ThreadID != "" {
+		var err error
+		root, err = store.GetMessage(r.Context(), m.ThreadID)
+		if err == errMessageNotFound {
+			writeErrorCode(w, http.StatusNotFound, codeUnknownMessage, errMessageNotFound.Error(), nil)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+	}
+	replies, err := store.ListThread(r.Context(), root.ID, maxThreadReplies)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, map[string]interface{}{"thread": buildThread(root, replies)})
+}
+
+// buildThread returns the tree of root and its replies, readied for the
+// api. Replies whose parent isn't listed are left out.
+func buildThread(root *Message, replies []*Message) *threadNode {
+	nodes := map[string]*threadNode{root.ID: {Message: root}}
+	for _, m := range replies {
+		nodes[m.ID] = &threadNode{Message: m}
+	}
+	for _, m := range replies {
+		if parent := nodes[m.ParentID]; parent != nil && m.ID != root.ID {
+			parent.Replies = append(parent.Replies, nodes[m.ID])
+		}
+	}
+	tree := nodes[root.ID]
+	for _, n := range nodes {
+		publicMessage(n.Message)
+	}
+	return tree
+}
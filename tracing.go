@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	requestIDHeader   = "X-Request-ID"
+	traceparentHeader = "traceparent"
+
+	// maxRequestIDLength bounds the request ids taken from the clients,
+	// longer ones being replaced.
+	maxRequestIDLength = 128
+
+	// serviceName names the backend in the traces and error reports.
+	serviceName = "chat-backend"
+
+	// The exported spans are queued, those ending while the queue is full
+	// being dropped, and posted by batches of at most spanBatchSize every
+	// spanExportPeriod.
+	spanQueueSize    = 4096
+	spanBatchSize    = 512
+	spanExportPeriod = 5 * time.Second
+)
+
+// The kinds and status codes of the OTLP spans.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+var (
+	// otlpEndpoint is the base url of the OTLP/HTTP collector the spans
+	// are exported to, e.g. http://localhost:4318, empty disabling
+	// tracing.
+	otlpEndpoint string
+
+	spanQueue  chan *span
+	otlpClient = &http.Client{Timeout: 10 * time.Second}
+
+	exportedSpans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "exported_spans_total",
+		Help:      "Number of trace spans by outcome (exported, dropped, failed).",
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(exportedSpans)
+}
+
+// startTracing enables tracing, the spans being exported by exportSpans.
+func startTracing(endpoint string) {
+	otlpEndpoint = strings.TrimSuffix(endpoint, "/")
+	spanQueue = make(chan *span, spanQueueSize)
+	goBackground(exportSpans)
+}
+
+// span is an operation of a trace, such as the handling of a request or an
+// RPC to lnd or Firestore. The nil span, of the operations not traced, does
+// nothing.
+type span struct {
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	sampled bool
+
+	name  string
+	kind  int
+	start time.Time
+
+	mu      sync.Mutex
+	attrs   map[string]interface{}
+	err     string
+	endTime time.Time
+}
+
+type spanKey struct{}
+
+// startSpan starts the span name in the trace of the span of ctx, if any,
+// with the attributes kv, and returns ctx with it.
+func startSpan(ctx context.Context, name string, kind int, kv ...interface{}) (context.Context, *span) {
+	if spanQueue == nil {
+		return ctx, nil
+	}
+	parent := spanFrom(ctx)
+	s := newSpan(name, kind)
+	if parent != nil {
+		s.traceID, s.parent, s.sampled = parent.traceID, parent.id, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	s.set(kv...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// spanFrom returns the span of ctx, nil if none.
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+func newSpan(name string, kind int) *span {
+	s := &span{name: name, kind: kind, start: time.Now(), sampled: true, attrs: map[string]interface{}{}}
+	rand.Read(s.id[:])
+	return s
+}
+
+// set sets the attributes kv, pairs of keys and values, of s.
+func (s *span) set(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.attrs[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+}
+
+// rename renames s, once what it is about is known.
+func (s *span) rename(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// end ends s, failed if err isn't nil, and queues it for the export.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.endTime.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.endTime = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+	if !s.sampled {
+		return
+	}
+	select {
+	case spanQueue <- s:
+	default:
+		exportedSpans.WithLabelValues("dropped").Inc()
+	}
+}
+
+// parseTraceparent returns the span of a W3C traceparent header, of another
+// service, which the spans of the request are the children of.
+func parseTraceparent(h string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return nil, false
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	id, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(id) != 8 || len(flags) != 1 {
+		return nil, false
+	}
+	s := &span{sampled: flags[0]&1 == 1}
+	copy(s.traceID[:], traceID)
+	copy(s.id[:], id)
+	if s.traceID == ([16]byte{}) || s.id == ([8]byte{}) {
+		return nil, false
+	}
+	return s, true
+}
+
+// validRequestID reports whether id, sent by a client, can be used as the id
+// of its request: short and printable.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDMiddleware gives every request an id, the X-Request-ID of the
+// client or a random one, answered in X-Request-ID and logged with it.
+func requestIDMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		stateOf(r).RequestID = id
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tracingMiddleware traces every request in a server span, named after its
+// route once matched, continuing the trace of its traceparent header if any.
+func tracingMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if spanQueue == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if parent, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			ctx = context.WithValue(ctx, spanKey{}, parent)
+		}
+		state := stateOf(r)
+		ctx, s := startSpan(ctx, r.Method, spanKindServer,
+			"http.method", r.Method, "http.target", r.URL.RequestURI(), "http.request_id", state.RequestID)
+		state.TraceID = hex.EncodeToString(s.traceID[:])
+		h.ServeHTTP(w, r.WithContext(ctx))
+
+		if state.Route != "" {
+			s.rename(r.Method + " " + state.Route)
+			s.set("http.route", state.Route)
+		}
+		s.set("http.status_code", state.Status)
+		var err error
+		if state.Status >= http.StatusInternalServerError {
+			err = fmt.Errorf("answered %d", state.Status)
+		}
+		s.end(err)
+	})
+}
+
+// traceUnaryRPC traces the unary RPCs of a gRPC client, lnd or Firestore,
+// in client spans.
+func traceUnaryRPC(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, s := startRPCSpan(ctx, method)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	s.set("rpc.grpc.status_code", int(status.Code(err)))
+	s.end(err)
+	return err
+}
+
+// traceStreamRPC traces the streaming RPCs of Firestore, such as the gets
+// and the queries, until their last answer. The listeners, which never end,
+// aren't.
+func traceStreamRPC(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if strings.HasSuffix(method, "/Listen") {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	ctx, s := startRPCSpan(ctx, method)
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		s.end(err)
+		return nil, err
+	}
+	return &tracedStream{ClientStream: stream, span: s}, nil
+}
+
+func startRPCSpan(ctx context.Context, method string) (context.Context, *span) {
+	service, name := "", strings.TrimPrefix(method, "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		service = name[:i]
+	}
+	return startSpan(ctx, name, spanKindClient,
+		"rpc.system", "grpc", "rpc.service", service, "rpc.method", name[len(service)+1:])
+}
+
+type tracedStream struct {
+	grpc.ClientStream
+	span *span
+}
+
+func (s *tracedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		s.span.end(nil)
+	} else if err != nil {
+		s.span.end(err)
+	}
+	return err
+}
+
+// The OTLP/HTTP JSON encoding of the spans.
+type (
+	otlpExport struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpSpan struct {
+		TraceID      string          `json:"traceId"`
+		SpanID       string          `json:"spanId"`
+		ParentSpanID string          `json:"parentSpanId,omitempty"`
+		Name         string          `json:"name"`
+		Kind         int             `json:"kind"`
+		Start        string          `json:"startTimeUnixNano"`
+		End          string          `json:"endTimeUnixNano"`
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+		Status       *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		String *string `json:"stringValue,omitempty"`
+		Int    *string `json:"intValue,omitempty"`
+		Bool   *bool   `json:"boolValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func otlpAttr(key string, v interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := v.(type) {
+	case bool:
+		a.Value.Bool = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.Int = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.Int = &s
+	default:
+		s := fmt.Sprint(v)
+		a.Value.String = &s
+	}
+	return a
+}
+
+func (s *span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID: hex.EncodeToString(s.traceID[:]),
+		SpanID:  hex.EncodeToString(s.id[:]),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(s.endTime.UnixNano(), 10),
+	}
+	if s.parent != ([8]byte{}) {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for k, v := range s.attrs {
+		o.Attributes = append(o.Attributes, otlpAttr(k, v))
+	}
+	if s.err != "" {
+		o.Status = &otlpStatus{Code: spanStatusError, Message: s.err}
+	}
+	return o
+}
+
+// exportSpans posts the ended spans to the collector, by batches, until
+// shutdown, then flushes the last ones.
+func exportSpans(ctx context.Context) {
+	ticker := time.NewTicker(spanExportPeriod)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-spanQueue:
+			if batch = append(batch, s); len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			for n := len(spanQueue); n > 0; n-- {
+				batch = append(batch, <-spanQueue)
+			}
+			postSpans(batch)
+			return
+		}
+		postSpans(batch)
+		batch = batch[:0]
+	}
+}
+
+func postSpans(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	var scope otlpScopeSpans
+	scope.Scope.Name = serviceName
+	for _, s := range batch {
+		scope.Spans = append(scope.Spans, s.otlp())
+	}
+	body, err := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{otlpAttr("service.name", serviceName)}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		logError("Failed to encode spans", "err", err)
+		return
+	}
+	res, err := otlpClient.Post(otlpEndpoint+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			err = fmt.Errorf("collector answered %v", res.Status)
+		}
+	}
+	if err != nil {
+		exportedSpans.WithLabelValues("failed").Add(float64(len(batch)))
+		logWarn("Failed to export spans", "spans", len(batch), "err", err)
+		return
+	}
+	exportedSpans.WithLabelValues("exported").Add(float64(len(batch)))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	transparencyCollection = "transparency"
+	metaCollection         = "meta"
+
+	// transparencyHead is the document of metaCollection holding the
+	// sequence number and hash of the last entry, kept out of
+	// transparencyCollection so that it isn't listed as an entry.
+	transparencyHead = "transparency"
+
+	maxTransparencyEntries = 500
+)
+
+// transparencyEntry is an entry of the append-only log of settled messages.
+// Each entry commits to the previous one, so that removing or altering a
+// message breaks the chain, and is signed by the lnd node key.
+//
+// Hash is the hex encoded SHA-256 of
+//
+//	prev_hash|seq|id|memo_hash|amount_msat|settled_at
+//
+// with settled_at in unix seconds, and Signature the signature of Hash made
+// with lnd's SignMessage, which lncli verifymessage checks against the node
+// pubkey.
+type transparencyEntry struct {
+	Seq        int64  `firestore:"seq" json:"seq"`
+	ID         string `firestore:"id" json:"id"`
+	MemoHash   string `firestore:"memo_hash" json:"memo_hash"`
+	AmountMsat int64  `firestore:"amount_msat" json:"amount_msat"`
+	SettledAt  int64  `firestore:"settled_at" json:"settled_at"`
+	PrevHash   string `firestore:"prev_hash" json:"prev_hash"`
+	Hash       string `firestore:"hash" json:"hash"`
+	Signature  string `firestore:"signature" json:"signature"`
+}
+
+func (e *transparencyEntry) computeHash() string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%v|%d|%v|%v|%d|%d",
+		e.PrevHash, e.Seq, e.ID, e.MemoHash, e.AmountMsat, e.SettledAt)))
+	return hex.EncodeToString(h[:])
+}
+
+// appendTransparency adds a settled message to the transparency log.
+func appendTransparency(ctx context.Context, m *Message, invoice *lnrpc.Invoice, settledAt time.Time) error {
+	memoHash := sha256.Sum256([]byte(m.Memo))
+
+	if err := waitForWrite(ctx, transparencyCollection); err != nil {
+		return err
+	}
+	col := collection(transparencyCollection)
+	head := collection(metaCollection).Doc(transparencyHead)
+	return firebaseDb.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var last transparencyEntry
+		hs, err := tx.Get(head)
+		switch {
+		case status.Code(err) == codes.NotFound:
+		case err != nil:
+			return err
+		default:
+			if err := hs.DataTo(&last); err != nil {
+				return err
+			}
+		}
+
+		e := transparencyEntry{
+			Seq:        last.Seq + 1,
+			ID:         publicIDs.Encode(m.ID),
+			MemoHash:   hex.EncodeToString(memoHash[:]),
+			AmountMsat: invoice.GetAmtPaidMsat(),
+			SettledAt:  settledAt.Unix(),
+			PrevHash:   last.Hash,
+		}
+		e.Hash = e.computeHash()
+		sig, err := lightning.SignMessage(ctx, []byte(e.Hash))
+		if err != nil {
+			return err
+		}
+		e.Signature = sig
+
+		if err := tx.Create(col.Doc(fmt.Sprintf("%020d", e.Seq)), e); err != nil {
+			return err
+		}
+		return tx.Set(head, map[string]interface{}{"seq": e.Seq, "hash": e.Hash})
+	})
+}
+
+// recordTransparency is appendTransparency for the settlement side effects,
+// which only log failures.
+func recordTransparency(ctx context.Context, m *Message, invoice *lnrpc.Invoice, settledAt time.Time) {
+	// LNDHub accounts have no node key to sign the entries with.
+	if !firestoreEnabled() || backendName() == backendLNDHub {
+		return
+	}
+	if err := appendTransparency(ctx, m, invoice, settledAt); err != nil {
+		logError("Failed to append to the transparency log", "doc_id", m.ID, "err", err)
+	}
+}
+
+// getTransparency returns the entries of the transparency log after the
+// "after" sequence number, along with the node pubkey signing them.
+func getTransparency(w http.ResponseWriter, r *http.Request) {
+	var after int64
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil || after < 0 {
+			writeError(w, http.StatusBadRequest, "invalid after")
+			return
+		}
+	}
+	limit := maxTransparencyEntries
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxTransparencyEntries {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxTransparencyEntries))
+			return
+		}
+		limit = n
+	}
+
+	info, err := nodeInfo(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	snapshot, err := collection(transparencyCollection).
+		Where("seq", ">", after).
+		OrderBy("seq", firestore.Asc).
+		Limit(limit).
+		Documents(r.Context()).GetAll()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	entries := make([]transparencyEntry, 0, len(snapshot))
+	for _, s := range snapshot {
+		var e transparencyEntry
+		if err := s.DataTo(&e); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		entries = append(entries, e)
+	}
+	writeJSON(w, map[string]interface{}{
+		"pubkey":  info.GetIdentityPubkey(),
+		"entries": entries,
+	})
+}
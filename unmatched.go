@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const unmatchedCollection = "unmatched"
+
+var unmatchedSettlements = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "unmatched_settlements_total",
+	Help:      "Number of settled invoices quarantined for not matching any message.",
+})
+
+// invoiceMemoPrefix prefixes the memos of the invoices of the backend, to
+// tell them apart from those of the other services of a shared node. Empty,
+// the node is the backend's alone.
+var invoiceMemoPrefix string
+
+func init() {
+	prometheus.MustRegister(unmatchedSettlements)
+}
+
+// prefixMemo prefixes the memo of an invoice of the backend, unless it
+// commits to a description by hash, which excludes a memo.
+func prefixMemo(invoice *lnrpc.Invoice) {
+	if invoiceMemoPrefix != "" && len(invoice.GetDescriptionHash()) == 0 {
+		invoice.Memo = invoiceMemoPrefix + invoice.GetMemo()
+	}
+}
+
+// ownInvoice reports whether invoice was created by the backend, as far as
+// its memo tells.
+func ownInvoice(invoice *lnrpc.Invoice) bool {
+	return strings.HasPrefix(invoice.GetMemo(), invoiceMemoPrefix)
+}
+
+// unmatchedSettlement is a settled invoice no message was found for, kept
+// until the operator reconciles it. The payment hash is its document ID, so
+// that replayed settlements are quarantined once.
+type unmatchedSettlement struct {
+	PaymentHash    string     `firestore:"-" json:"payment_hash"`
+	PaymentRequest string     `firestore:"payment_request" json:"payment_request"`
+	Memo           string     `firestore:"memo" json:"memo"`
+	ValueMsat      int64      `firestore:"value_msat" json:"value_msat"`
+	AmountPaidMsat int64      `firestore:"amount_paid_msat" json:"amount_paid_msat"`
+	AddIndex       uint64     `firestore:"add_index" json:"add_index"`
+	SettleIndex    uint64     `firestore:"settle_index" json:"settle_index"`
+	InvoiceCreated time.Time  `firestore:"invoice_created_at" json:"invoice_created_at"`
+	SettledAt      time.Time  `firestore:"settled_at" json:"settled_at"`
+	QuarantinedAt  time.Time  `firestore:"quarantined_at" json:"quarantined_at"`
+	Resolved       bool       `firestore:"resolved" json:"resolved"`
+	ResolvedAt     *time.Time `firestore:"resolved_at,omitempty" json:"resolved_at,omitempty"`
+	Note           string     `firestore:"note,omitempty" json:"note,omitempty"`
+}
+
+// quarantineSettlement records a settled invoice without a message so that
+// its funds aren't silently orphaned.
+func quarantineSettlement(ctx context.Context, invoice *lnrpc.Invoice) {
+	audit(auditSettlementUnmatched, nil, invoice, "")
+	if !firestoreEnabled() {
+		logWarn("No message for settled invoice", "payment_hash", hex.EncodeToString(invoice.GetRHash()), "amount_msat", invoice.GetAmtPaidMsat())
+		return
+	}
+	u := unmatchedSettlement{
+		PaymentHash:    hex.EncodeToString(invoice.GetRHash()),
+		PaymentRequest: invoice.GetPaymentRequest(),
+		Memo:           invoice.GetMemo(),
+		ValueMsat:      invoice.GetValueMsat(),
+		AmountPaidMsat: invoice.GetAmtPaidMsat(),
+		AddIndex:       invoice.GetAddIndex(),
+		SettleIndex:    invoice.GetSettleIndex(),
+		InvoiceCreated: time.Unix(invoice.GetCreationDate(), 0),
+		SettledAt:      time.Unix(invoice.GetSettleDate(), 0),
+		QuarantinedAt:  appClock.Now(),
+	}
+	err := waitForWrite(ctx, unmatchedCollection)
+	if err == nil {
+		_, err = collection(unmatchedCollection).Doc(u.PaymentHash).Create(ctx, u)
+	}
+	if status.Code(err) == codes.AlreadyExists {
+		return
+	}
+	if err != nil {
+		logError("Failed to quarantine settled invoice", "payment_hash", u.PaymentHash, "err", err)
+		return
+	}
+	unmatchedSettlements.Inc()
+	logWarn("Quarantined settled invoice", "payment_hash", u.PaymentHash, "amount_msat", u.AmountPaidMsat)
+}
+
+func unmatchedFromSnapshot(s *firestore.DocumentSnapshot) (*unmatchedSettlement, error) {
+	var u unmatchedSettlement
+	if err := s.DataTo(&u); err != nil {
+		return nil, err
+	}
+	u.PaymentHash = s.Ref.ID
+	return &u, nil
+}
+
+// getUnmatched lists the quarantined settlements still to reconcile, or all
+// of them with ?all=true, along with the amount they total.
+func getUnmatched(w http.ResponseWriter, r *http.Request) {
+	q := collection(unmatchedCollection).Query
+	if r.URL.Query().Get("all") != "true" {
+		q = q.Where("resolved", "==", false)
+	}
+	snapshot, err := q.Documents(r.Context()).GetAll()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	list := make([]*unmatchedSettlement, 0, len(snapshot))
+	var pendingMsat int64
+	for _, s := range snapshot {
+		u, err := unmatchedFromSnapshot(s)
+		if err != nil {
+			continue
+		}
+		if !u.Resolved {
+			pendingMsat += u.AmountPaidMsat
+		}
+		list = append(list, u)
+	}
+	writeJSON(w, map[string]interface{}{"unmatched": list, "pending_msat": pendingMsat})
+}
+
+// postUnmatchedResolve marks a quarantined settlement as reconciled, with an
+// optional note of what was done with the funds.
+func postUnmatchedResolve(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength > 0 {
+		if err := decodeJSON(r, &body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	ref := collection(unmatchedCollection).Doc(pathParam(r, "hash"))
+	s, err := ref.Get(r.Context())
+	if status.Code(err) == codes.NotFound {
+		writeError(w, http.StatusNotFound, "unknown settlement")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	u, err := unmatchedFromSnapshot(s)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if u.Resolved {
+		writeError(w, http.StatusConflict, "settlement already resolved")
+		return
+	}
+
+	now := appClock.Now()
+	err = updateDoc(r.Context(), ref, []firestore.Update{
+		{Path: "resolved", Value: true},
+		{Path: "resolved_at", Value: now},
+		{Path: "note", Value: body.Note},
+	})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	u.Resolved = true
+	u.ResolvedAt = &now
+	u.Note = body.Note
+	writeJSON(w, u)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+func TestOwnInvoice(t *testing.T) {
+	defer func(saved string) { invoiceMemoPrefix = saved }(invoiceMemoPrefix)
+
+	invoiceMemoPrefix = ""
+	if !ownInvoice(&lnrpc.Invoice{Memo: "coffee"}) {
+		t.Error("without a prefix, every invoice of the node is the backend's")
+	}
+
+	invoiceMemoPrefix = "chat: "
+	invoice := &lnrpc.Invoice{Memo: "hello"}
+	prefixMemo(invoice)
+	if invoice.Memo != "chat: hello" || !ownInvoice(invoice) {
+		t.Errorf("prefixed memo %q not recognized", invoice.Memo)
+	}
+	hashed := &lnrpc.Invoice{DescriptionHash: []byte{1}}
+	prefixMemo(hashed)
+	if hashed.Memo != "" {
+		t.Errorf("memo %q added to an invoice with a description hash", hashed.Memo)
+	}
+	if ownInvoice(&lnrpc.Invoice{Memo: "coffee"}) {
+		t.Error("invoice of another service recognized")
+	}
+}
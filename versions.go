@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// apiVersion is the current version of the api, served under /v1 and,
+	// for the integrations predating the versions, at the legacy paths.
+	apiVersion = 1
+
+	// apiVersionHeader names the version requested by clients on the
+	// legacy paths, and answered on every route.
+	apiVersionHeader = "API-Version"
+
+	codeUnsupportedVersion = "unsupported_version"
+)
+
+var (
+	// apiVersions are the versions served, a breaking change adding one
+	// while the former ones keep being served.
+	apiVersions = []int{apiVersion}
+
+	versionPath = regexp.MustCompile(`^/v([0-9]+)(/|$)`)
+
+	// versionMediaType is the Accept media type requesting a version, e.g.
+	// application/vnd.chat.v1+json.
+	versionMediaType = regexp.MustCompile(`application/vnd\.chat\.v([0-9]+)\+json`)
+)
+
+// unversionedRoutes are the paths kept out of /v1, which wallets expect
+// where the LNURL specs put them.
+var unversionedRoutes = []string{"/.well-known/", "/lnurlp", "/lnurlw/"}
+
+// versionRoutes returns routes under /v1 and at their legacy paths.
+func versionRoutes(routes []*route) []*route {
+	versioned := make([]*route, 0, 2*len(routes))
+	for _, r := range routes {
+		versioned = append(versioned, r)
+		if unversionedRoute(r.Pattern) {
+			continue
+		}
+		versioned = append(versioned, &route{
+			Method:  r.Method,
+			Pattern: "/v" + strconv.Itoa(apiVersion) + r.Pattern,
+			Handler: r.Handler,
+		})
+	}
+	return versioned
+}
+
+func unversionedRoute(path string) bool {
+	for _, p := range unversionedRoutes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func supportedVersion(v int) bool {
+	for _, s := range apiVersions {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedVersion returns the version r asks for: the one of its path, else
+// of its API-Version header or Accept media type, else the current one.
+func requestedVersion(r *http.Request) (int, bool) {
+	var s string
+	if m := versionPath.FindStringSubmatch(r.URL.Path); m != nil {
+		s = m[1]
+	} else if h := strings.TrimPrefix(strings.TrimSpace(r.Header.Get(apiVersionHeader)), "v"); h != "" {
+		s = h
+	} else if m := versionMediaType.FindStringSubmatch(r.Header.Get("Accept")); m != nil {
+		s = m[1]
+	} else {
+		return apiVersion, true
+	}
+	v, err := strconv.Atoi(s)
+	return v, err == nil && supportedVersion(v)
+}
+
+// requestVersion returns the version of the api r was served with.
+func requestVersion(r *http.Request) int {
+	if v := stateOf(r).Version; v != 0 {
+		return v
+	}
+	return apiVersion
+}
+
+// versionMiddleware negotiates the version of the api of each request,
+// answering it in the API-Version header, and rejects the versions not
+// served with a 406 listing those which are.
+func versionMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := requestedVersion(r)
+		if !ok {
+			writeErrorCode(w, http.StatusNotAcceptable, codeUnsupportedVersion, "unsupported api version",
+				map[string][]int{"supported": apiVersions})
+			return
+		}
+		stateOf(r).Version = v
+		w.Header().Set(apiVersionHeader, strconv.Itoa(v))
+		h.ServeHTTP(w, r)
+	})
+}
@@ -1,102 +1,593 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"cloud.google.com/go/firestore"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 )
 
-type Message struct {
-	Invoice string `json:"invoice,omitempty"`
-	Settled bool   `json:"settled,omitempty"`
-}
-
-// func watchPayments() {
-// 	//TODO: A better way is to watch for payments and then
-// 	// update firebase.
-// 	ticker := time.NewTicker(15 * time.Second)
-// 	go func() {
-// 		for {
-// 			select {
-// 			case <-ticker.C:
-// 				checkPayments()
-// 			}
-// 		}
-// 	}()
-// }
-
-func checkPayments() {
-	c, clean := getClient()
-	defer clean()
-
-	// 1st get unsettled message payment hashes
-	it := firebaseDb.Collection("messages").Where("settled", "==", false).Documents(context.Background())
-	snapshot, err := it.GetAll()
-	if err != nil {
-		log.Fatalln("Failed to get documents ", err)
-		return
+var (
+	// reconcileConcurrency is the maximum number of messages checked in
+	// parallel by checkPayments and reconcileRPCRate the maximum number of
+	// lnd RPCs per second it issues, 0 meaning unlimited.
+	reconcileConcurrency = defaultReconcileConcurrency
+	reconcileRPCRate     = defaultReconcileRPCRate
+
+	defaultReconcileConcurrency = 4
+	defaultReconcileRPCRate     = 20.0
+)
+
+const (
+	minSubscriptionBackoff = time.Second
+	maxSubscriptionBackoff = time.Minute
+)
+
+// checkPayments reconciles the unsettled messages with the node, reading them
+// reconcileBatchSize at a time so that a large backlog stays within the
+// limits of the store queries. A failure to list them is returned, the
+// watcher delivering the new settlements anyway.
+func checkPayments() error {
+	// Look the invoices up with bounded concurrency and at a bounded rate,
+	// a reconciliation of a large backlog shouldn't starve a small node.
+	limiter := newReconcileLimiter()
+	workers := reconcileConcurrency
+	if workers < 1 {
+		workers = 1
 	}
-	for _, s := range snapshot {
-		invoice := s.Data()["invoice"].(string)
-		decoded, err := c.DecodePayReq(context.Background(), &lnrpc.PayReqString{PayReq: invoice})
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var after string
+	for {
+		page, err := store.ListUnsettledPage(context.Background(), after, reconcileBatchSize)
 		if err != nil {
-			fmt.Println("Failed to decode payreq")
-			continue
+			logError("Failed to list the unsettled messages", "after", after, "err", err)
+			return err
+		}
+		for _, m := range page {
+			if m.Expired || foreignNetwork(m) {
+				continue
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(m *Message) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				checkPayment(limiter, m)
+			}(m)
+		}
+		if len(page) < reconcileBatchSize {
+			return nil
 		}
+		after = page[len(page)-1].ID
+	}
+}
 
-		lnInvoice, err := c.LookupInvoice(context.Background(), &lnrpc.PaymentHash{RHashStr: decoded.GetPaymentHash()})
-		if err != nil {
-			// It's possible that invoice generated with a test lnd won't appear in prod lnd.
-			// Best approach is to separate them in the DB, but for now, just ignore them.
-			fmt.Println("Failed to find invoice ", err)
-		} else {
-			if lnInvoice.GetSettled() {
-				_, err := s.Ref.Update(context.Background(), []firestore.Update{{Path: "settled", Value: true}})
-				if err != nil {
-					log.Println("Update failed ", err)
-				} else {
-					log.Println("Updated ", invoice)
-				}
+// newReconcileLimiter returns the limiter applied to the lnd RPCs issued
+// while reconciling.
+func newReconcileLimiter() *rate.Limiter {
+	limit := rate.Inf
+	if reconcileRPCRate > 0 {
+		limit = rate.Limit(reconcileRPCRate)
+	}
+	return rate.NewLimiter(limit, 1)
+}
+
+// checkPayment marks m as settled if its invoice was paid. Every lnd RPC
+// waits for the limiter first.
+func checkPayment(limiter *rate.Limiter, m *Message) error {
+	ctx := context.Background()
+	lnInvoice, err := lookupInvoice(ctx, limiter, m)
+	if err != nil {
+		// Invoices of messages created before they were tagged with
+		// their network may have been created on another node.
+		logDebug("Failed to find invoice", "doc_id", m.ID, "payment_hash", m.RHash, "err", err)
+		return err
+	}
+	switch lnInvoice.GetState() {
+	case lnrpc.Invoice_SETTLED:
+		if err := markSettled(ctx, m, lnInvoice); err != nil {
+			logError("Failed to mark the message settled", "doc_id", m.ID, "payment_hash", m.RHash, "err", err)
+			return err
+		}
+		// Only a settlement recorded here was missed, the subscription
+		// may have recorded it meanwhile.
+		if m.Settled {
+			reconcileDiscrepancies.WithLabelValues("settled").Inc()
+			audit(auditReconciled, m, lnInvoice, "")
+		}
+	case lnrpc.Invoice_ACCEPTED:
+		reconcileDiscrepancies.WithLabelValues("accepted").Inc()
+		if err := markAccepted(ctx, m, lnInvoice); err != nil {
+			logError("Failed to queue the message for review", "doc_id", m.ID, "payment_hash", m.RHash, "err", err)
+			return err
+		}
+	case lnrpc.Invoice_OPEN:
+		if m.Tags[backendTag] == backendLnbits {
+			trackFallback(m)
+		}
+		if m.HoldNonce != "" {
+			watchHold(m)
+		}
+	}
+	return nil
+}
+
+// paymentHash returns the payment hash of the invoice of m, decoding it when
+// the message doesn't record it, and then recording it so that the next
+// lookups take a single RPC. Keysend messages have no payment request, their
+// invoice field being keyed by the hash.
+func paymentHash(ctx context.Context, b LightningBackend, limiter *rate.Limiter, m *Message) (string, error) {
+	if strings.HasPrefix(m.Invoice, keysendInvoicePrefix) {
+		return strings.TrimPrefix(m.Invoice, keysendInvoicePrefix), nil
+	}
+	if m.RHash != "" {
+		return m.RHash, nil
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return "", err
+	}
+	decoded, err := b.DecodePayReq(ctx, m.Invoice)
+	if err != nil {
+		return "", err
+	}
+	hash := decoded.GetPaymentHash()
+	if err := store.SetPaymentHash(ctx, m.ID, hash); err != nil {
+		logWarn("Failed to record the payment hash", "doc_id", m.ID, "payment_hash", hash, "err", err)
+	} else {
+		m.RHash = hash
+	}
+	return hash, nil
+}
+
+// markSettled records the settlement of invoice on m. The settlement side
+// effects only run for the caller that actually flipped the message to
+// settled, so that the watcher and a reconciliation racing on the same
+// message don't both notify and count it. Messages are attributed to the
+// running session, or held for the next one with -holdOutsideSessions. A
+// failed session lookup doesn't lose the payment, the message is recorded
+// without a session and isn't held. m is only marked Settled when this call
+// recorded the settlement.
+func markSettled(ctx context.Context, m *Message, invoice *lnrpc.Invoice) (err error) {
+	ctx, sp := startSpan(ctx, "markSettled", spanKindInternal,
+		"doc_id", m.ID, "r_hash", m.RHash, "amount_paid_msat", invoice.GetAmtPaidMsat())
+	defer func() { sp.end(err) }()
+
+	settledAt := appClock.Now()
+	if invoice.GetSettleDate() != 0 {
+		settledAt = time.Unix(invoice.GetSettleDate(), 0)
+	}
+
+	session, sessionErr := activeSession(ctx)
+	if sessionErr != nil {
+		logError("Failed to look the active session up, settling without one", "doc_id", m.ID, "err", sessionErr)
+	}
+	settlement := Settlement{
+		SettledAt:      settledAt,
+		AmountPaidMsat: invoice.GetAmtPaidMsat(),
+		Preimage:       hex.EncodeToString(invoice.GetRPreimage()),
+		Held:           sessionErr == nil && session == nil && holdOutsideSessions && m.BoostOf == "",
+	}
+	if session != nil {
+		settlement.SessionID = session.ID
+	}
+	first, err := store.MarkSettled(ctx, m.ID, settlement)
+	if err != nil {
+		audit(auditSettlementFailed, m, invoice, err.Error())
+		return err
+	}
+	if !first {
+		return nil
+	}
+	audit(auditSettlementRecorded, m, invoice, messageBackend(m))
+	m.Settled = true
+	m.SettledAt = settledAt
+	m.AmountPaidMsat = settlement.AmountPaidMsat
+	m.Preimage = settlement.Preimage
+	m.SessionID = settlement.SessionID
+	m.Held = settlement.Held
+	invoicesSettled.WithLabelValues(messageBackend(m)).Inc()
+	payers.paid(m.ID)
+
+	logInfo("Message settled", "doc_id", m.ID, "payment_hash", hex.EncodeToString(invoice.GetRHash()))
+	observeSettleLag(invoice)
+	// The payer of a message which had expired isn't served, refund it.
+	if m.Expired {
+		issueRefund(ctx, m, invoice)
+		return nil
+	}
+	// Held messages are notified when the next session starts, boosts
+	// through the totals of the message they boost.
+	switch {
+	case m.BoostOf != "":
+		recordBoost(ctx, m, invoice)
+	case !m.Held:
+		notifySettled(m, invoice)
+		indexMessage(m)
+		if m.DM == nil {
+			runBots(ctx, m)
+			if m.AmountPaidMsat > 0 {
+				postSystemMessage(ctx, templatePaymentReceived, m, templateData{AmountPaid: m.AmountPaidMsat / 1000})
 			}
 		}
+	}
+	if session != nil {
+		recordSessionRevenue(ctx, session.ID, invoice.GetAmtPaidMsat())
+	}
+	recordSettlementStats(ctx, m, invoice, settledAt)
+	recordTransparency(ctx, m, invoice, settledAt)
+	return nil
+}
+
+// watchInvoices keeps an invoice subscription open, resubscribing with
+// exponential backoff when it fails. Subscriptions resume from the last
+// invoice seen so that settlements happening while lnd was unreachable are
+// replayed rather than missed, starting from the checkpoint saved by the
+// last shutdown. It returns once ctx is done.
+func watchInvoices(ctx context.Context) {
+	watchNodeInvoices(ctx, nil, lnrpc.InvoiceSubscription{SettleIndex: loadCheckpoint()})
+}
+
+// watchNodeInvoices is watchInvoices for node, nil being the primary, the
+// subscription starting after resume.
+func watchNodeInvoices(ctx context.Context, node *lndNode, resume lnrpc.InvoiceSubscription) {
+	backoff := minSubscriptionBackoff
+	for {
+		start := time.Now()
+		err := subscribeInvoices(ctx, node, &resume)
+		if ctx.Err() != nil {
+			return
+		}
+		invoiceResubscriptions.Inc()
 
+		// A subscription that stayed up for a while failed for a new
+		// reason, so the backoff starts over.
+		if time.Since(start) > maxSubscriptionBackoff {
+			backoff = minSubscriptionBackoff
+		}
+		if node != nil {
+			logWarn("Invoice subscription failed", "node", node.Name, "err", err, "retry_in", backoff)
+		} else {
+			logWarn("Invoice subscription failed", "err", err, "retry_in", backoff)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxSubscriptionBackoff {
+			backoff = maxSubscriptionBackoff
+		}
 	}
 }
 
-func watchInvoices() {
-	c, clean := getClient()
-	defer clean()
+// subscribeInvoices handles the invoices of a subscription to node, nil
+// being the primary, starting after the indexes of resume, which it
+// advances, until the subscription fails or ctx is done. The invoice being
+// handled then is recorded before returning, its updates not depending on
+// ctx. Only the primary checkpoints its settle index.
+func subscribeInvoices(ctx context.Context, node *lndNode, resume *lnrpc.InvoiceSubscription) error {
+	b, up := lightning, &invoiceSubscriptionUp
+	if node != nil {
+		b, up = lndBackend{node.lightning()}, &node.subscriptionUp
+	}
 
-	sub, err := c.SubscribeInvoices(context.Background(), &lnrpc.InvoiceSubscription{})
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub, err := b.SubscribeInvoices(ctx, resume)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
+	atomic.StoreInt32(up, 1)
+	defer atomic.StoreInt32(up, 0)
 	for {
 		invoice, err := sub.Recv()
 		if err == io.EOF {
-			sub.CloseSend()
+			return fmt.Errorf("subscription closed by lnd")
 		}
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
+		}
+		if invoice.GetAddIndex() > resume.AddIndex {
+			resume.AddIndex = invoice.GetAddIndex()
+		}
+		if invoice.GetSettleIndex() > resume.SettleIndex {
+			resume.SettleIndex = invoice.GetSettleIndex()
+		}
+		// Invoices are handled even once ctx is done, so the checkpoint
+		// can advance before.
+		if node == nil {
+			advanceCheckpoint(invoice)
 		}
 
-		if invoice.GetSettled() {
-			fmt.Println("Received ", invoice.GetPaymentRequest())
-			it := firebaseDb.Collection("messages").Where("invoice", "==", invoice.GetPaymentRequest()).Limit(1).Documents(context.Background())
-			snapshot, err := it.GetAll()
-			if err != nil {
-				fmt.Println("Couldn't find invoice in firebase")
-				continue
+		if invoice.GetState() == lnrpc.Invoice_SETTLED {
+			detail := "lnd"
+			if invoice.GetIsKeysend() {
+				detail = "keysend"
 			}
-			for _, s := range snapshot {
-				s.Ref.Update(context.Background(), []firestore.Update{{Path: "settled", Value: true}})
+			audit(auditSettleReceived, nil, invoice, detail)
+		}
+		if invoice.GetState() == lnrpc.Invoice_SETTLED && invoice.GetIsKeysend() {
+			handleKeysend(context.Background(), invoice)
+			continue
+		}
+		// lnd only streams the invoices added and settled here, the hold
+		// invoices accepted are followed by watchHold.
+		hash := hex.EncodeToString(invoice.GetRHash())
+		if invoice.GetState() == lnrpc.Invoice_SETTLED {
+			logDebug("Received settled invoice", "payment_hash", hash)
+			if err := recordSettledInvoice(context.Background(), invoice); err != nil {
+				addDeadLetter(invoice)
+			}
+		}
+	}
+}
+
+// recordSettledInvoice marks the message of a settled invoice settled, or
+// quarantines the invoice if it has none.
+func recordSettledInvoice(ctx context.Context, invoice *lnrpc.Invoice) error {
+	hash := hex.EncodeToString(invoice.GetRHash())
+	if strings.HasPrefix(invoice.GetPaymentRequest(), bolt12InvoicePrefix) {
+		err := handleOfferPayment(ctx, invoice)
+		if err != nil {
+			logError("Failed to handle the offer payment", "payment_hash", hash, "err", err)
+		}
+		return err
+	}
+	m, err := store.FindByInvoice(ctx, invoice.GetPaymentRequest())
+	if err == errMessageNotFound {
+		// The invoices of the other services of the node are theirs to
+		// handle.
+		if !ownInvoice(invoice) {
+			logDebug("Ignored settled invoice of another service", "payment_hash", hash)
+			return nil
+		}
+		quarantineSettlement(ctx, invoice)
+		return nil
+	}
+	if err != nil {
+		logError("Failed to find the message of the invoice", "payment_hash", hash, "err", err)
+		return err
+	}
+	if err := markSettled(ctx, m, invoice); err != nil {
+		logError("Failed to mark the message settled", "doc_id", m.ID, "payment_hash", hash, "err", err)
+		return err
+	}
+	return nil
+}
+
+// deadLetters are the settled invoices the watcher failed to record, retried
+// by watchDeadLetters with backoff until recorded, and on shutdown. Those
+// still failing are saved with the checkpoint and retried on the next start.
+var deadLetters struct {
+	sync.Mutex
+	invoices []*lnrpc.Invoice
+}
+
+const (
+	minDeadLetterBackoff = time.Second
+	maxDeadLetterBackoff = 5 * time.Minute
+)
+
+// deadLetterAdded wakes watchDeadLetters up when a dead letter is added.
+var deadLetterAdded = make(chan struct{}, 1)
+
+func addDeadLetter(invoice *lnrpc.Invoice) {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+	deadLetters.invoices = append(deadLetters.invoices, invoice)
+	deadLetterSettlements.Set(float64(len(deadLetters.invoices)))
+	select {
+	case deadLetterAdded <- struct{}{}:
+	default:
+	}
+}
+
+func pendingDeadLetters() int {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+	return len(deadLetters.invoices)
+}
+
+// watchDeadLetters retries recording the dead letters as they are added,
+// backing off exponentially while some keep failing, e.g. during an outage
+// of the message store. It returns once ctx is done, flushDeadLetters then
+// retrying them a last time.
+func watchDeadLetters(ctx context.Context) {
+	backoff := minDeadLetterBackoff
+	for {
+		if pendingDeadLetters() == 0 {
+			backoff = minDeadLetterBackoff
+			select {
+			case <-ctx.Done():
+				return
+			case <-deadLetterAdded:
 			}
 		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		left := retryDeadLetters(ctx)
+		if len(left) == 0 || ctx.Err() != nil {
+			continue
+		}
+		if backoff *= 2; backoff > maxDeadLetterBackoff {
+			backoff = maxDeadLetterBackoff
+		}
+		logWarn("Failed to record the dead letters", "left", len(left), "retry_in", backoff)
+	}
+}
+
+// retryDeadLetters retries recording the dead letters once each, unless ctx
+// is done, and returns those left.
+func retryDeadLetters(ctx context.Context) []*lnrpc.Invoice {
+	deadLetters.Lock()
+	invoices := deadLetters.invoices
+	deadLetters.Unlock()
+	var left []*lnrpc.Invoice
+	for i, invoice := range invoices {
+		switch {
+		case ctx.Err() != nil:
+			left = append(left, invoice)
+		case recordSettledInvoice(ctx, invoice) != nil:
+			deadLetterRetries.WithLabelValues("failed").Inc()
+			left = append(left, invoice)
+		default:
+			deadLetterRetries.WithLabelValues("recorded").Inc()
+		}
+		deadLetterSettlements.Set(float64(len(left) + len(invoices) - i - 1))
+	}
+
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+	deadLetters.invoices = append(left, deadLetters.invoices[len(invoices):]...)
+	deadLetterSettlements.Set(float64(len(deadLetters.invoices)))
+	return left
+}
+
+// flushDeadLetters retries recording the dead letters until they are all
+// recorded or ctx is done, logging those left.
+func flushDeadLetters(ctx context.Context) {
+	left := retryDeadLetters(ctx)
+	for _, invoice := range left {
+		logError("Settlement left unrecorded", "payment_hash", hex.EncodeToString(invoice.GetRHash()), "settle_index", invoice.GetSettleIndex(), "amount_msat", invoice.GetAmtPaidMsat())
+	}
+}
+
+var (
+	// checkpointPath is the file keeping the settle index of the last
+	// invoice handled across restarts, so that the subscription replays the
+	// settlements missed while the backend was down, keysends included,
+	// which the reconciliation can't find. Empty disables it.
+	checkpointPath = defaultCheckpointPath
+
+	defaultCheckpointPath = "chat-backend.checkpoint"
+
+	// settleCheckpoint is the settle index of the last invoice handled.
+	settleCheckpoint uint64
+)
+
+// invoiceCheckpoint is the content of the checkpoint file.
+type invoiceCheckpoint struct {
+	SettleIndex uint64 `json:"settle_index"`
+	// DeadLetters are the settled invoices left unrecorded on shutdown.
+	DeadLetters []*lnrpc.Invoice `json:"dead_letters,omitempty"`
+}
+
+func advanceCheckpoint(invoice *lnrpc.Invoice) {
+	for {
+		current := atomic.LoadUint64(&settleCheckpoint)
+		if invoice.GetSettleIndex() <= current || atomic.CompareAndSwapUint64(&settleCheckpoint, current, invoice.GetSettleIndex()) {
+			return
+		}
+	}
+}
+
+// loadCheckpoint returns the settle index saved by the last shutdown, 0 if
+// there is none.
+func loadCheckpoint() uint64 {
+	if checkpointPath == "" {
+		return 0
+	}
+	b, err := ioutil.ReadFile(checkpointPath)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	var c invoiceCheckpoint
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		logWarn("Failed to load the invoice checkpoint", "path", checkpointPath, "err", err)
+		return 0
+	}
+	atomic.StoreUint64(&settleCheckpoint, c.SettleIndex)
+	for _, invoice := range c.DeadLetters {
+		addDeadLetter(invoice)
+	}
+	logInfo("Resuming invoices", "settle_index", c.SettleIndex, "dead_letters", len(c.DeadLetters))
+	return c.SettleIndex
+}
+
+// saveCheckpoint saves the settle index of the last invoice handled and the
+// dead letters left, retried on the next start.
+func saveCheckpoint() {
+	if checkpointPath == "" {
+		return
+	}
+	c := invoiceCheckpoint{SettleIndex: atomic.LoadUint64(&settleCheckpoint)}
+	deadLetters.Lock()
+	c.DeadLetters = deadLetters.invoices
+	deadLetters.Unlock()
+	if c.SettleIndex == 0 && len(c.DeadLetters) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		logError("Failed to save the invoice checkpoint", "path", checkpointPath, "err", err)
+		return
+	}
+	tmp := checkpointPath + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err == nil {
+		err = os.Rename(tmp, checkpointPath)
+	}
+	if err != nil {
+		logError("Failed to save the invoice checkpoint", "path", checkpointPath, "err", err)
+		return
+	}
+	logInfo("Saved the invoice checkpoint", "settle_index", c.SettleIndex, "dead_letters", len(c.DeadLetters))
+}
+
+// notifySettled pushes a settlement event for m to the websocket
+// subscribers of its room, the webhooks and the devices subscribed to the
+// room.
+func notifySettled(m *Message, invoice *lnrpc.Invoice) {
+	data := map[string]interface{}{
+		"id":               publicIDs.Encode(m.ID),
+		"invoice":          invoice.GetPaymentRequest(),
+		"r_hash":           hex.EncodeToString(invoice.GetRHash()),
+		"amount":           m.Amount,
+		"amount_paid_msat": m.AmountPaidMsat,
+		"settled_at":       m.SettledAt.UTC(),
+	}
+	if m.Memo != "" {
+		data["memo"] = m.Memo
+	}
+	// Replies are placed in their thread by the clients.
+	if m.ParentID != "" {
+		data["parent_id"] = publicIDs.Encode(m.ParentID)
+	}
+	// Direct messages are delivered, still encrypted, to the sessions of
+	// their recipient. The public ones come with their Sphinx envelope.
+	if m.DM != nil {
+		data["dm"] = m.DM
+	} else {
+		data["envelope"] = sphinxEnvelopeOf(m)
+	}
+	ev := event{
+		Type:        eventSettled,
+		Room:        m.Room,
+		PaymentHash: hex.EncodeToString(invoice.GetRHash()),
+		Data:        data,
 	}
+	publishEvent(ev)
+	postWebhooks(ev)
+	pushSettled(m)
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// webhookAttempts is how many times an event is posted to a webhook
+	// before it is given up, the first retry coming after
+	// webhookRetryBackoff, doubled for every other.
+	webhookAttempts     = 5
+	webhookRetryBackoff = time.Second
+
+	webhookSignatureHeader = "X-Chat-Signature"
+	webhookTimestampHeader = "X-Chat-Timestamp"
+)
+
+var (
+	// webhookURLs are posted the settlement events, signed with
+	// webhookSecret when set.
+	webhookURLs   []string
+	webhookSecret string
+)
+
+var (
+	// webhookDeliveries tracks the deliveries in flight, which shutdown
+	// waits for, and webhooksPending counts them.
+	webhookDeliveries sync.WaitGroup
+	webhooksPending   int64
+
+	webhookPosts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_posts_total",
+		Help:      "Number of webhook posts by outcome (delivered, retried, failed).",
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(webhookPosts)
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookSignature returns the hex HMAC-SHA256, keyed with webhookSecret, of
+// the timestamp, a dot and the body, which receivers recompute to check the
+// origin of a post and reject the stale ones.
+func webhookSignature(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedPost posts the JSON body to url, signed when there is a
+// webhookSecret.
+func signedPost(url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhookSecret != "" {
+		timestamp := strconv.FormatInt(appClock.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(timestamp, body))
+	}
+	return webhookClient.Do(req)
+}
+
+// postWebhooks posts ev to the webhook targets in the background, retrying
+// with exponential backoff the posts failing or answered with a 429 or 5xx
+// status.
+func postWebhooks(ev event) {
+	if len(webhookURLs) == 0 {
+		return
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logError("Failed to encode webhook event", "err", err)
+		return
+	}
+	for _, url := range webhookURLs {
+		webhookDeliveries.Add(1)
+		atomic.AddInt64(&webhooksPending, 1)
+		go func(url string) {
+			defer func() {
+				atomic.AddInt64(&webhooksPending, -1)
+				webhookDeliveries.Done()
+			}()
+			deliverWebhook(url, ev.Type, body)
+		}(url)
+	}
+}
+
+func deliverWebhook(url, eventType string, body []byte) {
+	backoff := webhookRetryBackoff
+	for attempt := 1; ; attempt++ {
+		res, err := signedPost(url, body)
+		retry := err != nil
+		if err == nil {
+			res.Body.Close()
+			switch {
+			case res.StatusCode < 300:
+				webhookPosts.WithLabelValues("delivered").Inc()
+				return
+			case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+				retry = true
+			}
+			logWarn("Webhook failed", "url", url, "type", eventType, "attempt", attempt, "status", res.Status)
+		} else {
+			logWarn("Webhook failed", "url", url, "type", eventType, "attempt", attempt, "err", err)
+		}
+		if !retry || attempt == webhookAttempts {
+			webhookPosts.WithLabelValues("failed").Inc()
+			return
+		}
+		webhookPosts.WithLabelValues("retried").Inc()
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultRoom is the room of messages that don't carry one.
+	defaultRoom = "main"
+
+	// Event types pushed to websocket clients.
+	eventSettled = "settled"
+
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = (wsPongTimeout * 9) / 10
+	wsMaxFrameSize = 4096
+
+	// wsMaxHashSubscriptions bounds the payment hashes a connection may
+	// subscribe to.
+	wsMaxHashSubscriptions = 100
+)
+
+var (
+	// wsSendBuffer is the number of events queued per connection before
+	// the connection is considered a slow consumer and evicted.
+	wsSendBuffer = defaultWSSendBuffer
+
+	defaultWSSendBuffer = 64
+
+	eventHub = newHub()
+
+	errTooManyHashes = errors.New("too many payment hash subscriptions")
+
+	wsUpgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		// Same policy as the CORS middleware of the REST api.
+		CheckOrigin: checkWSOrigin,
+	}
+
+	wsConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ws_connections",
+		Help:      "Number of open websocket connections.",
+	})
+
+	wsEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ws_evictions_total",
+		Help:      "Number of websocket connections dropped for not keeping up.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(wsConnections, wsEvictions)
+}
+
+// event is a notification fanned out to the clients subscribed to its room
+// and type, or to its payment hash.
+type event struct {
+	Type        string      `json:"type"`
+	Room        string      `json:"room"`
+	PaymentHash string      `json:"payment_hash,omitempty"`
+	Data        interface{} `json:"data,omitempty"`
+
+	// Payer events carry secrets of the payer, and are only sent to the
+	// subscriptions of their payment hash made with its payer token.
+	Payer bool `json:"payer,omitempty"`
+}
+
+// clientFrame is a frame sent by a websocket client to manage its
+// subscriptions. An empty Events list means all event types of the room.
+// Frames with a PaymentHash subscribe to the events of that invoice only,
+// wherever its message was posted, which is how a payer waits for its own
+// message to settle. With the PayerToken of the invoice, they also get its
+// payer events.
+type clientFrame struct {
+	Type        string   `json:"type"`
+	Room        string   `json:"room"`
+	PaymentHash string   `json:"payment_hash,omitempty"`
+	PayerToken  string   `json:"payer_token,omitempty"`
+	Events      []string `json:"events,omitempty"`
+}
+
+// wsClient is a single websocket connection together with its
+// subscriptions.
+type wsClient struct {
+	conn   *websocket.Conn
+	send   chan []byte
+	claims *streamClaims
+
+	// subs maps rooms to the subscribed event types, a nil set meaning
+	// every type. It is guarded by the hub mutex.
+	subs map[string]map[string]bool
+
+	// hashes are the subscribed payment hashes, true for those subscribed
+	// by their payer, also guarded by the hub mutex.
+	hashes map[string]bool
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// close tears the connection down, it is safe to call several times. The
+// event streams of the payment pages subscribe without a connection.
+func (c *wsClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	})
+}
+
+// trySend queues msg for the client without blocking and reports whether
+// there was room for it.
+func (c *wsClient) trySend(msg []byte) bool {
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// hub keeps track of the room and payment hash subscriptions of all
+// connected clients.
+type hub struct {
+	mu     sync.RWMutex
+	rooms  map[string]map[*wsClient]struct{}
+	hashes map[string]map[*wsClient]struct{}
+}
+
+func newHub() *hub {
+	return &hub{
+		rooms:  make(map[string]map[*wsClient]struct{}),
+		hashes: make(map[string]map[*wsClient]struct{}),
+	}
+}
+
+// subscribe adds the given event types of room to the subscriptions of c.
+func (h *hub) subscribe(c *wsClient, room string, events []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[*wsClient]struct{})
+	}
+	h.rooms[room][c] = struct{}{}
+
+	types, ok := c.subs[room]
+	switch {
+	case len(events) == 0:
+		types = nil
+	case !ok:
+		types = make(map[string]bool)
+	}
+	if types != nil {
+		for _, e := range events {
+			types[e] = true
+		}
+	}
+	c.subs[room] = types
+}
+
+// unsubscribe removes the given event types, or the whole room if none are
+// given, from the subscriptions of c.
+func (h *hub) unsubscribe(c *wsClient, room string, events []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	types, ok := c.subs[room]
+	if !ok {
+		return
+	}
+	if len(events) > 0 && types != nil {
+		for _, e := range events {
+			delete(types, e)
+		}
+		if len(types) > 0 {
+			return
+		}
+	} else if len(events) > 0 {
+		// Subscribed to everything, narrowing it down isn't supported.
+		return
+	}
+	delete(c.subs, room)
+	delete(h.rooms[room], c)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// subscribeHash adds a payment hash to the subscriptions of c, by its payer
+// or not, failing when c already has too many of them.
+func (h *hub) subscribeHash(c *wsClient, hash string, payer bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := c.hashes[hash]; !ok && len(c.hashes) >= wsMaxHashSubscriptions {
+		return errTooManyHashes
+	}
+	if h.hashes[hash] == nil {
+		h.hashes[hash] = make(map[*wsClient]struct{})
+	}
+	h.hashes[hash][c] = struct{}{}
+	c.hashes[hash] = c.hashes[hash] || payer
+	return nil
+}
+
+// unsubscribeHash removes a payment hash from the subscriptions of c.
+func (h *hub) unsubscribeHash(c *wsClient, hash string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(c.hashes, hash)
+	delete(h.hashes[hash], c)
+	if len(h.hashes[hash]) == 0 {
+		delete(h.hashes, hash)
+	}
+}
+
+// remove drops every subscription of c.
+func (h *hub) remove(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for room := range c.subs {
+		delete(h.rooms[room], c)
+		if len(h.rooms[room]) == 0 {
+			delete(h.rooms, room)
+		}
+	}
+	for hash := range c.hashes {
+		delete(h.hashes[hash], c)
+		if len(h.hashes[hash]) == 0 {
+			delete(h.hashes, hash)
+		}
+	}
+	c.subs = nil
+	c.hashes = nil
+}
+
+// publish fans ev out to the subscribers of its room and payment hash.
+// Clients whose send buffer is full are evicted rather than blocking
+// everyone else.
+func (h *hub) publish(ev event) {
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		logError("Failed to encode event", "err", err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	sent := make(map[*wsClient]bool)
+	rooms := h.rooms[ev.Room]
+	if ev.Payer {
+		rooms = nil
+	}
+	for c := range rooms {
+		if types := c.subs[ev.Room]; types != nil && !types[ev.Type] {
+			continue
+		}
+		sent[c] = true
+		if !c.trySend(msg) {
+			wsEvictions.Inc()
+			c.close()
+		}
+	}
+	if ev.PaymentHash == "" {
+		return
+	}
+	for c := range h.hashes[ev.PaymentHash] {
+		// Knowing the hash of a message isn't enough to read a private
+		// room.
+		if sent[c] || !c.claims.canRead(ev.Room) || ev.Payer && !c.hashes[ev.PaymentHash] {
+			continue
+		}
+		if !c.trySend(msg) {
+			wsEvictions.Inc()
+			c.close()
+		}
+	}
+}
+
+// publishEvent notifies websocket subscribers of ev, those of the other
+// replicas through the event bus.
+func publishEvent(ev event) {
+	if ev.Room == "" {
+		ev.Room = defaultRoom
+	}
+	eventHub.publish(ev)
+	shareEvent(ev)
+}
+
+// serveWebsocket upgrades the request to a websocket connection on which
+// clients subscribe to room events. A stream token is required, see
+// streamClaimsOf.
+func serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	claims, err := streamClaimsOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already replied with an error.
+		return
+	}
+
+	c := &wsClient{
+		conn:   conn,
+		send:   make(chan []byte, wsSendBuffer),
+		claims: claims,
+		subs:   make(map[string]map[string]bool),
+		hashes: make(map[string]bool),
+		done:   make(chan struct{}),
+	}
+	wsConnections.Inc()
+	go c.writeLoop()
+	// ?room=a&room=b subscribes to all the events of these rooms right
+	// away, like subscribe frames.
+	for _, room := range r.URL.Query()["room"] {
+		if claims.canRead(room) {
+			eventHub.subscribe(c, room, nil)
+		}
+	}
+	c.readLoop()
+
+	eventHub.remove(c)
+	c.close()
+	wsConnections.Dec()
+}
+
+// readLoop handles the subscription frames sent by the client until the
+// connection is closed.
+func (c *wsClient) readLoop() {
+	c.conn.SetReadLimit(wsMaxFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var frame clientFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			c.reply("error", event{}, "invalid frame")
+			continue
+		}
+
+		if frame.PaymentHash != "" {
+			c.handleHashFrame(frame)
+			continue
+		}
+		room := frame.Room
+		if room == "" {
+			room = defaultRoom
+		}
+		ack := event{Room: room}
+		switch frame.Type {
+		case "subscribe":
+			if !c.claims.canRead(room) {
+				c.reply("error", ack, "forbidden")
+				continue
+			}
+			eventHub.subscribe(c, room, frame.Events)
+			c.reply("subscribed", ack, "")
+		case "unsubscribe":
+			eventHub.unsubscribe(c, room, frame.Events)
+			c.reply("unsubscribed", ack, "")
+		default:
+			c.reply("error", ack, "unknown frame type")
+		}
+	}
+}
+
+// handleHashFrame handles a payment hash subscription frame.
+func (c *wsClient) handleHashFrame(frame clientFrame) {
+	ack := event{PaymentHash: frame.PaymentHash}
+	if b, err := hex.DecodeString(frame.PaymentHash); err != nil || len(b) != 32 {
+		c.reply("error", ack, "invalid payment hash")
+		return
+	}
+	switch frame.Type {
+	case "subscribe":
+		payer := validPayerToken(frame.PaymentHash, frame.PayerToken)
+		if err := eventHub.subscribeHash(c, frame.PaymentHash, payer); err != nil {
+			c.reply("error", ack, err.Error())
+			return
+		}
+		c.reply("subscribed", ack, "")
+	case "unsubscribe":
+		eventHub.unsubscribeHash(c, frame.PaymentHash)
+		c.reply("unsubscribed", ack, "")
+	default:
+		c.reply("error", ack, "unknown frame type")
+	}
+}
+
+// reply acknowledges a client frame, ev identifying what it was about.
+func (c *wsClient) reply(typ string, ev event, errMsg string) {
+	ev.Type = typ
+	if errMsg != "" {
+		ev.Data = map[string]string{"error": errMsg}
+	}
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	if !c.trySend(msg) {
+		wsEvictions.Inc()
+		c.close()
+	}
+}
+
+// writeLoop delivers queued events and keeps the connection alive with
+// pings.
+func (c *wsClient) writeLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
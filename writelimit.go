@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+
+	"cloud.google.com/go/firestore"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+var (
+	// firestoreWriteRate and firestoreWriteBurst configure the token
+	// bucket applied to document writes, per collection. A rate of zero
+	// disables limiting.
+	firestoreWriteRate  = defaultFirestoreWriteRate
+	firestoreWriteBurst = defaultFirestoreWriteBurst
+
+	defaultFirestoreWriteRate  = 100.0
+	defaultFirestoreWriteBurst = 50
+
+	writeLimiters = &collectionLimiters{limiters: make(map[string]*rate.Limiter)}
+
+	firestoreWritesQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "firestore_writes_queued",
+		Help:      "Number of document writes waiting for the write rate limiter.",
+	}, []string{"collection"})
+)
+
+func init() {
+	prometheus.MustRegister(firestoreWritesQueued)
+}
+
+// collectionLimiters lazily creates one write limiter per collection so that
+// a burst on one collection doesn't starve writes to the others.
+type collectionLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func (c *collectionLimiters) get(collection string) *rate.Limiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := c.limiters[collection]
+	if !ok {
+		l = rate.NewLimiter(rate.Limit(firestoreWriteRate), firestoreWriteBurst)
+		c.limiters[collection] = l
+	}
+	return l
+}
+
+// waitForWrite blocks until a write to collection is allowed by the rate
+// limiter or ctx is done. Writers aren't queued, each one sleeps until the
+// time the limiter reserved for it, so no admission order is guaranteed.
+func waitForWrite(ctx context.Context, collection string) error {
+	if firestoreWriteRate <= 0 {
+		return nil
+	}
+
+	queued := firestoreWritesQueued.WithLabelValues(collection)
+	queued.Inc()
+	defer queued.Dec()
+
+	return writeLimiters.get(collection).Wait(ctx)
+}
+
+// updateDoc applies updates to the document once the write limiter of its
+// collection allows it.
+func updateDoc(ctx context.Context, ref *firestore.DocumentRef, updates []firestore.Update) error {
+	if err := waitForWrite(ctx, unnamespaced(ref.Parent.ID)); err != nil {
+		return err
+	}
+	_, err := ref.Update(ctx, updates)
+	countUpdateFailure(ref.Parent.ID, err)
+	return err
+}